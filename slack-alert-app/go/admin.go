@@ -0,0 +1,180 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/pprof"
+	"net/url"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// redactedValue replaces secrets in the config served by the admin API.
+const redactedValue = "REDACTED"
+
+// adminHandler serves diagnostics for debugging the bot in production:
+//
+//	GET /debug/pprof/...    Go runtime profiles, from net/http/pprof.
+//	GET /admin/config       Current config as YAML, with secrets redacted.
+//	GET /admin/incidents    Open incidents.
+//	GET /admin/checks       Status and timing of each rule's last check.
+//
+// It is served on its own address, which shouldn't be exposed outside the
+// pod, since profiles can reveal sensitive data.
+func (a *app) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.HandleFunc("/admin/config", a.handleAdminConfig)
+	mux.HandleFunc("/admin/incidents", a.handleAdminIncidents)
+	mux.HandleFunc("/admin/checks", a.handleAdminChecks)
+	return mux
+}
+
+func (a *app) handleAdminConfig(w http.ResponseWriter, r *http.Request) {
+	a.mu.Lock()
+	cfg := a.cfg.redacted()
+	a.mu.Unlock()
+	b, err := yaml.Marshal(cfg)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/yaml")
+	w.Write(b)
+}
+
+func (a *app) handleAdminIncidents(w http.ResponseWriter, r *http.Request) {
+	incidents, err := a.incidents.Open(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(incidents)
+}
+
+// checkTiming is a rule's check status, along with when its next check is due.
+type checkTiming struct {
+	RuleStatus
+	Interval  string    `json:"interval,omitempty"`
+	Schedule  string    `json:"schedule,omitempty"`
+	Streaming bool      `json:"streaming,omitempty"`
+	NextCheck time.Time `json:"nextCheck,omitempty"`
+}
+
+func (a *app) handleAdminChecks(w http.ResponseWriter, r *http.Request) {
+	a.mu.Lock()
+	engine := a.engine
+	a.mu.Unlock()
+
+	status := make(map[string]RuleStatus)
+	for _, st := range engine.Status() {
+		status[st.Rule] = st
+	}
+	var checks []checkTiming
+	for _, t := range engine.trackers {
+		st, ok := status[t.rule.Name]
+		if !ok {
+			st = RuleStatus{Rule: t.rule.Name}
+		}
+		c := checkTiming{RuleStatus: st, Streaming: t.rule.Streaming}
+		switch {
+		case t.rule.Streaming:
+		case t.schedule != nil:
+			c.Schedule = t.schedule.String()
+			c.NextCheck = t.schedule.Next(time.Now())
+		default:
+			interval := engine.backoff(t.rule.Interval.Duration, st.ConsecutiveFailures)
+			c.Interval = interval.String()
+			if ok {
+				c.NextCheck = st.LastCheck.Add(interval)
+			}
+		}
+		checks = append(checks, c)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(checks)
+}
+
+// redacted returns a copy of the config with its secrets replaced, for display.
+func (c *Config) redacted() Config {
+	r := *c
+	redact := func(s *string) {
+		if *s != "" {
+			*s = redactedValue
+		}
+	}
+	redact(&r.Pixie.APIKey)
+	redact(&r.Slack.Token)
+	redact(&r.Slack.SigningSecret)
+	redact(&r.Vault.Token)
+	redact(&r.APIToken)
+	redact(&r.Grafana.Token)
+	redact(&r.Influx.Token)
+	// URLs can hold credentials in their userinfo, such as Redis passwords,
+	// or query, such as InfluxDB 1.x's u and p parameters.
+	redactURL := func(s *string) {
+		u, err := url.Parse(*s)
+		if err != nil {
+			if *s != "" {
+				*s = redactedValue
+			}
+			return
+		}
+		if u.User != nil {
+			u.User = url.User(redactedValue)
+		}
+		if u.RawQuery != "" {
+			u.RawQuery = redactedValue
+		}
+		*s = u.String()
+	}
+	redactURL(&r.Heartbeat.URL)
+	redactURL(&r.Tracing.Endpoint)
+	redactURL(&r.RemoteWrite.URL)
+	redactURL(&r.OTLPMetrics.Endpoint)
+	redactURL(&r.Influx.URL)
+	redactURL(&r.Archive.URL)
+	redactURL(&r.Grafana.URL)
+	redactURL(&r.RulesURL.URL)
+	redactURL(&r.Vault.Addr)
+	redactURL(&r.Redis.URL)
+	redactHeaders := func(h *map[string]string) {
+		if len(*h) == 0 {
+			return
+		}
+		headers := make(map[string]string)
+		for k := range *h {
+			headers[k] = redactedValue
+		}
+		*h = headers
+	}
+	redactHeaders(&r.Tracing.Headers)
+	redactHeaders(&r.RemoteWrite.Headers)
+	redactHeaders(&r.RulesURL.Headers)
+	redactHeaders(&r.OTLPMetrics.Headers)
+	// Profiles have already been applied, and may hold secrets of their own.
+	r.Profiles = nil
+	return r
+}
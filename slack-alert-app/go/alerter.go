@@ -0,0 +1,121 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"sync"
+
+	"github.com/slack-go/slack"
+)
+
+// Alerter delivers messages produced by the ServiceTracker.
+type Alerter interface {
+	// SendAlert sends a message that should get someone's attention.
+	SendAlert(ctx context.Context, msg string) error
+	// SendInfo sends a purely informational message.
+	SendInfo(ctx context.Context, msg string) error
+}
+
+// logAlerter logs the messages it would send instead of sending them, for dry runs.
+type logAlerter struct {
+	// Where the messages would have been sent, such as a Slack channel.
+	dest string
+}
+
+func (l *logAlerter) SendAlert(ctx context.Context, msg string) error {
+	logInfo("[dry run] Would send alert.", "dest", l.dest, "message", msg)
+	return nil
+}
+
+func (l *logAlerter) SendInfo(ctx context.Context, msg string) error {
+	logInfo("[dry run] Would send message.", "dest", l.dest, "message", msg)
+	return nil
+}
+
+// multiAlerter sends every message to each of its alerters.
+type multiAlerter []Alerter
+
+func (m multiAlerter) SendAlert(ctx context.Context, msg string) error {
+	return m.each(func(a Alerter) error { return a.SendAlert(ctx, msg) })
+}
+
+func (m multiAlerter) SendInfo(ctx context.Context, msg string) error {
+	return m.each(func(a Alerter) error { return a.SendInfo(ctx, msg) })
+}
+
+// each calls fn with every alerter, even if some fail, and returns the first error.
+func (m multiAlerter) each(fn func(Alerter) error) error {
+	var first error
+	for _, a := range m {
+		if err := fn(a); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// slackAlerter posts messages to a Slack channel.
+// The Slack App must be a member of the channel.
+type slackAlerter struct {
+	channel string
+	// Where to get the token from when it can change, such as Vault, or nil.
+	tokens *vaultSecret
+
+	mu     sync.Mutex
+	client *slack.Client
+	token  string
+}
+
+func newSlackAlerter(token, channel string) *slackAlerter {
+	return &slackAlerter{client: slack.New(token), token: token, channel: channel}
+}
+
+func (s *slackAlerter) SendAlert(ctx context.Context, msg string) error {
+	return s.post(ctx, "<!here> "+msg)
+}
+
+func (s *slackAlerter) SendInfo(ctx context.Context, msg string) error {
+	return s.post(ctx, msg)
+}
+
+func (s *slackAlerter) post(ctx context.Context, msg string) error {
+	client, err := s.slackClient(ctx)
+	if err != nil {
+		return err
+	}
+	_, _, err = client.PostMessageContext(ctx, s.channel, slack.MsgOptionText(msg, false), slack.MsgOptionAsUser(true))
+	return err
+}
+
+// slackClient returns the client to post with, recreating it if the token changed.
+func (s *slackAlerter) slackClient(ctx context.Context) (*slack.Client, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.tokens == nil {
+		return s.client, nil
+	}
+	token, err := s.tokens.Get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if token != s.token {
+		s.client = slack.New(token)
+		s.token = token
+	}
+	return s.client, nil
+}
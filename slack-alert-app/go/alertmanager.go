@@ -0,0 +1,141 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"time"
+)
+
+// amAlert is an open incident in the format of Alertmanager's GET
+// /api/v2/alerts, which GET /api/v1/alerts wraps in a response envelope.
+type amAlert struct {
+	Labels       map[string]string `json:"labels"`
+	Annotations  map[string]string `json:"annotations"`
+	StartsAt     time.Time         `json:"startsAt"`
+	EndsAt       time.Time         `json:"endsAt"`
+	UpdatedAt    time.Time         `json:"updatedAt"`
+	GeneratorURL string            `json:"generatorURL"`
+	Fingerprint  string            `json:"fingerprint"`
+	Receivers    []amReceiver      `json:"receivers"`
+	Status       amAlertStatus     `json:"status"`
+}
+
+type amReceiver struct {
+	Name string `json:"name"`
+}
+
+type amAlertStatus struct {
+	// active or suppressed.
+	State       string   `json:"state"`
+	SilencedBy  []string `json:"silencedBy"`
+	InhibitedBy []string `json:"inhibitedBy"`
+}
+
+// amResolveTimeout is how far in the future open incidents are said to end,
+// like Alertmanager's default resolve_timeout, so that dashboards treat
+// incidents that stop being served as resolved.
+const amResolveTimeout = 5 * time.Minute
+
+// handleAlertmanagerAlerts serves the open incidents as Alertmanager alerts,
+// so that dashboards for Alertmanager, such as Karma or Grafana's alert list
+// panel, can show them. The incident's rule is the alertname. Silenced
+// incidents are suppressed, and silenced by the silences that match them.
+func (a *apiServer) handleAlertmanagerAlerts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	incidents, err := a.incidents.Open(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	now := time.Now()
+	silences, err := a.silences.Active(r.Context(), now)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	alerts := []amAlert{}
+	for _, inc := range incidents {
+		alert := amAlert{
+			Labels: map[string]string{
+				"alertname":  inc.Rule,
+				"incident":   inc.ID,
+				"cluster":    inc.Cluster.Name,
+				"cluster_id": inc.Cluster.ID,
+				"service":    inc.Service,
+			},
+			Annotations: map[string]string{
+				"summary": fmt.Sprintf("%s on %s at %s error rate", inc.Service, inc.Cluster.Name, formatRate(inc.Latest.ErrorRate())),
+				"description": fmt.Sprintf("%d errors out of %d requests in the last check, peak error rate %s.",
+					inc.Latest.ErrorCount, inc.Latest.TotalRequests, formatRate(inc.PeakErrorRate())),
+			},
+			StartsAt:     inc.OpenedAt,
+			EndsAt:       now.Add(amResolveTimeout),
+			UpdatedAt:    inc.UpdatedAt,
+			GeneratorURL: pixieServiceLink(inc.Cluster.Name, inc.Service),
+			Fingerprint:  amFingerprint(inc.ID),
+			Receivers:    []amReceiver{{Name: "slack"}},
+			Status:       amAlertStatus{State: "active", SilencedBy: []string{}, InhibitedBy: []string{}},
+		}
+		for k, v := range inc.Cluster.Labels {
+			if _, ok := alert.Labels[k]; !ok {
+				alert.Labels[k] = v
+			}
+		}
+		if inc.Acked {
+			alert.Annotations["acknowledged"] = "true"
+		}
+		if inc.Silenced(now) {
+			alert.Status.SilencedBy = append(alert.Status.SilencedBy, inc.ID)
+		}
+		for _, s := range silences {
+			if s.Matches(inc) {
+				alert.Status.SilencedBy = append(alert.Status.SilencedBy, s.ID)
+			}
+		}
+		if len(alert.Status.SilencedBy) > 0 {
+			alert.Status.State = "suppressed"
+		}
+		alerts = append(alerts, alert)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if r.URL.Path == "/api/v1/alerts" {
+		json.NewEncoder(w).Encode(struct {
+			Status string    `json:"status"`
+			Data   []amAlert `json:"data"`
+		}{"success", alerts})
+		return
+	}
+	json.NewEncoder(w).Encode(alerts)
+}
+
+// amFingerprint returns a stable fingerprint for an incident's alert, in the
+// 16 hex digit format of Alertmanager's.
+func amFingerprint(id string) string {
+	h := fnv.New64a()
+	h.Write([]byte(id))
+	return fmt.Sprintf("%016x", h.Sum64())
+}
@@ -0,0 +1,608 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// apiServer exposes incidents, keyed by incident ID, over HTTP:
+//
+//	GET  /api/incidents?state=open&rule=http-errors&cluster=prod&service=orders&limit=100
+//	GET  /api/incidents/{id}
+//	POST /api/incidents/{id}/ack
+//	POST /api/incidents/{id}/silence?duration=1h
+//
+// and silences for every incident of a rule, cluster, namespace or service:
+//
+//	GET    /api/silences
+//	POST   /api/silences
+//	DELETE /api/silences/{id}
+//
+// Requests that run checks or acknowledge or silence incidents must send the API token, if
+// one is configured, in an Authorization: Bearer header.
+//
+// With a Slack signing secret, incidents can also be acknowledged and
+// silenced with a Slack slash command, such as /pixie ack INC-7f3a9c21:
+//
+//	POST /slack/commands
+//
+// Open incidents are also served in the format of Alertmanager's alert list,
+// for dashboards built for Alertmanager:
+//
+//	GET /api/v1/alerts
+//	GET /api/v2/alerts
+//
+// Incidents opened, updated and resolved by this replica's checks are
+// streamed as server-sent events, for status pages:
+//
+//	GET /api/stream
+//
+// It also runs a rule's check on demand, such as from a deploy pipeline:
+//
+//	POST /api/checks/{rule}/run
+//
+// reports the stats of the latest query of each rule on each cluster:
+//
+//	GET /api/queries
+//
+// serves liveness and readiness probes for Kubernetes:
+//
+//	GET /healthz
+//	GET /readyz
+//
+// the bot's own metrics in the Prometheus text format:
+//
+//	GET /metrics
+//
+// and a dashboard of incidents and silences:
+//
+//	GET /
+type apiServer struct {
+	incidents IncidentManager
+	silences  SilenceStore
+	alerter   Alerter
+	queries   *queryRegistry
+	// Bearer token required to run checks and modify incidents and silences, or empty.
+	token string
+	// Whether the API only listens on localhost, so that it can run checks
+	// and modify incidents and silences without a token.
+	local bool
+	// Secret that Slack signs slash commands with, or empty to not serve them.
+	slackSigningSecret string
+	// Returns why the bot isn't ready, or nil if it is.
+	ready func() error
+	// Runs a check of a rule right away.
+	runCheck func(ctx context.Context, rule string) ([]IncidentEvent, error)
+	// Broadcasts incident events to GET /api/stream.
+	stream *incidentStream
+}
+
+func (a *apiServer) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/incidents", a.handleIncidents)
+	mux.HandleFunc("/api/incidents/", a.handleIncident)
+	mux.HandleFunc("/api/silences", a.handleSilences)
+	mux.HandleFunc("/api/silences/", a.handleSilence)
+	mux.HandleFunc("/api/checks/", a.handleCheck)
+	mux.HandleFunc("/api/stream", a.handleStream)
+	mux.HandleFunc("/api/v1/alerts", a.handleAlertmanagerAlerts)
+	mux.HandleFunc("/api/v2/alerts", a.handleAlertmanagerAlerts)
+	mux.HandleFunc("/api/queries", a.handleQueries)
+	if a.slackSigningSecret != "" {
+		mux.HandleFunc("/slack/commands", a.handleSlackCommand)
+	}
+	mux.HandleFunc("/healthz", a.handleHealthz)
+	mux.HandleFunc("/readyz", a.handleReadyz)
+	mux.HandleFunc("/metrics", handleMetrics)
+	mux.HandleFunc("/", a.handleDashboard)
+	return mux
+}
+
+// handleHealthz reports that the process is alive and serving requests.
+func (a *apiServer) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintln(w, "ok")
+}
+
+func (a *apiServer) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	if err := a.ready(); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+func (a *apiServer) handleQueries(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(a.queries.All())
+}
+
+// checkResult is the response to running a check on demand.
+type checkResult struct {
+	Rule     string `json:"rule"`
+	Duration string `json:"duration"`
+	// Incidents opened, still open and resolved by the check.
+	Opened   []Incident `json:"opened"`
+	Updated  []Incident `json:"updated"`
+	Resolved []Incident `json:"resolved"`
+}
+
+// handleCheck runs a rule's check and responds with the incidents it
+// opened, updated and resolved, once it has finished.
+func (a *apiServer) handleCheck(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/checks/"), "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] != "run" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !a.authorized(w, r) {
+		return
+	}
+
+	start := time.Now()
+	events, err := a.runCheck(r.Context(), parts[0])
+	switch {
+	case errors.Is(err, errRuleNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case errors.Is(err, errStreamingRule):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case errors.Is(err, errNotLeader):
+		http.Error(w, "this replica isn't the leader, so it doesn't run checks", http.StatusServiceUnavailable)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	res := checkResult{
+		Rule:     parts[0],
+		Duration: time.Since(start).Round(time.Millisecond).String(),
+		Opened:   []Incident{},
+		Updated:  []Incident{},
+		Resolved: []Incident{},
+	}
+	for _, e := range events {
+		switch e.Kind {
+		case IncidentOpened:
+			res.Opened = append(res.Opened, e.Incident)
+		case IncidentUpdated:
+			res.Updated = append(res.Updated, e.Incident)
+		case IncidentResolved:
+			res.Resolved = append(res.Resolved, e.Incident)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+// handleIncidents lists incidents, newest first, optionally filtered by
+// state (open, resolved or all), rule, cluster name or ID, and service.
+func (a *apiServer) handleIncidents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	limit := 100
+	if s := q.Get("limit"); s != "" {
+		v, err := strconv.Atoi(s)
+		if err != nil || v < 1 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = v
+	}
+	f := incidentFilter{State: q.Get("state"), Rule: q.Get("rule"), Cluster: q.Get("cluster"), Service: q.Get("service"), Limit: limit}
+	matches, err := a.listIncidents(r.Context(), f)
+	if errors.Is(err, errInvalidState) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(matches)
+}
+
+// errInvalidState is returned when listing incidents in an unknown state.
+var errInvalidState = errors.New("state must be open, resolved or all")
+
+// incidentFilter selects the incidents listed by the HTTP and gRPC APIs.
+// Empty fields match every incident.
+type incidentFilter struct {
+	// open, resolved or all.
+	State   string
+	Rule    string
+	Cluster string // Name or ID.
+	Service string
+	Limit   int
+}
+
+// listIncidents returns up to f.Limit incidents matching f, newest first.
+func (a *apiServer) listIncidents(ctx context.Context, f incidentFilter) ([]Incident, error) {
+	var incidents []Incident
+	var err error
+	switch f.State {
+	case "open":
+		incidents, err = a.incidents.Open(ctx)
+	case "", "all", "resolved":
+		incidents, err = a.incidents.All(ctx)
+	default:
+		return nil, errInvalidState
+	}
+	if err != nil {
+		return nil, err
+	}
+	matches := []Incident{}
+	for i := len(incidents) - 1; i >= 0 && len(matches) < f.Limit; i-- {
+		inc := incidents[i]
+		switch {
+		case f.State == "resolved" && inc.ResolvedAt.IsZero():
+		case f.Rule != "" && inc.Rule != f.Rule:
+		case f.Cluster != "" && inc.Cluster.Name != f.Cluster && inc.Cluster.ID != f.Cluster:
+		case f.Service != "" && inc.Service != f.Service:
+		default:
+			matches = append(matches, inc)
+		}
+	}
+	return matches, nil
+}
+
+// ackIncident acknowledges an incident and says so in Slack.
+func (a *apiServer) ackIncident(ctx context.Context, id string) (*Incident, error) {
+	inc, err := a.incidents.Ack(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	a.sendInfo(ctx, id, fmt.Sprintf("*[%s]* acknowledged.", id))
+	return inc, nil
+}
+
+// silenceIncident silences an incident for d and says so in Slack.
+func (a *apiServer) silenceIncident(ctx context.Context, id string, d time.Duration) (*Incident, error) {
+	inc, err := a.incidents.Silence(ctx, id, time.Now().Add(d))
+	if err != nil {
+		return nil, err
+	}
+	a.sendInfo(ctx, id, fmt.Sprintf("*[%s]* silenced for %s.", id, d))
+	return inc, nil
+}
+
+func (a *apiServer) sendInfo(ctx context.Context, id, msg string) {
+	if err := a.alerter.SendInfo(ctx, msg); err != nil {
+		logError("Error sending message.", "incident", id, "error", err)
+	}
+}
+
+func (a *apiServer) handleIncident(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/incidents/"), "/")
+	if parts[0] == "" || len(parts) > 2 {
+		http.NotFound(w, r)
+		return
+	}
+	if len(parts) == 1 {
+		a.getIncident(w, r, normalizeID(parts[0]))
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !a.authorized(w, r) {
+		return
+	}
+
+	id := normalizeID(parts[0])
+	var inc *Incident
+	var err error
+	switch parts[1] {
+	case "ack":
+		inc, err = a.ackIncident(r.Context(), id)
+	case "silence":
+		d := defaultIncidentSilence
+		if s := r.URL.Query().Get("duration"); s != "" {
+			d, err = time.ParseDuration(s)
+			if err != nil || d <= 0 {
+				http.Error(w, "invalid duration", http.StatusBadRequest)
+				return
+			}
+		}
+		inc, err = a.silenceIncident(r.Context(), id, d)
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if errors.Is(err, ErrIncidentNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(inc)
+}
+
+func (a *apiServer) getIncident(w http.ResponseWriter, r *http.Request, id string) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	inc, err := a.incidents.Get(r.Context(), id)
+	if errors.Is(err, ErrIncidentNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(inc)
+}
+
+// authorized checks that r carries the API token. Without a token
+// configured, only an API that listens on localhost is authorized, since
+// anyone who can reach the pod could otherwise silence every alert. If r
+// isn't authorized, an error is sent and false is returned.
+func (a *apiServer) authorized(w http.ResponseWriter, r *http.Request) bool {
+	if a.token == "" {
+		if a.local {
+			return true
+		}
+		http.Error(w, "set API_TOKEN to run checks or change incidents and silences through the API", http.StatusForbidden)
+		return false
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) != 1 {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "invalid or missing API token", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// How long an incident is silenced for when no duration is given.
+const defaultIncidentSilence = time.Hour
+
+// normalizeID returns an incident or silence ID as typed by a person, such as
+// inc-7F3A9C21, in the form it was generated in, INC-7f3a9c21.
+func normalizeID(id string) string {
+	if i := strings.IndexByte(id, '-'); i >= 0 {
+		return strings.ToUpper(id[:i]) + strings.ToLower(id[i:])
+	}
+	return strings.ToUpper(id)
+}
+
+// isLoopbackAddr returns whether the listen address addr, such as
+// localhost:8080, only accepts connections from the same host.
+func isLoopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// Longest createdBy and comment of a silence, in characters, since they are
+// shown in messages.
+const (
+	maxSilenceCreatedByLength = 100
+	maxSilenceCommentLength   = 500
+)
+
+// silenceRequest is the body of POST /api/silences. The silence lasts for
+// Duration, such as "2h", or until Until if Duration isn't set.
+type silenceRequest struct {
+	Rule      string    `json:"rule"`
+	Cluster   string    `json:"cluster"`
+	Namespace string    `json:"namespace"`
+	Service   string    `json:"service"`
+	Duration  string    `json:"duration"`
+	Until     time.Time `json:"until"`
+	CreatedBy string    `json:"createdBy"`
+	Comment   string    `json:"comment"`
+}
+
+// handleSilences lists the active silences, or creates a new one.
+func (a *apiServer) handleSilences(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		silences, err := a.silences.Active(r.Context(), time.Now())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if silences == nil {
+			silences = []Silence{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(silences)
+	case http.MethodPost:
+		a.createSilence(w, r)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (a *apiServer) createSilence(w http.ResponseWriter, r *http.Request) {
+	if !a.authorized(w, r) {
+		return
+	}
+	var req silenceRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	now := time.Now()
+	until := req.Until
+	if req.Duration != "" {
+		d, err := time.ParseDuration(req.Duration)
+		if err != nil || d <= 0 {
+			http.Error(w, "invalid duration", http.StatusBadRequest)
+			return
+		}
+		until = now.Add(d)
+	}
+	s := &Silence{
+		Rule:      req.Rule,
+		Cluster:   req.Cluster,
+		Namespace: req.Namespace,
+		Service:   req.Service,
+		Until:     until,
+		CreatedAt: now,
+		CreatedBy: req.CreatedBy,
+		Comment:   req.Comment,
+	}
+	err := a.addSilence(r.Context(), s)
+	var invalid invalidSilenceError
+	if errors.As(err, &invalid) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(s)
+}
+
+// invalidSilenceError is returned by addSilence for a silence that can't be
+// created, and says why.
+type invalidSilenceError string
+
+func (e invalidSilenceError) Error() string {
+	return string(e)
+}
+
+// addSilence checks and adds a silence created at s.CreatedAt, and says so in
+// Slack.
+func (a *apiServer) addSilence(ctx context.Context, s *Silence) error {
+	if s.Rule == "" && s.Cluster == "" && s.Namespace == "" && s.Service == "" {
+		return invalidSilenceError("silence must match a rule, cluster, namespace or service")
+	}
+	if utf8.RuneCountInString(s.CreatedBy) > maxSilenceCreatedByLength || utf8.RuneCountInString(s.Comment) > maxSilenceCommentLength {
+		return invalidSilenceError(fmt.Sprintf("createdBy must be at most %d characters and comment at most %d", maxSilenceCreatedByLength, maxSilenceCommentLength))
+	}
+	if !s.Until.After(s.CreatedAt) {
+		return invalidSilenceError("silence must have a duration or an until time in the future")
+	}
+	if err := a.silences.Add(ctx, s); err != nil {
+		return err
+	}
+	logInfo("Created silence.", "silence", s.ID, "matches", describeSilence(s), "until", s.Until, "created_by", s.CreatedBy)
+	msg := fmt.Sprintf(":no_bell: *[%s]* Silenced %s until %s.", s.ID, describeSilence(s), s.Until.Format("Jan 2 15:04 MST"))
+	if s.CreatedBy != "" {
+		msg += " Created by " + formatName(s.CreatedBy) + "."
+	}
+	if s.Comment != "" {
+		// Escaped, so that the comment can't mention @channel or add links.
+		msg += " " + escapeMrkdwn(s.Comment)
+	}
+	if err := a.alerter.SendInfo(ctx, msg); err != nil {
+		logError("Error sending message.", "silence", s.ID, "error", err)
+	}
+	return nil
+}
+
+// handleSilence ends a silence early.
+func (a *apiServer) handleSilence(w http.ResponseWriter, r *http.Request) {
+	id := normalizeID(strings.TrimPrefix(r.URL.Path, "/api/silences/"))
+	if id == "" || strings.Contains(id, "/") {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodDelete {
+		w.Header().Set("Allow", http.MethodDelete)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !a.authorized(w, r) {
+		return
+	}
+	err := a.silences.Delete(r.Context(), id)
+	if errors.Is(err, ErrSilenceNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := a.alerter.SendInfo(r.Context(), fmt.Sprintf(":bell: *[%s]* Silence ended.", id)); err != nil {
+		logError("Error sending message.", "silence", id, "error", err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// describeSilence describes what a silence matches in messages, such as
+// "namespace `px-sock-shop` on cluster `prod`".
+func describeSilence(s *Silence) string {
+	var parts []string
+	if s.Rule != "" {
+		parts = append(parts, "rule "+formatName(s.Rule))
+	}
+	if s.Service != "" {
+		parts = append(parts, "service "+formatName(s.Service))
+	}
+	if s.Namespace != "" {
+		parts = append(parts, "namespace "+formatName(s.Namespace))
+	}
+	d := strings.Join(parts, ", ")
+	if s.Cluster != "" {
+		if d == "" {
+			return "cluster " + formatName(s.Cluster)
+		}
+		d += " on cluster " + formatName(s.Cluster)
+	}
+	return d
+}
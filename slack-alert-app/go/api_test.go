@@ -0,0 +1,91 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAPIAuthorization(t *testing.T) {
+	for _, tt := range []struct {
+		token, header string
+		local         bool
+		want          int
+	}{
+		{token: "", local: false, want: http.StatusForbidden},
+		{token: "", local: true, want: http.StatusCreated},
+		{token: "secret", header: "Bearer wrong", want: http.StatusUnauthorized},
+		{token: "secret", header: "Bearer secret", want: http.StatusCreated},
+	} {
+		a := &apiServer{incidents: newMemoryIncidentManager(), silences: newMemorySilences(), alerter: &CaptureAlerter{}, token: tt.token, local: tt.local}
+		r := httptest.NewRequest(http.MethodPost, "/api/silences", strings.NewReader(`{"rule": "http-errors", "duration": "1h"}`))
+		if tt.header != "" {
+			r.Header.Set("Authorization", tt.header)
+		}
+		w := httptest.NewRecorder()
+		a.Handler().ServeHTTP(w, r)
+		if w.Code != tt.want {
+			t.Errorf("token %q, local %v, header %q: got status %d, want %d", tt.token, tt.local, tt.header, w.Code, tt.want)
+		}
+	}
+}
+
+func TestIsLoopbackAddr(t *testing.T) {
+	for addr, want := range map[string]bool{
+		"localhost:8080": true,
+		"127.0.0.1:8080": true,
+		"[::1]:8080":     true,
+		":8080":          false,
+		"0.0.0.0:8080":   false,
+		"10.0.0.1:8080":  false,
+		"localhost":      false,
+	} {
+		if got := isLoopbackAddr(addr); got != want {
+			t.Errorf("isLoopbackAddr(%q) = %v, want %v", addr, got, want)
+		}
+	}
+}
+
+func TestCreateSilenceEscapesMessage(t *testing.T) {
+	alerter := &CaptureAlerter{}
+	a := &apiServer{incidents: newMemoryIncidentManager(), silences: newMemorySilences(), alerter: alerter, local: true}
+	body := `{"rule": "http-*errors*", "duration": "1h", "createdBy": "<!channel>", "comment": "see <https://example.com|here> <@U123>"}`
+	w := httptest.NewRecorder()
+	a.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/silences", strings.NewReader(body)))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("got status %d: %s", w.Code, w.Body)
+	}
+	msgs := alerter.Messages()
+	if len(msgs) != 1 {
+		t.Fatalf("got %d messages, want 1", len(msgs))
+	}
+	for _, raw := range []string{"<!channel>", "<https://", "<@U123>", "rule http-*errors*"} {
+		if strings.Contains(msgs[0].Msg, raw) {
+			t.Errorf("message has unescaped %q: %s", raw, msgs[0].Msg)
+		}
+	}
+
+	long := `{"rule": "http-errors", "duration": "1h", "comment": "` + strings.Repeat("x", maxSilenceCommentLength+1) + `"}`
+	w = httptest.NewRecorder()
+	a.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/silences", strings.NewReader(long)))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("got status %d for a too long comment, want %d", w.Code, http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,655 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"reflect"
+	"regexp"
+	"sync"
+	"time"
+
+	"go.withpixie.dev/pixie/src/api/go/pxapi"
+	"google.golang.org/grpc"
+)
+
+// configPollInterval is how often the config file is checked for changes.
+const configPollInterval = 10 * time.Second
+
+// app is the bot. The connection to Pixie, the clusters and the incident
+// state are created once, while the trackers for each rule are rebuilt
+// whenever the config is reloaded.
+type app struct {
+	// Loads the config, both at startup and on reload.
+	load func() (*Config, error)
+	cfg  *Config
+
+	pixie     *pixieConn
+	clusters  clusterSource
+	fallbacks *fallbackClusters
+	// Recorded output that checks run against instead of Pixie, or nil.
+	replay    *replayer
+	incidents IncidentManager
+	silences  SilenceStore
+	queries   *queryRegistry
+	workers   *workerPool
+	leader    *leaderElector
+	tracer    *tracer
+	// Caps the messages sent across all rules, or nil.
+	budget    *alertBudget
+	heartbeat *heartbeat
+	// Annotates Grafana dashboards with incidents, or nil.
+	grafana *grafanaAnnotator
+	// Broadcasts incident events to API clients.
+	stream *incidentStream
+	api    *apiServer
+
+	mu     sync.Mutex
+	engine *RuleEngine
+	// When the current engine started running.
+	started time.Time
+	// Error from the last attempt to reload the config, if it failed.
+	reloadErr error
+}
+
+// newApp loads the config, connects to Pixie and builds the trackers for each rule.
+func newApp(ctx context.Context, load func() (*Config, error)) (*app, error) {
+	cfg, err := load()
+	if err != nil {
+		return nil, err
+	}
+	a := &app{load: load, cfg: cfg, queries: newQueryRegistry(), workers: newWorkerPool(cfg.Checks.Workers)}
+
+	// Replayed checks run against the recorded clusters instead of Pixie,
+	// and checks of local data against a single local cluster.
+	switch {
+	case cfg.ReplayDir != "":
+		if a.replay, err = loadReplay(cfg.ReplayDir); err != nil {
+			return nil, err
+		}
+		a.clusters = a.replay.clusters
+	case cfg.LocalDataDir != "":
+		a.clusters = staticClusters{newLocalDataCluster(cfg.LocalDataDir)}
+	default:
+		if err := a.connectPixie(ctx, cfg); err != nil {
+			return nil, err
+		}
+	}
+
+	// With leader election, only the replica holding the lease runs checks.
+	if le := cfg.LeaderElection; le.Enabled {
+		kube, err := newInClusterKubeClient()
+		if err != nil {
+			return nil, fmt.Errorf("leader election: %w", err)
+		}
+		identity := le.Identity
+		if identity == "" {
+			if identity, err = os.Hostname(); err != nil {
+				return nil, err
+			}
+		}
+		a.leader = newLeaderElector(kube, le.Lease, identity, le.Duration.Duration)
+	}
+
+	if cfg.Tracing.Endpoint != "" {
+		a.tracer = newTracer(cfg.Tracing)
+	}
+	if a.heartbeat, err = newHeartbeat(cfg); err != nil {
+		return nil, err
+	}
+	if cfg.Checks.AlertBudget > 0 {
+		a.budget = newAlertBudget(cfg.Checks.AlertBudget, cfg.Checks.OverflowSummaryEvery.Duration, cfg.channelAlerter(cfg.Defaults.Channel))
+	}
+
+	// Incident state is kept in memory, unless a Redis URL is given so that
+	// multiple replicas can share it, or a state file so that it survives
+	// restarts and one-off runs.
+	a.incidents = newMemoryIncidentManager()
+	a.silences = newMemorySilences()
+	switch {
+	case (cfg.Redis.URL != "" || cfg.StateFile != "") && cfg.DryRun:
+		logInfo("Dry run, keeping incident state in memory.")
+	case cfg.Redis.URL != "":
+		m, err := newRedisIncidentManager(cfg.Redis.URL, cfg.Redis.KeyPrefix)
+		if err != nil {
+			return nil, err
+		}
+		a.incidents, a.silences = m, newRedisSilences(m)
+	case cfg.StateFile != "":
+		a.incidents, err = newFileIncidentManager(cfg.StateFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading incident state from %s: %w", cfg.StateFile, err)
+		}
+	}
+
+	if cfg.Grafana.URL != "" {
+		a.grafana = newGrafanaAnnotator(cfg.Grafana)
+	}
+
+	a.stream = newIncidentStream()
+
+	alerter := cfg.channelAlerter(cfg.Defaults.Channel)
+	a.api = &apiServer{incidents: a.incidents, silences: a.silences, alerter: alerter, queries: a.queries, token: cfg.APIToken, local: isLoopbackAddr(cfg.HTTPAddr), slackSigningSecret: cfg.Slack.SigningSecret, ready: a.ready, runCheck: a.runCheck, stream: a.stream}
+
+	a.engine, err = a.newEngine(cfg, nil)
+	if err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// connectPixie connects to Pixie Cloud and to the clusters to monitor.
+func (a *app) connectPixie(ctx context.Context, cfg *Config) error {
+	// The API key is read from a file instead if one is set, which lets it be
+	// rotated without restarting the bot.
+	loadAPIKey, err := apiKeyLoader(cfg.Pixie.APIKey, cfg.Pixie.APIKeyFile)
+	if err != nil && cfg.vaultPixieKey == nil {
+		return err
+	}
+	// A key from Vault is fetched again whenever Pixie Cloud rejects it.
+	if s := cfg.vaultPixieKey; s != nil {
+		loadAPIKey = func() (string, error) {
+			s.Invalidate()
+			return s.Get(ctx)
+		}
+	}
+	var pixieOpts []pxapi.ClientOption
+	if cfg.Pixie.CloudAddr != "" {
+		pixieOpts = append(pixieOpts, pxapi.WithCloudAddr(cfg.Pixie.CloudAddr))
+		setPixieCloudAddr(cfg.Pixie.CloudAddr)
+	}
+	a.pixie, err = newPixieConn(ctx, loadAPIKey, pixieOpts...)
+	if err != nil {
+		return err
+	}
+
+	// When discovering clusters, only monitor those whose name matches this regex.
+	clusterFilter, err := regexp.Compile(cfg.Pixie.ClusterNameFilter)
+	if err != nil {
+		return fmt.Errorf("invalid cluster name filter: %w", err)
+	}
+	labels := cfg.Pixie.ClusterLabels
+	var sources combinedClusters
+	if cfg.Pixie.discoverClusters() {
+		sources = append(sources, newDiscoveredClusters(a.pixie, clusterFilter, labels))
+	} else if len(cfg.Pixie.Clusters) > 0 {
+		clusters, err := connectClusters(ctx, a.pixie, cfg.Pixie.Clusters, labels)
+		if err != nil {
+			return err
+		}
+		sources = append(sources, clusters)
+	}
+	if len(cfg.Pixie.DirectClusters) > 0 {
+		var direct staticClusters
+		for _, d := range cfg.Pixie.DirectClusters {
+			c, err := newDirectCluster(d, a.pixie.Key, labels)
+			if err != nil {
+				return err
+			}
+			direct = append(direct, c)
+		}
+		sources = append(sources, direct)
+	}
+	a.clusters = sources
+	if len(sources) == 1 {
+		a.clusters = sources[0]
+	}
+	// Standby clusters to run checks against when a cluster keeps failing.
+	if len(cfg.Pixie.FallbackClusters) > 0 {
+		a.fallbacks = newFallbackClusters(a.pixie, cfg.Pixie.FallbackClusters, cfg.Pixie.FallbackAfter, labels)
+	}
+	return nil
+}
+
+// newEngine builds the trackers for each rule in cfg. Trackers for rules
+// that were already running in prev keep track of where their last check
+// left off.
+func (a *app) newEngine(cfg *Config, prev *RuleEngine) (*RuleEngine, error) {
+	rules, err := cfg.loadRules()
+	if err != nil {
+		return nil, err
+	}
+
+	// Schedules and business hours are both in the configured timezone.
+	loc, err := time.LoadLocation(cfg.Timezone)
+	if err != nil {
+		return nil, err
+	}
+
+	// Outside of business hours, only critical incidents are sent as alerts.
+	// Everything else is posted as an info message.
+	var policy AlertPolicy = alwaysAlertPolicy{}
+	if cfg.BusinessHours != "" {
+		policy, err = parseBusinessHours(cfg.BusinessHours, loc)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Post-incident reports can be posted to a Slack channel and/or written
+	// as Markdown files to a directory.
+	var reports []ReportSink
+	if cfg.Reports.Channel != "" {
+		reports = append(reports, &slackReportSink{alerter: a.budget.wrap(cfg.channelAlerter(cfg.Reports.Channel))})
+	}
+	if cfg.Reports.Dir != "" {
+		reports = append(reports, &dirReportSink{dir: cfg.Reports.Dir})
+	}
+
+	// Everything built from here on is closed with the engine, or right
+	// away if the engine can't be built.
+	var closers []io.Closer
+	defer func() { closeAll(closers) }()
+
+	// The stats of every service can be exported after each check, so that
+	// dashboards show the same data the bot alerts on.
+	var exporters []StatsSink
+	if cfg.RemoteWrite.URL != "" {
+		exporters = append(exporters, newRemoteWriteSink(cfg.RemoteWrite))
+	}
+	if cfg.OTLPMetrics.Endpoint != "" {
+		exporters = append(exporters, newOTLPMetricsSink(cfg.OTLPMetrics, cfg.Tracing.ServiceName))
+	}
+	if cfg.StatsD.Addr != "" {
+		exporters = append(exporters, newStatsDSink(cfg.StatsD))
+	}
+	if cfg.Influx.URL != "" {
+		exporters = append(exporters, newInfluxSink(cfg.Influx))
+	}
+	for _, e := range exporters {
+		if c, ok := e.(io.Closer); ok {
+			closers = append(closers, c)
+		}
+	}
+	var bq *bigQueryExporter
+	if cfg.BigQuery.Project != "" {
+		bq = newBigQueryExporter(cfg.BigQuery)
+		if cfg.BigQuery.StatsTable != "" {
+			exporters = append(exporters, bq)
+		}
+	}
+
+	var record *resultRecorder
+	if cfg.RecordDir != "" {
+		record = &resultRecorder{dir: cfg.RecordDir}
+	}
+
+	var archive *resultArchiver
+	if cfg.Archive.URL != "" {
+		if archive, err = newResultArchiver(cfg.Archive); err != nil {
+			return nil, err
+		}
+		closers = append(closers, archive)
+	}
+
+	// Every change to an incident can be mirrored elsewhere. The Grafana
+	// annotator and the event stream outlive the engine, since they keep
+	// track of open incidents and connected clients.
+	sinks := []IncidentSink{a.stream}
+	if a.grafana != nil {
+		sinks = append(sinks, a.grafana)
+	}
+	if bq != nil && cfg.BigQuery.IncidentsTable != "" {
+		sinks = append(sinks, bq)
+	}
+	if cfg.KubeEvents.Cluster != "" {
+		instance := cfg.LeaderElection.Identity
+		if instance == "" {
+			instance, _ = os.Hostname()
+		}
+		events, err := newKubeEventRecorder(cfg.KubeEvents, instance)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, events)
+		closers = append(closers, events)
+	}
+
+	windows := make(map[string]*queryWindows)
+	if prev != nil {
+		for _, t := range prev.trackers {
+			windows[t.rule.Name] = t.windows
+		}
+	}
+
+	retry := retryPolicy{attempts: cfg.Checks.Attempts, initialDelay: time.Second, maxDelay: 30 * time.Second}
+	engine := &RuleEngine{
+		unhealthyAfter: cfg.Checks.UnhealthyAfter,
+		maxBackoff:     cfg.Checks.MaxBackoff.Duration,
+		missedTicks:    cfg.Checks.MissedTicks,
+	}
+	if engine.unhealthy, err = cfg.unhealthyAlerter(); err != nil {
+		return nil, err
+	}
+	for _, r := range rules {
+		script, err := loadRuleScript(r)
+		if err != nil {
+			return nil, fmt.Errorf("loading rule %s: %w", r.Name, err)
+		}
+		w, ok := windows[r.Name]
+		if !ok {
+			w = &queryWindows{}
+		}
+		var schedule *cronSchedule
+		if r.Schedule != "" {
+			if schedule, err = parseCron(r.Schedule, loc); err != nil {
+				return nil, fmt.Errorf("rule %s: %w", r.Name, err)
+			}
+		}
+		alerter, err := cfg.ruleAlerter(r)
+		if err != nil {
+			return nil, fmt.Errorf("rule %s: %w", r.Name, err)
+		}
+		engine.trackers = append(engine.trackers, &ServiceTracker{
+			rule:                   r,
+			script:                 script,
+			schedule:               schedule,
+			clusters:               a.clusters,
+			maxParallel:            cfg.Checks.MaxParallelClusters,
+			workers:                a.workers,
+			retry:                  retry,
+			windows:                w,
+			queries:                a.queries,
+			queryFailureAlertAfter: cfg.Checks.FailureAlertAfter,
+			malformedAlertRate:     cfg.Checks.MalformedAlertRate,
+			fallbacks:              a.fallbacks,
+			incidents:              a.incidents,
+			silences:               a.silences,
+			policy:                 policy,
+			alerter:                a.budget.wrap(alerter),
+			reports:                reports,
+			exporters:              exporters,
+			sinks:                  sinks,
+			archive:                archive,
+			record:                 record,
+			replay:                 a.replay,
+			leader:                 a.leader,
+			tracer:                 a.tracer,
+		})
+	}
+	engine.closers, closers = closers, nil
+	return engine, nil
+}
+
+// Run runs the pre-flight checks, if enabled, then serves the HTTP API and
+// runs every rule until ctx is cancelled. Each time reload receives, the
+// config is loaded again and the rules are restarted with it. If the new
+// config is invalid, the current rules keep running. Once ctx is cancelled,
+// checks in flight are given the shutdown timeout to finish.
+func (a *app) Run(ctx context.Context, reload <-chan struct{}) error {
+	if a.cfg.Checks.Preflight {
+		if err := preflight(ctx, a.engine.trackers); err != nil {
+			return err
+		}
+	}
+
+	// The lease is released once checks in flight have finished.
+	leaderCtx, stopLeader := context.WithCancel(context.Background())
+	leaderDone := make(chan struct{})
+	go func() {
+		defer close(leaderDone)
+		if a.leader != nil {
+			a.leader.Run(leaderCtx)
+		}
+	}()
+
+	// Spans are exported, held back messages summarized and heartbeats
+	// sent until the checks in flight have finished too.
+	bgCtx, stopBackground := context.WithCancel(context.Background())
+	var bg sync.WaitGroup
+	bg.Add(3)
+	go func() {
+		defer bg.Done()
+		a.tracer.Run(bgCtx)
+	}()
+	go func() {
+		defer bg.Done()
+		a.budget.Run(bgCtx)
+	}()
+	go func() {
+		defer bg.Done()
+		a.runHeartbeat(bgCtx)
+	}()
+
+	if a.cfg.APIToken == "" && !a.api.local {
+		logWarn("API_TOKEN isn't set, so the API can't run checks or change incidents and silences.", "addr", a.cfg.HTTPAddr)
+	}
+	servers := []*http.Server{{Addr: a.cfg.HTTPAddr, Handler: a.api.Handler()}}
+	if a.cfg.AdminAddr != "" {
+		servers = append(servers, &http.Server{Addr: a.cfg.AdminAddr, Handler: a.adminHandler()})
+	}
+	var grpcSrv *grpc.Server
+	if a.cfg.GRPCAddr != "" {
+		grpcSrv = newGRPCServer(a.api, isLoopbackAddr(a.cfg.GRPCAddr))
+		go func() {
+			lis, err := net.Listen("tcp", a.cfg.GRPCAddr)
+			if err == nil {
+				err = grpcSrv.Serve(lis)
+			}
+			if err != nil {
+				logError("Error serving gRPC.", "addr", a.cfg.GRPCAddr, "error", err)
+				os.Exit(1)
+			}
+		}()
+	}
+	for _, srv := range servers {
+		go func(srv *http.Server) {
+			if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				logError("Error serving HTTP.", "addr", srv.Addr, "error", err)
+				os.Exit(1)
+			}
+		}(srv)
+	}
+
+	for {
+		// Checks don't use ctx, so that they can finish when it's cancelled.
+		runCtx, stop := context.WithCancel(ctx)
+		work, cancelWork := context.WithCancel(context.Background())
+		a.mu.Lock()
+		a.started = time.Now()
+		a.mu.Unlock()
+		done := make(chan struct{})
+		go func(e *RuleEngine) {
+			defer close(done)
+			e.Run(runCtx, work)
+		}(a.engine)
+
+		var next *RuleEngine
+		for next == nil {
+			select {
+			case <-ctx.Done():
+				logInfo("Shutting down, waiting for checks in flight.", "timeout", a.cfg.ShutdownTimeout)
+				a.drain(stop, cancelWork, done)
+				a.engine.Close()
+				stopLeader()
+				<-leaderDone
+				stopBackground()
+				bg.Wait()
+				a.shutdown(servers, grpcSrv)
+				return nil
+			case <-reload:
+			}
+			var err error
+			next, err = a.reload(ctx)
+			if err != nil {
+				logError("Error reloading config, keeping the current config.", "error", err)
+			}
+			a.mu.Lock()
+			a.reloadErr = err
+			a.mu.Unlock()
+		}
+		a.drain(stop, cancelWork, done)
+		a.mu.Lock()
+		prev := a.engine
+		a.engine = next
+		a.mu.Unlock()
+		prev.Close()
+		logInfo("Config reloaded.", "rules", len(next.trackers))
+	}
+}
+
+// drain stops scheduling checks and waits for the checks in flight to
+// finish, until done is closed. Checks that haven't finished within the
+// shutdown timeout are cancelled.
+func (a *app) drain(stop, cancelWork context.CancelFunc, done <-chan struct{}) {
+	stop()
+	defer cancelWork()
+	timer := time.NewTimer(a.cfg.ShutdownTimeout.Duration)
+	defer timer.Stop()
+	select {
+	case <-done:
+		return
+	case <-timer.C:
+	}
+	logWarn("Checks still running after the shutdown timeout, cancelling them.", "timeout", a.cfg.ShutdownTimeout)
+	cancelWork()
+	<-done
+}
+
+// shutdown stops the HTTP and gRPC servers and closes the incident store. Incident
+// state in Redis is written as it changes, so only the connection needs to
+// be closed; in-memory state is lost.
+func (a *app) shutdown(servers []*http.Server, grpcSrv *grpc.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if grpcSrv != nil {
+		// Streams only end when their clients cancel, so they are cut off.
+		grpcSrv.Stop()
+	}
+	for _, srv := range servers {
+		if err := srv.Shutdown(ctx); err != nil {
+			logError("Error stopping the HTTP server.", "addr", srv.Addr, "error", err)
+		}
+	}
+	if c, ok := a.incidents.(io.Closer); ok {
+		if err := c.Close(); err != nil {
+			logError("Error closing incident store.", "error", err)
+		}
+	}
+	logInfo("Shut down.")
+}
+
+// reload loads the config and builds the trackers for it.
+func (a *app) reload(ctx context.Context) (*RuleEngine, error) {
+	cfg, err := a.load()
+	if err != nil {
+		return nil, err
+	}
+	engine, err := a.newEngine(cfg, a.engine)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Checks.Preflight {
+		if err := preflight(ctx, engine.trackers); err != nil {
+			engine.Close()
+			return nil, err
+		}
+	}
+	if cfg.LeaderElection != a.cfg.LeaderElection {
+		logWarn("Leader election settings can't be reloaded, restart the bot to apply them.")
+	}
+	if !reflect.DeepEqual(cfg.Pixie, a.cfg.Pixie) || cfg.Redis != a.cfg.Redis || cfg.StateFile != a.cfg.StateFile || cfg.Slack != a.cfg.Slack || cfg.HTTPAddr != a.cfg.HTTPAddr || cfg.APIToken != a.cfg.APIToken || cfg.GRPCAddr != a.cfg.GRPCAddr || cfg.AdminAddr != a.cfg.AdminAddr || cfg.Checks.Workers != a.cfg.Checks.Workers || cfg.Heartbeat != a.cfg.Heartbeat || cfg.Grafana != a.cfg.Grafana {
+		logWarn("Pixie, Slack, Redis, state file, HTTP, worker, heartbeat and Grafana settings can't be reloaded, restart the bot to apply them.")
+	}
+	a.mu.Lock()
+	a.cfg = cfg
+	a.mu.Unlock()
+	return engine, nil
+}
+
+// watchFile sends on the returned channel whenever the modification time of
+// the file at path changes, until ctx is cancelled.
+func watchFile(ctx context.Context, path string) <-chan struct{} {
+	changed := make(chan struct{}, 1)
+	modTime := func() time.Time {
+		info, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}
+		}
+		return info.ModTime()
+	}
+	go func() {
+		last := modTime()
+		ticker := time.NewTicker(configPollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			if t := modTime(); !t.Equal(last) {
+				last = t
+				logInfo("Config file changed, reloading config.", "path", path)
+				select {
+				case changed <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}()
+	return changed
+}
+
+var (
+	// errRuleNotFound is returned by runCheck for rules that aren't in the config.
+	errRuleNotFound = errors.New("rule not found")
+	// errStreamingRule is returned by runCheck for streaming rules, which are
+	// evaluated continuously instead of checked.
+	errStreamingRule = errors.New("streaming rules can't be checked on demand")
+)
+
+// runCheck runs a check of a rule right away, outside of its schedule, and
+// returns the changes to incidents it made. The check counts towards the
+// rule's status like any other.
+func (a *app) runCheck(ctx context.Context, rule string) ([]IncidentEvent, error) {
+	a.mu.Lock()
+	engine := a.engine
+	a.mu.Unlock()
+
+	var t *ServiceTracker
+	for _, tr := range engine.trackers {
+		if tr.rule.Name == rule {
+			t = tr
+		}
+	}
+	if t == nil {
+		return nil, errRuleNotFound
+	}
+	if t.rule.Streaming {
+		return nil, errStreamingRule
+	}
+
+	logInfo("Running check on demand.", "rule", rule)
+	start := time.Now()
+	var events []IncidentEvent
+	err := recoverPanic(func() error {
+		var err error
+		events, err = t.RunNow(ctx)
+		return err
+	})
+	if !errors.Is(err, errNotLeader) && ctx.Err() == nil {
+		engine.record(ctx, rule, start, err, time.Now())
+	}
+	return events, err
+}
@@ -0,0 +1,264 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"go.withpixie.dev/pixie/src/api/go/pxapi"
+	"go.withpixie.dev/pixie/src/api/go/pxapi/types"
+)
+
+// resultArchiver keeps the raw output table of every check in object
+// storage as gzipped CSV, for cheap retention of Pixie query results long
+// after Pixie has dropped the data. Objects are partitioned by rule and date,
+// with the other tables the script output next to the rule's table:
+//
+//	<prefix>/<rule>/2006/01/02/<cluster>/150405-<cluster ID>.csv.gz
+//	<prefix>/<rule>/2006/01/02/<cluster>/150405-<cluster ID>-<table>.csv.gz
+type resultArchiver struct {
+	store  objectStore
+	prefix string
+	http   *http.Client
+}
+
+// objectStore is a bucket in S3 or GCS.
+type objectStore interface {
+	Put(ctx context.Context, key string, body []byte, contentType string) error
+}
+
+// newResultArchiver returns an archiver for a URL such as s3://bucket/prefix
+// or gs://bucket/prefix.
+func newResultArchiver(cfg ArchiveConfig) (*resultArchiver, error) {
+	u, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("archive URL %q has no bucket", cfg.URL)
+	}
+	a := &resultArchiver{}
+	for _, seg := range strings.Split(u.Path, "/") {
+		if seg != "" {
+			a.prefix += keyUnsafe.ReplaceAllString(seg, "_") + "/"
+		}
+	}
+	client := newHTTPClient(time.Minute)
+	a.http = client
+	switch u.Scheme {
+	case "s3":
+		region := cfg.Region
+		if region == "" {
+			region = os.Getenv("AWS_REGION")
+		}
+		if region == "" {
+			return nil, fmt.Errorf("ARCHIVE_REGION or AWS_REGION must be set to archive to %s", cfg.URL)
+		}
+		a.store = &s3Store{bucket: u.Host, region: region, http: client}
+	case "gs":
+		a.store = &gcsStore{bucket: u.Host, http: client}
+	default:
+		return nil, fmt.Errorf("archive URL %q must start with s3:// or gs://", cfg.URL)
+	}
+	return a, nil
+}
+
+// Close closes the idle connections to the bucket.
+func (a *resultArchiver) Close() error {
+	if a.http != nil {
+		a.http.CloseIdleConnections()
+	}
+	return nil
+}
+
+// keyUnsafe matches the characters that aren't kept in object keys, so
+// that keys never need escaping.
+var keyUnsafe = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// Key returns the key of the results of a rule's check on a cluster at t:
+// of the rule's table if table is empty, or else of the named table.
+func (a *resultArchiver) Key(rule string, c Cluster, t time.Time, table string) string {
+	t = t.UTC()
+	suffix := ""
+	if table != "" {
+		suffix = "-" + keyUnsafe.ReplaceAllString(table, "_")
+	}
+	return fmt.Sprintf("%s%s/%s/%s/%s-%s%s.csv.gz", a.prefix, keyUnsafe.ReplaceAllString(rule, "_"), t.Format("2006/01/02"),
+		keyUnsafe.ReplaceAllString(c.Name, "_"), t.Format("150405"), keyUnsafe.ReplaceAllString(c.ID, "_"), suffix)
+}
+
+// csvArchive records every record of a table as gzipped CSV, with a header
+// of the column names, before passing it on to the next handler.
+type csvArchive struct {
+	next pxapi.TableRecordHandler
+	buf  bytes.Buffer
+	gz   *gzip.Writer
+	csv  *csv.Writer
+	row  []string
+}
+
+func newCSVArchive(next pxapi.TableRecordHandler) *csvArchive {
+	a := &csvArchive{next: next}
+	a.gz = gzip.NewWriter(&a.buf)
+	a.csv = csv.NewWriter(a.gz)
+	return a
+}
+
+func (a *csvArchive) HandleInit(ctx context.Context, metadata types.TableMetadata) error {
+	header := make([]string, len(metadata.ColInfo))
+	for i, col := range metadata.ColInfo {
+		header[i] = col.Name
+	}
+	if err := a.csv.Write(header); err != nil {
+		return err
+	}
+	return a.next.HandleInit(ctx, metadata)
+}
+
+func (a *csvArchive) HandleRecord(ctx context.Context, r *types.Record) error {
+	a.row = a.row[:0]
+	for _, d := range r.Data {
+		a.row = append(a.row, d.String())
+	}
+	if err := a.csv.Write(a.row); err != nil {
+		return err
+	}
+	return a.next.HandleRecord(ctx, r)
+}
+
+func (a *csvArchive) HandleDone(ctx context.Context) error {
+	return a.next.HandleDone(ctx)
+}
+
+// Bytes returns the gzipped CSV of every record handled.
+func (a *csvArchive) Bytes() ([]byte, error) {
+	a.csv.Flush()
+	if err := a.csv.Error(); err != nil {
+		return nil, err
+	}
+	if err := a.gz.Close(); err != nil {
+		return nil, err
+	}
+	return a.buf.Bytes(), nil
+}
+
+// Archive uploads the records of table to key.
+func (a *resultArchiver) Archive(ctx context.Context, key string, table *csvArchive) error {
+	body, err := table.Bytes()
+	if err != nil {
+		return err
+	}
+	if err := a.store.Put(ctx, key, body, "application/gzip"); err != nil {
+		return fmt.Errorf("archiving results to %s: %w", key, err)
+	}
+	return nil
+}
+
+// s3Store puts objects in an S3 bucket, using the credentials in the
+// environment or, on EKS, the pod's IAM role.
+type s3Store struct {
+	bucket string
+	region string
+	http   *http.Client
+
+	mu sync.Mutex
+	// Credentials of the last Put, kept until shortly before they expire.
+	creds *awsCredentials
+}
+
+// awsCredentialsRefresh is how long before they expire credentials from an
+// assumed role are replaced, so that none expire during a request.
+const awsCredentialsRefresh = 5 * time.Minute
+
+// credentials returns the cached credentials, or new ones if they are about to expire.
+func (s *s3Store) credentials(ctx context.Context) (*awsCredentials, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.creds != nil && (s.creds.expiration.IsZero() || time.Until(s.creds.expiration) > awsCredentialsRefresh) {
+		return s.creds, nil
+	}
+	creds, err := awsCredentialsFromEnv(ctx)
+	if err != nil {
+		return nil, err
+	}
+	s.creds = creds
+	return creds, nil
+}
+
+func (s *s3Store) Put(ctx context.Context, key string, body []byte, contentType string) error {
+	creds, err := s.credentials(ctx)
+	if err != nil {
+		return err
+	}
+	u := fmt.Sprintf("https://%s.s3.%s.amazonaws.com/%s", s.bucket, s.region, key)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("X-Amz-Content-Sha256", sha256Hex(body))
+	creds.sign(req, body, s.region, "s3", time.Now())
+	return doPut(s.http, req)
+}
+
+// gcsStore puts objects in a GCS bucket, using the service account of the
+// GKE node or, with Workload Identity, the pod.
+type gcsStore struct {
+	bucket string
+	http   *http.Client
+}
+
+func (s *gcsStore) Put(ctx context.Context, key string, body []byte, contentType string) error {
+	token, err := gcpAccessToken(ctx)
+	if err != nil {
+		return err
+	}
+	q := url.Values{}
+	q.Set("uploadType", "media")
+	q.Set("name", key)
+	u := fmt.Sprintf("https://storage.googleapis.com/upload/storage/v1/b/%s/o?%s", url.PathEscape(s.bucket), q.Encode())
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("Authorization", "Bearer "+token)
+	return doPut(s.http, req)
+}
+
+func doPut(client *http.Client, req *http.Request) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s %s returned %s", req.Method, req.URL.Host, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,263 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestArchiveKey(t *testing.T) {
+	a, err := newResultArchiver(ArchiveConfig{URL: "gs://bucket/pixie/results"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2021, 2, 8, 15, 30, 0, 0, time.FixedZone("EST", -5*3600))
+	c := Cluster{ID: "5a3c2b1e-9dad", Name: "prod us/east"}
+	if got, want := a.Key("http errors", c, now, ""), "pixie/results/http_errors/2021/02/08/prod_us_east/203000-5a3c2b1e-9dad.csv.gz"; got != want {
+		t.Errorf("Key() = %q, want %q", got, want)
+	}
+	if got, want := a.Key("http errors", c, now, "debug/table"), "pixie/results/http_errors/2021/02/08/prod_us_east/203000-5a3c2b1e-9dad-debug_table.csv.gz"; got != want {
+		t.Errorf("Key() of another table = %q, want %q", got, want)
+	}
+}
+
+// capturedStore is an objectStore that keeps the objects put in it.
+type capturedStore struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func (s *capturedStore) Put(ctx context.Context, key string, body []byte, contentType string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.objects == nil {
+		s.objects = make(map[string][]byte)
+	}
+	s.objects[key] = body
+	return nil
+}
+
+// readCSV returns the rows of a gzipped CSV.
+func readCSV(t *testing.T, b []byte) [][]string {
+	t.Helper()
+	gz, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows, err := csv.NewReader(gz).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rows
+}
+
+func TestArchiveEveryTable(t *testing.T) {
+	var tables []staticTable
+	for _, rt := range []*recordedTable{
+		httpTable([]string{"px-sock-shop/orders", "/orders", "40", "100"}, []string{"px-sock-shop/carts", "/carts", "0", "100"}),
+		localTable("debug", []string{"msg"}, [][]string{{"a"}, {"b"}}),
+	} {
+		st, err := rt.static()
+		if err != nil {
+			t.Fatal(err)
+		}
+		tables = append(tables, st)
+	}
+	c := &cluster{Cluster: Cluster{ID: "prod-id", Name: "prod"}, executor: newStaticExecutor(tables...)}
+	s, _ := newTestTracker(t, defaultConfig().Defaults, staticClusters{c})
+	store := &capturedStore{}
+	s.archive = &resultArchiver{store: store, prefix: "pixie/"}
+	if err := s.Check(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	var keys []string
+	for k := range store.objects {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	if len(keys) != 2 || !strings.HasSuffix(keys[0], "-prod-id-debug.csv.gz") || !strings.HasSuffix(keys[1], "-prod-id.csv.gz") {
+		t.Fatalf("archived %q, want the rule's table and the debug table", keys)
+	}
+	for _, k := range keys {
+		if dir := filepath.Dir(k); !strings.HasPrefix(dir, "pixie/http-errors/") || !strings.HasSuffix(dir, "/prod") {
+			t.Errorf("archived %s, want it under pixie/http-errors/<date>/prod", k)
+		}
+	}
+	want := map[string]string{
+		keys[0]: "msg\na\nb",
+		// Every row, not just those over the threshold.
+		keys[1]: "service,endpoint,error_count,total_requests\npx-sock-shop/orders,/orders,40,100\npx-sock-shop/carts,/carts,0,100",
+	}
+	for k, w := range want {
+		var lines []string
+		for _, row := range readCSV(t, store.objects[k]) {
+			lines = append(lines, strings.Join(row, ","))
+		}
+		if got := strings.Join(lines, "\n"); got != w {
+			t.Errorf("%s:\n%s\nwant:\n%s", k, got, w)
+		}
+	}
+}
+
+func TestS3Put(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := ioutil.WriteFile(tokenFile, []byte("web-identity-token"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	setenv(t, "AWS_ACCESS_KEY_ID", "")
+	setenv(t, "AWS_ROLE_ARN", "arn:aws:iam::123456789012:role/slackbot")
+	setenv(t, "AWS_WEB_IDENTITY_TOKEN_FILE", tokenFile)
+
+	var mu sync.Mutex
+	var assumed int
+	var expiresIn time.Duration
+	var puts []string
+	serveCloudSecrets(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.Host {
+		case "sts.amazonaws.com":
+			assumed++
+			fmt.Fprintf(w, `<AssumeRoleWithWebIdentityResponse><AssumeRoleWithWebIdentityResult><Credentials>
+<AccessKeyId>ASIA%d</AccessKeyId><SecretAccessKey>secret</SecretAccessKey><SessionToken>session-%d</SessionToken>
+<Expiration>%s</Expiration></Credentials></AssumeRoleWithWebIdentityResult></AssumeRoleWithWebIdentityResponse>`,
+				assumed, assumed, time.Now().Add(expiresIn).UTC().Format(time.RFC3339))
+		case "my-bucket.s3.eu-west-1.amazonaws.com":
+			body, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				t.Error(err)
+			}
+			if r.Method != http.MethodPut || r.Header.Get("Content-Type") != "application/gzip" {
+				t.Errorf("%s with Content-Type %q, want a PUT of application/gzip", r.Method, r.Header.Get("Content-Type"))
+			}
+			if got := r.Header.Get("X-Amz-Content-Sha256"); got != sha256Hex(body) {
+				t.Errorf("X-Amz-Content-Sha256 = %q, want the body's hash", got)
+			}
+			auth := r.Header.Get("Authorization")
+			if !strings.Contains(auth, "/eu-west-1/s3/aws4_request, SignedHeaders=content-type;host;x-amz-content-sha256;x-amz-date;x-amz-security-token,") {
+				t.Errorf("Authorization = %q", auth)
+			}
+			puts = append(puts, r.URL.Path+" "+string(body)+" "+r.Header.Get("X-Amz-Security-Token"))
+		default:
+			t.Errorf("unexpected request to %s", r.Host)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+	put := func(s *s3Store, key string) {
+		t.Helper()
+		if err := s.Put(context.Background(), key, []byte("gzipped"), "application/gzip"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Credentials are reused until shortly before they expire.
+	expiresIn = time.Hour
+	s := &s3Store{bucket: "my-bucket", region: "eu-west-1", http: cloudSecretsHTTP}
+	put(s, "pixie/a.csv.gz")
+	put(s, "pixie/b.csv.gz")
+	if assumed != 1 {
+		t.Errorf("assumed the role %d times for credentials valid for an hour, want once", assumed)
+	}
+	expiresIn = time.Minute
+	s = &s3Store{bucket: "my-bucket", region: "eu-west-1", http: cloudSecretsHTTP}
+	put(s, "pixie/c.csv.gz")
+	put(s, "pixie/d.csv.gz")
+	if assumed != 3 {
+		t.Errorf("assumed the role %d times in all, want credentials about to expire replaced", assumed)
+	}
+	want := []string{
+		"/pixie/a.csv.gz gzipped session-1",
+		"/pixie/b.csv.gz gzipped session-1",
+		"/pixie/c.csv.gz gzipped session-2",
+		"/pixie/d.csv.gz gzipped session-3",
+	}
+	if strings.Join(puts, "\n") != strings.Join(want, "\n") {
+		t.Errorf("puts:\n%s\nwant:\n%s", strings.Join(puts, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestS3PutStaticCredentials(t *testing.T) {
+	setenv(t, "AWS_ACCESS_KEY_ID", awsExampleAccessKeyID)
+	setenv(t, "AWS_SECRET_ACCESS_KEY", awsExampleSecretAccessKey)
+	setenv(t, "AWS_SESSION_TOKEN", "")
+	serveCloudSecrets(t, func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/") {
+			t.Errorf("Authorization = %q, want the environment's access key", r.Header.Get("Authorization"))
+		}
+		w.WriteHeader(http.StatusForbidden)
+	})
+	s := &s3Store{bucket: "my-bucket", region: "eu-west-1", http: cloudSecretsHTTP}
+	err := s.Put(context.Background(), "pixie/a.csv.gz", []byte("gzipped"), "application/gzip")
+	if err == nil || err.Error() != "PUT my-bucket.s3.eu-west-1.amazonaws.com returned 403 Forbidden" {
+		t.Errorf("got error %v, want S3's status", err)
+	}
+}
+
+func TestGCSPut(t *testing.T) {
+	var got []string
+	serveCloudSecrets(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.Host {
+		case "metadata.google.internal":
+			w.Write([]byte(`{"access_token": "ya29.token", "expires_in": 3599, "token_type": "Bearer"}`))
+		case "storage.googleapis.com":
+			if got := r.Header.Get("Authorization"); got != "Bearer ya29.token" {
+				t.Errorf("Authorization = %q, want the metadata server's token", got)
+			}
+			body, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				t.Error(err)
+			}
+			got = append(got, fmt.Sprintf("%s %s name=%s uploadType=%s %s %s", r.Method, r.URL.Path,
+				r.URL.Query().Get("name"), r.URL.Query().Get("uploadType"), r.Header.Get("Content-Type"), body))
+			if r.URL.Query().Get("name") == "pixie/denied.csv.gz" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			w.Write([]byte(`{"name": "pixie/a.csv.gz"}`))
+		default:
+			t.Errorf("unexpected request to %s", r.Host)
+		}
+	})
+	s := &gcsStore{bucket: "my-bucket", http: cloudSecretsHTTP}
+	if err := s.Put(context.Background(), "pixie/http-errors/2021/02/08/prod/153000-id.csv.gz", []byte("gzipped"), "application/gzip"); err != nil {
+		t.Fatal(err)
+	}
+	err := s.Put(context.Background(), "pixie/denied.csv.gz", []byte("gzipped"), "application/gzip")
+	if err == nil || err.Error() != "POST storage.googleapis.com returned 403 Forbidden" {
+		t.Errorf("got error %v, want GCS's status", err)
+	}
+	want := []string{
+		"POST /upload/storage/v1/b/my-bucket/o name=pixie/http-errors/2021/02/08/prod/153000-id.csv.gz uploadType=media application/gzip gzipped",
+		"POST /upload/storage/v1/b/my-bucket/o name=pixie/denied.csv.gz uploadType=media application/gzip gzipped",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("uploads:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
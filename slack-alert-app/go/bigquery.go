@@ -0,0 +1,183 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// bigQueryExporter streams every change to an incident and the stats of
+// every service from each check to BigQuery tables, so that reliability
+// reports and SLOs can be computed in SQL over months of data. The tables
+// must already exist, with the columns of bigQueryIncidentRow and
+// bigQueryStatsRow. It authenticates as the service account of the GKE node
+// or, with Workload Identity, the pod.
+type bigQueryExporter struct {
+	// Base URL of the dataset's tables.
+	tablesURL      string
+	incidentsTable string
+	statsTable     string
+}
+
+func newBigQueryExporter(cfg BigQueryConfig) *bigQueryExporter {
+	return &bigQueryExporter{
+		tablesURL: fmt.Sprintf("https://bigquery.googleapis.com/bigquery/v2/projects/%s/datasets/%s/tables/",
+			url.PathEscape(cfg.Project), url.PathEscape(cfg.Dataset)),
+		incidentsTable: cfg.IncidentsTable,
+		statsTable:     cfg.StatsTable,
+	}
+}
+
+// bigQueryIncidentRow is a change to an incident.
+type bigQueryIncidentRow struct {
+	Time          time.Time  `json:"time"`
+	Event         string     `json:"event"`
+	IncidentID    string     `json:"incident_id"`
+	Rule          string     `json:"rule"`
+	Cluster       string     `json:"cluster"`
+	ClusterID     string     `json:"cluster_id"`
+	Service       string     `json:"service"`
+	OpenedAt      time.Time  `json:"opened_at"`
+	ResolvedAt    *time.Time `json:"resolved_at"`
+	ErrorCount    int64      `json:"error_count"`
+	TotalRequests int64      `json:"total_requests"`
+	ErrorRate     float64    `json:"error_rate"`
+	PeakErrorRate float64    `json:"peak_error_rate"`
+	Acked         bool       `json:"acked"`
+}
+
+// bigQueryStatsRow is the stats of a service from one check.
+type bigQueryStatsRow struct {
+	Time                   time.Time `json:"time"`
+	Rule                   string    `json:"rule"`
+	Cluster                string    `json:"cluster"`
+	ClusterID              string    `json:"cluster_id"`
+	Service                string    `json:"service"`
+	ErrorCount             int64     `json:"error_count"`
+	TotalRequests          int64     `json:"total_requests"`
+	ErrorRate              float64   `json:"error_rate"`
+	MaxError               float64   `json:"max_error"`
+	PercentExceedThreshold float64   `json:"percent_exceed_threshold"`
+}
+
+type bigQueryRow struct {
+	// Lets BigQuery drop rows that are inserted twice, such as on retries.
+	InsertID string      `json:"insertId"`
+	JSON     interface{} `json:"json"`
+}
+
+func (b *bigQueryExporter) WriteEvent(ctx context.Context, e IncidentEvent) error {
+	inc := e.Incident
+	row := bigQueryIncidentRow{
+		Time:          inc.UpdatedAt,
+		Event:         e.Kind.String(),
+		IncidentID:    inc.ID,
+		Rule:          inc.Rule,
+		Cluster:       inc.Cluster.Name,
+		ClusterID:     inc.Cluster.ID,
+		Service:       inc.Service,
+		OpenedAt:      inc.OpenedAt,
+		ErrorCount:    inc.Latest.ErrorCount,
+		TotalRequests: inc.Latest.TotalRequests,
+		ErrorRate:     inc.Latest.ErrorRate(),
+		PeakErrorRate: inc.PeakErrorRate(),
+		Acked:         inc.Acked,
+	}
+	if !inc.ResolvedAt.IsZero() {
+		row.Time = inc.ResolvedAt
+		row.ResolvedAt = &inc.ResolvedAt
+	}
+	return b.insert(ctx, b.incidentsTable, []bigQueryRow{{
+		InsertID: fmt.Sprintf("%s-%s-%d", inc.ID, row.Event, row.Time.UnixNano()),
+		JSON:     row,
+	}})
+}
+
+func (b *bigQueryExporter) WriteStats(ctx context.Context, s *statsBatch) error {
+	if len(s.Services) == 0 {
+		return nil
+	}
+	rows := make([]bigQueryRow, len(s.Services))
+	for i, svc := range s.Services {
+		rows[i] = bigQueryRow{
+			InsertID: fmt.Sprintf("%s-%s-%s-%d", s.Rule, s.Cluster.ID, svc.Service, s.Time.UnixNano()),
+			JSON: bigQueryStatsRow{
+				Time:                   s.Time,
+				Rule:                   s.Rule,
+				Cluster:                s.Cluster.Name,
+				ClusterID:              s.Cluster.ID,
+				Service:                svc.Service,
+				ErrorCount:             svc.ErrorCount,
+				TotalRequests:          svc.TotalRequests,
+				ErrorRate:              svc.ErrorRate,
+				MaxError:               svc.MaxError,
+				PercentExceedThreshold: svc.PercentExceedThreshold,
+			},
+		}
+	}
+	return b.insert(ctx, b.statsTable, rows)
+}
+
+// insert streams rows into a table with the tabledata.insertAll API.
+func (b *bigQueryExporter) insert(ctx context.Context, table string, rows []bigQueryRow) error {
+	body, err := json.Marshal(struct {
+		Rows []bigQueryRow `json:"rows"`
+	}{rows})
+	if err != nil {
+		return err
+	}
+	token, err := gcpAccessToken(ctx)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, b.tablesURL+url.PathEscape(table)+"/insertAll", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	var resp struct {
+		InsertErrors []struct {
+			Index  int `json:"index"`
+			Errors []struct {
+				Reason  string `json:"reason"`
+				Message string `json:"message"`
+			} `json:"errors"`
+		} `json:"insertErrors"`
+	}
+	if err := doJSON(req, &resp); err != nil {
+		return fmt.Errorf("inserting into BigQuery table %s: %w", table, err)
+	}
+	// Rows can be rejected even though the request succeeded.
+	if len(resp.InsertErrors) > 0 {
+		var msgs []string
+		for _, e := range resp.InsertErrors {
+			for _, err := range e.Errors {
+				msgs = append(msgs, fmt.Sprintf("row %d: %s: %s", e.Index, err.Reason, err.Message))
+			}
+		}
+		return fmt.Errorf("inserting into BigQuery table %s: %d of %d rows rejected: %s", table, len(resp.InsertErrors), len(rows), strings.Join(msgs, "; "))
+	}
+	return nil
+}
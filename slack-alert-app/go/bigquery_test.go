@@ -0,0 +1,197 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// bigQueryInsert is an insertAll request to the fake BigQuery API.
+type bigQueryInsert struct {
+	path string
+	rows []struct {
+		InsertID string                 `json:"insertId"`
+		JSON     map[string]interface{} `json:"json"`
+	}
+}
+
+// serveBigQuery serves the metadata server and an insertAll API that
+// rejects the second row of every request to the rejecting table.
+func serveBigQuery(t *testing.T) func() []bigQueryInsert {
+	var mu sync.Mutex
+	var inserts []bigQueryInsert
+	serveCloudSecrets(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.Host {
+		case "metadata.google.internal":
+			json.NewEncoder(w).Encode(map[string]interface{}{"access_token": "ya29.token", "expires_in": 3599, "token_type": "Bearer"})
+		case "bigquery.googleapis.com":
+			if got := r.Header.Get("Authorization"); got != "Bearer ya29.token" {
+				t.Errorf("Authorization = %q, want the metadata server's token", got)
+			}
+			if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" {
+				t.Errorf("sent %s with Content-Type %q", r.Method, r.Header.Get("Content-Type"))
+			}
+			insert := bigQueryInsert{path: r.URL.EscapedPath()}
+			var body struct {
+				Rows interface{} `json:"rows"`
+			}
+			body.Rows = &insert.rows
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			mu.Lock()
+			inserts = append(inserts, insert)
+			mu.Unlock()
+			switch {
+			case strings.Contains(r.URL.Path, "/tables/missing/"):
+				w.WriteHeader(http.StatusNotFound)
+				w.Write([]byte(`{"error": {"code": 404, "message": "Not found: Table demo:pixie.missing"}}`))
+			case strings.Contains(r.URL.Path, "/tables/rejecting/"):
+				w.Write([]byte(`{"kind": "bigquery#tableDataInsertAllResponse", "insertErrors": [{"index": 1, "errors": [{"reason": "invalid", "message": "no such field: max_error"}]}]}`))
+			default:
+				w.Write([]byte(`{"kind": "bigquery#tableDataInsertAllResponse"}`))
+			}
+		default:
+			t.Errorf("unexpected request to %s", r.Host)
+		}
+	})
+	return func() []bigQueryInsert {
+		mu.Lock()
+		defer mu.Unlock()
+		return inserts
+	}
+}
+
+func TestBigQueryWriteEvent(t *testing.T) {
+	inserts := serveBigQuery(t)
+	b := newBigQueryExporter(BigQueryConfig{Project: "demo", Dataset: "pixie", IncidentsTable: "incidents", StatsTable: "stats"})
+	opened := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+	inc := Incident{
+		ID:        "INC-7f3a9c21",
+		Rule:      "http-errors",
+		Cluster:   Cluster{ID: "c1", Name: "prod"},
+		Service:   "px-sock-shop/orders",
+		OpenedAt:  opened,
+		UpdatedAt: opened,
+		Latest:    IncidentData{Service: "px-sock-shop/orders", ErrorCount: 30, TotalRequests: 100},
+	}
+	if err := b.WriteEvent(context.Background(), IncidentEvent{Kind: IncidentOpened, Incident: inc}); err != nil {
+		t.Fatal(err)
+	}
+	inc.ResolvedAt = opened.Add(10 * time.Minute)
+	inc.Acked = true
+	if err := b.WriteEvent(context.Background(), IncidentEvent{Kind: IncidentResolved, Incident: inc}); err != nil {
+		t.Fatal(err)
+	}
+
+	got := inserts()
+	if len(got) != 2 {
+		t.Fatalf("got %d inserts, want one per event", len(got))
+	}
+	for _, insert := range got {
+		if insert.path != "/bigquery/v2/projects/demo/datasets/pixie/tables/incidents/insertAll" {
+			t.Errorf("inserted into %s", insert.path)
+		}
+		if len(insert.rows) != 1 {
+			t.Fatalf("inserted %d rows, want 1", len(insert.rows))
+		}
+	}
+	open, resolved := got[0].rows[0], got[1].rows[0]
+	if open.InsertID != "INC-7f3a9c21-opened-"+strconv.FormatInt(opened.UnixNano(), 10) {
+		t.Errorf("insertId %q", open.InsertID)
+	}
+	want := map[string]interface{}{
+		"time":            "2021-03-01T12:00:00Z",
+		"event":           "opened",
+		"incident_id":     "INC-7f3a9c21",
+		"rule":            "http-errors",
+		"cluster":         "prod",
+		"cluster_id":      "c1",
+		"service":         "px-sock-shop/orders",
+		"opened_at":       "2021-03-01T12:00:00Z",
+		"resolved_at":     nil,
+		"error_count":     float64(30),
+		"total_requests":  float64(100),
+		"error_rate":      0.3,
+		"peak_error_rate": inc.PeakErrorRate(),
+		"acked":           false,
+	}
+	if !reflect.DeepEqual(open.JSON, want) {
+		t.Errorf("opened row %v, want %v", open.JSON, want)
+	}
+	if resolved.JSON["event"] != "resolved" || resolved.JSON["time"] != "2021-03-01T12:10:00Z" || resolved.JSON["resolved_at"] != "2021-03-01T12:10:00Z" || resolved.JSON["acked"] != true {
+		t.Errorf("resolved row %v", resolved.JSON)
+	}
+}
+
+func TestBigQueryWriteStats(t *testing.T) {
+	inserts := serveBigQuery(t)
+	b := newBigQueryExporter(BigQueryConfig{Project: "demo", Dataset: "pixie", IncidentsTable: "incidents", StatsTable: "stats"})
+	s := testStatsBatch()
+	if err := b.WriteStats(context.Background(), s); err != nil {
+		t.Fatal(err)
+	}
+	// Checks that found no services insert nothing.
+	if err := b.WriteStats(context.Background(), &statsBatch{Rule: "http-errors", Time: s.Time}); err != nil {
+		t.Fatal(err)
+	}
+	got := inserts()
+	if len(got) != 1 || got[0].path != "/bigquery/v2/projects/demo/datasets/pixie/tables/stats/insertAll" || len(got[0].rows) != 2 {
+		t.Fatalf("got inserts %+v, want the two services inserted into stats once", got)
+	}
+	row := got[0].rows[0]
+	if row.InsertID != "http-errors-c1-px-sock-shop/orders-"+strconv.FormatInt(s.Time.UnixNano(), 10) {
+		t.Errorf("insertId %q", row.InsertID)
+	}
+	want := map[string]interface{}{
+		"time":                     "2021-03-01T12:00:00Z",
+		"rule":                     "http-errors",
+		"cluster":                  "prod",
+		"cluster_id":               "c1",
+		"service":                  "px-sock-shop/orders",
+		"error_count":              float64(30),
+		"total_requests":           float64(100),
+		"error_rate":               0.3,
+		"max_error":                0.5,
+		"percent_exceed_threshold": float64(50),
+	}
+	if !reflect.DeepEqual(row.JSON, want) {
+		t.Errorf("stats row %v, want %v", row.JSON, want)
+	}
+}
+
+func TestBigQueryInsertErrors(t *testing.T) {
+	serveBigQuery(t)
+	for _, tt := range []struct{ table, want string }{
+		{"rejecting", "inserting into BigQuery table rejecting: 1 of 2 rows rejected: row 1: invalid: no such field: max_error"},
+		{"missing", "inserting into BigQuery table missing: 404 Not Found"},
+	} {
+		b := newBigQueryExporter(BigQueryConfig{Project: "demo", Dataset: "pixie", StatsTable: tt.table})
+		if err := b.WriteStats(context.Background(), testStatsBatch()); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("table %s: got %v, want an error containing %q", tt.table, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Window the alert budget applies to.
+	alertBudgetWindow = time.Hour
+	// Most held back messages listed in an overflow summary.
+	overflowSummaryLines = 20
+)
+
+// alertBudget caps the number of messages sent across all rules per hour.
+// Messages over the budget are held back and summarized in a single
+// message every so often instead, so that a cluster meltdown doesn't flood Slack.
+type alertBudget struct {
+	limit int
+	// How often held back messages are summarized.
+	summaryEvery time.Duration
+	// Where summaries are sent. Summaries don't count against the budget.
+	summary Alerter
+
+	mu sync.Mutex
+	// When each message in the current window was sent.
+	sent []time.Time
+	// Messages held back since the last summary, and how many of them were alerts.
+	overflow []string
+	alerts   int
+}
+
+func newAlertBudget(limit int, summaryEvery time.Duration, summary Alerter) *alertBudget {
+	return &alertBudget{limit: limit, summaryEvery: summaryEvery, summary: summary}
+}
+
+// wrap returns an alerter that sends through a within the budget. It
+// returns a itself if b is nil, so that the budget is optional.
+func (b *alertBudget) wrap(a Alerter) Alerter {
+	if b == nil {
+		return a
+	}
+	return &budgetedAlerter{alerter: a, budget: b}
+}
+
+// take uses up one message of the budget, returning false if none is left.
+// If there is none, msg is held back for the next summary.
+func (b *alertBudget) take(msg string, alert bool, now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	i := 0
+	for i < len(b.sent) && now.Sub(b.sent[i]) >= alertBudgetWindow {
+		i++
+	}
+	b.sent = b.sent[i:]
+	if len(b.sent) < b.limit {
+		b.sent = append(b.sent, now)
+		return true
+	}
+	b.overflow = append(b.overflow, msg)
+	if alert {
+		b.alerts++
+	}
+	metricAlertsSuppressed.Inc()
+	return false
+}
+
+// Run sends a summary of the held back messages every summaryEvery until
+// ctx is cancelled, and a last one then.
+func (b *alertBudget) Run(ctx context.Context) {
+	if b == nil {
+		return
+	}
+	ticker := time.NewTicker(b.summaryEvery)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			sendCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			b.flush(sendCtx)
+			cancel()
+			return
+		case <-ticker.C:
+			b.flush(ctx)
+		}
+	}
+}
+
+// flush sends a summary of the messages held back since the last one, if any.
+func (b *alertBudget) flush(ctx context.Context) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	overflow, alerts := b.overflow, b.alerts
+	b.overflow, b.alerts = nil, 0
+	b.mu.Unlock()
+	if len(overflow) == 0 {
+		return
+	}
+
+	var s strings.Builder
+	fmt.Fprintf(&s, ":no_entry: Over the budget of %d messages per hour, held back %d messages (%d alerts):", b.limit, len(overflow), alerts)
+	for i, msg := range overflow {
+		if i == overflowSummaryLines {
+			fmt.Fprintf(&s, "\n…and %d more.", len(overflow)-i)
+			break
+		}
+		// The first line of a message is enough to tell what it was about.
+		if j := strings.IndexByte(msg, '\n'); j >= 0 {
+			msg = msg[:j]
+		}
+		fmt.Fprintf(&s, "\n• %s", msg)
+	}
+	var err error
+	if alerts > 0 {
+		err = b.summary.SendAlert(ctx, s.String())
+	} else {
+		err = b.summary.SendInfo(ctx, s.String())
+	}
+	if err != nil {
+		logError("Error sending overflow summary.", "messages", len(overflow), "error", err)
+	}
+}
+
+// budgetedAlerter sends messages through an alerter while the budget lasts.
+type budgetedAlerter struct {
+	alerter Alerter
+	budget  *alertBudget
+}
+
+func (a *budgetedAlerter) SendAlert(ctx context.Context, msg string) error {
+	if !a.budget.take(msg, true, time.Now()) {
+		return nil
+	}
+	return a.alerter.SendAlert(ctx, msg)
+}
+
+func (a *budgetedAlerter) SendInfo(ctx context.Context, msg string) error {
+	if !a.budget.take(msg, false, time.Now()) {
+		return nil
+	}
+	return a.alerter.SendInfo(ctx, msg)
+}
@@ -0,0 +1,177 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"embed"
+	"fmt"
+	"sort"
+)
+
+// builtinScriptFS holds the PxL scripts shipped with the bot.
+//
+//go:embed scripts/*.pxl
+var builtinScriptFS embed.FS
+
+// builtinScript is a PxL script shipped with the bot that a rule can select
+// by name, so that common checks don't require writing PxL.
+type builtinScript struct {
+	// File in the scripts directory.
+	file string
+	// Name of the table output by the script.
+	table string
+	// Whether the script is a streaming script.
+	streaming bool
+	// What the script's error_count column counts, used in messages.
+	problem string
+	// What the script's total_requests column counts, if not requests.
+	unit string
+	// Columns shown in messages.
+	details []string
+	// Default values of the script's `{{ .Params }}`.
+	params map[string]string
+}
+
+var builtinScripts = map[string]builtinScript{
+	"http-errors": {
+		file:    "http_errors.pxl",
+		table:   "http_table",
+		problem: "4xx+ errors",
+	},
+	"http-errors-stream": {
+		file:      "http_errors_stream.pxl",
+		table:     "http_table",
+		streaming: true,
+		problem:   "4xx+ errors",
+	},
+	"http-latency": {
+		file:    "http_latency.pxl",
+		table:   "http_latency_table",
+		problem: "slow requests",
+		params:  map[string]string{"latency_ms": "500"},
+	},
+	"dns-errors": {
+		file:    "dns_errors.pxl",
+		table:   "dns_table",
+		problem: "DNS errors",
+		details: []string{"nxdomain", "servfail"},
+		params:  map[string]string{"nxdomain_only": "false"},
+	},
+	"http-latency-percentiles": {
+		file:    "http_latency_percentiles.pxl",
+		table:   "http_latency_percentiles_table",
+		problem: "requests to services over their latency thresholds",
+		details: []string{"p95_ms", "p99_ms", "previous_p95_ms", "previous_p99_ms"},
+		params:  map[string]string{"p95_ms": "500", "p99_ms": "1000", "regression": "1.5"},
+	},
+	"tls-errors": {
+		file:    "tls_errors.pxl",
+		table:   "tls_table",
+		problem: "failed TLS handshakes",
+		unit:    "handshakes",
+	},
+	"mysql-errors": {
+		file:    "mysql_errors.pxl",
+		table:   "mysql_table",
+		problem: "MySQL errors",
+		unit:    "queries",
+	},
+	"mysql-latency": {
+		file:    "mysql_latency.pxl",
+		table:   "mysql_latency_table",
+		problem: "slow MySQL queries",
+		unit:    "queries",
+		details: []string{"max_latency_ms"},
+		params:  map[string]string{"latency_ms": "200"},
+	},
+	"pgsql-errors": {
+		file:    "pgsql_errors.pxl",
+		table:   "pgsql_table",
+		problem: "PostgreSQL errors",
+		unit:    "queries",
+	},
+	"pgsql-latency": {
+		file:    "pgsql_latency.pxl",
+		table:   "pgsql_latency_table",
+		problem: "slow PostgreSQL queries",
+		unit:    "queries",
+		details: []string{"max_latency_ms"},
+		params:  map[string]string{"latency_ms": "200"},
+	},
+	"kafka": {
+		file:    "kafka.pxl",
+		table:   "kafka_table",
+		problem: "failed or slow Kafka requests",
+		details: []string{"failed", "slow", "max_latency_ms"},
+		params:  map[string]string{"latency_ms": "500"},
+	},
+	"redis": {
+		file:    "redis.pxl",
+		table:   "redis_table",
+		problem: "failed or slow Redis commands",
+		unit:    "commands",
+		details: []string{"failed", "slow", "max_latency_ms"},
+		params:  map[string]string{"latency_ms": "50"},
+	},
+	"pod-resources": {
+		file:    "pod_resources.pxl",
+		table:   "pod_resources_table",
+		problem: "pods over their CPU or memory threshold",
+		unit:    "pods",
+		details: []string{"cpu_cores", "memory_mb"},
+		params:  map[string]string{"cpu_cores": "1", "memory_mb": "1024"},
+	},
+	"pod-restarts": {
+		file:    "pod_restarts.pxl",
+		table:   "pod_restarts_table",
+		problem: "restarted or OOM killed containers",
+		unit:    "containers",
+		details: []string{"restarts", "oom_kills"},
+		params:  map[string]string{"min_restarts": "1"},
+	},
+}
+
+// lookupBuiltin returns the built-in script with the given name.
+func lookupBuiltin(name string) (builtinScript, error) {
+	b, ok := builtinScripts[name]
+	if !ok {
+		return builtinScript{}, fmt.Errorf("unknown built-in script %q, expected one of %v", name, builtinNames())
+	}
+	return b, nil
+}
+
+func builtinNames() []string {
+	var names []string
+	for name := range builtinScripts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// loadBuiltinScript loads the built-in script template with the given name.
+func loadBuiltinScript(name string) (*pxlTemplate, error) {
+	b, err := lookupBuiltin(name)
+	if err != nil {
+		return nil, err
+	}
+	src, err := builtinScriptFS.ReadFile("scripts/" + b.file)
+	if err != nil {
+		return nil, err
+	}
+	return parsePxLTemplate(b.file, string(src))
+}
@@ -0,0 +1,51 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBuiltinScriptsRender(t *testing.T) {
+	for _, name := range builtinNames() {
+		for _, exclude := range [][]string{nil, {"kube-system"}} {
+			r := Rule{Name: name, Builtin: name, Threshold: 0.1, ExcludeNamespaces: exclude}
+			if err := r.applyDefaults(Rule{}); err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			tmpl, err := loadRuleScript(r)
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			pxl, err := tmpl.Render(newScriptVars(r, 5*time.Minute))
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			if want := `, "` + r.Table + `")`; !strings.Contains(pxl, "px.display(") || !strings.Contains(pxl, want) {
+				t.Errorf("%s: script doesn't display its table, want %s in:\n%s", name, want, pxl)
+			}
+			if strings.Contains(pxl, "{{") || strings.Contains(pxl, "<no value>") {
+				t.Errorf("%s: script has unfilled variables:\n%s", name, pxl)
+			}
+			if (exclude != nil) != strings.Contains(pxl, "kube-system") {
+				t.Errorf("%s: excluded namespaces %v not applied:\n%s", name, exclude, pxl)
+			}
+		}
+	}
+}
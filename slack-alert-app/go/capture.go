@@ -0,0 +1,112 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// capturedMessageKind says whether a captured message was sent as an alert
+// or as an info message.
+type capturedMessageKind string
+
+const (
+	capturedAlert capturedMessageKind = "alert"
+	capturedInfo  capturedMessageKind = "info"
+)
+
+// CapturedMessage is a message sent to a CaptureAlerter.
+type CapturedMessage struct {
+	Kind capturedMessageKind
+	Msg  string
+	// Severity of the incident the message is about, taken from the message,
+	// or empty if it doesn't have one, such as resolved messages.
+	Severity string
+	Time     time.Time
+}
+
+// Incident messages include the severity as "(critical)" or "(warning)".
+var messageSeverity = regexp.MustCompile(`\((` + SeverityWarning.String() + `|` + SeverityCritical.String() + `)\)`)
+
+// CaptureAlerter is an Alerter that records every message instead of
+// sending it, so that simulations can print them and tests can check which
+// alerts rules and thresholds lead to.
+type CaptureAlerter struct {
+	mu       sync.Mutex
+	messages []CapturedMessage
+}
+
+func (c *CaptureAlerter) SendAlert(ctx context.Context, msg string) error {
+	c.capture(capturedAlert, msg)
+	return nil
+}
+
+func (c *CaptureAlerter) SendInfo(ctx context.Context, msg string) error {
+	c.capture(capturedInfo, msg)
+	return nil
+}
+
+func (c *CaptureAlerter) capture(kind capturedMessageKind, msg string) {
+	m := CapturedMessage{Kind: kind, Msg: msg, Time: time.Now()}
+	if sev := messageSeverity.FindStringSubmatch(msg); sev != nil {
+		m.Severity = sev[1]
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.messages = append(c.messages, m)
+}
+
+// Messages returns every message captured so far, in the order they were sent.
+func (c *CaptureAlerter) Messages() []CapturedMessage {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]CapturedMessage(nil), c.messages...)
+}
+
+// Alerts returns the messages sent as alerts.
+func (c *CaptureAlerter) Alerts() []CapturedMessage {
+	var alerts []CapturedMessage
+	for _, m := range c.Messages() {
+		if m.Kind == capturedAlert {
+			alerts = append(alerts, m)
+		}
+	}
+	return alerts
+}
+
+// AlertsFor returns the alerts whose message mentions s, such as a service
+// name, "orders", or an incident ID.
+func (c *CaptureAlerter) AlertsFor(s string) []CapturedMessage {
+	var alerts []CapturedMessage
+	for _, m := range c.Alerts() {
+		if strings.Contains(m.Msg, s) {
+			alerts = append(alerts, m)
+		}
+	}
+	return alerts
+}
+
+// Reset forgets every message captured so far.
+func (c *CaptureAlerter) Reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.messages = nil
+}
@@ -0,0 +1,74 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// AssertAlertedFor fails the test unless an alert mentioning s was sent.
+func (c *CaptureAlerter) AssertAlertedFor(t testing.TB, s string) {
+	t.Helper()
+	if len(c.AlertsFor(s)) == 0 {
+		t.Errorf("no alert for %q, got %s", s, c.describe())
+	}
+}
+
+// AssertNotAlertedFor fails the test if an alert mentioning s was sent.
+func (c *CaptureAlerter) AssertNotAlertedFor(t testing.TB, s string) {
+	t.Helper()
+	if alerts := c.AlertsFor(s); len(alerts) > 0 {
+		t.Errorf("unexpected alert for %q: %s", s, alerts[0].Msg)
+	}
+}
+
+// AssertSeverity fails the test unless every alert mentioning s has the
+// given severity, and there is at least one.
+func (c *CaptureAlerter) AssertSeverity(t testing.TB, s string, sev Severity) {
+	t.Helper()
+	alerts := c.AlertsFor(s)
+	if len(alerts) == 0 {
+		t.Errorf("no alert for %q, got %s", s, c.describe())
+	}
+	for _, m := range alerts {
+		if m.Severity != sev.String() {
+			t.Errorf("alert for %q is %s, not %s: %s", s, m.Severity, sev, m.Msg)
+		}
+	}
+}
+
+// AssertNoAlerts fails the test if any alert was sent. Info messages are allowed.
+func (c *CaptureAlerter) AssertNoAlerts(t testing.TB) {
+	t.Helper()
+	if alerts := c.Alerts(); len(alerts) > 0 {
+		t.Errorf("expected no alerts, got %s", c.describe())
+	}
+}
+
+// describe lists the alerts captured so far, for failure messages.
+func (c *CaptureAlerter) describe() string {
+	alerts := c.Alerts()
+	if len(alerts) == 0 {
+		return "none"
+	}
+	msgs := make([]string, len(alerts))
+	for i, m := range alerts {
+		msgs[i] = m.Msg
+	}
+	return "\n\t" + strings.Join(msgs, "\n\t")
+}
@@ -0,0 +1,518 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/slack-go/slack"
+)
+
+// version is set at build time with -ldflags "-X main.version=...".
+var version = "dev"
+
+// command is a subcommand of the slackbot CLI.
+type command struct {
+	usage string
+	run   func(args []string) error
+}
+
+var commands = map[string]command{
+	"run":             {"Run the bot until it is stopped. This is the default.", runCommand},
+	"check-once":      {"Run every rule once, send any alerts and exit.", checkOnceCommand},
+	"validate":        {"Check the config and print a report of every rule, without sending anything.", validateCommand},
+	"dump":            {"Run a PxL script once and print every table it outputs.", dumpCommand},
+	"send-test-alert": {"Send a test message to Slack.", sendTestAlertCommand},
+	"simulate":        {"Run synthetic stats through a rule and print or post the messages it would send.", simulateCommand},
+	"version":         {"Print the version.", versionCommand},
+}
+
+// runCLI runs the subcommand named by the first argument, or "run" if the
+// first argument is a flag or there are no arguments.
+func runCLI(args []string) error {
+	name := "run"
+	if len(args) > 0 && args[0] != "" && args[0][0] != '-' {
+		name, args = args[0], args[1:]
+	}
+	if name == "help" {
+		printUsage()
+		return nil
+	}
+	cmd, ok := commands[name]
+	if !ok {
+		printUsage()
+		return fmt.Errorf("unknown command %q", name)
+	}
+	return cmd.run(args)
+}
+
+func printUsage() {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprintf(os.Stderr, "Usage: slackbot [command] [flags]\n\nCommands:\n")
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-16s %s\n", name, commands[name].usage)
+	}
+	fmt.Fprintf(os.Stderr, "\nRun 'slackbot [command] -h' for the command's flags.\n")
+}
+
+// configFlags adds the flags that select the config to fs, and returns a
+// function that loads the config once the flags are parsed. The command's
+// overrides are applied after the flags', before the config is validated.
+func configFlags(fs *flag.FlagSet, overrides ...func(*Config)) (load func() (*Config, error), configPath *string) {
+	configPath = fs.String("config", os.Getenv("CONFIG_FILE"), "Path to a YAML config file, such as one mounted from a ConfigMap. Defaults to CONFIG_FILE. Environment variables override its settings.")
+	scriptPath := fs.String("script", "", "Path to the PxL script for the default rule. Defaults to the embedded http_errors.pxl.")
+	profile := fs.String("profile", os.Getenv("PROFILE"), "Profile in the config file to use, such as dev or prod. Defaults to PROFILE.")
+	dryRun := fs.Bool("dry-run", false, "Run the scripts and track incidents, but log the messages that would be sent instead of sending them.")
+	record := fs.String("record", "", "Directory to save the raw output of every check to, to replay it later. Defaults to RECORD_DIR.")
+	replay := fs.String("replay", "", "Directory of output saved with -record to run the checks against instead of Pixie. Defaults to REPLAY_DIR.")
+	localData := fs.String("local-data", "", "Directory of CSV and JSON files, one per table, to run the checks against instead of Pixie. Defaults to LOCAL_DATA_DIR.")
+	// The slackbot is configured with a config file and/or environment
+	// variables. See the README for the available settings.
+	load = func() (*Config, error) {
+		flagOverrides := func(c *Config) {
+			if *record != "" {
+				c.RecordDir = *record
+			}
+			if *replay != "" {
+				c.ReplayDir = *replay
+			}
+			if *localData != "" {
+				c.LocalDataDir = *localData
+			}
+			// Before validating, since dry runs don't need a Slack token.
+			c.DryRun = c.DryRun || *dryRun
+		}
+		cfg, err := loadConfig(*configPath, *profile, append([]func(*Config){flagOverrides}, overrides...)...)
+		if err != nil {
+			return nil, err
+		}
+		if *scriptPath != "" {
+			cfg.Defaults.Script = *scriptPath
+		}
+		logger.configure(cfg.Log)
+		return cfg, nil
+	}
+	return load, configPath
+}
+
+func runCommand(args []string) error {
+	fs := flag.NewFlagSet("run", flag.ExitOnError)
+	load, configPath := configFlags(fs)
+	fs.Parse(args)
+
+	a, err := newApp(context.Background(), load)
+	if err != nil {
+		return err
+	}
+
+	// Shut down gracefully on SIGTERM, such as during a Kubernetes rollout, or SIGINT.
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer cancel()
+
+	// Reload the config on SIGHUP, or when the config file or rules change.
+	reload := make(chan struct{}, 1)
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	var fileChanged, rulesChanged <-chan struct{}
+	if *configPath != "" {
+		fileChanged = watchFile(ctx, *configPath)
+	}
+	// Rules are also reloaded when their custom resources or rules URL change.
+	if a.cfg.RulesCRD.Enabled {
+		rulesChanged = watchRulesCRD(ctx, a.cfg.RulesCRD)
+	} else if a.cfg.RulesURL.URL != "" {
+		rulesChanged = watchRulesURL(ctx, a.cfg.RulesURL)
+	}
+	go func() {
+		for {
+			select {
+			case <-hup:
+				logInfo("Received SIGHUP, reloading config.")
+			case <-fileChanged:
+			case <-rulesChanged:
+			}
+			select {
+			case reload <- struct{}{}:
+			default:
+			}
+		}
+	}()
+
+	return a.Run(ctx, reload)
+}
+
+// Exit codes of check-once.
+const (
+	exitNoIncidents = 0
+	exitIncidents   = 1
+	exitCheckFailed = 2
+)
+
+// exitError is an error that makes the CLI exit with a specific status.
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string { return e.err.Error() }
+
+func (e *exitError) Unwrap() error { return e.err }
+
+// oneOffIncidents is the IncidentManager of check-once. It deliberately
+// hides the ClaimCheck method of the IncidentManager it wraps, so that
+// check-once always runs every rule, even if the bot is also running against
+// the same Redis.
+type oneOffIncidents struct {
+	IncidentManager
+}
+
+// checkOnceCommand runs every rule once. It exits with exitNoIncidents if
+// no incidents are open afterwards, exitIncidents if any are, and
+// exitCheckFailed if a rule couldn't be run, so it can be used as a
+// Kubernetes CronJob or a CI gate.
+func checkOnceCommand(args []string) error {
+	fs := flag.NewFlagSet("check-once", flag.ExitOnError)
+	load, _ := configFlags(fs)
+	fs.Parse(args)
+
+	ctx := context.Background()
+	a, err := newApp(ctx, load)
+	if err != nil {
+		return &exitError{code: exitCheckFailed, err: err}
+	}
+	open, err := checkOnce(ctx, a)
+	if err != nil {
+		return err
+	}
+	if open > 0 {
+		return &exitError{code: exitIncidents, err: fmt.Errorf("%d incidents open", open)}
+	}
+	logInfo("No incidents found.")
+	return nil
+}
+
+// checkOnce runs every rule of a once, replaying all of its recordings if
+// any, and returns the number of incidents open once all of them have run.
+func checkOnce(ctx context.Context, a *app) (int, error) {
+	incidents := oneOffIncidents{IncidentManager: a.incidents}
+	failed := 0
+	for _, t := range a.engine.trackers {
+		t.incidents = incidents
+		// A one-off check always runs, whichever replica leads.
+		t.leader = nil
+		if err := t.Check(ctx); err != nil {
+			logError("Error running rule.", "rule", t.rule.Name, "error", err)
+			failed++
+			continue
+		}
+		// Replays every recording of the rule, in the order they were recorded,
+		// so incidents open and resolve like they did.
+		for t.replay != nil && t.replay.Remaining(t.rule.Name) > 0 {
+			if err := t.Check(ctx); err != nil {
+				logError("Error running rule.", "rule", t.rule.Name, "error", err)
+				failed++
+				break
+			}
+		}
+	}
+	a.budget.flush(ctx)
+	a.tracer.Flush(ctx)
+	if failed > 0 {
+		return 0, &exitError{code: exitCheckFailed, err: fmt.Errorf("%d of %d rules failed", failed, len(a.engine.trackers))}
+	}
+	open, err := a.incidents.Open(ctx)
+	if err != nil {
+		return 0, &exitError{code: exitCheckFailed, err: err}
+	}
+	return len(open), nil
+}
+
+// validateCommand checks the config and prints a report of every rule,
+// without sending anything. Each rule's script is rendered to catch template
+// errors. With -online, the Slack token is also checked and each script is
+// compiled on a cluster.
+func validateCommand(args []string) error {
+	fs := flag.NewFlagSet("validate", flag.ExitOnError)
+	load, _ := configFlags(fs)
+	online := fs.Bool("online", false, "Also check the Slack token and compile each rule's PxL script on a cluster.")
+	fs.Parse(args)
+
+	cfg, err := load()
+	if err != nil {
+		return err
+	}
+	rules, err := cfg.loadRules()
+	if err != nil {
+		return err
+	}
+	for _, r := range rules {
+		script, err := loadRuleScript(r)
+		if err != nil {
+			return fmt.Errorf("rule %s: %w", r.Name, err)
+		}
+		if _, err := script.Render(newScriptVars(r, r.Interval.Duration)); err != nil {
+			return fmt.Errorf("rule %s: rendering PxL script: %w", r.Name, err)
+		}
+		printRule(os.Stdout, r)
+	}
+
+	if *online {
+		ctx := context.Background()
+		auth, err := slack.New(cfg.Slack.Token).AuthTestContext(ctx)
+		if err != nil {
+			return fmt.Errorf("checking Slack token: %w", err)
+		}
+		fmt.Printf("Slack token is valid for %s in %s.\n", auth.User, auth.Team)
+
+		a, err := newApp(ctx, load)
+		if err != nil {
+			return err
+		}
+		if err := preflight(ctx, a.engine.trackers); err != nil {
+			return err
+		}
+	}
+	fmt.Printf("Config is valid, %d rules.\n", len(rules))
+	return nil
+}
+
+// printRule writes a human readable description of a rule to w.
+func printRule(w io.Writer, r Rule) {
+	script := r.Script
+	if r.Builtin != "" {
+		script = "builtin " + r.Builtin
+	} else if r.Source != "" {
+		script = "inline source"
+	} else if script == "" && r.Streaming {
+		script = "builtin http-errors-stream"
+	} else if script == "" {
+		script = "builtin http-errors"
+	}
+	namespaces := "all"
+	if ns := r.monitoredNamespaces(); ns != nil {
+		namespaces = strings.Join(ns, ", ")
+	}
+	if len(r.ExcludeNamespaces) > 0 {
+		namespaces += " except " + strings.Join(r.ExcludeNamespaces, ", ")
+	}
+	mode := "every " + r.Interval.String()
+	if r.Schedule != "" {
+		mode = "on schedule " + r.Schedule
+	}
+	if r.Streaming {
+		mode = "streaming, over the last " + r.Interval.String()
+	}
+
+	fmt.Fprintf(w, "%s:\n", r.Name)
+	fmt.Fprintf(w, "  script:     %s (table %s)\n", script, r.Table)
+	fmt.Fprintf(w, "  alerts on:  %s\n", r.Problem)
+	fmt.Fprintf(w, "  namespaces: %s\n", namespaces)
+	fmt.Fprintf(w, "  threshold:  %s, critical at %s\n", formatRate(r.Threshold), formatRate(r.CriticalThreshold))
+	fmt.Fprintf(w, "  runs:       %s, timeout %s\n", mode, r.Timeout)
+	if len(r.Alerters) > 0 {
+		fmt.Fprintf(w, "  alerters:   %s\n", strings.Join(r.Alerters, ", "))
+	} else {
+		fmt.Fprintf(w, "  channel:    %s\n", r.Channel)
+	}
+	for _, k := range sortedLabelKeys(r.Params) {
+		fmt.Fprintf(w, "  param:      %s=%s\n", k, r.Params[k])
+	}
+}
+
+func sendTestAlertCommand(args []string) error {
+	fs := flag.NewFlagSet("send-test-alert", flag.ExitOnError)
+	load, _ := configFlags(fs)
+	channel := fs.String("channel", "", "Slack channel to send the message to. Defaults to the default rule's channel.")
+	alert := fs.Bool("alert", false, "Send the message as an alert, which notifies the channel, instead of an info message.")
+	fs.Parse(args)
+
+	cfg, err := load()
+	if err != nil {
+		return err
+	}
+	if *channel == "" {
+		*channel = cfg.Defaults.Channel
+	}
+	if *channel == "" {
+		return errors.New("no channel to send the test message to")
+	}
+	alerter := cfg.channelAlerter(*channel)
+	msg := "This is a test message from the Pixie slackbot."
+	ctx := context.Background()
+	if *alert {
+		err = alerter.SendAlert(ctx, msg)
+	} else {
+		err = alerter.SendInfo(ctx, msg)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Sent a test message to %s.\n", *channel)
+	return nil
+}
+
+// simulateCommand runs synthetic stats, from flags or a JSON file, through a
+// rule's incident tracking and messages, as if a check had returned them,
+// and prints the messages that would be sent or posts them to a test channel.
+func simulateCommand(args []string) error {
+	fs := flag.NewFlagSet("simulate", flag.ExitOnError)
+	channel := fs.String("channel", "", "Test channel to post the messages to, instead of printing them.")
+	load, _ := configFlags(fs, func(c *Config) {
+		// Simulations never connect to Pixie, and only send messages with -channel.
+		c.offline = true
+		if *channel == "" {
+			c.DryRun = true
+		}
+	})
+	ruleName := fs.String("rule", "", "Rule to simulate. Defaults to the first rule.")
+	clusterName := fs.String("cluster", "simulated", "Name of the cluster the stats are from.")
+	service := fs.String("service", "px-sock-shop/orders", "Service the stats are for.")
+	endpoint := fs.String("endpoint", "", "Endpoint the stats are for, or empty for the whole service.")
+	errorCount := fs.Int64("errors", 40, "Number of errors.")
+	requests := fs.Int64("requests", 100, "Number of requests.")
+	checks := fs.Int("checks", 1, "Number of checks in a row that return the stats.")
+	resolve := fs.Bool("resolve", false, "Follow the checks with one that returns no stats, so the incidents resolve.")
+	file := fs.String("file", "", `JSON file with the stats of each check instead, such as [[{"service": "px-sock-shop/orders", "errorCount": 40, "totalRequests": 100}], []].`)
+	golden := fs.String("golden", "", "Golden file to compare the messages to, failing if they differ.")
+	update := fs.Bool("update", false, "Write the messages to the -golden file instead of comparing them.")
+	fs.Parse(args)
+	if *golden != "" && *channel != "" {
+		return fmt.Errorf("-golden and -channel can't be used together")
+	}
+
+	cfg, err := load()
+	if err != nil {
+		return err
+	}
+	rules, err := cfg.loadRules()
+	if err != nil {
+		return err
+	}
+	r := rules[0]
+	if *ruleName != "" {
+		found := false
+		for _, rule := range rules {
+			if rule.Name == *ruleName {
+				r, found = rule, true
+			}
+		}
+		if !found {
+			return fmt.Errorf("unknown rule %q", *ruleName)
+		}
+	}
+
+	var stats [][]IncidentData
+	if *file != "" {
+		b, err := ioutil.ReadFile(*file)
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(b, &stats); err != nil {
+			return fmt.Errorf("parsing %s: %w", *file, err)
+		}
+	} else {
+		for i := 0; i < *checks; i++ {
+			stats = append(stats, []IncidentData{{Service: *service, Endpoint: *endpoint, ErrorCount: *errorCount, TotalRequests: *requests}})
+		}
+	}
+	if *resolve {
+		stats = append(stats, nil)
+	}
+
+	capture := &CaptureAlerter{}
+	var alerter Alerter = capture
+	if *channel != "" {
+		alerter = cfg.channelAlerter(*channel)
+	}
+	c := &cluster{Cluster: Cluster{ID: *clusterName, Name: *clusterName, Labels: cfg.Pixie.ClusterLabels.For(*clusterName, *clusterName)}}
+	if err := simulate(context.Background(), newSimulationTracker(r, alerter), c, stats); err != nil {
+		return err
+	}
+
+	if *channel != "" {
+		fmt.Printf("Posted the messages of %d checks of rule %s to %s.\n", len(stats), r.Name, *channel)
+		return nil
+	}
+	msgs := capture.Messages()
+	if *golden != "" {
+		if err := checkGolden(*golden, renderGolden(msgs), *update); err != nil {
+			return err
+		}
+		if *update {
+			fmt.Printf("Wrote %d messages to %s.\n", len(msgs), *golden)
+		} else {
+			fmt.Printf("Messages match %s.\n", *golden)
+		}
+		return nil
+	}
+	if len(msgs) == 0 {
+		fmt.Printf("Rule %s would send no messages: nothing is over the %s threshold.\n", r.Name, formatRate(r.Threshold))
+	}
+	for _, m := range msgs {
+		fmt.Printf("[%s to %s] %s\n", m.Kind, r.Channel, m.Msg)
+	}
+	return nil
+}
+
+// newSimulationTracker returns a tracker of rule r for simulations, which
+// keeps incidents in memory and sends every message to alerter.
+func newSimulationTracker(r Rule, alerter Alerter) *ServiceTracker {
+	return &ServiceTracker{
+		rule:      r,
+		incidents: newMemoryIncidentManager(),
+		silences:  newMemorySilences(),
+		// Every message is shown as it would be sent during business hours.
+		policy:  alwaysAlertPolicy{},
+		alerter: alerter,
+	}
+}
+
+// simulate runs a check of t on c for each of the given stats. Checks are a
+// rule interval apart, starting at simulationStart, so incidents stay open
+// for a realistic time, and every run gives the same messages.
+func simulate(ctx context.Context, t *ServiceTracker, c *cluster, stats [][]IncidentData) error {
+	var now time.Time
+	t.now = func() time.Time { return now }
+	for i, s := range stats {
+		now = simulationStart.Add(time.Duration(i) * t.rule.Interval.Duration)
+		if _, err := t.evaluate(ctx, c, s); err != nil {
+			return fmt.Errorf("check %d: %w", i+1, err)
+		}
+	}
+	return nil
+}
+
+func versionCommand(args []string) error {
+	fmt.Println(version)
+	return nil
+}
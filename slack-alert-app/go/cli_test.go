@@ -0,0 +1,83 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeRecording saves rec where loadReplay looks for it.
+func writeRecording(t *testing.T, dir string, rec *recording) {
+	t.Helper()
+	path := filepath.Join(dir, rec.Rule, rec.Cluster.ID, rec.Time.Format("20060102T150405Z")+".json")
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	b, err := json.Marshal(rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, b, 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCheckOnceReplay(t *testing.T) {
+	c := Cluster{ID: "prod", Name: "prod"}
+	start := time.Date(2021, 2, 8, 12, 0, 0, 0, time.UTC)
+	over := httpTable([]string{"px-sock-shop/orders", "/orders", "40", "100"})
+	under := httpTable([]string{"px-sock-shop/orders", "/orders", "1", "100"})
+
+	tests := []struct {
+		name       string
+		recordings [][]*recordedTable
+		want       int
+	}{
+		{name: "opens", recordings: [][]*recordedTable{{under}, {over}}, want: 1},
+		{name: "opens and resolves", recordings: [][]*recordedTable{{over}, {under}}, want: 0},
+		{name: "stays open", recordings: [][]*recordedTable{{over}, {over}, {over}}, want: 1},
+		{name: "never opens", recordings: [][]*recordedTable{{under}}, want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for i, tables := range tt.recordings {
+				writeRecording(t, dir, &recording{Rule: "http-errors", Cluster: c, Time: start.Add(time.Duration(i) * 5 * time.Minute), Tables: tables})
+			}
+			cfg := defaultConfig()
+			cfg.DryRun = true
+			cfg.ReplayDir = dir
+			a, err := newApp(context.Background(), func() (*Config, error) { return cfg, nil })
+			if err != nil {
+				t.Fatal(err)
+			}
+			open, err := checkOnce(context.Background(), a)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if open != tt.want {
+				t.Errorf("got %d incidents open, want %d", open, tt.want)
+			}
+		})
+	}
+}
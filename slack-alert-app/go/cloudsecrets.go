@@ -0,0 +1,350 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Secrets can be given as references to a cloud secret manager instead of
+// their value:
+//
+//	awssm://<secret name or ARN>[#<JSON key>]  AWS Secrets Manager
+//	gcpsm://projects/<project>/secrets/<secret>[/versions/<version>]  GCP Secret Manager
+//
+// References are resolved once, when the config is loaded.
+const (
+	awsSecretPrefix = "awssm://"
+	gcpSecretPrefix = "gcpsm://"
+)
+
+var cloudSecretsHTTP = &http.Client{Timeout: 10 * time.Second}
+
+// resolveSecret returns the value of v, fetching it from a cloud secret
+// manager if it is a reference to one.
+func resolveSecret(ctx context.Context, v string) (string, error) {
+	switch {
+	case strings.HasPrefix(v, awsSecretPrefix):
+		return awsSecret(ctx, strings.TrimPrefix(v, awsSecretPrefix))
+	case strings.HasPrefix(v, gcpSecretPrefix):
+		return gcpSecret(ctx, strings.TrimPrefix(v, gcpSecretPrefix))
+	}
+	return v, nil
+}
+
+// awsSecret fetches a secret from AWS Secrets Manager in AWS_REGION, using
+// the credentials in the environment or, on EKS, the pod's IAM role. If key
+// is given after a #, the secret is parsed as JSON and the key's value is returned.
+func awsSecret(ctx context.Context, ref string) (string, error) {
+	id, key := ref, ""
+	if i := strings.LastIndex(ref, "#"); i >= 0 {
+		id, key = ref[:i], ref[i+1:]
+	}
+	region := os.Getenv("AWS_REGION")
+	if region == "" {
+		region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if region == "" {
+		return "", fmt.Errorf("Please set AWS_REGION environment variable to read %s%s.", awsSecretPrefix, id)
+	}
+	creds, err := awsCredentialsFromEnv(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	body, err := json.Marshal(map[string]string{"SecretId": id})
+	if err != nil {
+		return "", err
+	}
+	host := "secretsmanager." + region + ".amazonaws.com"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "https://"+host+"/", strings.NewReader(string(body)))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "secretsmanager.GetSecretValue")
+	creds.sign(req, body, region, "secretsmanager", time.Now())
+
+	var resp struct {
+		SecretString string `json:"SecretString"`
+	}
+	if err := doJSON(req, &resp); err != nil {
+		return "", fmt.Errorf("reading %s from AWS Secrets Manager: %w", id, err)
+	}
+	if key == "" {
+		return resp.SecretString, nil
+	}
+	var values map[string]string
+	if err := json.Unmarshal([]byte(resp.SecretString), &values); err != nil {
+		return "", fmt.Errorf("AWS secret %s is not a JSON object: %w", id, err)
+	}
+	v, ok := values[key]
+	if !ok {
+		return "", fmt.Errorf("AWS secret %s has no %s", id, key)
+	}
+	return v, nil
+}
+
+type awsCredentials struct {
+	accessKeyID     string
+	secretAccessKey string
+	sessionToken    string
+	// When the credentials of an assumed role expire, or zero for
+	// credentials from the environment.
+	expiration time.Time
+}
+
+// awsCredentialsFromEnv returns the credentials in AWS_ACCESS_KEY_ID and
+// AWS_SECRET_ACCESS_KEY or, if AWS_ROLE_ARN and AWS_WEB_IDENTITY_TOKEN_FILE
+// are set as they are on EKS, assumes the role with the web identity token.
+func awsCredentialsFromEnv(ctx context.Context) (*awsCredentials, error) {
+	if id := os.Getenv("AWS_ACCESS_KEY_ID"); id != "" {
+		return &awsCredentials{
+			accessKeyID:     id,
+			secretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			sessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+		}, nil
+	}
+	role, tokenFile := os.Getenv("AWS_ROLE_ARN"), os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE")
+	if role == "" || tokenFile == "" {
+		return nil, fmt.Errorf("no AWS credentials found, set AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY, or AWS_ROLE_ARN and AWS_WEB_IDENTITY_TOKEN_FILE")
+	}
+	token, err := ioutil.ReadFile(tokenFile)
+	if err != nil {
+		return nil, fmt.Errorf("reading web identity token: %w", err)
+	}
+	q := url.Values{}
+	q.Set("Action", "AssumeRoleWithWebIdentity")
+	q.Set("Version", "2011-06-15")
+	q.Set("RoleArn", role)
+	q.Set("RoleSessionName", "pixie-slackbot")
+	q.Set("WebIdentityToken", strings.TrimSpace(string(token)))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://sts.amazonaws.com/?"+q.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := cloudSecretsHTTP.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("assuming AWS role %s: %s: %s", role, resp.Status, strings.TrimSpace(string(b)))
+	}
+	var r struct {
+		Credentials struct {
+			AccessKeyID     string    `xml:"AccessKeyId"`
+			SecretAccessKey string    `xml:"SecretAccessKey"`
+			SessionToken    string    `xml:"SessionToken"`
+			Expiration      time.Time `xml:"Expiration"`
+		} `xml:"AssumeRoleWithWebIdentityResult>Credentials"`
+	}
+	if err := xml.Unmarshal(b, &r); err != nil {
+		return nil, fmt.Errorf("parsing AWS credentials: %w", err)
+	}
+	return &awsCredentials{
+		accessKeyID:     r.Credentials.AccessKeyID,
+		secretAccessKey: r.Credentials.SecretAccessKey,
+		sessionToken:    r.Credentials.SessionToken,
+		expiration:      r.Credentials.Expiration,
+	}, nil
+}
+
+// sign signs req, whose body is body, with AWS Signature Version 4. The
+// path is signed as net/url escapes it, which only matches AWS's encoding for
+// paths made of letters, digits and "-_.~/".
+func (c *awsCredentials) sign(req *http.Request, body []byte, region, service string, now time.Time) {
+	now = now.UTC()
+	date := now.Format("20060102")
+	amzDate := now.Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Date", amzDate)
+	if c.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", c.sessionToken)
+	}
+
+	canonicalRequest, signedHeaders := awsCanonicalRequest(req, body)
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	signature := awsSignature(c.secretAccessKey, date, region, service, awsStringToSign(amzDate, scope, canonicalRequest))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		c.accessKeyID, scope, signedHeaders, signature))
+}
+
+// awsCanonicalRequest returns the canonical form of req, whose body is body,
+// and the headers it signs.
+func awsCanonicalRequest(req *http.Request, body []byte) (canonical, signedHeaders string) {
+	headers := []string{"host", "x-amz-date"}
+	for _, h := range []string{"content-type", "x-amz-target", "x-amz-content-sha256", "x-amz-security-token"} {
+		if req.Header.Get(h) != "" {
+			headers = append(headers, h)
+		}
+	}
+	sort.Strings(headers)
+	var canonicalHeaders strings.Builder
+	for _, h := range headers {
+		v := req.Header.Get(h)
+		if h == "host" {
+			v = req.URL.Host
+		}
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", h, strings.TrimSpace(v))
+	}
+	signedHeaders = strings.Join(headers, ";")
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	return strings.Join([]string{
+		req.Method,
+		path,
+		awsCanonicalQuery(req.URL.RawQuery),
+		canonicalHeaders.String(),
+		signedHeaders,
+		sha256Hex(body),
+	}, "\n"), signedHeaders
+}
+
+// awsCanonicalQuery sorts the parameters of the raw query by name, then
+// value. They are kept escaped as they are.
+func awsCanonicalQuery(raw string) string {
+	if raw == "" {
+		return ""
+	}
+	params := strings.Split(raw, "&")
+	sort.Slice(params, func(i, j int) bool {
+		ki, vi := splitQueryParam(params[i])
+		kj, vj := splitQueryParam(params[j])
+		if ki != kj {
+			return ki < kj
+		}
+		return vi < vj
+	})
+	return strings.Join(params, "&")
+}
+
+func splitQueryParam(p string) (key, value string) {
+	if i := strings.Index(p, "="); i >= 0 {
+		return p[:i], p[i+1:]
+	}
+	return p, ""
+}
+
+// awsStringToSign returns the string to sign of a canonical request made at
+// amzDate in scope.
+func awsStringToSign(amzDate, scope, canonicalRequest string) string {
+	return strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, sha256Hex([]byte(canonicalRequest))}, "\n")
+}
+
+// awsSignature returns the hex signature of stringToSign, with the key
+// derived from the secret access key for the date, region and service.
+func awsSignature(secretAccessKey, date, region, service, stringToSign string) string {
+	key := []byte("AWS4" + secretAccessKey)
+	for _, s := range []string{date, region, service, "aws4_request"} {
+		key = hmacSHA256(key, s)
+	}
+	return hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, s string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(s))
+	return h.Sum(nil)
+}
+
+// gcpSecret fetches a secret version from GCP Secret Manager, using the
+// service account of the GKE node or, with Workload Identity, the pod. The
+// latest version is used if none is given.
+func gcpSecret(ctx context.Context, name string) (string, error) {
+	if !strings.Contains(name, "/versions/") {
+		name += "/versions/latest"
+	}
+	token, err := gcpAccessToken(ctx)
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://secretmanager.googleapis.com/v1/"+name+":access", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	var resp struct {
+		Payload struct {
+			Data string `json:"data"`
+		} `json:"payload"`
+	}
+	if err := doJSON(req, &resp); err != nil {
+		return "", fmt.Errorf("reading %s from GCP Secret Manager: %w", name, err)
+	}
+	b, err := base64.StdEncoding.DecodeString(resp.Payload.Data)
+	if err != nil {
+		return "", fmt.Errorf("decoding GCP secret %s: %w", name, err)
+	}
+	return string(b), nil
+}
+
+// gcpAccessToken gets an access token for the default service account from
+// the GCE metadata server.
+func gcpAccessToken(ctx context.Context) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		"http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	var resp struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := doJSON(req, &resp); err != nil {
+		return "", fmt.Errorf("getting GCP access token: %w", err)
+	}
+	return resp.AccessToken, nil
+}
+
+// doJSON sends req and decodes the JSON response into v.
+func doJSON(req *http.Request, v interface{}) error {
+	resp, err := cloudSecretsHTTP.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(b)))
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
@@ -0,0 +1,358 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// AWS's example credentials, as used by its Signature Version 4 test suite.
+const (
+	awsExampleAccessKeyID     = "AKIDEXAMPLE"
+	awsExampleSecretAccessKey = "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"
+)
+
+// TestAWSSignatureV4 checks the signer against AWS's published test
+// vectors, signed on 2015-08-30 at 12:36:00 UTC in us-east-1.
+func TestAWSSignatureV4(t *testing.T) {
+	const emptyHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	for _, tt := range []struct {
+		name        string
+		method, url string
+		contentType string
+		body        string
+		service     string
+
+		wantCanonicalRequest string
+		wantStringToSign     string
+		wantSignature        string
+	}{
+		{
+			name:   "get-vanilla",
+			method: http.MethodGet, url: "https://example.amazonaws.com/",
+			service: "service",
+			wantCanonicalRequest: "GET\n/\n\nhost:example.amazonaws.com\nx-amz-date:20150830T123600Z\n\nhost;x-amz-date\n" +
+				emptyHash,
+			wantStringToSign: "AWS4-HMAC-SHA256\n20150830T123600Z\n20150830/us-east-1/service/aws4_request\n" +
+				"bb579772317eb040ac9ed261061d46c1f17a8133879d6129b6e1c25292927e63",
+			wantSignature: "5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31",
+		},
+		{
+			name:   "post-vanilla",
+			method: http.MethodPost, url: "https://example.amazonaws.com/",
+			service: "service",
+			wantCanonicalRequest: "POST\n/\n\nhost:example.amazonaws.com\nx-amz-date:20150830T123600Z\n\nhost;x-amz-date\n" +
+				emptyHash,
+			wantStringToSign: "AWS4-HMAC-SHA256\n20150830T123600Z\n20150830/us-east-1/service/aws4_request\n" +
+				"553f88c9e4d10fc9e109e2aeb65f030801b70c2f6468faca261d401ae622fc87",
+			wantSignature: "5da7c1a2acd57cee7505fc6676e4e544621c30862966e37dddb68e92efbe5d6b",
+		},
+		{
+			name:   "get-vanilla-query, parameters out of order",
+			method: http.MethodGet, url: "https://example.amazonaws.com/?Param2=value2&Param1=value1",
+			service: "service",
+			wantCanonicalRequest: "GET\n/\nParam1=value1&Param2=value2\nhost:example.amazonaws.com\nx-amz-date:20150830T123600Z\n\nhost;x-amz-date\n" +
+				emptyHash,
+			wantStringToSign: "AWS4-HMAC-SHA256\n20150830T123600Z\n20150830/us-east-1/service/aws4_request\n" +
+				"816cd5b414d056048ba4f7c5386d6e0533120fb1fcfa93762cf0fc39e2cf19e0",
+			wantSignature: "b97d918cfa904a5beff61c982a1b6f458b799221646efd99d3219ec94cdf2500",
+		},
+		{
+			name:   "post-x-www-form-urlencoded",
+			method: http.MethodPost, url: "https://example.amazonaws.com/",
+			contentType: "application/x-www-form-urlencoded",
+			body:        "Param1=value1",
+			service:     "service",
+			wantCanonicalRequest: "POST\n/\n\ncontent-type:application/x-www-form-urlencoded\nhost:example.amazonaws.com\nx-amz-date:20150830T123600Z\n\n" +
+				"content-type;host;x-amz-date\n9095672bbd1f56dfc5b65f3e153adc8731a4a654192329106275f4c7b24d0b6e",
+			wantStringToSign: "AWS4-HMAC-SHA256\n20150830T123600Z\n20150830/us-east-1/service/aws4_request\n" +
+				"42a5e5bb34198acb3e84da4f085bb7927f2bc277ca766e6d19c73c2154021281",
+			wantSignature: "ff11897932ad3f4e8b18135d722051e5ac45fc38421b1da7b9d196a0fe09473a",
+		},
+		{
+			name:   "IAM ListUsers",
+			method: http.MethodGet, url: "https://iam.amazonaws.com/?Action=ListUsers&Version=2010-05-08",
+			contentType: "application/x-www-form-urlencoded; charset=utf-8",
+			service:     "iam",
+			wantCanonicalRequest: "GET\n/\nAction=ListUsers&Version=2010-05-08\ncontent-type:application/x-www-form-urlencoded; charset=utf-8\n" +
+				"host:iam.amazonaws.com\nx-amz-date:20150830T123600Z\n\ncontent-type;host;x-amz-date\n" + emptyHash,
+			wantStringToSign: "AWS4-HMAC-SHA256\n20150830T123600Z\n20150830/us-east-1/iam/aws4_request\n" +
+				"f536975d06c0309214f805bb90ccff089219ecd68b2577efef23edd43b7e1a59",
+			wantSignature: "5d672d79c15b13162d9279b0855cfba6789a8edb4c82c400e06b5924a6f2b5d7",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(tt.method, tt.url, strings.NewReader(tt.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.contentType != "" {
+				req.Header.Set("Content-Type", tt.contentType)
+			}
+			creds := &awsCredentials{accessKeyID: awsExampleAccessKeyID, secretAccessKey: awsExampleSecretAccessKey}
+			creds.sign(req, []byte(tt.body), "us-east-1", tt.service, time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC))
+
+			canonicalRequest, signedHeaders := awsCanonicalRequest(req, []byte(tt.body))
+			if canonicalRequest != tt.wantCanonicalRequest {
+				t.Errorf("canonical request:\n%s\nwant:\n%s", canonicalRequest, tt.wantCanonicalRequest)
+			}
+			scope := "20150830/us-east-1/" + tt.service + "/aws4_request"
+			if got := awsStringToSign("20150830T123600Z", scope, canonicalRequest); got != tt.wantStringToSign {
+				t.Errorf("string to sign:\n%s\nwant:\n%s", got, tt.wantStringToSign)
+			}
+			want := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/" + scope + ", SignedHeaders=" + signedHeaders + ", Signature=" + tt.wantSignature
+			if got := req.Header.Get("Authorization"); got != want {
+				t.Errorf("Authorization = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestAWSSignatureV4SessionToken(t *testing.T) {
+	req, err := http.NewRequest(http.MethodGet, "https://example.amazonaws.com/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	creds := &awsCredentials{accessKeyID: awsExampleAccessKeyID, secretAccessKey: awsExampleSecretAccessKey, sessionToken: "session"}
+	creds.sign(req, nil, "us-east-1", "service", time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC))
+	if got := req.Header.Get("X-Amz-Security-Token"); got != "session" {
+		t.Errorf("X-Amz-Security-Token = %q, want the session token", got)
+	}
+	if got := req.Header.Get("Authorization"); !strings.Contains(got, "SignedHeaders=host;x-amz-date;x-amz-security-token,") {
+		t.Errorf("Authorization = %q, want the session token signed", got)
+	}
+}
+
+// setenv sets an environment variable for the rest of the test.
+func setenv(t *testing.T, key, value string) {
+	t.Helper()
+	old, ok := os.LookupEnv(key)
+	if value == "" {
+		os.Unsetenv(key)
+	} else {
+		os.Setenv(key, value)
+	}
+	t.Cleanup(func() {
+		if ok {
+			os.Setenv(key, old)
+		} else {
+			os.Unsetenv(key)
+		}
+	})
+}
+
+// redirectTransport sends every request to a test server, keeping the Host
+// header it was meant for.
+type redirectTransport struct {
+	to *url.URL
+}
+
+func (t redirectTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.URL.Scheme, req.URL.Host = t.to.Scheme, t.to.Host
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+// serveCloudSecrets sends the requests to AWS and GCP made while resolving
+// secrets to h for the rest of the test.
+func serveCloudSecrets(t *testing.T, h http.HandlerFunc) {
+	t.Helper()
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+	to, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := cloudSecretsHTTP
+	cloudSecretsHTTP = &http.Client{Transport: redirectTransport{to: to}}
+	t.Cleanup(func() { cloudSecretsHTTP = old })
+}
+
+func TestAWSCredentialsFromWebIdentity(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := ioutil.WriteFile(tokenFile, []byte("web-identity-token\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	setenv(t, "AWS_ACCESS_KEY_ID", "")
+	setenv(t, "AWS_ROLE_ARN", "arn:aws:iam::123456789012:role/slackbot")
+	setenv(t, "AWS_WEB_IDENTITY_TOKEN_FILE", tokenFile)
+
+	var got url.Values
+	serveCloudSecrets(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Host != "sts.amazonaws.com" {
+			t.Errorf("request to %s, want sts.amazonaws.com", r.Host)
+		}
+		got = r.URL.Query()
+		w.Header().Set("Content-Type", "text/xml")
+		w.Write([]byte(`<AssumeRoleWithWebIdentityResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+  <AssumeRoleWithWebIdentityResult>
+    <Credentials>
+      <AccessKeyId>ASIAEXAMPLE</AccessKeyId>
+      <SecretAccessKey>secret</SecretAccessKey>
+      <SessionToken>session</SessionToken>
+      <Expiration>2021-02-08T13:00:00Z</Expiration>
+    </Credentials>
+  </AssumeRoleWithWebIdentityResult>
+</AssumeRoleWithWebIdentityResponse>`))
+	})
+	creds, err := awsCredentialsFromEnv(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, want := range map[string]string{
+		"Action":           "AssumeRoleWithWebIdentity",
+		"Version":          "2011-06-15",
+		"RoleArn":          "arn:aws:iam::123456789012:role/slackbot",
+		"RoleSessionName":  "pixie-slackbot",
+		"WebIdentityToken": "web-identity-token",
+	} {
+		if got.Get(k) != want {
+			t.Errorf("%s = %q, want %q", k, got.Get(k), want)
+		}
+	}
+	want := awsCredentials{accessKeyID: "ASIAEXAMPLE", secretAccessKey: "secret", sessionToken: "session",
+		expiration: time.Date(2021, 2, 8, 13, 0, 0, 0, time.UTC)}
+	if *creds != want {
+		t.Errorf("got credentials %+v, want %+v", *creds, want)
+	}
+}
+
+func TestAWSCredentialsFromWebIdentityDenied(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := ioutil.WriteFile(tokenFile, []byte("expired"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	setenv(t, "AWS_ACCESS_KEY_ID", "")
+	setenv(t, "AWS_ROLE_ARN", "arn:aws:iam::123456789012:role/slackbot")
+	setenv(t, "AWS_WEB_IDENTITY_TOKEN_FILE", tokenFile)
+	serveCloudSecrets(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`<ErrorResponse><Error><Code>ExpiredTokenException</Code></Error></ErrorResponse>`))
+	})
+	_, err := awsCredentialsFromEnv(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "role/slackbot") || !strings.Contains(err.Error(), "ExpiredTokenException") {
+		t.Errorf("got error %v, want the role and STS's error", err)
+	}
+}
+
+func TestAWSSecret(t *testing.T) {
+	setenv(t, "AWS_REGION", "eu-west-1")
+	setenv(t, "AWS_ACCESS_KEY_ID", awsExampleAccessKeyID)
+	setenv(t, "AWS_SECRET_ACCESS_KEY", awsExampleSecretAccessKey)
+	setenv(t, "AWS_SESSION_TOKEN", "")
+	serveCloudSecrets(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Host != "secretsmanager.eu-west-1.amazonaws.com" {
+			t.Errorf("request to %s, want secretsmanager.eu-west-1.amazonaws.com", r.Host)
+		}
+		if got := r.Header.Get("X-Amz-Target"); got != "secretsmanager.GetSecretValue" {
+			t.Errorf("X-Amz-Target = %q", got)
+		}
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/") ||
+			!strings.Contains(auth, "/eu-west-1/secretsmanager/aws4_request, SignedHeaders=content-type;host;x-amz-date;x-amz-target,") {
+			t.Errorf("Authorization = %q", auth)
+		}
+		var req struct{ SecretId string }
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+		}
+		switch req.SecretId {
+		case "slackbot":
+			json.NewEncoder(w).Encode(map[string]string{"SecretString": `{"slackToken": "xoxb-token"}`})
+		case "plain":
+			json.NewEncoder(w).Encode(map[string]string{"SecretString": "xoxb-plain"})
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"__type": "ResourceNotFoundException"}`))
+		}
+	})
+	for _, tt := range []struct {
+		ref, want, wantErr string
+	}{
+		{ref: "awssm://slackbot#slackToken", want: "xoxb-token"},
+		{ref: "awssm://plain", want: "xoxb-plain"},
+		{ref: "awssm://slackbot#missing", wantErr: "has no missing"},
+		{ref: "awssm://plain#slackToken", wantErr: "not a JSON object"},
+		{ref: "awssm://deleted", wantErr: "ResourceNotFoundException"},
+	} {
+		got, err := resolveSecret(context.Background(), tt.ref)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("resolveSecret(%q) = %q, %v, want an error containing %q", tt.ref, got, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("resolveSecret(%q) = %q, %v, want %q", tt.ref, got, err, tt.want)
+		}
+	}
+}
+
+func TestGCPSecret(t *testing.T) {
+	serveCloudSecrets(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.Host {
+		case "metadata.google.internal":
+			if r.URL.Path != "/computeMetadata/v1/instance/service-accounts/default/token" || r.Header.Get("Metadata-Flavor") != "Google" {
+				t.Errorf("metadata request for %s with Metadata-Flavor %q", r.URL.Path, r.Header.Get("Metadata-Flavor"))
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"access_token": "ya29.token", "expires_in": 3599, "token_type": "Bearer"})
+		case "secretmanager.googleapis.com":
+			if got := r.Header.Get("Authorization"); got != "Bearer ya29.token" {
+				t.Errorf("Authorization = %q, want the metadata server's token", got)
+			}
+			switch r.URL.Path {
+			case "/v1/projects/demo/secrets/slack-token/versions/latest:access":
+				w.Write([]byte(`{"name": "projects/demo/secrets/slack-token/versions/3", "payload": {"data": "eG94Yi1sYXRlc3Q="}}`))
+			case "/v1/projects/demo/secrets/slack-token/versions/2:access":
+				w.Write([]byte(`{"name": "projects/demo/secrets/slack-token/versions/2", "payload": {"data": "eG94Yi0y"}}`))
+			default:
+				w.WriteHeader(http.StatusNotFound)
+				w.Write([]byte(`{"error": {"code": 404, "status": "NOT_FOUND"}}`))
+			}
+		default:
+			t.Errorf("unexpected request to %s", r.Host)
+		}
+	})
+	for _, tt := range []struct {
+		ref, want, wantErr string
+	}{
+		{ref: "gcpsm://projects/demo/secrets/slack-token", want: "xoxb-latest"},
+		{ref: "gcpsm://projects/demo/secrets/slack-token/versions/2", want: "xoxb-2"},
+		{ref: "gcpsm://projects/demo/secrets/deleted", wantErr: "404 Not Found"},
+	} {
+		got, err := resolveSecret(context.Background(), tt.ref)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("resolveSecret(%q) = %q, %v, want an error containing %q", tt.ref, got, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("resolveSecret(%q) = %q, %v, want %q", tt.ref, got, err, tt.want)
+		}
+	}
+}
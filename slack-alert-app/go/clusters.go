@@ -0,0 +1,374 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"go.withpixie.dev/pixie/src/api/go/pxapi"
+	"google.golang.org/grpc/codes"
+)
+
+// Cluster identifies a Pixie cluster.
+type Cluster struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	// User defined labels, such as env=prod, shown in messages.
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// formatCluster describes a cluster in messages, such as
+// "`prod-us` (`env=prod`)". Labels are formatted like names, since they may
+// come from the cluster too.
+func formatCluster(c Cluster) string {
+	s := formatName(c.Name)
+	if len(c.Labels) == 0 {
+		return s
+	}
+	keys := sortedLabelKeys(c.Labels)
+	labels := make([]string, len(keys))
+	for i, k := range keys {
+		labels[i] = formatName(k + "=" + c.Labels[k])
+	}
+	return s + " (" + strings.Join(labels, ", ") + ")"
+}
+
+func sortedLabelKeys(labels map[string]string) []string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// clusterLabels are the labels of each cluster, keyed by cluster name or ID.
+type clusterLabels map[string]map[string]string
+
+// parseClusterLabels parses labels given as JSON, such as
+// {"prod-us": {"env": "prod", "region": "us-east-1"}}.
+func parseClusterLabels(s string) (clusterLabels, error) {
+	var labels clusterLabels
+	if err := json.Unmarshal([]byte(s), &labels); err != nil {
+		return nil, fmt.Errorf("parsing cluster labels: %w", err)
+	}
+	return labels, nil
+}
+
+// For returns the labels of the cluster with the given ID and name. Labels
+// keyed by ID take precedence, since names can change.
+func (l clusterLabels) For(id, name string) map[string]string {
+	if labels, ok := l[id]; ok {
+		return labels
+	}
+	return l[name]
+}
+
+// cluster is a Pixie cluster the ServiceTracker runs the PxL script against.
+type cluster struct {
+	Cluster
+	conn *pixieConn
+	// Runs scripts instead of the cluster's Vizier, such as a fake, or nil.
+	executor ScriptExecutor
+
+	mu sync.Mutex
+	vz *pxapi.VizierClient
+	// Generation of the pixieConn client vz was created from.
+	generation int
+}
+
+func newCluster(conn *pixieConn, id, name string, labels clusterLabels) *cluster {
+	return &cluster{Cluster: Cluster{ID: id, Name: name, Labels: labels.For(id, name)}, conn: conn}
+}
+
+// vizier returns a client for the cluster, connecting to it if this is the
+// first query, the previous connection was lost or the API key was rotated.
+func (c *cluster) vizier(ctx context.Context) (*pxapi.VizierClient, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	client, generation := c.conn.Client()
+	if c.vz != nil && c.generation == generation {
+		return c.vz, nil
+	}
+	vz, err := client.NewVizierClient(ctx, c.ID)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to cluster %s: %w", c.ID, err)
+	}
+	c.vz = vz
+	c.generation = generation
+	return vz, nil
+}
+
+// scriptExecutor returns what runs scripts against the cluster: its
+// executor, if it has one, or else a client for its Vizier.
+func (c *cluster) scriptExecutor(ctx context.Context) (ScriptExecutor, error) {
+	if c.executor != nil {
+		return c.executor, nil
+	}
+	vz, err := c.vizier(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return vizierExecutor{vz: vz}, nil
+}
+
+// handleError reconnects to the cluster if err means the connection was lost
+// or the API key was rejected. The returned error is retryable if a new
+// connection was made.
+func (c *cluster) handleError(ctx context.Context, err error) error {
+	if c.executor != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	switch {
+	case isAuthError(err):
+		rotated, rerr := c.conn.Refresh(ctx, c.generation)
+		if rerr != nil {
+			logError("Error reloading Pixie API key.", "error", rerr)
+		}
+		if !rotated {
+			return err
+		}
+	case grpcCode(err) == codes.Unavailable:
+		logWarn("Lost connection to cluster, reconnecting.", "cluster", c.Name, "cluster_id", c.ID)
+	default:
+		return err
+	}
+	c.vz = nil
+	return &reconnectedError{err: err}
+}
+
+// clusterSource provides the clusters to run the PxL script against on each check.
+type clusterSource interface {
+	Clusters(ctx context.Context) ([]*cluster, error)
+}
+
+// staticClusters is a fixed list of clusters.
+type staticClusters []*cluster
+
+func (s staticClusters) Clusters(ctx context.Context) ([]*cluster, error) {
+	return s, nil
+}
+
+// combinedClusters checks the clusters of every source, such as clusters
+// queried through Pixie Cloud and directly.
+type combinedClusters []clusterSource
+
+func (s combinedClusters) Clusters(ctx context.Context) ([]*cluster, error) {
+	var all []*cluster
+	for _, src := range s {
+		clusters, err := src.Clusters(ctx)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, clusters...)
+	}
+	return all, nil
+}
+
+// connectClusters connects to each of the given cluster IDs.
+func connectClusters(ctx context.Context, conn *pixieConn, ids []string, labels clusterLabels) (staticClusters, error) {
+	client, _ := conn.Client()
+	names := make(map[string]string)
+	viziers, err := client.ListViziers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range viziers {
+		names[v.ID] = v.Name
+	}
+
+	var clusters staticClusters
+	for _, id := range ids {
+		name, ok := names[id]
+		if !ok {
+			logWarn("Could not get the name of cluster, using the ID instead.", "cluster_id", id)
+			name = id
+		}
+		c := newCluster(conn, id, name, labels)
+		if _, err := c.vizier(ctx); err != nil {
+			return nil, err
+		}
+		clusters = append(clusters, c)
+	}
+	return clusters, nil
+}
+
+// discoveredClusters lists the healthy clusters on the account on every
+// check, so newly connected clusters are picked up without a restart.
+type discoveredClusters struct {
+	conn *pixieConn
+	// Only clusters whose name matches filter are monitored.
+	filter *regexp.Regexp
+	labels clusterLabels
+	// Lists the clusters on the account instead of conn, such as in tests, or nil.
+	listViziers func(ctx context.Context) ([]*pxapi.VizierInfo, error)
+
+	mu sync.Mutex
+	// Clusters that have been seen before, keyed by ID.
+	known map[string]*cluster
+}
+
+func newDiscoveredClusters(conn *pixieConn, filter *regexp.Regexp, labels clusterLabels) *discoveredClusters {
+	return &discoveredClusters{
+		conn:   conn,
+		filter: filter,
+		labels: labels,
+		known:  make(map[string]*cluster),
+	}
+}
+
+func (d *discoveredClusters) Clusters(ctx context.Context) ([]*cluster, error) {
+	viziers, err := d.list(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var clusters []*cluster
+	for _, v := range viziers {
+		if v.Status != pxapi.VizierStatusHealthy || !d.filter.MatchString(v.Name) {
+			continue
+		}
+		c, ok := d.known[v.ID]
+		if !ok {
+			c = newCluster(d.conn, v.ID, v.Name, d.labels)
+			if _, err := c.vizier(ctx); err != nil {
+				logError("Error connecting to cluster.", "cluster", v.Name, "cluster_id", v.ID, "error", err)
+				continue
+			}
+			logInfo("Discovered cluster.", "cluster", v.Name, "cluster_id", v.ID)
+			d.known[v.ID] = c
+		}
+		// Names can change, along with the labels keyed by them. Checks still
+		// running may be reading the old cluster, so it's replaced rather than
+		// modified, keeping its connection.
+		if c.Name != v.Name {
+			renamed := newCluster(d.conn, v.ID, v.Name, d.labels)
+			c.mu.Lock()
+			renamed.vz, renamed.generation = c.vz, c.generation
+			c.mu.Unlock()
+			logInfo("Cluster was renamed.", "cluster", v.Name, "previous_name", c.Name, "cluster_id", v.ID)
+			c = renamed
+			d.known[v.ID] = c
+		}
+		clusters = append(clusters, c)
+	}
+	if len(clusters) == 0 {
+		return nil, fmt.Errorf("no healthy clusters matching %q found", d.filter)
+	}
+	return clusters, nil
+}
+
+// list lists the clusters on the account.
+func (d *discoveredClusters) list(ctx context.Context) ([]*pxapi.VizierInfo, error) {
+	if d.listViziers != nil {
+		return d.listViziers(ctx)
+	}
+	client, generation := d.conn.Client()
+	viziers, err := client.ListViziers(ctx)
+	if err != nil && isAuthError(err) {
+		// The API key may have been rotated since the last check.
+		if rotated, rerr := d.conn.Refresh(ctx, generation); rerr == nil && rotated {
+			client, _ = d.conn.Client()
+			viziers, err = client.ListViziers(ctx)
+		}
+	}
+	return viziers, err
+}
+
+// fallbackClusters maps clusters to standby clusters that a check runs
+// against instead once the primary cluster has failed a number of checks in
+// a row, so that a broken Vizier doesn't leave the rule blind.
+type fallbackClusters struct {
+	conn *pixieConn
+	// Number of failed checks in a row after which the standby is used.
+	after int
+	// Standby cluster IDs, keyed by primary cluster name or ID.
+	standbyIDs map[string]string
+	labels     clusterLabels
+
+	mu       sync.Mutex
+	standbys map[string]*cluster
+}
+
+func newFallbackClusters(conn *pixieConn, standbyIDs map[string]string, after int, labels clusterLabels) *fallbackClusters {
+	return &fallbackClusters{
+		conn:       conn,
+		after:      after,
+		standbyIDs: standbyIDs,
+		labels:     labels,
+		standbys:   make(map[string]*cluster),
+	}
+}
+
+// parseFallbackClusters parses a comma separated list of primary=standby
+// pairs, where the primary is a cluster name or ID and the standby is a
+// cluster ID, into standby IDs keyed by primary.
+func parseFallbackClusters(s string) (map[string]string, error) {
+	standbyIDs := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid fallback cluster %q, expected primary=standby", pair)
+		}
+		standbyIDs[parts[0]] = parts[1]
+	}
+	return standbyIDs, nil
+}
+
+// Standby returns the standby cluster for a primary cluster that has failed
+// the given number of checks in a row, or nil if there is none or it
+// shouldn't be used yet.
+func (f *fallbackClusters) Standby(ctx context.Context, primary Cluster, failures int) *cluster {
+	if f == nil || failures < f.after {
+		return nil
+	}
+	id, ok := f.standbyIDs[primary.ID]
+	if !ok {
+		if id, ok = f.standbyIDs[primary.Name]; !ok {
+			return nil
+		}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if c, ok := f.standbys[id]; ok {
+		return c
+	}
+	name := id
+	client, _ := f.conn.Client()
+	if info, err := client.GetVizierInfo(ctx, id); err == nil {
+		name = info.Name
+	} else {
+		logWarn("Could not get the name of standby cluster, using the ID instead.", "cluster_id", id, "error", err)
+	}
+	c := newCluster(f.conn, id, name, f.labels)
+	f.standbys[id] = c
+	return c
+}
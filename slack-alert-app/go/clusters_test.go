@@ -0,0 +1,105 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"regexp"
+	"sync"
+	"testing"
+
+	"go.withpixie.dev/pixie/src/api/go/pxapi"
+)
+
+// TestDiscoveredClustersRename renames a cluster back and forth while checks
+// read the cluster they were given, for go test -race to catch the rename
+// modifying a cluster that is in use.
+func TestDiscoveredClustersRename(t *testing.T) {
+	ctx := context.Background()
+	labels := clusterLabels{"prod-us": {"env": "prod"}, "prod-us-east": {"env": "prod", "region": "us-east-1"}}
+	var mu sync.Mutex
+	name := "prod-us"
+	d := newDiscoveredClusters(&pixieConn{}, regexp.MustCompile(""), labels)
+	d.listViziers = func(ctx context.Context) ([]*pxapi.VizierInfo, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return []*pxapi.VizierInfo{{ID: "c1", Name: name, Status: pxapi.VizierStatusHealthy}}, nil
+	}
+	// Already connected, so that listing doesn't connect to the cluster.
+	c := newCluster(d.conn, "c1", name, labels)
+	c.vz = &pxapi.VizierClient{}
+	d.known["c1"] = c
+
+	checks := make(chan *cluster)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for c := range checks {
+				// What a check reads: the cluster's name and labels for
+				// messages, and its connection.
+				_ = formatCluster(c.Cluster)
+				_ = c.Labels["region"]
+				if _, err := c.vizier(ctx); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	for i := 0; i < 200; i++ {
+		mu.Lock()
+		if i%2 == 0 {
+			name = "prod-us-east"
+		} else {
+			name = "prod-us"
+		}
+		want := name
+		mu.Unlock()
+		clusters, err := d.Clusters(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(clusters) != 1 || clusters[0].Name != want || clusters[0].Labels["env"] != "prod" {
+			t.Fatalf("got clusters %v, want %s", clusters, want)
+		}
+		if clusters[0].vz != c.vz {
+			t.Fatal("renamed cluster didn't keep its connection")
+		}
+		checks <- clusters[0]
+		checks <- clusters[0]
+	}
+	close(checks)
+	wg.Wait()
+}
+
+func TestFormatCluster(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		labels map[string]string
+		want   string
+	}{
+		{name: "prod-us", want: "`prod-us`"},
+		{name: "prod-us", labels: map[string]string{"region": "us-east-1", "env": "prod"}, want: "`prod-us` (`env=prod`, `region=us-east-1`)"},
+		{name: "<!channel>", labels: map[string]string{"<@U123>": "<!here>"}, want: "`&lt;!channel&gt;` (`&lt;@U123&gt;=&lt;!here&gt;`)"},
+		{name: "prod", labels: map[string]string{"team": "*on-call* & `ops`"}, want: "`prod` (`team=*on-call* &amp; 'ops'`)"},
+	} {
+		if got := formatCluster(Cluster{Name: tt.name, Labels: tt.labels}); got != tt.want {
+			t.Errorf("formatCluster(%q, %v) = %q, want %q", tt.name, tt.labels, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,1188 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Config is the bot's configuration. It starts with defaults, is overlaid with
+// the YAML config file given by -config or CONFIG_FILE, if any, then with
+// environment variables, so that a deployment can override individual
+// settings, and finally with the files in SecretsDir.
+type Config struct {
+	Pixie PixieConfig `yaml:"pixie"`
+	Slack SlackConfig `yaml:"slack"`
+	// The default rule, which is run if no other rules are configured. Any
+	// field other rules leave out is taken from it.
+	Defaults Rule `yaml:"defaults"`
+	// Rules to run instead of the default rule.
+	Rules []Rule `yaml:"rules"`
+	// Named alerters that rules can send their alerts to, keyed by name.
+	Alerters map[string]AlerterConfig `yaml:"alerters"`
+	// JSON file or directory of PxL scripts to load the rules from instead.
+	RulesFile string `yaml:"rulesFile"`
+	RulesDir  string `yaml:"rulesDir"`
+	// URL to fetch the rules file from instead, polled for changes.
+	RulesURL RulesURLConfig `yaml:"rulesURL"`
+	// Operator mode, where rules are PixieAlertRule custom resources.
+	RulesCRD RulesCRDConfig `yaml:"rulesCRD"`
+	Checks   ChecksConfig   `yaml:"checks"`
+	// Business hours, such as "Mon-Fri 09:00-17:00", in Timezone.
+	BusinessHours string        `yaml:"businessHours"`
+	Timezone      string        `yaml:"timezone"`
+	Reports       ReportsConfig `yaml:"reports"`
+	Redis         RedisConfig   `yaml:"redis"`
+	// JSON file to keep incident state in when Redis isn't used, such as on
+	// a PersistentVolume for check-once runs from a CronJob.
+	StateFile string `yaml:"stateFile"`
+	// Listen address for the HTTP API.
+	HTTPAddr string `yaml:"httpAddr"`
+	// Token that requests acknowledging or silencing incidents or running
+	// checks through the HTTP API must send as a bearer token, or empty to not
+	// require one.
+	APIToken string `yaml:"apiToken"`
+	// Listen address for the gRPC API, or empty to not serve it.
+	GRPCAddr string `yaml:"grpcAddr"`
+	// Listen address for pprof and the admin API, or empty to not serve them.
+	AdminAddr      string               `yaml:"adminAddr"`
+	LeaderElection LeaderElectionConfig `yaml:"leaderElection"`
+	// How long to wait for in-flight checks to finish when shutting down.
+	ShutdownTimeout duration `yaml:"shutdownTimeout"`
+	// Directory of a mounted Kubernetes secret to read the Pixie API key and
+	// Slack token from.
+	SecretsDir string `yaml:"secretsDir"`
+	// Vault to fetch the Pixie API key and Slack token from.
+	Vault VaultConfig `yaml:"vault"`
+	// Whether to log alerts instead of sending them.
+	DryRun bool `yaml:"dryRun"`
+	// Whether the command never connects to Pixie, such as simulate, so
+	// doesn't need an API key.
+	offline bool
+	// Directory to save the raw output of every check to, or empty.
+	RecordDir string `yaml:"recordDir"`
+	// Directory of recorded output to run checks against instead of Pixie, or empty.
+	ReplayDir string `yaml:"replayDir"`
+	// Directory of CSV and JSON tables to run checks against instead of
+	// Pixie, for development, or empty.
+	LocalDataDir string `yaml:"localDataDir"`
+	// Where to export traces of each check to, if anywhere.
+	Tracing TracingConfig `yaml:"tracing"`
+	Log     LogConfig     `yaml:"log"`
+	// Where to push the per-service stats of each check to, if anywhere.
+	RemoteWrite RemoteWriteConfig `yaml:"remoteWrite"`
+	OTLPMetrics OTLPMetricsConfig `yaml:"otlpMetrics"`
+	StatsD      StatsDConfig      `yaml:"statsd"`
+	Influx      InfluxConfig      `yaml:"influx"`
+	BigQuery    BigQueryConfig    `yaml:"bigquery"`
+	// Where to keep the raw output of every check, if anywhere.
+	Archive ArchiveConfig `yaml:"archive"`
+	// Where to annotate dashboards with incidents, if anywhere.
+	Grafana GrafanaConfig `yaml:"grafana"`
+	// Kubernetes Events for the incidents of the cluster the bot runs in.
+	KubeEvents KubeEventsConfig `yaml:"kubernetesEvents"`
+	// Messages and pings that show the bot is still running.
+	Heartbeat HeartbeatConfig `yaml:"heartbeat"`
+	// Named sets of settings, such as dev and prod, that override the rest
+	// of the config file when selected with -profile.
+	Profiles map[string]interface{} `yaml:"profiles"`
+
+	// Directory of the config file, which relative paths in it are resolved against.
+	dir string
+	// Secrets fetched from Vault, if configured.
+	vaultPixieKey   *vaultSecret
+	vaultSlackToken *vaultSecret
+}
+
+// PixieConfig configures the connection to Pixie and the clusters to monitor.
+type PixieConfig struct {
+	APIKey     string `yaml:"apiKey"`
+	APIKeyFile string `yaml:"apiKeyFile"`
+	// Address of a self-hosted Pixie Cloud.
+	CloudAddr string `yaml:"cloudAddr"`
+	// IDs of the clusters to monitor. If empty, or "all", clusters are discovered.
+	Clusters          []string          `yaml:"clusters"`
+	ClusterNameFilter string            `yaml:"clusterNameFilter"`
+	ClusterLabels     clusterLabels     `yaml:"clusterLabels"`
+	FallbackClusters  map[string]string `yaml:"fallbackClusters"`
+	FallbackAfter     int               `yaml:"fallbackAfter"`
+	// Clusters whose Vizier is queried directly instead of through Pixie
+	// Cloud. Clusters are only discovered along with them if clusters is "all".
+	DirectClusters []DirectClusterConfig `yaml:"directClusters"`
+}
+
+// SlackConfig configures the Slack alerter.
+type SlackConfig struct {
+	Token     string `yaml:"token"`
+	TokenFile string `yaml:"tokenFile"`
+	// Signing secret of the Slack app, to verify that slash commands come
+	// from Slack. Slash commands aren't served without it.
+	SigningSecret string `yaml:"signingSecret"`
+}
+
+// LeaderElectionConfig configures electing a single replica to run checks
+// with a Kubernetes Lease.
+type LeaderElectionConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	Lease   string `yaml:"lease"`
+	// Defaults to the pod name.
+	Identity string   `yaml:"identity"`
+	Duration duration `yaml:"duration"`
+}
+
+// HeartbeatConfig configures the heartbeat.
+type HeartbeatConfig struct {
+	// Cron expression for when to post a message that the bot is alive,
+	// such as "0 9 * * *", in Timezone.
+	Schedule string `yaml:"schedule"`
+	// Name of the alerter to post the message to. Defaults to the default
+	// rule's channel.
+	Alerter string `yaml:"alerter"`
+	// Post an all-clear message on the schedule instead, saying every rule
+	// has been checked since the previous one and no incidents are open, or
+	// which rules haven't been. Nothing is posted while incidents are open.
+	AllClear bool `yaml:"allClear"`
+	// URL of a dead man's switch, such as a Healthchecks.io check, to ping
+	// every Interval while the bot is ready.
+	URL      string   `yaml:"url"`
+	Interval duration `yaml:"interval"`
+}
+
+// LogConfig configures the bot's logs.
+type LogConfig struct {
+	// Lowest level logged: debug, info, warn or error.
+	Level string `yaml:"level"`
+	// Either text or json.
+	Format string `yaml:"format"`
+}
+
+// TracingConfig configures exporting traces to an OpenTelemetry collector.
+type TracingConfig struct {
+	// Base URL of the collector's OTLP/HTTP endpoint, such as
+	// http://otel-collector:4318. Tracing is off if empty.
+	Endpoint string `yaml:"endpoint"`
+	// Headers to send with each export, such as an API key.
+	Headers     map[string]string `yaml:"headers"`
+	ServiceName string            `yaml:"serviceName"`
+}
+
+// RemoteWriteConfig configures pushing per-service stats to a Prometheus
+// remote-write endpoint.
+type RemoteWriteConfig struct {
+	// URL of the endpoint, such as http://prometheus:9090/api/v1/write.
+	// Stats aren't pushed if empty.
+	URL string `yaml:"url"`
+	// Headers to send with each request, such as Authorization.
+	Headers map[string]string `yaml:"headers"`
+}
+
+// OTLPMetricsConfig configures sending per-service stats to an OpenTelemetry
+// collector as metrics.
+type OTLPMetricsConfig struct {
+	// URL of the collector's OTLP/HTTP metrics endpoint, such as
+	// http://otel-collector:4318/v1/metrics. Metrics aren't sent if empty.
+	Endpoint string `yaml:"endpoint"`
+	// Headers to send with each export, such as an API key.
+	Headers map[string]string `yaml:"headers"`
+}
+
+// StatsDConfig configures sending per-service stats to a StatsD or DogStatsD server.
+type StatsDConfig struct {
+	// Address of the server, such as localhost:8125. Stats aren't sent if empty.
+	Addr string `yaml:"addr"`
+	// Prefix of every metric name, such as "pixie.".
+	Prefix string `yaml:"prefix"`
+	// Either dogstatsd, to send tags, or statsd, to append them to the metric name.
+	Format string `yaml:"format"`
+}
+
+// InfluxConfig configures writing per-service stats to InfluxDB, or any
+// other endpoint that accepts the line protocol.
+type InfluxConfig struct {
+	// Write URL, such as
+	// http://influxdb:8086/api/v2/write?org=example&bucket=pixie for
+	// InfluxDB 2 or http://influxdb:8086/write?db=pixie for InfluxDB 1.
+	// Stats aren't written if empty.
+	URL string `yaml:"url"`
+	// API token, sent as "Authorization: Token <token>".
+	Token string `yaml:"token"`
+	// Measurement of the per-service points.
+	Measurement string `yaml:"measurement"`
+}
+
+// BigQueryConfig configures archiving incidents and per-service stats in BigQuery.
+type BigQueryConfig struct {
+	// GCP project of the dataset. Nothing is archived if empty.
+	Project string `yaml:"project"`
+	Dataset string `yaml:"dataset"`
+	// Table for every change to an incident, or empty to not archive them.
+	IncidentsTable string `yaml:"incidentsTable"`
+	// Table for the stats of every service from each check, or empty to not archive them.
+	StatsTable string `yaml:"statsTable"`
+}
+
+// ArchiveConfig configures archiving the raw output table of every check in object storage.
+type ArchiveConfig struct {
+	// Bucket and prefix to archive to, such as s3://bucket/pixie or
+	// gs://bucket/pixie. Results aren't archived if empty.
+	URL string `yaml:"url"`
+	// AWS region of an S3 bucket. Defaults to AWS_REGION.
+	Region string `yaml:"region"`
+}
+
+// GrafanaConfig configures annotating Grafana dashboards with incidents.
+type GrafanaConfig struct {
+	// Base URL of Grafana, such as https://grafana.example.com. Incidents
+	// aren't annotated if empty.
+	URL string `yaml:"url"`
+	// Service account token with permission to write annotations.
+	Token string `yaml:"token"`
+	// UID of the dashboard to annotate, or empty for organization wide
+	// annotations that dashboards can show by querying their tags.
+	DashboardUID string `yaml:"dashboardUID"`
+}
+
+// RulesURLConfig configures fetching the rules file from a URL.
+type RulesURLConfig struct {
+	// HTTP(S) URL of a file in the format of RulesFile, or empty.
+	URL string `yaml:"url"`
+	// Headers to send, such as for authentication.
+	Headers map[string]string `yaml:"headers"`
+	// Base64 encoded Ed25519 public key that the file's signature, at URL
+	// with .sig appended, must verify with. The signature isn't checked if empty.
+	PublicKey string `yaml:"publicKey"`
+	// How often to check the file for changes.
+	PollInterval duration `yaml:"pollInterval"`
+}
+
+// RulesCRDConfig configures reading rules from PixieAlertRule custom resources.
+type RulesCRDConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Namespace to watch for PixieAlertRules, or empty for every namespace.
+	Namespace string `yaml:"namespace"`
+}
+
+// KubeEventsConfig configures creating Kubernetes Events for incidents.
+type KubeEventsConfig struct {
+	// Name or ID of the Pixie cluster the bot runs in, whose incidents get
+	// Events. No Events are created if empty.
+	Cluster string `yaml:"cluster"`
+	// Whether to also annotate each incident's Service with its ID while open.
+	Annotate bool `yaml:"annotate"`
+}
+
+// AlerterConfig configures a named alerter.
+type AlerterConfig struct {
+	// Kind of alerter. Only "slack" is supported, which is the default.
+	Type string `yaml:"type"`
+	// Slack channel to post to.
+	Channel string `yaml:"channel"`
+}
+
+// VaultConfig configures fetching secrets from HashiCorp Vault. Secrets are
+// given as path#key, such as secret/data/slackbot#slack-bot-token.
+type VaultConfig struct {
+	Addr string `yaml:"addr"`
+	// Role to log in as with the Kubernetes auth method mounted at AuthPath.
+	Role     string `yaml:"role"`
+	AuthPath string `yaml:"authPath"`
+	// Token to use instead of logging in, such as for local development.
+	Token       string `yaml:"token"`
+	PixieAPIKey string `yaml:"pixieApiKey"`
+	SlackToken  string `yaml:"slackToken"`
+}
+
+// ChecksConfig configures how checks query clusters.
+type ChecksConfig struct {
+	// Maximum number of cluster queries running at the same time, across all rules.
+	Workers             int `yaml:"workers"`
+	MaxParallelClusters int `yaml:"maxParallelClusters"`
+	Attempts            int `yaml:"attempts"`
+	// Alert after this many failed checks in a row on a cluster, or 0 to never alert.
+	FailureAlertAfter int `yaml:"failureAlertAfter"`
+	// Alert when more than this fraction (0-1) of a query's records
+	// couldn't be decoded, or 0 to never alert.
+	MalformedAlertRate float64 `yaml:"malformedAlertRate"`
+	Preflight          bool    `yaml:"preflight"`
+	// Send an alert that the bot itself is unhealthy once a rule has failed
+	// this many checks in a row on every cluster, and back off its checks,
+	// or 0 to do neither.
+	UnhealthyAfter int `yaml:"unhealthyAfter"`
+	// Name of the alerter to send unhealthy alerts to. Defaults to the
+	// default rule's channel.
+	UnhealthyAlerter string `yaml:"unhealthyAlerter"`
+	// Longest time between the checks of an unhealthy rule.
+	MaxBackoff duration `yaml:"maxBackoff"`
+	// Most messages sent per hour across all rules, or 0 for no limit.
+	AlertBudget int `yaml:"alertBudget"`
+	// How often messages held back by the budget are summarized.
+	OverflowSummaryEvery duration `yaml:"overflowSummaryEvery"`
+	// What to do when checks weren't run when due, because the previous
+	// check overran or the process was suspended: catch-up runs a check right
+	// away, querying the time since the previous check, and skip waits for
+	// the next check that is still to come.
+	MissedTicks string `yaml:"missedTicks"`
+}
+
+// ReportsConfig configures where post-incident reports are published.
+type ReportsConfig struct {
+	Channel string `yaml:"channel"`
+	Dir     string `yaml:"dir"`
+}
+
+// RedisConfig configures the shared incident state.
+type RedisConfig struct {
+	URL       string `yaml:"url"`
+	KeyPrefix string `yaml:"keyPrefix"`
+}
+
+// defaultConfig returns the configuration used when nothing is set.
+func defaultConfig() *Config {
+	return &Config{
+		// The default rule runs a PxL script that ouputs a table of the HTTP total
+		// requests count and HTTP error (>4xxx) count for each service in the
+		// monitored namespace. The namespace, time window and threshold are filled
+		// in on each run. To deploy the px-sock-shop demo, see:
+		// https://docs.pixielabs.ai/tutorials/slackbot-alert for how to
+		Defaults: Rule{
+			Name:              "http-errors",
+			Table:             "http_table",
+			Problem:           "4xx+ errors",
+			Namespaces:        []string{"px-sock-shop"},
+			Threshold:         0.1,
+			CriticalThreshold: 0.5,
+			Interval:          duration{5 * time.Minute},
+			Timeout:           duration{time.Minute},
+			// Slack channel for Slackbot to post in.
+			// Slack App must be a member of this channel.
+			Channel: "#pixie-alerts",
+		},
+		Checks: ChecksConfig{
+			Workers:              8,
+			MaxParallelClusters:  4,
+			Attempts:             3,
+			Preflight:            true,
+			UnhealthyAfter:       5,
+			MaxBackoff:           duration{30 * time.Minute},
+			OverflowSummaryEvery: duration{15 * time.Minute},
+			MissedTicks:          missedTicksCatchUp,
+		},
+		Pixie: PixieConfig{
+			FallbackAfter: 3,
+		},
+		Redis: RedisConfig{
+			KeyPrefix: "pixie-alerts",
+		},
+		HTTPAddr: ":8080",
+		// Kubernetes kills pods 30s after asking them to stop by default.
+		ShutdownTimeout: duration{25 * time.Second},
+		RulesURL: RulesURLConfig{
+			PollInterval: duration{time.Minute},
+		},
+		LeaderElection: LeaderElectionConfig{
+			Lease:    "pixie-slackbot",
+			Duration: duration{15 * time.Second},
+		},
+		Vault: VaultConfig{
+			AuthPath: "kubernetes",
+		},
+		Tracing: TracingConfig{
+			ServiceName: "pixie-slackbot",
+		},
+		Heartbeat: HeartbeatConfig{
+			Interval: duration{time.Minute},
+		},
+		BigQuery: BigQueryConfig{
+			IncidentsTable: "incidents",
+			StatsTable:     "service_stats",
+		},
+		Influx: InfluxConfig{
+			Measurement: "pixie_service",
+		},
+		StatsD: StatsDConfig{
+			Prefix: "pixie.",
+			Format: statsdFormatDogStatsD,
+		},
+		Log: LogConfig{
+			Level:  "info",
+			Format: "text",
+		},
+	}
+}
+
+// loadConfig returns the configuration from the config file at path, if
+// not empty, with the given profile, if any, and the environment. The
+// overrides, such as from command line flags, are applied last, before the
+// config is validated.
+func loadConfig(path, profile string, overrides ...func(*Config)) (*Config, error) {
+	c := defaultConfig()
+	if path != "" {
+		if err := c.loadFile(path, profile); err != nil {
+			return nil, err
+		}
+	} else if profile != "" {
+		return nil, fmt.Errorf("profile %s selected, but there is no config file to load it from", profile)
+	}
+	// Collect every problem, so that they can all be fixed at once.
+	errs := &ConfigError{}
+	c.loadEnv(errs)
+	if err := c.loadSecrets(); err != nil {
+		errs.add(err.Error())
+	}
+	for _, override := range overrides {
+		override(c)
+	}
+	c.validate(errs)
+	if len(errs.Problems) > 0 {
+		return nil, errs
+	}
+	return c, nil
+}
+
+// ConfigError lists every problem found while loading the config.
+type ConfigError struct {
+	Problems []string
+}
+
+func (e *ConfigError) Error() string {
+	if len(e.Problems) == 1 {
+		return "invalid config: " + e.Problems[0]
+	}
+	return "invalid config:\n  - " + strings.Join(e.Problems, "\n  - ")
+}
+
+func (e *ConfigError) add(format string, args ...interface{}) {
+	e.Problems = append(e.Problems, fmt.Sprintf(format, args...))
+}
+
+// validate adds the problems with the loaded config to errs.
+func (c *Config) validate(errs *ConfigError) {
+	// Replayed checks and checks of local data don't connect to Pixie.
+	if c.Pixie.APIKey == "" && c.Pixie.APIKeyFile == "" && c.Vault.PixieAPIKey == "" && c.ReplayDir == "" && c.LocalDataDir == "" && !c.offline {
+		errs.add("Please set PIXIE_API_KEY or PIXIE_API_KEY_FILE environment variable, or pixie.apiKey in the config file.")
+	}
+	// Dry runs log messages instead of sending them.
+	if c.Slack.Token == "" && !c.DryRun {
+		errs.add("Please set SLACK_BOT_TOKEN or SLACK_BOT_TOKEN_FILE environment variable, or slack.token in the config file.")
+	}
+	if _, err := regexp.Compile(c.Pixie.ClusterNameFilter); err != nil {
+		errs.add("PIXIE_CLUSTER_NAME_FILTER must be a regular expression, such as ^prod-: %v", err)
+	}
+	if c.Timezone != "" {
+		if _, err := time.LoadLocation(c.Timezone); err != nil {
+			errs.add("TIMEZONE must be a timezone, such as America/Los_Angeles: %v", err)
+		}
+	}
+	if c.BusinessHours != "" {
+		if _, err := parseBusinessHours(c.BusinessHours, time.UTC); err != nil {
+			errs.add("BUSINESS_HOURS must be days and hours, such as Mon-Fri 09:00-17:00: %v", err)
+		}
+	}
+	if _, err := parseLogLevel(c.Log.Level); err != nil {
+		errs.add("LOG_LEVEL must be debug, info, warn or error, not %q.", c.Log.Level)
+	}
+	if c.Log.Format != "text" && c.Log.Format != "json" {
+		errs.add("LOG_FORMAT must be text or json, not %q.", c.Log.Format)
+	}
+	if c.BigQuery.Project != "" && c.BigQuery.Dataset == "" {
+		errs.add("BIGQUERY_DATASET must be set along with BIGQUERY_PROJECT.")
+	}
+	if u := c.RulesURL.URL; u != "" && !strings.HasPrefix(u, "https://") && !strings.HasPrefix(u, "http://") {
+		errs.add("RULES_URL must be an http or https URL, not %q.", u)
+	}
+	if c.RulesURL.PublicKey != "" {
+		if _, err := parsePublicKey(c.RulesURL.PublicKey); err != nil {
+			errs.add("RULES_URL_PUBLIC_KEY must be a base64 encoded Ed25519 public key.")
+		}
+	}
+	ids := make(map[string]bool)
+	for i, d := range c.Pixie.DirectClusters {
+		if d.Name == "" || d.Addr == "" {
+			errs.add("pixie.directClusters[%d] must have a name and an addr.", i)
+		}
+		if d.Insecure && (d.CAFile != "" || d.InsecureSkipVerify) {
+			errs.add("pixie.directClusters[%d] can't set caFile or insecureSkipVerify without TLS.", i)
+		}
+		id := d.ID
+		if id == "" {
+			id = d.Name
+		}
+		if ids[id] {
+			errs.add("pixie.directClusters has more than one cluster with the ID %q.", id)
+		}
+		ids[id] = true
+	}
+	if c.ReplayDir != "" && c.LocalDataDir != "" {
+		errs.add("REPLAY_DIR and LOCAL_DATA_DIR can't both be set.")
+	}
+	if c.StatsD.Format != statsdFormatDogStatsD && c.StatsD.Format != statsdFormatStatsD {
+		errs.add("STATSD_FORMAT must be dogstatsd or statsd, not %q.", c.StatsD.Format)
+	}
+
+	positive := []struct {
+		name string
+		v    int
+	}{
+		{"checks.workers", c.Checks.Workers},
+		{"checks.maxParallelClusters", c.Checks.MaxParallelClusters},
+		{"checks.attempts", c.Checks.Attempts},
+		{"pixie.fallbackAfter", c.Pixie.FallbackAfter},
+	}
+	for _, e := range positive {
+		if e.v < 1 {
+			errs.add("%s must be a positive integer.", e.name)
+		}
+	}
+	if c.Checks.FailureAlertAfter < 0 {
+		errs.add("checks.failureAlertAfter must be a positive integer, or 0 to never alert.")
+	}
+	if c.Checks.MalformedAlertRate < 0 || c.Checks.MalformedAlertRate > 1 {
+		errs.add("checks.malformedAlertRate must be a number between 0 and 1, or 0 to never alert.")
+	}
+	if c.Checks.MissedTicks != missedTicksCatchUp && c.Checks.MissedTicks != missedTicksSkip {
+		errs.add("MISSED_TICKS must be catch-up or skip, not %q.", c.Checks.MissedTicks)
+	}
+	if c.Heartbeat.Schedule != "" {
+		if _, err := parseCron(c.Heartbeat.Schedule, time.UTC); err != nil {
+			errs.add("HEARTBEAT_SCHEDULE must be a cron expression, such as 0 9 * * *: %v", err)
+		}
+	}
+	if name := c.Heartbeat.Alerter; name != "" {
+		if _, ok := c.Alerters[name]; !ok {
+			errs.add("heartbeat.alerter is %q, which isn't one of the alerters.", name)
+		}
+	}
+	if c.Checks.AlertBudget < 0 {
+		errs.add("checks.alertBudget must be a positive integer, or 0 for no limit.")
+	}
+	if c.Checks.UnhealthyAfter < 0 {
+		errs.add("checks.unhealthyAfter must be a positive integer, or 0 to never alert.")
+	}
+	if name := c.Checks.UnhealthyAlerter; name != "" {
+		if _, ok := c.Alerters[name]; !ok {
+			errs.add("checks.unhealthyAlerter is %q, which isn't one of the alerters.", name)
+		}
+	}
+	for _, e := range []struct {
+		name string
+		v    float64
+	}{
+		{"defaults.threshold", c.Defaults.Threshold},
+		{"defaults.criticalThreshold", c.Defaults.CriticalThreshold},
+	} {
+		if e.v < 0 || e.v > 1 {
+			errs.add("%s must be a number between 0 and 1.", e.name)
+		}
+	}
+
+	for _, name := range sortedAlerterNames(c.Alerters) {
+		a := c.Alerters[name]
+		switch a.Type {
+		case "", "slack":
+			if a.Channel == "" {
+				errs.add("alerters.%s.channel must be a Slack channel, such as \"#pixie-alerts\".", name)
+			}
+		default:
+			errs.add("alerters.%s.type must be slack, not %q.", name, a.Type)
+		}
+	}
+}
+
+func sortedAlerterNames(alerters map[string]AlerterConfig) []string {
+	names := make([]string, 0, len(alerters))
+	for name := range alerters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// loadFile overlays c with the YAML config file at path, which may be
+// encrypted, and then with the settings of the given profile in it, if not empty. Environment variables
+// in the file, such as ${SLACK_BOT_TOKEN} or ${REGION:-us-east-1}, are
+// replaced with their values.
+func (c *Config) loadFile(path, profile string) error {
+	b, err := readConfigFile(path)
+	if err != nil {
+		return err
+	}
+	if err := yaml.UnmarshalStrict([]byte(expandEnv(string(b))), c); err != nil {
+		return fmt.Errorf("parsing %s: %w", path, err)
+	}
+	if profile != "" {
+		p, ok := c.Profiles[profile]
+		if !ok {
+			return fmt.Errorf("%s has no profile %q, it has: %s", path, profile, strings.Join(c.profileNames(), ", "))
+		}
+		// Decoding the profile's settings into c only overrides the settings
+		// that the profile sets.
+		pb, err := yaml.Marshal(p)
+		if err != nil {
+			return err
+		}
+		if err := yaml.UnmarshalStrict(pb, c); err != nil {
+			return fmt.Errorf("parsing profile %s in %s: %w", profile, path, err)
+		}
+	}
+	c.dir = filepath.Dir(path)
+	c.Defaults.Script = c.resolve(c.Defaults.Script)
+	c.RulesFile = c.resolve(c.RulesFile)
+	c.RulesDir = c.resolve(c.RulesDir)
+	c.RecordDir = c.resolve(c.RecordDir)
+	c.ReplayDir = c.resolve(c.ReplayDir)
+	c.LocalDataDir = c.resolve(c.LocalDataDir)
+	c.Pixie.APIKeyFile = c.resolve(c.Pixie.APIKeyFile)
+	for i := range c.Pixie.DirectClusters {
+		c.Pixie.DirectClusters[i].CAFile = c.resolve(c.Pixie.DirectClusters[i].CAFile)
+	}
+	c.Reports.Dir = c.resolve(c.Reports.Dir)
+	c.Slack.TokenFile = c.resolve(c.Slack.TokenFile)
+	c.SecretsDir = c.resolve(c.SecretsDir)
+	c.StateFile = c.resolve(c.StateFile)
+	return nil
+}
+
+func (c *Config) profileNames() []string {
+	names := make([]string, 0, len(c.Profiles))
+	for name := range c.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// resolve returns path relative to the config file's directory.
+func (c *Config) resolve(path string) string {
+	if path == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(c.dir, path)
+}
+
+// expandEnv replaces ${VAR} in s with the value of the environment variable,
+// and ${VAR:-default} with default if the variable is unset or empty. $$ is
+// replaced with $, so that a literal ${VAR} can be written as $${VAR}. Any
+// other $, such as in a password or a bcrypt hash, is left as is.
+func expandEnv(s string) string {
+	var b strings.Builder
+	for {
+		i := strings.IndexByte(s, '$')
+		if i < 0 || i == len(s)-1 {
+			b.WriteString(s)
+			return b.String()
+		}
+		b.WriteString(s[:i])
+		s = s[i:]
+		if s[1] == '$' {
+			b.WriteByte('$')
+			s = s[2:]
+			continue
+		}
+		end := strings.IndexByte(s, '}')
+		if s[1] != '{' || end < 0 {
+			b.WriteByte('$')
+			s = s[1:]
+			continue
+		}
+		name, def, hasDef := s[2:end], "", false
+		if j := strings.Index(name, ":-"); j >= 0 {
+			name, def, hasDef = name[:j], name[j+2:], true
+		}
+		if !isEnvName(name) {
+			b.WriteByte('$')
+			s = s[1:]
+			continue
+		}
+		v := os.Getenv(name)
+		if v == "" && hasDef {
+			v = def
+		}
+		b.WriteString(v)
+		s = s[end+1:]
+	}
+}
+
+// isEnvName returns whether s is a valid environment variable name.
+func isEnvName(s string) bool {
+	for i, r := range s {
+		if r != '_' && !(r >= 'A' && r <= 'Z') && !(r >= 'a' && r <= 'z') && !(i > 0 && r >= '0' && r <= '9') {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// loadEnv overlays c with the environment variables that are set, adding
+// the ones with invalid values to errs.
+func (c *Config) loadEnv(errs *ConfigError) {
+	// For directions on how to find these config values, see:
+	// https://docs.pixielabs.ai/tutorials/slackbot-alert
+	envString("PIXIE_API_KEY", &c.Pixie.APIKey)
+	envString("PIXIE_API_KEY_FILE", &c.Pixie.APIKeyFile)
+	envString("PIXIE_CLOUD_ADDR", &c.Pixie.CloudAddr)
+	// Either a single cluster ID or a comma separated list of cluster IDs.
+	envList("PIXIE_CLUSTER_ID", &c.Pixie.Clusters)
+	envString("PIXIE_CLUSTER_NAME_FILTER", &c.Pixie.ClusterNameFilter)
+	if s, ok := os.LookupEnv("PIXIE_CLUSTER_LABELS"); ok {
+		labels, err := parseClusterLabels(s)
+		if err != nil {
+			errs.add("PIXIE_CLUSTER_LABELS must be JSON, such as {\"prod-us\": {\"env\": \"prod\"}}: %v", err)
+		}
+		c.Pixie.ClusterLabels = labels
+	}
+	if s, ok := os.LookupEnv("PIXIE_FALLBACK_CLUSTERS"); ok {
+		standbys, err := parseFallbackClusters(s)
+		if err != nil {
+			errs.add("PIXIE_FALLBACK_CLUSTERS must be a comma separated list of primary=standby pairs: %v", err)
+		}
+		c.Pixie.FallbackClusters = standbys
+	}
+	envString("SLACK_BOT_TOKEN", &c.Slack.Token)
+	envString("SLACK_BOT_TOKEN_FILE", &c.Slack.TokenFile)
+	envString("SLACK_SIGNING_SECRET", &c.Slack.SigningSecret)
+	envString("SECRETS_DIR", &c.SecretsDir)
+	envString("STATE_FILE", &c.StateFile)
+	envString("ADMIN_ADDR", &c.AdminAddr)
+	envString("API_TOKEN", &c.APIToken)
+	envString("VAULT_ADDR", &c.Vault.Addr)
+	envString("VAULT_ROLE", &c.Vault.Role)
+	envString("VAULT_AUTH_PATH", &c.Vault.AuthPath)
+	envString("VAULT_TOKEN", &c.Vault.Token)
+	envString("VAULT_PIXIE_API_KEY", &c.Vault.PixieAPIKey)
+	envString("VAULT_SLACK_TOKEN", &c.Vault.SlackToken)
+	if s, ok := os.LookupEnv("LEADER_ELECTION"); ok {
+		c.LeaderElection.Enabled = s == "true"
+	}
+	envString("LEADER_ELECTION_LEASE", &c.LeaderElection.Lease)
+	envString("POD_NAME", &c.LeaderElection.Identity)
+	if s, ok := os.LookupEnv("DRY_RUN"); ok {
+		c.DryRun = s == "true"
+	}
+	envString("LOG_LEVEL", &c.Log.Level)
+	envString("LOG_FORMAT", &c.Log.Format)
+	envString("OTEL_EXPORTER_OTLP_ENDPOINT", &c.Tracing.Endpoint)
+	envString("OTEL_SERVICE_NAME", &c.Tracing.ServiceName)
+	if s, ok := os.LookupEnv("OTEL_EXPORTER_OTLP_HEADERS"); ok {
+		headers, err := parseOTLPHeaders(s)
+		if err != nil {
+			errs.add("OTEL_EXPORTER_OTLP_HEADERS must be a comma separated list of key=value pairs: %v", err)
+		}
+		c.Tracing.Headers = headers
+	}
+	envString("OTEL_EXPORTER_OTLP_METRICS_ENDPOINT", &c.OTLPMetrics.Endpoint)
+	if s, ok := os.LookupEnv("OTEL_EXPORTER_OTLP_METRICS_HEADERS"); ok {
+		headers, err := parseOTLPHeaders(s)
+		if err != nil {
+			errs.add("OTEL_EXPORTER_OTLP_METRICS_HEADERS must be a comma separated list of key=value pairs: %v", err)
+		}
+		c.OTLPMetrics.Headers = headers
+	}
+	// Like other OpenTelemetry SDKs, OTEL_METRICS_EXPORTER=otlp sends metrics
+	// to the same collector as traces unless a metrics endpoint is given.
+	if os.Getenv("OTEL_METRICS_EXPORTER") == "otlp" && c.OTLPMetrics.Endpoint == "" && c.Tracing.Endpoint != "" {
+		c.OTLPMetrics.Endpoint = strings.TrimSuffix(c.Tracing.Endpoint, "/") + "/v1/metrics"
+		if c.OTLPMetrics.Headers == nil {
+			c.OTLPMetrics.Headers = c.Tracing.Headers
+		}
+	}
+	envString("GRAFANA_URL", &c.Grafana.URL)
+	envString("GRAFANA_TOKEN", &c.Grafana.Token)
+	envString("GRAFANA_DASHBOARD_UID", &c.Grafana.DashboardUID)
+	envString("KUBERNETES_EVENTS_CLUSTER", &c.KubeEvents.Cluster)
+	if s := os.Getenv("KUBERNETES_EVENTS_ANNOTATE"); s != "" {
+		c.KubeEvents.Annotate = s == "true"
+	}
+	envString("ARCHIVE_URL", &c.Archive.URL)
+	envString("ARCHIVE_REGION", &c.Archive.Region)
+	envString("BIGQUERY_PROJECT", &c.BigQuery.Project)
+	envString("BIGQUERY_DATASET", &c.BigQuery.Dataset)
+	envString("BIGQUERY_INCIDENTS_TABLE", &c.BigQuery.IncidentsTable)
+	envString("BIGQUERY_STATS_TABLE", &c.BigQuery.StatsTable)
+	envString("INFLUX_URL", &c.Influx.URL)
+	envString("INFLUX_TOKEN", &c.Influx.Token)
+	envString("INFLUX_MEASUREMENT", &c.Influx.Measurement)
+	envString("STATSD_ADDR", &c.StatsD.Addr)
+	envString("STATSD_PREFIX", &c.StatsD.Prefix)
+	envString("STATSD_FORMAT", &c.StatsD.Format)
+	envString("PROMETHEUS_REMOTE_WRITE_URL", &c.RemoteWrite.URL)
+	if s, ok := os.LookupEnv("PROMETHEUS_REMOTE_WRITE_HEADERS"); ok {
+		headers, err := parseOTLPHeaders(s)
+		if err != nil {
+			errs.add("PROMETHEUS_REMOTE_WRITE_HEADERS must be a comma separated list of key=value pairs: %v", err)
+		}
+		c.RemoteWrite.Headers = headers
+	}
+
+	// Namespaces to monitor, as a comma separated list, or "all".
+	envList("PIXIE_NAMESPACE", &c.Defaults.Namespaces)
+	envList("PIXIE_EXCLUDE_NAMESPACES", &c.Defaults.ExcludeNamespaces)
+	// Stream HTTP requests instead of polling, for lower alert latency.
+	if s, ok := os.LookupEnv("STREAMING"); ok {
+		c.Defaults.Streaming = s == "true"
+	}
+	if s, ok := os.LookupEnv("PREFLIGHT"); ok {
+		c.Checks.Preflight = s != "false"
+	}
+	envString("RULES_FILE", &c.RulesFile)
+	envString("RULES_DIR", &c.RulesDir)
+	if s := os.Getenv("RULES_CRD"); s != "" {
+		c.RulesCRD.Enabled = s == "true"
+	}
+	envString("RULES_CRD_NAMESPACE", &c.RulesCRD.Namespace)
+	envString("RECORD_DIR", &c.RecordDir)
+	envString("REPLAY_DIR", &c.ReplayDir)
+	envString("LOCAL_DATA_DIR", &c.LocalDataDir)
+	envString("RULES_URL", &c.RulesURL.URL)
+	envString("RULES_URL_PUBLIC_KEY", &c.RulesURL.PublicKey)
+	if s, ok := os.LookupEnv("RULES_URL_HEADERS"); ok {
+		headers, err := parseOTLPHeaders(s)
+		if err != nil {
+			errs.add("RULES_URL_HEADERS must be a comma separated list of key=value pairs: %v", err)
+		}
+		c.RulesURL.Headers = headers
+	}
+	envString("BUSINESS_HOURS", &c.BusinessHours)
+	envString("TIMEZONE", &c.Timezone)
+	envString("REPORT_CHANNEL", &c.Reports.Channel)
+	envString("REPORT_DIR", &c.Reports.Dir)
+	envString("REDIS_URL", &c.Redis.URL)
+	envString("REDIS_KEY_PREFIX", &c.Redis.KeyPrefix)
+	envString("HTTP_ADDR", &c.HTTPAddr)
+	envString("GRPC_ADDR", &c.GRPCAddr)
+
+	ints := []struct {
+		name string
+		v    *int
+	}{
+		{"CHECK_WORKERS", &c.Checks.Workers},
+		{"MAX_PARALLEL_CLUSTERS", &c.Checks.MaxParallelClusters},
+		{"QUERY_ATTEMPTS", &c.Checks.Attempts},
+		{"FALLBACK_AFTER", &c.Pixie.FallbackAfter},
+	}
+	for _, e := range ints {
+		if s, ok := os.LookupEnv(e.name); ok {
+			v, err := strconv.Atoi(s)
+			if err != nil || v < 1 {
+				errs.add("%s must be a positive integer, not %q.", e.name, s)
+				continue
+			}
+			*e.v = v
+		}
+	}
+	// Counts where 0 turns the feature off.
+	counts := []struct {
+		name, zero string
+		v          *int
+	}{
+		{"QUERY_FAILURE_ALERT_AFTER", "to never alert", &c.Checks.FailureAlertAfter},
+		{"UNHEALTHY_ALERT_AFTER", "to never alert", &c.Checks.UnhealthyAfter},
+		{"ALERT_BUDGET", "for no limit", &c.Checks.AlertBudget},
+	}
+	for _, e := range counts {
+		if s, ok := os.LookupEnv(e.name); ok {
+			v, err := strconv.Atoi(s)
+			if err != nil || v < 0 {
+				errs.add("%s must be a positive integer, or 0 %s, not %q.", e.name, e.zero, s)
+				continue
+			}
+			*e.v = v
+		}
+	}
+	envString("UNHEALTHY_ALERTER", &c.Checks.UnhealthyAlerter)
+	envString("MISSED_TICKS", &c.Checks.MissedTicks)
+	envString("HEARTBEAT_SCHEDULE", &c.Heartbeat.Schedule)
+	envString("HEARTBEAT_ALERTER", &c.Heartbeat.Alerter)
+	if s := os.Getenv("HEARTBEAT_ALL_CLEAR"); s != "" {
+		c.Heartbeat.AllClear = s == "true"
+	}
+	envString("HEARTBEAT_URL", &c.Heartbeat.URL)
+
+	rates := []struct {
+		name string
+		v    *float64
+	}{
+		// Services with an error rate at or above this threshold get an incident.
+		{"ERROR_RATE_THRESHOLD", &c.Defaults.Threshold},
+		// Services with an error rate at or above this threshold get a critical incident.
+		{"CRITICAL_ERROR_RATE_THRESHOLD", &c.Defaults.CriticalThreshold},
+		{"MALFORMED_RECORDS_ALERT_RATE", &c.Checks.MalformedAlertRate},
+	}
+	for _, e := range rates {
+		if s, ok := os.LookupEnv(e.name); ok {
+			v, err := strconv.ParseFloat(s, 64)
+			if err != nil || v < 0 || v > 1 {
+				errs.add("%s must be a number between 0 and 1, not %q.", e.name, s)
+				continue
+			}
+			*e.v = v
+		}
+	}
+
+	durations := []struct {
+		name    string
+		v       *duration
+		example string
+	}{
+		{"CHECK_TIMEOUT", &c.Defaults.Timeout, "30s"},
+		{"SLOW_QUERY_THRESHOLD", &c.Defaults.SlowQuery, "10s"},
+		{"SCHEDULE_JITTER", &c.Defaults.Jitter, "10s"},
+		{"SHUTDOWN_TIMEOUT", &c.ShutdownTimeout, "25s"},
+		{"CHECK_MAX_BACKOFF", &c.Checks.MaxBackoff, "30m"},
+		{"ALERT_OVERFLOW_SUMMARY_INTERVAL", &c.Checks.OverflowSummaryEvery, "15m"},
+		{"HEARTBEAT_INTERVAL", &c.Heartbeat.Interval, "1m"},
+		{"LEADER_ELECTION_DURATION", &c.LeaderElection.Duration, "15s"},
+		{"RULES_URL_POLL_INTERVAL", &c.RulesURL.PollInterval, "1m"},
+	}
+	for _, e := range durations {
+		if s, ok := os.LookupEnv(e.name); ok {
+			if err := e.v.parse(s); err != nil {
+				errs.add("%s must be a positive duration, such as %s, not %q.", e.name, e.example, s)
+			}
+		}
+	}
+}
+
+// Names of the keys read from a Kubernetes secret mounted at SecretsDir.
+const (
+	secretPixieAPIKey = "pixie-api-key"
+	secretSlackToken  = "slack-bot-token"
+)
+
+// loadSecrets points c at the Pixie API key and Slack token in SecretsDir,
+// if they are there, and then reads the Slack token file. Secrets in
+// SecretsDir take precedence over both the config file and environment
+// variables. The API key file is read again whenever Pixie Cloud rejects the
+// key, so it can be rotated by updating the secret.
+func (c *Config) loadSecrets() error {
+	if c.SecretsDir != "" {
+		secrets := []struct {
+			name string
+			v    *string
+		}{
+			{secretPixieAPIKey, &c.Pixie.APIKeyFile},
+			{secretSlackToken, &c.Slack.TokenFile},
+		}
+		for _, e := range secrets {
+			path := filepath.Join(c.SecretsDir, e.name)
+			if _, err := os.Stat(path); err == nil {
+				*e.v = path
+			} else if !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	if c.Slack.TokenFile != "" {
+		b, err := ioutil.ReadFile(c.Slack.TokenFile)
+		if err != nil {
+			return fmt.Errorf("reading Slack token: %w", err)
+		}
+		c.Slack.Token = strings.TrimSpace(string(b))
+	}
+
+	// Values can also be references to AWS or GCP secret managers.
+	ctx := context.Background()
+	for _, v := range []*string{&c.Pixie.APIKey, &c.Slack.Token} {
+		secret, err := resolveSecret(ctx, *v)
+		if err != nil {
+			return err
+		}
+		*v = secret
+	}
+	return c.loadVaultSecrets()
+}
+
+// loadVaultSecrets fetches the Pixie API key and Slack token from Vault, if
+// configured, which takes precedence over every other source. Both are
+// fetched again when their lease expires.
+func (c *Config) loadVaultSecrets() error {
+	if c.Vault.PixieAPIKey == "" && c.Vault.SlackToken == "" {
+		return nil
+	}
+	if c.Vault.Addr == "" {
+		return errors.New("Please set VAULT_ADDR environment variable, or vault.addr in the config file.")
+	}
+	client := newVaultClient(c.Vault)
+	ctx := context.Background()
+	if c.Vault.PixieAPIKey != "" {
+		c.vaultPixieKey = newVaultSecret(client, c.Vault.PixieAPIKey)
+		if _, err := c.vaultPixieKey.Get(ctx); err != nil {
+			return err
+		}
+	}
+	if c.Vault.SlackToken != "" {
+		c.vaultSlackToken = newVaultSecret(client, c.Vault.SlackToken)
+		token, err := c.vaultSlackToken.Get(ctx)
+		if err != nil {
+			return err
+		}
+		c.Slack.Token = token
+	}
+	return nil
+}
+
+// ruleAlerter returns the alerter for a rule's alerts: the rule's named
+// alerters, if it has any, or else its Slack channel.
+func (c *Config) ruleAlerter(r Rule) (Alerter, error) {
+	if len(r.Alerters) == 0 {
+		return c.channelAlerter(r.Channel), nil
+	}
+	var alerters multiAlerter
+	for _, name := range r.Alerters {
+		a, err := c.namedAlerter(name)
+		if err != nil {
+			return nil, err
+		}
+		alerters = append(alerters, a)
+	}
+	if len(alerters) == 1 {
+		return alerters[0], nil
+	}
+	return alerters, nil
+}
+
+// namedAlerter builds the alerter with the given name.
+func (c *Config) namedAlerter(name string) (Alerter, error) {
+	cfg, ok := c.Alerters[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown alerter %q", name)
+	}
+	switch cfg.Type {
+	case "", "slack":
+		if cfg.Channel == "" {
+			return nil, fmt.Errorf("alerter %s has no channel", name)
+		}
+		if c.DryRun {
+			return &instrumentedAlerter{Alerter: &logAlerter{dest: "alerter " + name + " (" + cfg.Channel + ")"}, backend: "log"}, nil
+		}
+		return &instrumentedAlerter{Alerter: c.slackAlerter(cfg.Channel), backend: "slack"}, nil
+	}
+	return nil, fmt.Errorf("alerter %s has unknown type %q", name, cfg.Type)
+}
+
+// unhealthyAlerter returns the alerter that alerts about the bot itself being unhealthy.
+func (c *Config) unhealthyAlerter() (Alerter, error) {
+	if c.Checks.UnhealthyAlerter != "" {
+		return c.namedAlerter(c.Checks.UnhealthyAlerter)
+	}
+	return c.channelAlerter(c.Defaults.Channel), nil
+}
+
+// channelAlerter returns an alerter that posts to a Slack channel, or logs
+// what it would post in a dry run.
+func (c *Config) channelAlerter(channel string) Alerter {
+	if c.DryRun {
+		return &instrumentedAlerter{Alerter: &logAlerter{dest: channel}, backend: "log"}
+	}
+	return &instrumentedAlerter{Alerter: c.slackAlerter(channel), backend: "slack"}
+}
+
+// slackAlerter returns an alerter that posts to channel with the configured
+// Slack token.
+func (c *Config) slackAlerter(channel string) *slackAlerter {
+	a := newSlackAlerter(c.Slack.Token, channel)
+	a.tokens = c.vaultSlackToken
+	return a
+}
+
+func envString(name string, v *string) {
+	if s, ok := os.LookupEnv(name); ok {
+		*v = s
+	}
+}
+
+func envList(name string, v *[]string) {
+	if s, ok := os.LookupEnv(name); ok {
+		if s == "" {
+			*v = nil
+		} else {
+			*v = strings.Split(s, ",")
+		}
+	}
+}
+
+// loadRules returns the rules to run: those in the config file, in the
+// rules file or directory, or else just the default rule.
+func (c *Config) loadRules() ([]Rule, error) {
+	rules, err := c.readRules()
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range rules {
+		if r.Jitter.Duration >= r.Interval.Duration && r.Schedule == "" && !r.Streaming {
+			return nil, fmt.Errorf("rule %s: jitter must be shorter than the interval", r.Name)
+		}
+		if r.Schedule != "" {
+			if _, err := parseCron(r.Schedule, time.UTC); err != nil {
+				return nil, fmt.Errorf("rule %s: %w", r.Name, err)
+			}
+			if r.Streaming {
+				return nil, fmt.Errorf("rule %s: streaming rules can't have a schedule", r.Name)
+			}
+		}
+		for _, name := range r.Alerters {
+			if _, ok := c.Alerters[name]; !ok {
+				return nil, fmt.Errorf("rule %s: unknown alerter %q", r.Name, name)
+			}
+		}
+	}
+	return rules, nil
+}
+
+func (c *Config) readRules() ([]Rule, error) {
+	defaults := c.Defaults
+	switch {
+	case c.RulesCRD.Enabled:
+		return loadRulesCRD(c.RulesCRD, defaults)
+	case len(c.Rules) > 0:
+		rules := append([]Rule(nil), c.Rules...)
+		if err := prepareRules(rules, defaults, c.dir); err != nil {
+			return nil, fmt.Errorf("config file: %w", err)
+		}
+		return rules, nil
+	case c.RulesURL.URL != "":
+		return loadRulesURL(c.RulesURL, defaults, c.dir)
+	case c.RulesFile != "":
+		return loadRules(c.RulesFile, defaults)
+	case c.RulesDir != "":
+		return loadRulesDir(c.RulesDir, defaults)
+	}
+	if err := defaults.applyDefaults(defaults); err != nil {
+		return nil, err
+	}
+	return []Rule{defaults}, nil
+}
+
+// discoverClusters returns whether clusters should be discovered instead of
+// using a fixed list.
+func (c *PixieConfig) discoverClusters() bool {
+	if len(c.Clusters) == 1 && c.Clusters[0] == "all" {
+		return true
+	}
+	return len(c.Clusters) == 0 && len(c.DirectClusters) == 0
+}
@@ -0,0 +1,104 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestExpandEnv(t *testing.T) {
+	os.Setenv("SLACKBOT_TEST_SET", "value")
+	os.Unsetenv("SLACKBOT_TEST_UNSET")
+	defer os.Unsetenv("SLACKBOT_TEST_SET")
+	for _, tt := range []struct{ in, want string }{
+		{"token: ${SLACKBOT_TEST_SET}", "token: value"},
+		{"token: ${SLACKBOT_TEST_UNSET}", "token: "},
+		{"addr: ${SLACKBOT_TEST_UNSET:-withpixie.ai:443}", "addr: withpixie.ai:443"},
+		{"addr: ${SLACKBOT_TEST_SET:-default}", "addr: value"},
+		{"password: pa$word", "password: pa$word"},
+		{"hash: $2a$10$abc", "hash: $2a$10$abc"},
+		{"password: $SLACKBOT_TEST_SET", "password: $SLACKBOT_TEST_SET"},
+		{"literal: $${SLACKBOT_TEST_SET}", "literal: ${SLACKBOT_TEST_SET}"},
+		{"price: 5$$", "price: 5$"},
+		{"trailing: $", "trailing: $"},
+		{"unclosed: ${SLACKBOT_TEST_SET", "unclosed: ${SLACKBOT_TEST_SET"},
+		{"not a name: ${1X}", "not a name: ${1X}"},
+	} {
+		if got := expandEnv(tt.in); got != tt.want {
+			t.Errorf("expandEnv(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestDiscoverClusters(t *testing.T) {
+	direct := []DirectClusterConfig{{Name: "prod", Addr: "vizier:50300"}}
+	for _, tt := range []struct {
+		clusters []string
+		direct   []DirectClusterConfig
+		want     bool
+	}{
+		{want: true},
+		{clusters: []string{"all"}, want: true},
+		{clusters: []string{"6ba7b810-9dad-11d1-80b4-00c04fd430c8"}, want: false},
+		{direct: direct, want: false},
+		{clusters: []string{"all"}, direct: direct, want: true},
+	} {
+		c := PixieConfig{Clusters: tt.clusters, DirectClusters: tt.direct}
+		if got := c.discoverClusters(); got != tt.want {
+			t.Errorf("clusters %q with %d direct clusters: discoverClusters() = %v, want %v", tt.clusters, len(tt.direct), got, tt.want)
+		}
+	}
+}
+
+func TestLoadEnvCounts(t *testing.T) {
+	for _, tt := range []struct {
+		name, value string
+		want        int
+		wantErr     bool
+	}{
+		{name: "QUERY_FAILURE_ALERT_AFTER", value: "3", want: 3},
+		{name: "QUERY_FAILURE_ALERT_AFTER", value: "0", want: 0},
+		{name: "QUERY_FAILURE_ALERT_AFTER", value: "-1", wantErr: true},
+		{name: "UNHEALTHY_ALERT_AFTER", value: "0", want: 0},
+		{name: "UNHEALTHY_ALERT_AFTER", value: "often", wantErr: true},
+		{name: "ALERT_BUDGET", value: "20", want: 20},
+		{name: "ALERT_BUDGET", value: "0", want: 0},
+		{name: "ALERT_BUDGET", value: "-5", wantErr: true},
+		{name: "CHECK_WORKERS", value: "0", wantErr: true},
+	} {
+		setenv(t, tt.name, tt.value)
+		c := defaultConfig()
+		var errs ConfigError
+		c.loadEnv(&errs)
+		got := map[string]int{
+			"QUERY_FAILURE_ALERT_AFTER": c.Checks.FailureAlertAfter,
+			"UNHEALTHY_ALERT_AFTER":     c.Checks.UnhealthyAfter,
+			"ALERT_BUDGET":              c.Checks.AlertBudget,
+			"CHECK_WORKERS":             c.Checks.Workers,
+		}[tt.name]
+		switch {
+		case tt.wantErr && len(errs.Problems) == 0:
+			t.Errorf("%s=%s: no error", tt.name, tt.value)
+		case !tt.wantErr && len(errs.Problems) > 0:
+			t.Errorf("%s=%s: %v", tt.name, tt.value, &errs)
+		case !tt.wantErr && got != tt.want:
+			t.Errorf("%s=%s: got %d, want %d", tt.name, tt.value, got, tt.want)
+		}
+		setenv(t, tt.name, "")
+	}
+}
@@ -0,0 +1,202 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// API group and version of the PixieAlertRule custom resource.
+const pixieAlertRuleAPI = "/apis/px.dev/v1alpha1"
+
+// pixieAlertRule is a rule defined as a Kubernetes custom resource, so that
+// teams can add their own rules through GitOps. The spec takes the same
+// fields as a rule in the rules file.
+type pixieAlertRule struct {
+	Metadata struct {
+		Name            string `json:"name"`
+		Namespace       string `json:"namespace"`
+		UID             string `json:"uid"`
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Spec pixieAlertRuleSpec `json:"spec"`
+}
+
+type pixieAlertRuleSpec struct {
+	Rule
+	// ConfigMap in the resource's namespace holding the PxL script, instead
+	// of a built-in script or an inline source.
+	ScriptConfigMap *configMapKeyRef `json:"scriptConfigMap"`
+}
+
+type configMapKeyRef struct {
+	Name string `json:"name"`
+	Key  string `json:"key"`
+}
+
+type pixieAlertRuleList struct {
+	Items []pixieAlertRule `json:"items"`
+}
+
+// listPixieAlertRules lists the PixieAlertRules in namespace, or in every
+// namespace if it is empty.
+func listPixieAlertRules(ctx context.Context, kube *kubeClient, namespace string) ([]pixieAlertRule, error) {
+	path := pixieAlertRuleAPI + "/pixiealertrules"
+	if namespace != "" {
+		path = pixieAlertRuleAPI + "/namespaces/" + namespace + "/pixiealertrules"
+	}
+	var list pixieAlertRuleList
+	if err := kube.do(ctx, http.MethodGet, path, nil, &list); err != nil {
+		return nil, fmt.Errorf("listing PixieAlertRules: %w", err)
+	}
+	return list.Items, nil
+}
+
+// loadRulesCRD turns every PixieAlertRule into a rule named
+// <namespace>.<name>. Fields that a resource doesn't set are taken from
+// defaults, except that rules monitor the resource's own namespace unless
+// they set namespaces. Resources that are invalid, such as ones referencing
+// a missing ConfigMap, are logged and left out, so that one team's mistake
+// doesn't stop everyone else's rules from reloading.
+func loadRulesCRD(cfg RulesCRDConfig, defaults Rule) ([]Rule, error) {
+	kube, err := newInClusterKubeClient()
+	if err != nil {
+		return nil, fmt.Errorf("PixieAlertRules: %w", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	return rulesFromCRD(ctx, kube, cfg.Namespace, defaults)
+}
+
+// rulesFromCRD lists the PixieAlertRules in namespace, or in every namespace
+// if it is empty, and returns the valid ones as rules, sorted by name.
+func rulesFromCRD(ctx context.Context, kube *kubeClient, namespace string, defaults Rule) ([]Rule, error) {
+	items, err := listPixieAlertRules(ctx, kube, namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	var rules []Rule
+	for _, item := range items {
+		r, err := item.rule(ctx, kube, defaults)
+		if err != nil {
+			logError("Skipping invalid PixieAlertRule.", "namespace", item.Metadata.Namespace, "name", item.Metadata.Name, "error", err)
+			continue
+		}
+		rules = append(rules, r)
+	}
+	if len(rules) == 0 {
+		return nil, fmt.Errorf("no valid PixieAlertRules found")
+	}
+	sort.Slice(rules, func(i, j int) bool { return rules[i].Name < rules[j].Name })
+	return rules, nil
+}
+
+func (item *pixieAlertRule) rule(ctx context.Context, kube *kubeClient, defaults Rule) (Rule, error) {
+	r := item.Spec.Rule
+	r.Name = item.Metadata.Namespace + "." + item.Metadata.Name
+	// Paths on the bot's filesystem mean nothing to the resource's author.
+	if r.Script != "" {
+		return Rule{}, fmt.Errorf("script is not supported, use scriptConfigMap, source or builtin")
+	}
+	if ref := item.Spec.ScriptConfigMap; ref != nil {
+		if r.Source != "" || r.Builtin != "" {
+			return Rule{}, fmt.Errorf("scriptConfigMap can't be combined with source or builtin")
+		}
+		var cm struct {
+			Data map[string]string `json:"data"`
+		}
+		path := "/api/v1/namespaces/" + item.Metadata.Namespace + "/configmaps/" + ref.Name
+		if err := kube.do(ctx, http.MethodGet, path, nil, &cm); err != nil {
+			return Rule{}, fmt.Errorf("reading ConfigMap %s: %w", ref.Name, err)
+		}
+		src, ok := cm.Data[ref.Key]
+		if !ok {
+			return Rule{}, fmt.Errorf("ConfigMap %s has no key %q", ref.Name, ref.Key)
+		}
+		r.Source = src
+	}
+	if r.Namespace == "" && len(r.Namespaces) == 0 {
+		r.Namespace = item.Metadata.Namespace
+	}
+	if r.Source == "" && r.Builtin == "" {
+		r.Script = defaults.Script
+	}
+	if err := r.applyDefaults(defaults); err != nil {
+		return Rule{}, err
+	}
+	if _, err := loadRuleScript(r); err != nil {
+		return Rule{}, err
+	}
+	return r, nil
+}
+
+// watchRulesCRD sends on the returned channel whenever a PixieAlertRule is
+// added, changed or deleted, until ctx is cancelled. Resources are listed
+// every configPollInterval, like the config file is checked for changes.
+func watchRulesCRD(ctx context.Context, cfg RulesCRDConfig) <-chan struct{} {
+	changed := make(chan struct{}, 1)
+	kube, err := newInClusterKubeClient()
+	if err != nil {
+		logError("Can't watch PixieAlertRules.", "error", err)
+		return changed
+	}
+	// Versions of every resource, which change on every update.
+	versions := func() (string, bool) {
+		ctx, cancel := context.WithTimeout(ctx, configPollInterval)
+		defer cancel()
+		items, err := listPixieAlertRules(ctx, kube, cfg.Namespace)
+		if err != nil {
+			logWarn("Error listing PixieAlertRules.", "error", err)
+			return "", false
+		}
+		keys := make([]string, len(items))
+		for i, item := range items {
+			keys[i] = item.Metadata.UID + "@" + item.Metadata.ResourceVersion
+		}
+		sort.Strings(keys)
+		return strings.Join(keys, ","), true
+	}
+	go func() {
+		last, _ := versions()
+		ticker := time.NewTicker(configPollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			v, ok := versions()
+			if !ok || v == last {
+				continue
+			}
+			last = v
+			logInfo("PixieAlertRules changed, reloading config.")
+			select {
+			case changed <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return changed
+}
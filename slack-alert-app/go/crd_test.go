@@ -0,0 +1,141 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const crdTestScript = `import px
+df = px.DataFrame(table='http_events', start_time='-{{.Window}}')
+px.display(df, 'output')
+`
+
+// servePixieAlertRules serves a list of PixieAlertRules in the team-a and
+// team-b namespaces, along with the ConfigMap one of them reads its script
+// from, and returns the paths requested.
+func servePixieAlertRules(t *testing.T) (*kubeClient, func() []string) {
+	var mu sync.Mutex
+	var paths []string
+	list := `{
+  "apiVersion": "px.dev/v1alpha1",
+  "kind": "PixieAlertRuleList",
+  "items": [
+    {"metadata": {"name": "orders", "namespace": "team-a", "uid": "u1", "resourceVersion": "10"},
+     "spec": {"builtin": "http-errors", "threshold": 0.2, "interval": "1m", "channel": "#team-a"}},
+    {"metadata": {"name": "checkout", "namespace": "team-b", "uid": "u2", "resourceVersion": "11"},
+     "spec": {"scriptConfigMap": {"name": "scripts", "key": "checkout.pxl"}, "table": "output", "namespaces": ["team-b", "payments"]}},
+    {"metadata": {"name": "local-file", "namespace": "team-b", "uid": "u3", "resourceVersion": "12"},
+     "spec": {"script": "/etc/scripts/errors.pxl"}},
+    {"metadata": {"name": "missing-script", "namespace": "team-b", "uid": "u4", "resourceVersion": "13"},
+     "spec": {"scriptConfigMap": {"name": "scripts", "key": "missing.pxl"}}}
+  ]
+}`
+	kube := serveKube(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer kube-token" || r.Method != http.MethodGet {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		mu.Lock()
+		paths = append(paths, r.URL.Path)
+		mu.Unlock()
+		switch r.URL.Path {
+		case "/apis/px.dev/v1alpha1/pixiealertrules", "/apis/px.dev/v1alpha1/namespaces/team-b/pixiealertrules":
+			w.Write([]byte(list))
+		case "/api/v1/namespaces/team-b/configmaps/scripts":
+			json.NewEncoder(w).Encode(map[string]interface{}{"apiVersion": "v1", "kind": "ConfigMap", "data": map[string]string{"checkout.pxl": crdTestScript}})
+		default:
+			http.Error(w, `{"kind": "Status", "reason": "NotFound"}`, http.StatusNotFound)
+		}
+	}))
+	return kube, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return paths
+	}
+}
+
+func TestRulesFromCRD(t *testing.T) {
+	kube, paths := servePixieAlertRules(t)
+	rules, err := rulesFromCRD(context.Background(), kube, "", defaultConfig().Defaults)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := paths(); len(got) < 2 || got[0] != "/apis/px.dev/v1alpha1/pixiealertrules" {
+		t.Errorf("requested %v, want the PixieAlertRules of every namespace first", got)
+	}
+	if len(rules) != 2 {
+		t.Fatalf("got %d rules, want the two valid PixieAlertRules: %+v", len(rules), rules)
+	}
+	// Sorted by name.
+	orders, checkout := rules[0], rules[1]
+	if orders.Name != "team-a.orders" || orders.Builtin != "http-errors" || orders.Threshold != 0.2 || orders.Interval.Duration != time.Minute || orders.Channel != "#team-a" {
+		t.Errorf("orders rule %+v", orders)
+	}
+	// Rules monitor their own namespace by default.
+	if orders.Namespace != "team-a" {
+		t.Errorf("orders rule monitors %q, want team-a", orders.Namespace)
+	}
+	if checkout.Name != "team-b.checkout" || checkout.Source != crdTestScript || checkout.Table != "output" || strings.Join(checkout.Namespaces, ",") != "team-b,payments" {
+		t.Errorf("checkout rule %+v", checkout)
+	}
+	// Defaults fill in what the resources leave out.
+	if checkout.Threshold != 0.1 || checkout.Channel != "#pixie-alerts" {
+		t.Errorf("checkout rule has threshold %v and channel %q, want the defaults", checkout.Threshold, checkout.Channel)
+	}
+}
+
+func TestRulesFromCRDNamespace(t *testing.T) {
+	kube, paths := servePixieAlertRules(t)
+	if _, err := rulesFromCRD(context.Background(), kube, "team-b", defaultConfig().Defaults); err != nil {
+		t.Fatal(err)
+	}
+	if got := paths(); got[0] != "/apis/px.dev/v1alpha1/namespaces/team-b/pixiealertrules" {
+		t.Errorf("requested %v, want the PixieAlertRules of team-b", got)
+	}
+}
+
+func TestRulesFromCRDErrors(t *testing.T) {
+	kube, _ := servePixieAlertRules(t)
+	kube.host += "/missing"
+	if _, err := rulesFromCRD(context.Background(), kube, "", defaultConfig().Defaults); err == nil || !strings.Contains(err.Error(), "listing PixieAlertRules: Kubernetes API returned 404") {
+		t.Errorf("got %v, want the API server's error", err)
+	}
+
+	for _, tt := range []struct {
+		spec pixieAlertRuleSpec
+		want string
+	}{
+		{pixieAlertRuleSpec{Rule: Rule{Script: "/etc/scripts/errors.pxl"}}, "script is not supported"},
+		{pixieAlertRuleSpec{Rule: Rule{Builtin: "http-errors"}, ScriptConfigMap: &configMapKeyRef{Name: "scripts", Key: "checkout.pxl"}}, "can't be combined"},
+		{pixieAlertRuleSpec{ScriptConfigMap: &configMapKeyRef{Name: "scripts", Key: "missing.pxl"}}, `ConfigMap scripts has no key "missing.pxl"`},
+		{pixieAlertRuleSpec{ScriptConfigMap: &configMapKeyRef{Name: "other", Key: "checkout.pxl"}}, "reading ConfigMap other: Kubernetes API returned 404"},
+	} {
+		kube, _ := servePixieAlertRules(t)
+		item := &pixieAlertRule{Spec: tt.spec}
+		item.Metadata.Name, item.Metadata.Namespace = "bad", "team-b"
+		if _, err := item.rule(context.Background(), kube, defaultConfig().Defaults); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("got %v, want an error containing %q", err, tt.want)
+		}
+	}
+}
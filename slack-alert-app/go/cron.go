@@ -0,0 +1,233 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronSchedule is a standard five field cron expression: minute, hour, day
+// of month, month and day of week.
+type cronSchedule struct {
+	expr                         string
+	minutes, hours, days, months []bool
+	weekdays                     []bool
+	// Whether the day of month and day of week fields are restricted. As in
+	// cron, if both are, a day matching either runs the schedule.
+	daysRestricted, weekdaysRestricted bool
+	// Whether the hour field is *, so the schedule runs every hour, including
+	// both times an hour repeats when daylight saving time ends.
+	everyHour bool
+	loc       *time.Location
+}
+
+var cronAliases = map[string]string{
+	"@hourly":  "0 * * * *",
+	"@daily":   "0 0 * * *",
+	"@weekly":  "0 0 * * 0",
+	"@monthly": "0 0 1 * *",
+}
+
+var months = map[string]int{
+	"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+	"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+}
+
+// parseCron parses a cron expression, such as "*/15 9-17 * * Mon-Fri", or
+// one of @hourly, @daily, @weekly and @monthly, evaluated in loc.
+func parseCron(expr string, loc *time.Location) (*cronSchedule, error) {
+	spec := expr
+	if alias, ok := cronAliases[strings.ToLower(expr)]; ok {
+		spec = alias
+	}
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("invalid schedule %q, expected 5 fields, such as \"*/15 9-17 * * Mon-Fri\"", expr)
+	}
+	s := &cronSchedule{expr: expr, loc: loc}
+	weekdayNames := make(map[string]int)
+	for name, d := range weekdays {
+		weekdayNames[name] = int(d)
+	}
+	var err error
+	if s.minutes, err = parseCronField(fields[0], 0, 59, nil); err != nil {
+		return nil, fmt.Errorf("schedule %q: minute: %w", expr, err)
+	}
+	if s.hours, err = parseCronField(fields[1], 0, 23, nil); err != nil {
+		return nil, fmt.Errorf("schedule %q: hour: %w", expr, err)
+	}
+	if s.days, err = parseCronField(fields[2], 1, 31, nil); err != nil {
+		return nil, fmt.Errorf("schedule %q: day of month: %w", expr, err)
+	}
+	if s.months, err = parseCronField(fields[3], 1, 12, months); err != nil {
+		return nil, fmt.Errorf("schedule %q: month: %w", expr, err)
+	}
+	// Both 0 and 7 are Sunday.
+	if s.weekdays, err = parseCronField(fields[4], 0, 7, weekdayNames); err != nil {
+		return nil, fmt.Errorf("schedule %q: day of week: %w", expr, err)
+	}
+	s.weekdays[0] = s.weekdays[0] || s.weekdays[7]
+	s.daysRestricted = !strings.HasPrefix(fields[2], "*")
+	s.weekdaysRestricted = !strings.HasPrefix(fields[4], "*")
+	s.everyHour = fields[1] == "*"
+	return s, nil
+}
+
+// parseCronField parses a comma separated list of values, ranges such as
+// 9-17 and steps such as */15 or 0-30/10, into the set of matching values.
+func parseCronField(field string, min, max int, names map[string]int) ([]bool, error) {
+	set := make([]bool, max+1)
+	value := func(s string) (int, error) {
+		if v, ok := names[strings.ToLower(s)]; ok {
+			return v, nil
+		}
+		v, err := strconv.Atoi(s)
+		if err != nil || v < min || v > max {
+			return 0, fmt.Errorf("invalid value %q, expected %d-%d", s, min, max)
+		}
+		return v, nil
+	}
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			if step, err = strconv.Atoi(part[i+1:]); err != nil || step < 1 {
+				return nil, fmt.Errorf("invalid step %q", part[i+1:])
+			}
+			part = part[:i]
+		}
+		first, last := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			if first, err = value(bounds[0]); err != nil {
+				return nil, err
+			}
+			last = first
+			if len(bounds) == 2 {
+				if last, err = value(bounds[1]); err != nil {
+					return nil, err
+				}
+			} else if step > 1 {
+				last = max
+			}
+			if last < first {
+				return nil, fmt.Errorf("invalid range %q", part)
+			}
+		}
+		for v := first; v <= last; v += step {
+			set[v] = true
+		}
+	}
+	return set, nil
+}
+
+func (s *cronSchedule) String() string {
+	return s.expr
+}
+
+// Next returns the first time after t that the schedule runs. Around
+// daylight saving time changes it does what cron does: times skipped when
+// clocks go forward run right after the change, and times repeated when
+// clocks go back run once, unless the schedule runs every hour.
+func (s *cronSchedule) Next(t time.Time) time.Time {
+	t = t.In(s.loc).Truncate(time.Minute).Add(time.Minute)
+	// Every schedule runs at least once within a few years, such as on Feb 29.
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		if !s.months[t.Month()] {
+			t = cronDate(t.Year(), t.Month()+1, 1, 0, s.loc)
+			continue
+		}
+		if !s.dayMatches(t) {
+			t = cronDate(t.Year(), t.Month(), t.Day()+1, 0, s.loc)
+			continue
+		}
+		if !s.hours[t.Hour()] {
+			if s.skippedHour(t) {
+				return t
+			}
+			t = cronDate(t.Year(), t.Month(), t.Day(), t.Hour()+1, s.loc)
+			continue
+		}
+		if !s.minutes[t.Minute()] || (!s.everyHour && repeatedWallTime(t)) {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+// cronDate returns the start of the hour on the clock in loc or, if clocks
+// went forward over it, the time they went forward to. time.Date leaves
+// such times before the change.
+func cronDate(year int, month time.Month, day, hour int, loc *time.Location) time.Time {
+	want := time.Date(year, month, day, hour, 0, 0, 0, time.UTC)
+	t := time.Date(year, month, day, hour, 0, 0, 0, loc)
+	for wallClock(t).Before(want) {
+		t = t.Add(time.Minute)
+	}
+	return t
+}
+
+// wallClock returns the time shown on the clock at t, as a time in UTC.
+func wallClock(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.UTC)
+}
+
+// skippedHour returns whether clocks went forward to t, skipping an hour
+// of the same day that the schedule runs in.
+func (s *cronSchedule) skippedHour(t time.Time) bool {
+	before, now := wallClock(t.Add(-time.Minute)), wallClock(t)
+	if now.Sub(before) == time.Minute {
+		return false
+	}
+	first := 0
+	if before.Day() == now.Day() {
+		first = before.Hour() + 1
+	}
+	for h := first; h < now.Hour(); h++ {
+		if s.hours[h] {
+			return true
+		}
+	}
+	return false
+}
+
+// repeatedWallTime returns whether the clock already showed t's time of day
+// earlier the same day, before clocks went back.
+func repeatedWallTime(t time.Time) bool {
+	_, offset := t.Zone()
+	_, before := t.Add(-12 * time.Hour).Zone()
+	if before <= offset {
+		return false
+	}
+	earlier := t.Add(-time.Duration(before-offset) * time.Second)
+	return earlier.Day() == t.Day() && earlier.Hour() == t.Hour() && earlier.Minute() == t.Minute()
+}
+
+func (s *cronSchedule) dayMatches(t time.Time) bool {
+	day, weekday := s.days[t.Day()], s.weekdays[t.Weekday()]
+	if s.daysRestricted && s.weekdaysRestricted {
+		return day || weekday
+	}
+	return day && weekday
+}
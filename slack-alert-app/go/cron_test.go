@@ -0,0 +1,167 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseCronErrors(t *testing.T) {
+	for _, tt := range []struct{ expr, wantErr string }{
+		{"* * * *", "expected 5 fields"},
+		{"* * * * * *", "expected 5 fields"},
+		{"@yearly", "expected 5 fields"},
+		{"60 * * * *", `minute: invalid value "60", expected 0-59`},
+		{"-1 * * * *", `minute: invalid value "", expected 0-59`},
+		{"* 24 * * *", `hour: invalid value "24", expected 0-23`},
+		{"* * 0 * *", `day of month: invalid value "0", expected 1-31`},
+		{"* * 32 * *", `day of month: invalid value "32", expected 1-31`},
+		{"* * * 13 *", `month: invalid value "13", expected 1-12`},
+		{"* * * foo *", `month: invalid value "foo", expected 1-12`},
+		{"* * * * 8", `day of week: invalid value "8", expected 0-7`},
+		{"* * * * Mon-Funday", `day of week: invalid value "Funday", expected 0-7`},
+		{"*/0 * * * *", `minute: invalid step "0"`},
+		{"*/x * * * *", `minute: invalid step "x"`},
+		{"0-30/ * * * *", `minute: invalid step ""`},
+		{"* 17-9 * * *", `hour: invalid range "17-9"`},
+		{"* * * * Fri-Mon", `day of week: invalid range "Fri-Mon"`},
+		{"1,,2 * * * *", `minute: invalid value "", expected 0-59`},
+	} {
+		if _, err := parseCron(tt.expr, time.UTC); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("parseCron(%q) returned error %v, want %q", tt.expr, err, tt.wantErr)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	utc := func(year int, month time.Month, day, hour, min int) time.Time {
+		return time.Date(year, month, day, hour, min, 0, 0, time.UTC)
+	}
+	for _, tt := range []struct {
+		expr     string
+		from     time.Time
+		want     time.Time
+		wantNone bool
+	}{
+		{expr: "* * * * *", from: utc(2021, 2, 8, 12, 0).Add(30 * time.Second), want: utc(2021, 2, 8, 12, 1)},
+		{expr: "@hourly", from: utc(2021, 2, 8, 12, 0), want: utc(2021, 2, 8, 13, 0)},
+		{expr: "@daily", from: utc(2021, 2, 8, 12, 0), want: utc(2021, 2, 9, 0, 0)},
+		{expr: "@weekly", from: utc(2021, 2, 8, 12, 0), want: utc(2021, 2, 14, 0, 0)},
+		{expr: "@monthly", from: utc(2021, 2, 8, 12, 0), want: utc(2021, 3, 1, 0, 0)},
+		{expr: "*/15 9-17 * * Mon-Fri", from: utc(2021, 2, 8, 9, 10), want: utc(2021, 2, 8, 9, 15)},
+		{expr: "*/15 9-17 * * Mon-Fri", from: utc(2021, 2, 8, 17, 45), want: utc(2021, 2, 9, 9, 0)},
+		{expr: "*/15 9-17 * * Mon-Fri", from: utc(2021, 2, 12, 17, 50), want: utc(2021, 2, 15, 9, 0)},
+		{expr: "0-30/10 * * * *", from: utc(2021, 2, 8, 12, 25), want: utc(2021, 2, 8, 12, 30)},
+		{expr: "0-30/10 * * * *", from: utc(2021, 2, 8, 12, 30), want: utc(2021, 2, 8, 13, 0)},
+		// A step from a single value runs to the end of the range.
+		{expr: "5/20 * * * *", from: utc(2021, 2, 8, 12, 26), want: utc(2021, 2, 8, 12, 45)},
+		{expr: "0,30 8,20 * * *", from: utc(2021, 2, 8, 8, 30), want: utc(2021, 2, 8, 20, 0)},
+		{expr: "0 0 1 jan,JUL *", from: utc(2021, 2, 8, 12, 0), want: utc(2021, 7, 1, 0, 0)},
+		{expr: "0 0 1-7 * sun", from: utc(2021, 2, 8, 12, 0), want: utc(2021, 2, 14, 0, 0)},
+		// Both 0 and 7 are Sunday.
+		{expr: "0 12 * * 7", from: utc(2021, 2, 6, 12, 0), want: utc(2021, 2, 7, 12, 0)},
+		{expr: "0 12 * * 0", from: utc(2021, 2, 6, 12, 0), want: utc(2021, 2, 7, 12, 0)},
+		// With both the day of month and day of week restricted, either runs it.
+		{expr: "0 0 13 * Fri", from: utc(2021, 2, 8, 12, 0), want: utc(2021, 2, 12, 0, 0)},
+		{expr: "0 0 13 * Fri", from: utc(2021, 2, 12, 0, 0), want: utc(2021, 2, 13, 0, 0)},
+		{expr: "0 0 29 2 *", from: utc(2021, 3, 1, 0, 0), want: utc(2024, 2, 29, 0, 0)},
+		{expr: "0 0 31 2 *", from: utc(2021, 3, 1, 0, 0), wantNone: true},
+	} {
+		s, err := parseCron(tt.expr, time.UTC)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := s.Next(tt.from)
+		if tt.wantNone {
+			if !got.IsZero() {
+				t.Errorf("%q.Next(%v) = %v, want never", tt.expr, tt.from, got)
+			}
+			continue
+		}
+		if !got.Equal(tt.want) {
+			t.Errorf("%q.Next(%v) = %v, want %v", tt.expr, tt.from, got, tt.want)
+		}
+	}
+}
+
+// TestCronNextDaylightSaving checks schedules in New York, where clocks went
+// forward from 02:00 to 03:00 on 2021-03-14 and back from 02:00 to 01:00 on
+// 2021-11-07.
+func TestCronNextDaylightSaving(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := func(year int, month time.Month, day, hour, min int) time.Time {
+		return time.Date(year, month, day, hour, min, 0, 0, ny)
+	}
+	// The two times it was 01:30 on 2021-11-07.
+	firstOneThirty := time.Date(2021, 11, 7, 5, 30, 0, 0, time.UTC)
+	secondOneThirty := time.Date(2021, 11, 7, 6, 30, 0, 0, time.UTC)
+	for _, tt := range []struct {
+		name string
+		expr string
+		from time.Time
+		want time.Time
+	}{
+		{name: "daily across the change", expr: "0 9 * * *", from: at(2021, 3, 13, 9, 0), want: at(2021, 3, 14, 9, 0)},
+		{name: "skipped time runs after the change", expr: "30 2 * * *", from: at(2021, 3, 14, 0, 0), want: at(2021, 3, 14, 3, 0)},
+		{name: "skipped time the next day", expr: "30 2 * * *", from: at(2021, 3, 14, 3, 0), want: at(2021, 3, 15, 2, 30)},
+		{name: "time after the skipped hour", expr: "30 3 * * *", from: at(2021, 3, 14, 0, 0), want: at(2021, 3, 14, 3, 30)},
+		{name: "every hour over the skipped hour", expr: "30 * * * *", from: at(2021, 3, 14, 1, 30), want: at(2021, 3, 14, 3, 30)},
+		{name: "repeated time runs the first time", expr: "30 1 * * *", from: at(2021, 11, 7, 0, 0), want: firstOneThirty},
+		{name: "repeated time runs once", expr: "30 1 * * *", from: firstOneThirty, want: at(2021, 11, 8, 1, 30)},
+		{name: "every hour in the repeated hour", expr: "30 * * * *", from: firstOneThirty, want: secondOneThirty},
+		{name: "after the repeated hour", expr: "0 2 * * *", from: firstOneThirty, want: at(2021, 11, 7, 2, 0)},
+		{name: "every 15 minutes of business hours", expr: "*/15 9-17 * * Mon-Fri", from: at(2021, 3, 12, 17, 45), want: at(2021, 3, 15, 9, 0)},
+	} {
+		s, err := parseCron(tt.expr, ny)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := s.Next(tt.from); !got.Equal(tt.want) {
+			t.Errorf("%s: %q.Next(%v) = %v, want %v", tt.name, tt.expr, tt.from, got, tt.want)
+		}
+	}
+}
+
+// TestCronNextSkippedMidnight checks schedules in Havana, where clocks went
+// forward from midnight to 01:00 on 2021-03-14.
+func TestCronNextSkippedMidnight(t *testing.T) {
+	havana, err := time.LoadLocation("America/Havana")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		expr       string
+		from, want time.Time
+	}{
+		{expr: "0 12 * * *", from: time.Date(2021, 3, 13, 12, 0, 0, 0, havana), want: time.Date(2021, 3, 14, 12, 0, 0, 0, havana)},
+		{expr: "@daily", from: time.Date(2021, 3, 13, 12, 0, 0, 0, havana), want: time.Date(2021, 3, 14, 1, 0, 0, 0, havana)},
+		{expr: "0 0 14 3 *", from: time.Date(2021, 2, 1, 0, 0, 0, 0, havana), want: time.Date(2021, 3, 14, 1, 0, 0, 0, havana)},
+	} {
+		s, err := parseCron(tt.expr, havana)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := s.Next(tt.from); !got.Equal(tt.want) {
+			t.Errorf("%q.Next(%v) = %v, want %v", tt.expr, tt.from, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package datum converts the values in PxL table records into Go types.
+// Every helper returns an error, rather than panicking, when the value is
+// missing or isn't of a type that can be converted.
+package datum
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"go.withpixie.dev/pixie/src/api/go/pxapi/types"
+)
+
+// ErrMissing is returned when there's no value, for example because the
+// column doesn't exist in the table.
+var ErrMissing = errors.New("missing value")
+
+// UInt128 is a 128-bit unsigned integer, such as a UPID.
+type UInt128 struct {
+	High uint64
+	Low  uint64
+}
+
+func (u UInt128) String() string {
+	return fmt.Sprintf("%016x%016x", u.High, u.Low)
+}
+
+func typeError(d types.Datum, want string) error {
+	return fmt.Errorf("cannot convert %s to %s", d.Type(), want)
+}
+
+// AsBool returns the value of a BOOLEAN datum.
+func AsBool(d types.Datum) (bool, error) {
+	switch v := d.(type) {
+	case nil:
+		return false, ErrMissing
+	case *types.BooleanValue:
+		return v.Value(), nil
+	default:
+		return false, typeError(d, "bool")
+	}
+}
+
+// AsInt64 returns the value of an INT64 datum.
+func AsInt64(d types.Datum) (int64, error) {
+	switch v := d.(type) {
+	case nil:
+		return 0, ErrMissing
+	case *types.Int64Value:
+		return v.Value(), nil
+	default:
+		return 0, typeError(d, "int64")
+	}
+}
+
+// AsFloat64 returns the value of a FLOAT64 or INT64 datum.
+func AsFloat64(d types.Datum) (float64, error) {
+	switch v := d.(type) {
+	case nil:
+		return 0, ErrMissing
+	case *types.Float64Value:
+		return v.Value(), nil
+	case *types.Int64Value:
+		return float64(v.Value()), nil
+	default:
+		return 0, typeError(d, "float64")
+	}
+}
+
+// AsString returns the value of a STRING datum.
+func AsString(d types.Datum) (string, error) {
+	switch v := d.(type) {
+	case nil:
+		return "", ErrMissing
+	case *types.StringValue:
+		return v.Value(), nil
+	default:
+		return "", typeError(d, "string")
+	}
+}
+
+// AsTime returns the value of a TIME64NS datum.
+func AsTime(d types.Datum) (time.Time, error) {
+	switch v := d.(type) {
+	case nil:
+		return time.Time{}, ErrMissing
+	case *types.Time64NSValue:
+		return v.Value(), nil
+	default:
+		return time.Time{}, typeError(d, "time.Time")
+	}
+}
+
+// AsDuration returns the value of an INT64 datum holding nanoseconds, such as
+// the latency columns in Pixie's tables.
+func AsDuration(d types.Datum) (time.Duration, error) {
+	ns, err := AsInt64(d)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(ns), nil
+}
+
+// AsUInt128 returns the value of a UINT128 datum.
+func AsUInt128(d types.Datum) (UInt128, error) {
+	switch v := d.(type) {
+	case nil:
+		return UInt128{}, ErrMissing
+	case *types.UInt128Value:
+		u := v.Value()
+		if u == nil {
+			return UInt128{}, ErrMissing
+		}
+		return UInt128{High: u.High, Low: u.Low}, nil
+	default:
+		return UInt128{}, typeError(d, "UInt128")
+	}
+}
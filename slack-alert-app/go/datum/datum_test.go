@@ -0,0 +1,228 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package datum
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"go.withpixie.dev/pixie/src/api/go/pxapi/types"
+	"go.withpixie.dev/pixie/src/api/public/vizierapipb"
+)
+
+func boolDatum(b bool) types.Datum {
+	d := types.NewBooleanValue(&types.ColSchema{Name: "b", Type: vizierapipb.BOOLEAN})
+	d.ScalarValue(b)
+	return d
+}
+
+func int64Datum(i int64) types.Datum {
+	d := types.NewInt64Value(&types.ColSchema{Name: "i", Type: vizierapipb.INT64})
+	d.ScalarValue(i)
+	return d
+}
+
+func float64Datum(f float64) types.Datum {
+	d := types.NewFloat64Value(&types.ColSchema{Name: "f", Type: vizierapipb.FLOAT64})
+	d.ScalarValue(f)
+	return d
+}
+
+func stringDatum(s string) types.Datum {
+	d := types.NewStringValue(&types.ColSchema{Name: "s", Type: vizierapipb.STRING})
+	d.ScalarValue(s)
+	return d
+}
+
+func timeDatum(ns int64) types.Datum {
+	d := types.NewTime64NSValue(&types.ColSchema{Name: "t", Type: vizierapipb.TIME64NS})
+	d.ScalarValue(ns)
+	return d
+}
+
+func uint128Datum(u *vizierapipb.UInt128) types.Datum {
+	d := types.NewUint128Value(&types.ColSchema{Name: "u", Type: vizierapipb.UINT128})
+	d.ScalarValue(u)
+	return d
+}
+
+// checkErr checks err against the error wanted: none, ErrMissing, or the
+// message of a type error.
+func checkErr(t *testing.T, name string, err error, want interface{}) bool {
+	t.Helper()
+	switch want := want.(type) {
+	case nil:
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", name, err)
+			return false
+		}
+		return true
+	case error:
+		if !errors.Is(err, want) {
+			t.Errorf("%s: got error %v, want %v", name, err, want)
+		}
+	case string:
+		if err == nil || err.Error() != want {
+			t.Errorf("%s: got error %v, want %q", name, err, want)
+		}
+	}
+	return false
+}
+
+func TestAsBool(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		d       types.Datum
+		want    bool
+		wantErr interface{}
+	}{
+		{name: "true", d: boolDatum(true), want: true},
+		{name: "false", d: boolDatum(false), want: false},
+		{name: "missing", d: nil, wantErr: ErrMissing},
+		{name: "int64", d: int64Datum(1), wantErr: "cannot convert INT64 to bool"},
+		{name: "string", d: stringDatum("true"), wantErr: "cannot convert STRING to bool"},
+	} {
+		got, err := AsBool(tt.d)
+		if checkErr(t, tt.name, err, tt.wantErr) && got != tt.want {
+			t.Errorf("%s: AsBool() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestAsInt64(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		d       types.Datum
+		want    int64
+		wantErr interface{}
+	}{
+		{name: "int64", d: int64Datum(-42), want: -42},
+		{name: "missing", d: nil, wantErr: ErrMissing},
+		{name: "float64", d: float64Datum(1.5), wantErr: "cannot convert FLOAT64 to int64"},
+		{name: "time", d: timeDatum(1), wantErr: "cannot convert TIME64NS to int64"},
+		{name: "string", d: stringDatum("42"), wantErr: "cannot convert STRING to int64"},
+	} {
+		got, err := AsInt64(tt.d)
+		if checkErr(t, tt.name, err, tt.wantErr) && got != tt.want {
+			t.Errorf("%s: AsInt64() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestAsFloat64(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		d       types.Datum
+		want    float64
+		wantErr interface{}
+	}{
+		{name: "float64", d: float64Datum(0.25), want: 0.25},
+		{name: "int64", d: int64Datum(3), want: 3},
+		{name: "missing", d: nil, wantErr: ErrMissing},
+		{name: "bool", d: boolDatum(true), wantErr: "cannot convert BOOLEAN to float64"},
+		{name: "string", d: stringDatum("0.25"), wantErr: "cannot convert STRING to float64"},
+	} {
+		got, err := AsFloat64(tt.d)
+		if checkErr(t, tt.name, err, tt.wantErr) && got != tt.want {
+			t.Errorf("%s: AsFloat64() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestAsString(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		d       types.Datum
+		want    string
+		wantErr interface{}
+	}{
+		{name: "string", d: stringDatum("px-sock-shop/orders"), want: "px-sock-shop/orders"},
+		{name: "empty", d: stringDatum(""), want: ""},
+		{name: "missing", d: nil, wantErr: ErrMissing},
+		{name: "int64", d: int64Datum(1), wantErr: "cannot convert INT64 to string"},
+		{name: "uint128", d: uint128Datum(&vizierapipb.UInt128{High: 1, Low: 2}), wantErr: "cannot convert UINT128 to string"},
+	} {
+		got, err := AsString(tt.d)
+		if checkErr(t, tt.name, err, tt.wantErr) && got != tt.want {
+			t.Errorf("%s: AsString() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestAsTime(t *testing.T) {
+	ts := time.Date(2021, 2, 8, 12, 0, 0, 123, time.UTC)
+	for _, tt := range []struct {
+		name    string
+		d       types.Datum
+		want    time.Time
+		wantErr interface{}
+	}{
+		{name: "time", d: timeDatum(ts.UnixNano()), want: ts},
+		{name: "missing", d: nil, wantErr: ErrMissing},
+		{name: "int64", d: int64Datum(ts.UnixNano()), wantErr: "cannot convert INT64 to time.Time"},
+	} {
+		got, err := AsTime(tt.d)
+		if checkErr(t, tt.name, err, tt.wantErr) && !got.Equal(tt.want) {
+			t.Errorf("%s: AsTime() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestAsDuration(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		d       types.Datum
+		want    time.Duration
+		wantErr interface{}
+	}{
+		{name: "nanoseconds", d: int64Datum(1500000), want: 1500 * time.Microsecond},
+		{name: "missing", d: nil, wantErr: ErrMissing},
+		{name: "float64", d: float64Datum(1.5), wantErr: "cannot convert FLOAT64 to int64"},
+	} {
+		got, err := AsDuration(tt.d)
+		if checkErr(t, tt.name, err, tt.wantErr) && got != tt.want {
+			t.Errorf("%s: AsDuration() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestAsUInt128(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		d       types.Datum
+		want    UInt128
+		wantErr interface{}
+	}{
+		{name: "uint128", d: uint128Datum(&vizierapipb.UInt128{High: 0xab, Low: 0xcd}), want: UInt128{High: 0xab, Low: 0xcd}},
+		{name: "no value", d: uint128Datum(nil), wantErr: ErrMissing},
+		{name: "missing", d: nil, wantErr: ErrMissing},
+		{name: "string", d: stringDatum("00000000000000ab00000000000000cd"), wantErr: "cannot convert STRING to UInt128"},
+	} {
+		got, err := AsUInt128(tt.d)
+		if checkErr(t, tt.name, err, tt.wantErr) && got != tt.want {
+			t.Errorf("%s: AsUInt128() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestUInt128String(t *testing.T) {
+	u := UInt128{High: 0xab, Low: 0xcd}
+	if got, want := u.String(), "00000000000000ab00000000000000cd"; got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,216 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"go.withpixie.dev/pixie/src/api/go/pxapi/types"
+	"go.withpixie.dev/pixie/src/api/public/vizierapipb"
+
+	"slackbot/datum"
+)
+
+// decodeRecord sets the fields of the struct pointed to by v from the columns
+// of a PxL table record. Fields are mapped to columns with a `px` tag:
+//
+//	type row struct {
+//		Service  string  `px:"service"`
+//		Endpoint string  `px:"endpoint,optional"`
+//		MaxError float64 `px:"max_error"`
+//	}
+//
+// It's an error for a tagged column to be missing, unless the tag has the
+// "optional" option. Fields without a `px` tag are left alone.
+//
+// String, bool, integer, float, time.Time and time.Duration fields are
+// supported, using the conversions in the datum package.
+func decodeRecord(r *types.Record, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("decodeRecord: expected a pointer to a struct, got %T", v)
+	}
+	rv = rv.Elem()
+	rt := rv.Type()
+
+	for i := 0; i < rt.NumField(); i++ {
+		f := rt.Field(i)
+		tag, ok := f.Tag.Lookup("px")
+		if !ok || tag == "-" {
+			continue
+		}
+		opts := strings.Split(tag, ",")
+		col := opts[0]
+		optional := len(opts) > 1 && opts[1] == "optional"
+
+		d := r.GetDatum(col)
+		if d == nil {
+			if optional {
+				continue
+			}
+			return fmt.Errorf("missing column %q", col)
+		}
+		if err := setField(rv.Field(i), d); err != nil {
+			return fmt.Errorf("column %q: %w", col, err)
+		}
+	}
+	return nil
+}
+
+var (
+	durationType = reflect.TypeOf(time.Duration(0))
+	timeType     = reflect.TypeOf(time.Time{})
+)
+
+// validateSchema checks that a table has every column needed to decode
+// records into v, a pointer to a struct with `px` tags, and that each column
+// has a type that can be decoded into its field.
+func validateSchema(metadata types.TableMetadata, v interface{}) error {
+	rt := reflect.TypeOf(v)
+	if rt.Kind() != reflect.Ptr || rt.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("validateSchema: expected a pointer to a struct, got %T", v)
+	}
+	rt = rt.Elem()
+
+	cols := make(map[string]vizierapipb.DataType)
+	for _, c := range metadata.ColInfo {
+		cols[c.Name] = c.Type
+	}
+
+	var problems []string
+	for i := 0; i < rt.NumField(); i++ {
+		f := rt.Field(i)
+		tag, ok := f.Tag.Lookup("px")
+		if !ok || tag == "-" {
+			continue
+		}
+		opts := strings.Split(tag, ",")
+		col := opts[0]
+		optional := len(opts) > 1 && opts[1] == "optional"
+
+		got, ok := cols[col]
+		if !ok {
+			if !optional {
+				problems = append(problems, fmt.Sprintf("missing column %q", col))
+			}
+			continue
+		}
+		want := columnTypes(f.Type)
+		if !containsType(want, got) {
+			problems = append(problems, fmt.Sprintf("column %q is %s, expected %s", col, got, want[0]))
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("table %q doesn't have the expected schema: %s", metadata.Name, strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// columnTypes returns the column types that can be decoded into a field of type t.
+func columnTypes(t reflect.Type) []vizierapipb.DataType {
+	switch t {
+	case timeType:
+		return []vizierapipb.DataType{vizierapipb.TIME64NS}
+	case durationType:
+		return []vizierapipb.DataType{vizierapipb.INT64}
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return []vizierapipb.DataType{vizierapipb.STRING}
+	case reflect.Bool:
+		return []vizierapipb.DataType{vizierapipb.BOOLEAN}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return []vizierapipb.DataType{vizierapipb.INT64}
+	case reflect.Float32, reflect.Float64:
+		return []vizierapipb.DataType{vizierapipb.FLOAT64, vizierapipb.INT64}
+	}
+	return []vizierapipb.DataType{vizierapipb.DATA_TYPE_UNKNOWN}
+}
+
+func containsType(ts []vizierapipb.DataType, t vizierapipb.DataType) bool {
+	for _, c := range ts {
+		if c == t {
+			return true
+		}
+	}
+	return false
+}
+
+func setField(f reflect.Value, d types.Datum) error {
+	switch f.Type() {
+	case timeType:
+		v, err := datum.AsTime(d)
+		if err != nil {
+			return err
+		}
+		f.Set(reflect.ValueOf(v))
+		return nil
+	case durationType:
+		v, err := datum.AsDuration(d)
+		if err != nil {
+			return err
+		}
+		f.SetInt(int64(v))
+		return nil
+	}
+
+	switch f.Kind() {
+	case reflect.String:
+		v, err := datum.AsString(d)
+		if err != nil {
+			return err
+		}
+		f.SetString(v)
+	case reflect.Bool:
+		v, err := datum.AsBool(d)
+		if err != nil {
+			return err
+		}
+		f.SetBool(v)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		v, err := datum.AsInt64(d)
+		if err != nil {
+			return err
+		}
+		if f.OverflowInt(v) {
+			return fmt.Errorf("%d overflows %s", v, f.Type())
+		}
+		f.SetInt(v)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		v, err := datum.AsInt64(d)
+		if err != nil {
+			return err
+		}
+		if v < 0 || f.OverflowUint(uint64(v)) {
+			return fmt.Errorf("%d overflows %s", v, f.Type())
+		}
+		f.SetUint(uint64(v))
+	case reflect.Float32, reflect.Float64:
+		v, err := datum.AsFloat64(d)
+		if err != nil {
+			return err
+		}
+		f.SetFloat(v)
+	default:
+		return fmt.Errorf("unsupported field type %s", f.Type())
+	}
+	return nil
+}
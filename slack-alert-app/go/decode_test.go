@@ -0,0 +1,265 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"go.withpixie.dev/pixie/src/api/go/pxapi/types"
+	"go.withpixie.dev/pixie/src/api/public/vizierapipb"
+)
+
+// testColumn is a column of a record made by testRecord, with a bool, int64,
+// float64, string or time.Time value.
+type testColumn struct {
+	name  string
+	value interface{}
+}
+
+// testRecord returns a record with the given columns.
+func testRecord(cols ...testColumn) *types.Record {
+	md := &types.TableMetadata{Name: "test", ColIdxByName: make(map[string]int64)}
+	r := &types.Record{TableMetadata: md}
+	for i, c := range cols {
+		var d types.Datum
+		switch v := c.value.(type) {
+		case bool:
+			b := types.NewBooleanValue(&types.ColSchema{Name: c.name, Type: vizierapipb.BOOLEAN})
+			b.ScalarValue(v)
+			d = b
+		case int64:
+			n := types.NewInt64Value(&types.ColSchema{Name: c.name, Type: vizierapipb.INT64})
+			n.ScalarValue(v)
+			d = n
+		case float64:
+			f := types.NewFloat64Value(&types.ColSchema{Name: c.name, Type: vizierapipb.FLOAT64})
+			f.ScalarValue(v)
+			d = f
+		case string:
+			s := types.NewStringValue(&types.ColSchema{Name: c.name, Type: vizierapipb.STRING})
+			s.ScalarValue(v)
+			d = s
+		case time.Time:
+			ts := types.NewTime64NSValue(&types.ColSchema{Name: c.name, Type: vizierapipb.TIME64NS})
+			ts.ScalarValue(v.UnixNano())
+			d = ts
+		default:
+			panic("unsupported test column value")
+		}
+		md.ColInfo = append(md.ColInfo, types.ColSchema{Name: c.name, Type: d.Type()})
+		md.ColIdxByName[c.name] = int64(i)
+		r.Data = append(r.Data, d)
+	}
+	return r
+}
+
+type decodeTestRow struct {
+	Service  string        `px:"service"`
+	Endpoint string        `px:"endpoint,optional"`
+	Errors   int64         `px:"error_count"`
+	Rate     float64       `px:"rate"`
+	Latency  time.Duration `px:"latency,optional"`
+	Time     time.Time     `px:"time_,optional"`
+	Healthy  bool          `px:"healthy,optional"`
+	Pods     uint8         `px:"pods,optional"`
+	Replicas int8          `px:"replicas,optional"`
+	Untagged string
+	Skipped  string `px:"-"`
+}
+
+func TestDecodeRecord(t *testing.T) {
+	ts := time.Date(2021, 2, 8, 12, 0, 0, 0, time.UTC)
+	required := []testColumn{{"service", "px-sock-shop/orders"}, {"error_count", int64(40)}, {"rate", 0.4}}
+	with := func(cols ...testColumn) []testColumn {
+		return append(append([]testColumn{}, required...), cols...)
+	}
+	for _, tt := range []struct {
+		name    string
+		cols    []testColumn
+		want    decodeTestRow
+		wantErr string
+	}{
+		{
+			name: "required columns",
+			cols: required,
+			want: decodeTestRow{Service: "px-sock-shop/orders", Errors: 40, Rate: 0.4},
+		},
+		{
+			name: "every column",
+			cols: with(testColumn{"endpoint", "/orders"}, testColumn{"latency", int64(1500000)}, testColumn{"time_", ts},
+				testColumn{"healthy", true}, testColumn{"pods", int64(3)}, testColumn{"replicas", int64(-1)},
+				testColumn{"Untagged", "x"}, testColumn{"-", "x"}, testColumn{"extra", "ignored"}),
+			want: decodeTestRow{Service: "px-sock-shop/orders", Endpoint: "/orders", Errors: 40, Rate: 0.4,
+				Latency: 1500 * time.Microsecond, Time: ts, Healthy: true, Pods: 3, Replicas: -1},
+		},
+		{
+			name: "integer into float",
+			cols: []testColumn{{"service", "s"}, {"error_count", int64(1)}, {"rate", int64(2)}},
+			want: decodeTestRow{Service: "s", Errors: 1, Rate: 2},
+		},
+		{
+			name:    "missing required column",
+			cols:    []testColumn{{"service", "s"}, {"rate", 0.4}},
+			wantErr: `missing column "error_count"`,
+		},
+		{
+			name:    "string into int64",
+			cols:    []testColumn{{"service", "s"}, {"error_count", "40"}, {"rate", 0.4}},
+			wantErr: `column "error_count": cannot convert STRING to int64`,
+		},
+		{
+			name:    "int64 into string",
+			cols:    []testColumn{{"service", int64(1)}, {"error_count", int64(40)}, {"rate", 0.4}},
+			wantErr: `column "service": cannot convert INT64 to string`,
+		},
+		{
+			name:    "float into int64",
+			cols:    []testColumn{{"service", "s"}, {"error_count", 40.5}, {"rate", 0.4}},
+			wantErr: `column "error_count": cannot convert FLOAT64 to int64`,
+		},
+		{
+			name:    "optional column of the wrong type",
+			cols:    with(testColumn{"healthy", "yes"}),
+			wantErr: `column "healthy": cannot convert STRING to bool`,
+		},
+		{
+			name:    "int64 into time",
+			cols:    with(testColumn{"time_", int64(1)}),
+			wantErr: `column "time_": cannot convert INT64 to time.Time`,
+		},
+		{
+			name:    "overflows uint8",
+			cols:    with(testColumn{"pods", int64(256)}),
+			wantErr: `column "pods": 256 overflows uint8`,
+		},
+		{
+			name:    "negative into uint8",
+			cols:    with(testColumn{"pods", int64(-1)}),
+			wantErr: `column "pods": -1 overflows uint8`,
+		},
+		{
+			name:    "overflows int8",
+			cols:    with(testColumn{"replicas", int64(128)}),
+			wantErr: `column "replicas": 128 overflows int8`,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var got decodeTestRow
+			err := decodeRecord(testRecord(tt.cols...), &got)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("got error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !got.Time.Equal(tt.want.Time) {
+				t.Errorf("got time %v, want %v", got.Time, tt.want.Time)
+			}
+			got.Time, tt.want.Time = time.Time{}, time.Time{}
+			if got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeRecordTarget(t *testing.T) {
+	r := testRecord(testColumn{"service", "s"}, testColumn{"tags", "a,b"})
+	var row decodeTestRow
+	for _, tt := range []struct {
+		name    string
+		v       interface{}
+		wantErr string
+	}{
+		{name: "struct", v: row, wantErr: "expected a pointer to a struct, got main.decodeTestRow"},
+		{name: "pointer to a string", v: new(string), wantErr: "expected a pointer to a struct, got *string"},
+		{name: "unsupported field", v: &struct {
+			Tags []string `px:"tags"`
+		}{}, wantErr: `column "tags": unsupported field type []string`},
+	} {
+		err := decodeRecord(r, tt.v)
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%s: got error %v, want %q", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestValidateSchema(t *testing.T) {
+	schema := func(cols ...types.ColSchema) types.TableMetadata {
+		return types.TableMetadata{Name: "http_table", ColInfo: cols}
+	}
+	str := func(name string) types.ColSchema { return types.ColSchema{Name: name, Type: vizierapipb.STRING} }
+	i64 := func(name string) types.ColSchema { return types.ColSchema{Name: name, Type: vizierapipb.INT64} }
+	f64 := func(name string) types.ColSchema { return types.ColSchema{Name: name, Type: vizierapipb.FLOAT64} }
+	for _, tt := range []struct {
+		name    string
+		md      types.TableMetadata
+		wantErr string
+	}{
+		{name: "required columns", md: schema(str("service"), i64("error_count"), f64("rate"))},
+		{name: "integer rate", md: schema(str("service"), i64("error_count"), i64("rate"))},
+		{
+			name: "every column",
+			md: schema(str("service"), str("endpoint"), i64("error_count"), f64("rate"), i64("latency"),
+				types.ColSchema{Name: "time_", Type: vizierapipb.TIME64NS}, types.ColSchema{Name: "healthy", Type: vizierapipb.BOOLEAN},
+				i64("pods"), i64("replicas"), str("extra")),
+		},
+		{
+			name:    "missing required columns",
+			md:      schema(str("service")),
+			wantErr: `table "http_table" doesn't have the expected schema: missing column "error_count"; missing column "rate"`,
+		},
+		{
+			name:    "wrong types",
+			md:      schema(i64("service"), f64("error_count"), str("rate")),
+			wantErr: `table "http_table" doesn't have the expected schema: column "service" is INT64, expected STRING; column "error_count" is FLOAT64, expected INT64; column "rate" is STRING, expected FLOAT64`,
+		},
+		{
+			name:    "optional column of the wrong type",
+			md:      schema(str("service"), i64("error_count"), f64("rate"), str("latency"), i64("time_")),
+			wantErr: `table "http_table" doesn't have the expected schema: column "latency" is STRING, expected INT64; column "time_" is INT64, expected TIME64NS`,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateSchema(tt.md, &decodeTestRow{})
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("got error %v, want none", err)
+				}
+				return
+			}
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("got error %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+
+	if err := validateSchema(schema(), decodeTestRow{}); err == nil || !strings.Contains(err.Error(), "expected a pointer to a struct") {
+		t.Errorf("got error %v for a struct, want it to need a pointer", err)
+	}
+	unsupported := &struct {
+		Tags []string `px:"tags"`
+	}{}
+	if err := validateSchema(schema(str("tags")), unsupported); err == nil || !strings.Contains(err.Error(), `column "tags" is STRING, expected DATA_TYPE_UNKNOWN`) {
+		t.Errorf("got error %v for an unsupported field, want it to expect no type", err)
+	}
+}
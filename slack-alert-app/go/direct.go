@@ -0,0 +1,299 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"go.withpixie.dev/pixie/src/api/go/pxapi"
+	"go.withpixie.dev/pixie/src/api/go/pxapi/errdefs"
+	"go.withpixie.dev/pixie/src/api/go/pxapi/types"
+	"go.withpixie.dev/pixie/src/api/public/vizierapipb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+)
+
+// DirectClusterConfig is a cluster whose Vizier is queried directly over
+// gRPC instead of through Pixie Cloud, such as from a bot running in the
+// cluster, so that results don't pass through Pixie Cloud.
+type DirectClusterConfig struct {
+	Name string `yaml:"name"`
+	// ID of the cluster, sent with every script and used to keep track of its
+	// incidents. Defaults to the name.
+	ID string `yaml:"id"`
+	// Address of Vizier's API, such as vizier-query-broker-svc.pl.svc:50300.
+	Addr string `yaml:"addr"`
+	// Connect without TLS, such as through a service mesh that encrypts traffic.
+	Insecure bool `yaml:"insecure"`
+	// PEM file of the CA certificates to verify Vizier's certificate with,
+	// instead of the system's.
+	CAFile string `yaml:"caFile"`
+	// Don't verify Vizier's certificate, such as when it is self-signed.
+	InsecureSkipVerify bool `yaml:"insecureSkipVerify"`
+}
+
+// newDirectCluster returns a cluster whose scripts run on its Vizier
+// directly, sending the Pixie API key as they would through Pixie Cloud.
+func newDirectCluster(cfg DirectClusterConfig, loadKey func() (string, error), labels clusterLabels) (*cluster, error) {
+	id := cfg.ID
+	if id == "" {
+		id = cfg.Name
+	}
+	creds, err := directCredentials(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("direct cluster %s: %w", cfg.Name, err)
+	}
+	exec, err := newDirectExecutor(cfg.Addr, id, creds, loadKey)
+	if err != nil {
+		return nil, fmt.Errorf("direct cluster %s: %w", cfg.Name, err)
+	}
+	return &cluster{Cluster: Cluster{ID: id, Name: cfg.Name, Labels: labels.For(id, cfg.Name)}, executor: exec}, nil
+}
+
+// directCredentials returns how to secure the connection to a direct cluster.
+func directCredentials(cfg DirectClusterConfig) (grpc.DialOption, error) {
+	if cfg.Insecure {
+		return grpc.WithInsecure(), nil
+	}
+	tlsConfig := &tls.Config{InsecureSkipVerify: cfg.InsecureSkipVerify}
+	if cfg.CAFile != "" {
+		b, err := ioutil.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("no certificates found in %s", cfg.CAFile)
+		}
+	}
+	return grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)), nil
+}
+
+// directExecutor is a ScriptExecutor that runs scripts on a Vizier over its
+// gRPC API. The connection is made once and reconnects by itself.
+type directExecutor struct {
+	clusterID string
+	client    vizierapipb.VizierServiceClient
+	loadKey   func() (string, error)
+}
+
+func newDirectExecutor(addr, clusterID string, creds grpc.DialOption, loadKey func() (string, error)) (*directExecutor, error) {
+	conn, err := grpc.Dial(addr, creds)
+	if err != nil {
+		return nil, err
+	}
+	return &directExecutor{clusterID: clusterID, client: vizierapipb.NewVizierServiceClient(conn), loadKey: loadKey}, nil
+}
+
+func (e *directExecutor) ExecuteScript(ctx context.Context, pxl string, mux pxapi.TableMuxer) (ScriptResults, error) {
+	key, err := e.loadKey()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	req := &vizierapipb.ExecuteScriptRequest{ClusterID: e.clusterID, QueryStr: pxl}
+	stream, err := e.client.ExecuteScript(metadata.AppendToOutgoingContext(ctx, "pixie-api-key", key), req)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return &directResults{ctx: ctx, cancel: cancel, stream: stream, mux: mux, tables: make(map[string]*directTable)}, nil
+}
+
+// directTable is a table a script is streaming, with its handler.
+type directTable struct {
+	metadata *types.TableMetadata
+	handler  pxapi.TableRecordHandler
+}
+
+// directResults decodes the stream of a script run by a directExecutor,
+// sending each table's records to the handler the TableMuxer picked for it.
+type directResults struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	stream vizierapipb.VizierService_ExecuteScriptClient
+	mux    pxapi.TableMuxer
+	// Tables by their ID.
+	tables map[string]*directTable
+	stats  *pxapi.ResultsStats
+}
+
+func (r *directResults) Stream() error {
+	for {
+		res, err := r.stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := r.handle(res); err != nil {
+			return err
+		}
+	}
+}
+
+func (r *directResults) handle(res *vizierapipb.ExecuteScriptResponse) error {
+	if s := res.Status; s != nil && s.Code != int32(codes.OK) {
+		return directStatusError(s)
+	}
+	if md := res.GetMetaData(); md != nil {
+		return r.handleMetadata(md)
+	}
+	data := res.GetData()
+	if data == nil {
+		return nil
+	}
+	if s := data.ExecutionStats; s != nil {
+		r.stats = &pxapi.ResultsStats{
+			AcceptedTablesCount: len(r.tables),
+			ExecutionTime:       time.Duration(s.GetTiming().GetExecutionTimeNs()),
+			CompilationTime:     time.Duration(s.GetTiming().GetCompilationTimeNs()),
+			BytesProcessed:      s.BytesProcessed,
+			RecordsProcessed:    s.RecordsProcessed,
+		}
+	}
+	if b := data.Batch; b != nil {
+		return r.handleBatch(b)
+	}
+	return nil
+}
+
+func (r *directResults) handleMetadata(md *vizierapipb.QueryMetadata) error {
+	tm := &types.TableMetadata{Name: md.Name, ID: md.ID, ColIdxByName: make(map[string]int64)}
+	for i, col := range md.GetRelation().GetColumns() {
+		typ := col.ColumnType
+		// UINT128 values, such as UPIDs, are decoded as hex strings, like
+		// recorded ones.
+		if typ == vizierapipb.UINT128 {
+			typ = vizierapipb.STRING
+		}
+		tm.ColInfo = append(tm.ColInfo, types.ColSchema{Name: col.ColumnName, Type: typ, SemanticType: col.ColumnSemanticType})
+		tm.ColIdxByName[col.ColumnName] = int64(i)
+	}
+	h, err := r.mux.AcceptTable(r.ctx, *tm)
+	if err != nil {
+		return fmt.Errorf("accepting table %s: %w", md.Name, err)
+	}
+	r.tables[md.ID] = &directTable{metadata: tm, handler: h}
+	return h.HandleInit(r.ctx, *tm)
+}
+
+func (r *directResults) handleBatch(b *vizierapipb.RowBatchData) error {
+	t, ok := r.tables[b.TableID]
+	if !ok {
+		return fmt.Errorf("%w: rows of table %s before its metadata", errdefs.ErrInternal, b.TableID)
+	}
+	if len(b.Cols) != len(t.metadata.ColInfo) {
+		return fmt.Errorf("%w: batch of table %s has %d columns, expected %d", errdefs.ErrInternal, t.metadata.Name, len(b.Cols), len(t.metadata.ColInfo))
+	}
+	for row := 0; row < int(b.NumRows); row++ {
+		rec := &types.Record{TableMetadata: t.metadata}
+		for i, col := range b.Cols {
+			d, err := directDatum(&t.metadata.ColInfo[i], col, row)
+			if err != nil {
+				return fmt.Errorf("%w: column %s of table %s: %v", errdefs.ErrInternal, t.metadata.ColInfo[i].Name, t.metadata.Name, err)
+			}
+			rec.Data = append(rec.Data, d)
+		}
+		if err := t.handler.HandleRecord(r.ctx, rec); err != nil {
+			return err
+		}
+	}
+	if b.Eos {
+		return t.handler.HandleDone(r.ctx)
+	}
+	return nil
+}
+
+// directDatum returns the value of a column in a row of a batch.
+func directDatum(schema *types.ColSchema, col *vizierapipb.Column, row int) (types.Datum, error) {
+	switch c := col.ColData.(type) {
+	case *vizierapipb.Column_BooleanData:
+		if row < len(c.BooleanData.GetData()) {
+			d := types.NewBooleanValue(schema)
+			d.ScalarValue(c.BooleanData.Data[row])
+			return d, nil
+		}
+	case *vizierapipb.Column_Int64Data:
+		if row < len(c.Int64Data.GetData()) {
+			d := types.NewInt64Value(schema)
+			d.ScalarValue(c.Int64Data.Data[row])
+			return d, nil
+		}
+	case *vizierapipb.Column_Uint128Data:
+		if row < len(c.Uint128Data.GetData()) {
+			v := c.Uint128Data.Data[row]
+			d := types.NewStringValue(schema)
+			d.ScalarValue(fmt.Sprintf("%016x%016x", v.GetHigh(), v.GetLow()))
+			return d, nil
+		}
+	case *vizierapipb.Column_Time64NsData:
+		if row < len(c.Time64NsData.GetData()) {
+			d := types.NewTime64NSValue(schema)
+			d.ScalarValue(c.Time64NsData.Data[row])
+			return d, nil
+		}
+	case *vizierapipb.Column_Float64Data:
+		if row < len(c.Float64Data.GetData()) {
+			d := types.NewFloat64Value(schema)
+			d.ScalarValue(c.Float64Data.Data[row])
+			return d, nil
+		}
+	case *vizierapipb.Column_StringData:
+		if row < len(c.StringData.GetData()) {
+			d := types.NewStringValue(schema)
+			d.ScalarValue(c.StringData.Data[row])
+			return d, nil
+		}
+	default:
+		return nil, fmt.Errorf("unsupported column type %T", c)
+	}
+	return nil, errors.New("fewer values than rows")
+}
+
+// directStatusError converts an error status sent by Vizier to the errdefs
+// error pxapi returns for it, so that script errors aren't retried.
+func directStatusError(s *vizierapipb.Status) error {
+	for _, d := range s.ErrorDetails {
+		if e := d.GetCompilerError(); e != nil {
+			return fmt.Errorf("%w: line %d, column %d: %s", errdefs.ErrCompilation, e.Line, e.Column, e.Message)
+		}
+	}
+	if codes.Code(s.Code) == codes.InvalidArgument {
+		return fmt.Errorf("%w: %s", errdefs.ErrInvalidArgument, s.Message)
+	}
+	return fmt.Errorf("%w: %s", errdefs.ErrInternal, s.Message)
+}
+
+func (r *directResults) Close() error {
+	r.cancel()
+	return nil
+}
+
+func (r *directResults) Stats() *pxapi.ResultsStats {
+	return r.stats
+}
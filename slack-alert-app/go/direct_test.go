@@ -0,0 +1,104 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"go.withpixie.dev/pixie/src/api/public/cloudapipb"
+)
+
+func TestDirectClusters(t *testing.T) {
+	const id = "6ba7b810-9dad-11d1-80b4-00c04fd430c8"
+	table := httpTable(
+		[]string{"px-sock-shop/orders", "/orders", "40", "100"},
+		[]string{"px-sock-shop/orders", "/orders/new", "30", "100"},
+		[]string{"px-sock-shop/carts", "/carts", "0", "100"},
+	)
+	tlsVizier := newFakeVizier(t, "px-api-key", fakeVizierCluster{ID: id, Name: "prod", Status: cloudapipb.CS_HEALTHY})
+	plainVizier := newPlaintextFakeVizier(t, "px-api-key", fakeVizierCluster{ID: id, Name: "prod", Status: cloudapipb.CS_HEALTHY})
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := ioutil.WriteFile(caFile, tlsVizier.certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name   string
+		vizier *fakeVizier
+		cfg    DirectClusterConfig
+		// Whether the connection fails.
+		fails bool
+	}{
+		{name: "insecure", vizier: plainVizier, cfg: DirectClusterConfig{Insecure: true}},
+		{name: "ca file", vizier: tlsVizier, cfg: DirectClusterConfig{CAFile: caFile}},
+		{name: "skip verify", vizier: tlsVizier, cfg: DirectClusterConfig{InsecureSkipVerify: true}},
+		{name: "unverified", vizier: tlsVizier, fails: true},
+		{name: "TLS to plaintext", vizier: plainVizier, cfg: DirectClusterConfig{InsecureSkipVerify: true}, fails: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.vizier.reply(fakeVizierReply{Tables: []*recordedTable{table}})
+			cfg := tt.cfg
+			cfg.Name, cfg.ID, cfg.Addr = "prod", id, tt.vizier.addr
+			c, err := newDirectCluster(cfg, func() (string, error) { return "px-api-key", nil }, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			s, alerts := newTestTracker(t, defaultConfig().Defaults, staticClusters{c})
+			s.retry.attempts = 1
+			err = s.Check(context.Background())
+			if tt.fails {
+				if err == nil {
+					t.Error("check succeeded, want the connection to fail")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			alerts.AssertSeverity(t, "orders", SeverityWarning)
+			alerts.AssertNotAlertedFor(t, "carts")
+		})
+	}
+}
+
+func TestDirectClusterErrors(t *testing.T) {
+	const id = "6ba7b810-9dad-11d1-80b4-00c04fd430c8"
+	f := newPlaintextFakeVizier(t, "px-api-key", fakeVizierCluster{ID: id, Name: "prod", Status: cloudapipb.CS_HEALTHY})
+	for _, tt := range []struct {
+		name    string
+		id, key string
+		want    string
+	}{
+		{name: "unknown cluster", id: "6ba7b811-9dad-11d1-80b4-00c04fd430c8", key: "px-api-key", want: "NotFound"},
+		{name: "wrong API key", id: id, key: "revoked", want: "Unauthenticated"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := newDirectCluster(DirectClusterConfig{Name: "prod", ID: tt.id, Addr: f.addr, Insecure: true}, func() (string, error) { return tt.key, nil }, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			s, _ := newTestTracker(t, defaultConfig().Defaults, staticClusters{c})
+			err = s.Check(context.Background())
+			if got := grpcCode(err).String(); got != tt.want {
+				t.Errorf("got %v, want %s", err, tt.want)
+			}
+		})
+	}
+}
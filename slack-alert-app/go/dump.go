@@ -0,0 +1,340 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"go.withpixie.dev/pixie/src/api/go/pxapi/types"
+)
+
+// dumpCommand runs a PxL script once, on a single cluster, and prints every
+// table it outputs, for writing and debugging rule scripts.
+func dumpCommand(args []string) error {
+	fs := flag.NewFlagSet("dump", flag.ExitOnError)
+	load, _ := configFlags(fs)
+	ruleName := fs.String("rule", "", "Rule whose script to run, instead of a script given as an argument.")
+	clusterName := fs.String("cluster", "", "Name or ID of the cluster to run the script on. Defaults to the first cluster.")
+	window := fs.Duration("window", 0, "Time window for the script to query. Defaults to the rule's interval.")
+	format := fs.String("format", "table", "Output format: table, json or csv.")
+	out := fs.String("out", "", "Directory to write each table to as <table>.csv or <table>.json, such as for -local-data, instead of printing them.")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: slackbot dump [flags] [script.pxl]\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	switch *format {
+	case "table", "json", "csv":
+	default:
+		return fmt.Errorf("unknown format %q, expected table, json or csv", *format)
+	}
+	if *out != "" && *format == "table" {
+		*format = "csv"
+	}
+	if (*ruleName == "") == (fs.NArg() == 0) {
+		return fmt.Errorf("give either a PxL script or -rule")
+	}
+
+	cfg, err := load()
+	if err != nil {
+		return err
+	}
+	var r Rule
+	if *ruleName != "" {
+		rules, err := cfg.loadRules()
+		if err != nil {
+			return err
+		}
+		found := false
+		for _, rule := range rules {
+			if rule.Name == *ruleName {
+				r, found = rule, true
+			}
+		}
+		if !found {
+			return fmt.Errorf("unknown rule %q", *ruleName)
+		}
+	} else {
+		// Scripts are rendered with the default rule's variables, such as its namespaces.
+		path := fs.Arg(0)
+		r = Rule{Name: strings.TrimSuffix(filepath.Base(path), filepath.Ext(path)), Script: path}
+		if err := r.applyDefaults(cfg.Defaults); err != nil {
+			return err
+		}
+	}
+	if *window == 0 {
+		*window = r.Interval.Duration
+	}
+	script, err := loadRuleScript(r)
+	if err != nil {
+		return err
+	}
+	pxl, err := script.Render(newScriptVars(r, *window))
+	if err != nil {
+		return fmt.Errorf("rendering PxL script: %w", err)
+	}
+
+	ctx := context.Background()
+	c, err := dumpCluster(ctx, cfg, *clusterName)
+	if err != nil {
+		return err
+	}
+	tables, err := runDump(ctx, c, pxl, r.Timeout.Duration)
+	if err != nil {
+		return fmt.Errorf("running script on cluster %s: %w", c.Name, err)
+	}
+
+	if *out != "" {
+		if err := os.MkdirAll(*out, 0o755); err != nil {
+			return err
+		}
+		for _, t := range tables {
+			path := filepath.Join(*out, keyUnsafe.ReplaceAllString(t.name, "_")+"."+*format)
+			if err := writeDumpFile(path, t, *format); err != nil {
+				return err
+			}
+			fmt.Printf("Wrote %d rows of table %s to %s.\n", len(t.records), t.name, path)
+		}
+		return nil
+	}
+	switch *format {
+	case "json":
+		return writeDumpJSON(os.Stdout, tables)
+	case "csv":
+		for i, t := range tables {
+			if i > 0 {
+				fmt.Println()
+			}
+			fmt.Printf("# %s\n", t.name)
+			if err := writeDumpCSV(os.Stdout, t); err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		for i, t := range tables {
+			if i > 0 {
+				fmt.Println()
+			}
+			writeDumpTable(os.Stdout, t)
+		}
+		return nil
+	}
+}
+
+// dumpCluster returns the cluster with the given name or ID, or the first
+// cluster if name is empty: the local cluster with -local-data, or else one
+// of the clusters the config monitors.
+func dumpCluster(ctx context.Context, cfg *Config, name string) (*cluster, error) {
+	if cfg.ReplayDir != "" {
+		return nil, fmt.Errorf("dump runs scripts, so it can't replay recordings")
+	}
+	var source clusterSource
+	if cfg.LocalDataDir != "" {
+		source = staticClusters{newLocalDataCluster(cfg.LocalDataDir)}
+	} else {
+		a := &app{}
+		if err := a.connectPixie(ctx, cfg); err != nil {
+			return nil, err
+		}
+		source = a.clusters
+	}
+	clusters, err := source.Clusters(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range clusters {
+		if name == "" || c.Name == name || c.ID == name {
+			return c, nil
+		}
+	}
+	return nil, fmt.Errorf("no cluster named %q", name)
+}
+
+// dumpedTable is a table output by a script run with dump.
+type dumpedTable struct {
+	name     string
+	metadata types.TableMetadata
+	records  []*types.Record
+}
+
+// runDump runs pxl on c and returns every table it output, sorted by name.
+func runDump(ctx context.Context, c *cluster, pxl string, timeout time.Duration) ([]dumpedTable, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	exec, err := c.scriptExecutor(ctx)
+	if err != nil {
+		return nil, err
+	}
+	mux := newTableMux()
+	mux.keepOthers = true
+	results, err := exec.ExecuteScript(ctx, pxl, mux)
+	if err != nil {
+		return nil, err
+	}
+	defer results.Close()
+	if err := results.Stream(); err != nil {
+		return nil, err
+	}
+
+	var tables []dumpedTable
+	for name, collector := range mux.Others() {
+		metadata, _, records, err := collector.GetRecordsSync(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("table %s: %w", name, err)
+		}
+		tables = append(tables, dumpedTable{name: name, metadata: metadata, records: records})
+	}
+	sort.Slice(tables, func(i, j int) bool { return tables[i].name < tables[j].name })
+	return tables, nil
+}
+
+// writeDumpTable writes a table as aligned columns, under a row of column
+// names and a row of their types.
+func writeDumpTable(w io.Writer, t dumpedTable) {
+	fmt.Fprintf(w, "%s (%d rows)\n", t.name, len(t.records))
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	names := make([]string, len(t.metadata.ColInfo))
+	kinds := make([]string, len(t.metadata.ColInfo))
+	for i, col := range t.metadata.ColInfo {
+		names[i] = col.Name
+		kinds[i] = col.Type.String()
+	}
+	fmt.Fprintln(tw, strings.Join(names, "\t"))
+	fmt.Fprintln(tw, strings.Join(kinds, "\t"))
+	for _, r := range t.records {
+		fmt.Fprintln(tw, strings.Join(dumpRow(r), "\t"))
+	}
+	tw.Flush()
+}
+
+// writeDumpCSV writes a table as CSV with a header row, in the format read by -local-data.
+func writeDumpCSV(w io.Writer, t dumpedTable) error {
+	cw := csv.NewWriter(w)
+	names := make([]string, len(t.metadata.ColInfo))
+	for i, col := range t.metadata.ColInfo {
+		names[i] = col.Name
+	}
+	if err := cw.Write(names); err != nil {
+		return err
+	}
+	for _, r := range t.records {
+		if err := cw.Write(dumpRow(r)); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// writeDumpJSON writes the tables as a JSON object of each table's rows,
+// keyed by table name.
+func writeDumpJSON(w io.Writer, tables []dumpedTable) error {
+	out := make(map[string][]map[string]interface{}, len(tables))
+	for _, t := range tables {
+		out[t.name] = dumpObjects(t)
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(out)
+}
+
+// writeDumpFile writes a table to path in the given format. JSON files are
+// an array of the table's rows, in the format read by -local-data.
+func writeDumpFile(path string, t dumpedTable, format string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if format == "json" {
+		enc := json.NewEncoder(f)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(dumpObjects(t))
+	} else {
+		err = writeDumpCSV(f, t)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// dumpRow formats each value of a record. Times are RFC 3339.
+func dumpRow(r *types.Record) []string {
+	row := make([]string, len(r.Data))
+	for i, d := range r.Data {
+		switch v := d.(type) {
+		case *types.Time64NSValue:
+			row[i] = v.Value().UTC().Format(time.RFC3339Nano)
+		case *types.Float64Value:
+			row[i] = strconv.FormatFloat(v.Value(), 'g', -1, 64)
+		case nil:
+		default:
+			row[i] = d.String()
+		}
+	}
+	return row
+}
+
+// dumpObjects returns each row of a table as an object keyed by column name.
+func dumpObjects(t dumpedTable) []map[string]interface{} {
+	objects := make([]map[string]interface{}, 0, len(t.records))
+	for _, r := range t.records {
+		obj := make(map[string]interface{}, len(r.Data))
+		for i, d := range r.Data {
+			if i >= len(t.metadata.ColInfo) {
+				break
+			}
+			var v interface{}
+			switch d := d.(type) {
+			case *types.BooleanValue:
+				v = d.Value()
+			case *types.Int64Value:
+				v = d.Value()
+			case *types.Float64Value:
+				if f := d.Value(); math.IsNaN(f) || math.IsInf(f, 0) {
+					v = strconv.FormatFloat(f, 'g', -1, 64)
+				} else {
+					v = f
+				}
+			case *types.Time64NSValue:
+				v = d.Value().UTC().Format(time.RFC3339Nano)
+			case nil:
+			default:
+				v = d.String()
+			}
+			obj[t.metadata.ColInfo[i].Name] = v
+		}
+		objects = append(objects, obj)
+	}
+	return objects
+}
@@ -0,0 +1,64 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+)
+
+// sopsMetadata matches the top level sops key that sops adds to the files it encrypts.
+var sopsMetadata = regexp.MustCompile(`(?m)^sops:\s*$`)
+
+// readConfigFile reads the config file at path, decrypting it first if it
+// was encrypted with sops, or with age if its name ends in .age. Decryption
+// is done by the sops and age commands, which must be on the PATH, so that
+// every key management option they support works, such as age keys in
+// SOPS_AGE_KEY_FILE or AWS KMS.
+func readConfigFile(path string) ([]byte, error) {
+	if strings.HasSuffix(path, ".age") {
+		identity := os.Getenv("AGE_IDENTITY_FILE")
+		if identity == "" {
+			return nil, fmt.Errorf("Please set AGE_IDENTITY_FILE environment variable to decrypt %s.", path)
+		}
+		return decrypt(path, "age", "--decrypt", "--identity", identity, path)
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if sopsMetadata.Match(b) {
+		return decrypt(path, "sops", "--decrypt", "--input-type", "yaml", "--output-type", "yaml", path)
+	}
+	return b, nil
+}
+
+func decrypt(path, name string, args ...string) ([]byte, error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command(name, args...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("decrypting %s with %s: %w: %s", path, name, err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
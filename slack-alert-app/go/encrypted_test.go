@@ -0,0 +1,126 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// fakeDecrypter puts a command with the given name on the PATH that writes
+// its arguments, one per line, to the returned file and then runs script.
+func fakeDecrypter(t *testing.T, name, script string) (argsFile string) {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("fake commands are shell scripts")
+	}
+	dir := t.TempDir()
+	argsFile = filepath.Join(dir, name+".args")
+	cmd := "#!/bin/sh\nfor a in \"$@\"; do echo \"$a\"; done > " + argsFile + "\n" + script + "\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(cmd), 0755); err != nil {
+		t.Fatal(err)
+	}
+	setenv(t, "PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	return argsFile
+}
+
+func readArgs(t *testing.T, path string) string {
+	t.Helper()
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("command wasn't run: %v", err)
+	}
+	return strings.Join(strings.Fields(string(b)), " ")
+}
+
+func TestReadConfigFileSops(t *testing.T) {
+	args := fakeDecrypter(t, "sops", "echo 'slack:'; echo '  token: xoxb-decrypted'")
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	encrypted := "slack:\n  token: ENC[AES256_GCM,data:abc=,type:str]\nsops:\n  age:\n    - recipient: age1example\n  version: 3.7.1\n"
+	if err := ioutil.WriteFile(path, []byte(encrypted), 0600); err != nil {
+		t.Fatal(err)
+	}
+	b, err := readConfigFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "slack:\n  token: xoxb-decrypted\n"; string(b) != want {
+		t.Errorf("got %q, want %q", b, want)
+	}
+	if got, want := readArgs(t, args), "--decrypt --input-type yaml --output-type yaml "+path; got != want {
+		t.Errorf("sops %s, want sops %s", got, want)
+	}
+}
+
+func TestReadConfigFilePlain(t *testing.T) {
+	args := fakeDecrypter(t, "sops", "exit 1")
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	// Keys under another key named sops don't make the file encrypted.
+	plain := "slack:\n  token: xoxb-plain\nalerters:\n  sops:\n    channel: '#sops'\n"
+	if err := ioutil.WriteFile(path, []byte(plain), 0600); err != nil {
+		t.Fatal(err)
+	}
+	b, err := readConfigFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != plain {
+		t.Errorf("got %q, want the file unchanged", b)
+	}
+	if _, err := os.Stat(args); err == nil {
+		t.Error("sops was run for a plain config file")
+	}
+}
+
+func TestReadConfigFileAge(t *testing.T) {
+	args := fakeDecrypter(t, "age", "echo 'slack:'; echo '  token: xoxb-decrypted'")
+	path := filepath.Join(t.TempDir(), "config.yaml.age")
+	if err := ioutil.WriteFile(path, []byte("age-encryption.org/v1\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	setenv(t, "AGE_IDENTITY_FILE", "")
+	if _, err := readConfigFile(path); err == nil || !strings.Contains(err.Error(), "AGE_IDENTITY_FILE") {
+		t.Errorf("got %v without an identity, want an error asking for AGE_IDENTITY_FILE", err)
+	}
+	setenv(t, "AGE_IDENTITY_FILE", "/keys/age.txt")
+	b, err := readConfigFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "slack:\n  token: xoxb-decrypted\n"; string(b) != want {
+		t.Errorf("got %q, want %q", b, want)
+	}
+	if got, want := readArgs(t, args), "--decrypt --identity /keys/age.txt "+path; got != want {
+		t.Errorf("age %s, want age %s", got, want)
+	}
+}
+
+func TestReadConfigFileDecryptError(t *testing.T) {
+	fakeDecrypter(t, "sops", "echo 'Failed to get the data key' >&2; exit 128")
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := ioutil.WriteFile(path, []byte("slack: {}\nsops:\n  version: 3.7.1\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	_, err := readConfigFile(path)
+	if err == nil || !strings.Contains(err.Error(), "decrypting "+path+" with sops: exit status 128: Failed to get the data key") {
+		t.Errorf("got %v, want the error sops printed", err)
+	}
+}
@@ -0,0 +1,367 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// RuleEngine runs the ServiceTracker of each rule independently, on the rule's own interval.
+type RuleEngine struct {
+	trackers []*ServiceTracker
+	// Number of failed checks in a row after which a rule is unhealthy, or 0
+	// if rules are never unhealthy.
+	unhealthyAfter int
+	// Where to alert about unhealthy rules.
+	unhealthy Alerter
+	// Longest time between the checks of an unhealthy rule.
+	maxBackoff time.Duration
+	// What to do about checks that weren't run when due: missedTicksCatchUp or missedTicksSkip.
+	missedTicks string
+	// Exporters, sinks and the archiver built for this engine, which are
+	// closed once it is replaced.
+	closers []io.Closer
+
+	mu     sync.Mutex
+	status map[string]*RuleStatus
+}
+
+// RuleStatus is the outcome of a rule's recent checks.
+type RuleStatus struct {
+	Rule        string    `json:"rule"`
+	LastCheck   time.Time `json:"lastCheck,omitempty"`
+	LastSuccess time.Time `json:"lastSuccess,omitempty"`
+	LastError   string    `json:"lastError,omitempty"`
+	// Number of checks in a row that have failed.
+	ConsecutiveFailures int `json:"consecutiveFailures"`
+}
+
+// Run runs every rule until ctx is cancelled. Checks run with work instead,
+// so that checks in flight when ctx is cancelled can finish, including
+// sending their alerts, unless work is cancelled too. Streaming rules stop
+// as soon as ctx is cancelled.
+func (e *RuleEngine) Run(ctx, work context.Context) {
+	var wg sync.WaitGroup
+	for _, t := range e.trackers {
+		wg.Add(1)
+		go func(t *ServiceTracker) {
+			defer wg.Done()
+			e.runRule(ctx, work, t)
+		}(t)
+	}
+	wg.Wait()
+}
+
+// runRule checks a rule right away and then every interval, until ctx is
+// cancelled. Failed checks are logged and retried on the next interval, which
+// backs off once the rule is unhealthy.
+func (e *RuleEngine) runRule(ctx, work context.Context, t *ServiceTracker) {
+	if t.rule.Streaming {
+		t.Stream(ctx)
+		return
+	}
+	if t.schedule != nil {
+		e.runScheduled(ctx, work, t)
+		return
+	}
+
+	// Ticks are compared by wall clock, which keeps running while the
+	// process is suspended, unlike the monotonic clock.
+	next := time.Now().Round(0)
+	for {
+		due := next
+		if !sleepJitter(ctx, t.rule.Jitter.Duration) {
+			return
+		}
+		start := time.Now()
+		err := recoverPanic(func() error { return t.Check(work) })
+		if work.Err() != nil {
+			// Checks cut short by a shutdown or reload don't count as failures.
+			return
+		}
+		var failures int
+		if !errors.Is(err, errNotLeader) {
+			failures = e.record(work, t.rule.Name, start, err, time.Now())
+		}
+
+		delay := e.backoff(t.rule.Interval.Duration, failures)
+		after := func(tick time.Time) time.Time { return tick.Add(delay) }
+		next = e.nextTick(t.rule.Name, after(due), after, time.Now().Round(0))
+		if !e.sleepUntilTick(ctx, t.rule.Name, &next, after) {
+			return
+		}
+	}
+}
+
+const (
+	// Run a single check right away for the ticks that were missed. It
+	// queries the whole time since the previous check, up to maxWindowIntervals.
+	missedTicksCatchUp = "catch-up"
+	// Wait for the next tick that is still to come.
+	missedTicksSkip = "skip"
+)
+
+// nextTick returns when to run the check due at next, given by after from
+// the previous tick. If next has already passed, because the previous check
+// overran or the process was suspended, the missed ticks are counted and the
+// check runs according to the engine's missed tick policy: right away, or at
+// the first tick after now.
+func (e *RuleEngine) nextTick(rule string, next time.Time, after func(time.Time) time.Time, now time.Time) time.Time {
+	if next.IsZero() || next.After(now) {
+		return next
+	}
+	missed := 0
+	for !next.IsZero() && !next.After(now) {
+		missed++
+		next = after(next)
+	}
+	metricMissedTicks.Add(float64(missed), rule)
+	logWarn("Missed checks.", "rule", rule, "missed", missed, "policy", e.missedTicks)
+	if e.missedTicks == missedTicksSkip {
+		return next
+	}
+	return now
+}
+
+// sleepUntilTick sleeps until next. If the sleep ran so long that the
+// following ticks were due too, such as when the process was suspended, next
+// is moved according to the missed tick policy, and sleeping continues if
+// it is still to come. It returns false if ctx was cancelled first.
+func (e *RuleEngine) sleepUntilTick(ctx context.Context, rule string, next *time.Time, after func(time.Time) time.Time) bool {
+	for {
+		timer := time.NewTimer(time.Until(*next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return false
+		case <-timer.C:
+		}
+		now := time.Now().Round(0)
+		following := after(*next)
+		if following.IsZero() || following.After(now) {
+			return true
+		}
+		if *next = e.nextTick(rule, following, after, now); !next.After(now) {
+			return true
+		}
+	}
+}
+
+// backoff returns the time between checks of a rule that has failed the
+// given number of checks in a row. Once the rule is unhealthy, it doubles
+// with each failure, up to maxBackoff.
+func (e *RuleEngine) backoff(interval time.Duration, failures int) time.Duration {
+	if e.unhealthyAfter == 0 || failures < e.unhealthyAfter {
+		return interval
+	}
+	d := interval
+	for i := e.unhealthyAfter; i <= failures && d < e.maxBackoff; i++ {
+		d *= 2
+	}
+	if d > e.maxBackoff && interval < e.maxBackoff {
+		d = e.maxBackoff
+	}
+	return d
+}
+
+// runScheduled checks a rule each time its cron schedule is due, until ctx is cancelled.
+func (e *RuleEngine) runScheduled(ctx, work context.Context, t *ServiceTracker) {
+	next := t.schedule.Next(time.Now().Round(0))
+	for {
+		if next.IsZero() {
+			logError("Schedule of rule never runs.", "rule", t.rule.Name, "schedule", t.schedule)
+			return
+		}
+		if !e.sleepUntilTick(ctx, t.rule.Name, &next, t.schedule.Next) {
+			return
+		}
+
+		due := next
+		if !sleepJitter(ctx, t.rule.Jitter.Duration) {
+			return
+		}
+		start := time.Now()
+		err := recoverPanic(func() error { return t.Check(work) })
+		if work.Err() != nil {
+			return
+		}
+		if !errors.Is(err, errNotLeader) {
+			e.record(work, t.rule.Name, start, err, time.Now())
+		}
+		next = e.nextTick(t.rule.Name, t.schedule.Next(due), t.schedule.Next, time.Now().Round(0))
+	}
+}
+
+// panicError is a panic recovered by recoverPanic.
+type panicError struct {
+	value interface{}
+}
+
+func (e *panicError) Error() string {
+	return fmt.Sprintf("panic: %v", e.value)
+}
+
+// recoverPanic runs fn, turning a panic into an error so that a bug
+// triggered by one malformed record or cluster fails the check instead of
+// taking down every rule. The stack is logged, since the error doesn't carry it.
+func recoverPanic(fn func() error) (err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			metricPanics.Inc()
+			logError("Recovered from panic.", "panic", fmt.Sprint(v), "stack", string(debug.Stack()))
+			err = &panicError{value: v}
+		}
+	}()
+	return fn()
+}
+
+// workerPool bounds the number of cluster queries running at the same time
+// across all rules, so that many rules don't overload Pixie Cloud while each
+// rule still runs on its own schedule.
+type workerPool struct {
+	slots chan struct{}
+}
+
+func newWorkerPool(size int) *workerPool {
+	return &workerPool{slots: make(chan struct{}, size)}
+}
+
+// Do runs fn once a worker is free, or returns ctx's error if it is cancelled first.
+func (p *workerPool) Do(ctx context.Context, fn func() error) error {
+	select {
+	case p.slots <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() { <-p.slots }()
+	return fn()
+}
+
+var (
+	jitterMu   sync.Mutex
+	jitterRand = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+// sleepJitter sleeps for a random duration up to max. It returns false if
+// ctx was cancelled first.
+func sleepJitter(ctx context.Context, max time.Duration) bool {
+	if max <= 0 {
+		return ctx.Err() == nil
+	}
+	jitterMu.Lock()
+	d := time.Duration(jitterRand.Int63n(int64(max)))
+	jitterMu.Unlock()
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// record updates a rule's status and metrics with the outcome of a check
+// that started at start, logs failures and recoveries, and alerts when the
+// rule becomes unhealthy and when it recovers. It returns the number of
+// checks in a row that have failed.
+func (e *RuleEngine) record(ctx context.Context, rule string, start time.Time, err error, now time.Time) int {
+	observeCheck(rule, now.Sub(start), err)
+	e.mu.Lock()
+	if e.status == nil {
+		e.status = make(map[string]*RuleStatus)
+	}
+	st, ok := e.status[rule]
+	if !ok {
+		st = &RuleStatus{Rule: rule}
+		e.status[rule] = st
+	}
+	st.LastCheck = now
+	prev := st.ConsecutiveFailures
+	if err != nil {
+		st.ConsecutiveFailures++
+		st.LastError = err.Error()
+		logError("Error running rule.", "rule", rule, "duration", now.Sub(start), "consecutive_failures", st.ConsecutiveFailures, "error", err)
+	} else {
+		if prev > 0 {
+			logInfo("Rule recovered.", "rule", rule, "failed_checks", prev)
+		}
+		logInfo("Check finished.", "rule", rule, "duration", now.Sub(start))
+		st.ConsecutiveFailures = 0
+		st.LastError = ""
+		st.LastSuccess = now
+	}
+	cur := st.ConsecutiveFailures
+	e.mu.Unlock()
+
+	// Alert without holding the lock, since Slack may be slow.
+	var msgErr error
+	switch n := e.unhealthyAfter; {
+	case n > 0 && cur == n:
+		msgErr = e.unhealthy.SendAlert(ctx, fmt.Sprintf(":skull: The Pixie alert bot itself is unhealthy: rule %s has failed %d checks in a row, "+
+			"so its alerts can't be trusted. Checking less often until it recovers. Last error: %v", rule, n, err))
+	case n > 0 && prev >= n && cur == 0:
+		msgErr = e.unhealthy.SendInfo(ctx, fmt.Sprintf(":white_check_mark: The Pixie alert bot is healthy again: rule %s recovered after %d failed checks.", rule, prev))
+	}
+	if msgErr != nil {
+		logError("Error sending unhealthy alert.", "rule", rule, "error", msgErr)
+	}
+	return cur
+}
+
+// Status returns the status of each rule that has been checked, in the order of the rules.
+func (e *RuleEngine) Status() []RuleStatus {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	var status []RuleStatus
+	for _, t := range e.trackers {
+		if st, ok := e.status[t.rule.Name]; ok {
+			status = append(status, *st)
+		}
+	}
+	return status
+}
+
+// Close closes the resources built for the engine. It's called once the
+// engine's checks have finished, but on-demand checks may still use them, so
+// closing only drops idle connections.
+func (e *RuleEngine) Close() {
+	closeAll(e.closers)
+}
+
+func closeAll(closers []io.Closer) {
+	for _, c := range closers {
+		if err := c.Close(); err != nil {
+			logError("Error closing the resources of a config.", "type", fmt.Sprintf("%T", c), "error", err)
+		}
+	}
+}
+
+// newHTTPClient returns a client with its own connection pool, so that the
+// connections of an engine's exporters can be closed with the engine.
+func newHTTPClient(timeout time.Duration) *http.Client {
+	return &http.Client{Timeout: timeout, Transport: http.DefaultTransport.(*http.Transport).Clone()}
+}
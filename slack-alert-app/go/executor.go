@@ -0,0 +1,116 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"go.withpixie.dev/pixie/src/api/go/pxapi"
+	"go.withpixie.dev/pixie/src/api/go/pxapi/types"
+)
+
+// ScriptExecutor runs PxL scripts against a cluster, sending their output
+// tables to mux. It is implemented for Vizier by vizierExecutor, and by
+// staticExecutor to run checks without a cluster.
+type ScriptExecutor interface {
+	ExecuteScript(ctx context.Context, pxl string, mux pxapi.TableMuxer) (ScriptResults, error)
+}
+
+// ScriptResults are the results of a script started by a ScriptExecutor.
+type ScriptResults interface {
+	// Stream sends the output tables to the TableMuxer, returning once the
+	// script is done.
+	Stream() error
+	Close() error
+	// Stats returns the stats of the script's execution, or nil if there are none.
+	Stats() *pxapi.ResultsStats
+}
+
+// vizierExecutor runs scripts on a Vizier through pxapi.
+type vizierExecutor struct {
+	vz *pxapi.VizierClient
+}
+
+func (e vizierExecutor) ExecuteScript(ctx context.Context, pxl string, mux pxapi.TableMuxer) (ScriptResults, error) {
+	rs, err := e.vz.ExecuteScript(ctx, pxl, mux)
+	if err != nil {
+		// Not a nil *pxapi.ScriptResults in a non-nil interface.
+		return nil, err
+	}
+	return rs, nil
+}
+
+// staticTable is a table output by a staticExecutor.
+type staticTable struct {
+	Metadata types.TableMetadata
+	Records  []*types.Record
+	// Whether the table stops without being finished, as when a stream is cut short.
+	Unfinished bool
+}
+
+// staticExecutor is a ScriptExecutor that ignores the script and replays the
+// same canned tables on every execution, in order.
+type staticExecutor struct {
+	tables []staticTable
+	stats  *pxapi.ResultsStats
+}
+
+func newStaticExecutor(tables ...staticTable) *staticExecutor {
+	return &staticExecutor{tables: tables}
+}
+
+func (e *staticExecutor) ExecuteScript(ctx context.Context, pxl string, mux pxapi.TableMuxer) (ScriptResults, error) {
+	return &staticResults{ctx: ctx, mux: mux, exec: e}, nil
+}
+
+type staticResults struct {
+	ctx  context.Context
+	mux  pxapi.TableMuxer
+	exec *staticExecutor
+}
+
+func (r *staticResults) Stream() error {
+	for _, t := range r.exec.tables {
+		h, err := r.mux.AcceptTable(r.ctx, t.Metadata)
+		if err != nil {
+			return fmt.Errorf("accepting table %s: %w", t.Metadata.Name, err)
+		}
+		if err := h.HandleInit(r.ctx, t.Metadata); err != nil {
+			return err
+		}
+		for _, rec := range t.Records {
+			if err := r.ctx.Err(); err != nil {
+				return err
+			}
+			if err := h.HandleRecord(r.ctx, rec); err != nil {
+				return err
+			}
+		}
+		if t.Unfinished {
+			continue
+		}
+		if err := h.HandleDone(r.ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *staticResults) Close() error { return nil }
+
+func (r *staticResults) Stats() *pxapi.ResultsStats { return r.exec.stats }
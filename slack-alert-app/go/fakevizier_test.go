@@ -0,0 +1,347 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.withpixie.dev/pixie/src/api/public/cloudapipb"
+	"go.withpixie.dev/pixie/src/api/public/uuidpb"
+	"go.withpixie.dev/pixie/src/api/public/vizierapipb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Number of rows the fake sends in each batch of a table, small enough that
+// the tables in tests take a few batches.
+const fakeVizierBatchRows = 2
+
+// fakeVizier is an in-process Pixie Cloud and Vizier that pxapi can connect
+// to, so that checks can be tested through pxapi's streaming and the bot's
+// table muxing without a cluster. Like Pixie Cloud with passthrough enabled,
+// it serves the cluster info API and the Vizier API on the same address.
+// Each script run gets the next of its replies, with the last one repeated.
+type fakeVizier struct {
+	cloudapipb.UnimplementedVizierClusterInfoServer
+	vizierapipb.UnimplementedVizierServiceServer
+
+	addr   string
+	apiKey string
+	// PEM of the self-signed certificate it serves, or nil without TLS.
+	certPEM []byte
+
+	mu       sync.Mutex
+	clusters []fakeVizierCluster
+	replies  []fakeVizierReply
+	// Scripts run so far.
+	scripts []string
+}
+
+type fakeVizierCluster struct {
+	// A UUID, as Pixie uses for cluster IDs.
+	ID     string
+	Name   string
+	Status cloudapipb.ClusterStatus
+}
+
+// fakeVizierReply is what the fake sends for one script.
+type fakeVizierReply struct {
+	// Tables output by the script. Their metadata is sent first, then their
+	// rows in batches, taking turns between tables.
+	Tables []*recordedTable
+	// Error the script fails with before any output, such as codes.Unavailable.
+	Err error
+	// Error the stream ends with after the first batch of each table, as when
+	// the connection is lost.
+	StreamErr error
+	// Whether the stream stalls after the first batch of each table, until the
+	// client gives up.
+	Stall bool
+	// Status sent instead of any output, such as a compiler error.
+	Status *vizierapipb.Status
+}
+
+// newFakeVizier serves a fake for the given clusters over TLS on a local
+// port until the test ends. Requests must send apiKey.
+func newFakeVizier(t *testing.T, apiKey string, clusters ...fakeVizierCluster) *fakeVizier {
+	t.Helper()
+	cert, err := selfSignedCert()
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeVizier{apiKey: apiKey, clusters: clusters}
+	f.certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})
+	// pxapi skips verifying the certificate of cluster-local addresses, which,
+	// as it checks for them with strings.ContainsAny, include 127.0.0.1.
+	f.serve(t, grpc.Creds(credentials.NewTLS(&tls.Config{Certificates: []tls.Certificate{cert}})))
+	return f
+}
+
+// newPlaintextFakeVizier is newFakeVizier without TLS.
+func newPlaintextFakeVizier(t *testing.T, apiKey string, clusters ...fakeVizierCluster) *fakeVizier {
+	t.Helper()
+	f := &fakeVizier{apiKey: apiKey, clusters: clusters}
+	f.serve(t)
+	return f
+}
+
+func (f *fakeVizier) serve(t *testing.T, opts ...grpc.ServerOption) {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.addr = lis.Addr().String()
+	srv := grpc.NewServer(opts...)
+	cloudapipb.RegisterVizierClusterInfoServer(srv, f)
+	vizierapipb.RegisterVizierServiceServer(srv, f)
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+}
+
+// reply sets the replies to the next scripts.
+func (f *fakeVizier) reply(replies ...fakeVizierReply) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.replies = replies
+}
+
+// Scripts returns the scripts run so far.
+func (f *fakeVizier) Scripts() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.scripts...)
+}
+
+func (f *fakeVizier) authorize(ctx context.Context) error {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if keys := md.Get("pixie-api-key"); len(keys) == 0 || keys[0] != f.apiKey {
+		return status.Error(codes.Unauthenticated, "invalid API key")
+	}
+	return nil
+}
+
+func (f *fakeVizier) GetClusterInfo(ctx context.Context, req *cloudapipb.GetClusterInfoRequest) (*cloudapipb.GetClusterInfoResponse, error) {
+	if err := f.authorize(ctx); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	res := &cloudapipb.GetClusterInfoResponse{}
+	for _, c := range f.clusters {
+		id := fakeVizierUUID(c.ID)
+		if req.ID != nil && string(req.ID.Data) != string(id.Data) {
+			continue
+		}
+		res.Clusters = append(res.Clusters, &cloudapipb.ClusterInfo{
+			ID:            id,
+			Status:        c.Status,
+			Config:        &cloudapipb.VizierConfig{PassthroughEnabled: true},
+			ClusterName:   c.Name,
+			VizierVersion: "0.5.0",
+		})
+	}
+	return res, nil
+}
+
+func (f *fakeVizier) ExecuteScript(req *vizierapipb.ExecuteScriptRequest, srv vizierapipb.VizierService_ExecuteScriptServer) error {
+	if err := f.authorize(srv.Context()); err != nil {
+		return err
+	}
+	f.mu.Lock()
+	known := false
+	for _, c := range f.clusters {
+		known = known || c.ID == req.ClusterID
+	}
+	f.scripts = append(f.scripts, req.QueryStr)
+	var reply fakeVizierReply
+	if len(f.replies) > 0 {
+		reply = f.replies[0]
+	}
+	if len(f.replies) > 1 {
+		f.replies = f.replies[1:]
+	}
+	f.mu.Unlock()
+
+	switch {
+	case !known:
+		return status.Errorf(codes.NotFound, "cluster %s not found", req.ClusterID)
+	case reply.Err != nil:
+		return reply.Err
+	case reply.Status != nil:
+		return srv.Send(&vizierapipb.ExecuteScriptResponse{Status: reply.Status})
+	}
+
+	batches := make([][]*vizierapipb.RowBatchData, len(reply.Tables))
+	records := 0
+	for i, t := range reply.Tables {
+		id := t.ID
+		if id == "" {
+			id = fmt.Sprintf("table-%d", i)
+		}
+		relation := &vizierapipb.Relation{}
+		for _, col := range t.Columns {
+			relation.Columns = append(relation.Columns, &vizierapipb.Relation_ColumnInfo{ColumnName: col.Name, ColumnType: col.Type, ColumnSemanticType: col.SemanticType})
+		}
+		md := &vizierapipb.QueryMetadata{Relation: relation, Name: t.Name, ID: id}
+		if err := srv.Send(&vizierapipb.ExecuteScriptResponse{Result: &vizierapipb.ExecuteScriptResponse_MetaData{MetaData: md}}); err != nil {
+			return err
+		}
+		var err error
+		if batches[i], err = fakeVizierBatches(id, t); err != nil {
+			return status.Error(codes.Internal, err.Error())
+		}
+		records += len(t.Rows)
+	}
+	for n, sent := 0, true; sent; n++ {
+		sent = false
+		for _, b := range batches {
+			if n >= len(b) {
+				continue
+			}
+			data := &vizierapipb.QueryData{Batch: b[n]}
+			if err := srv.Send(&vizierapipb.ExecuteScriptResponse{Result: &vizierapipb.ExecuteScriptResponse_Data{Data: data}}); err != nil {
+				return err
+			}
+			sent = true
+		}
+		if reply.StreamErr != nil {
+			return reply.StreamErr
+		}
+		if reply.Stall {
+			<-srv.Context().Done()
+			return status.FromContextError(srv.Context().Err()).Err()
+		}
+	}
+	stats := &vizierapipb.QueryExecutionStats{
+		Timing:           &vizierapipb.QueryTimingInfo{ExecutionTimeNs: int64(10 * time.Millisecond), CompilationTimeNs: int64(time.Millisecond)},
+		RecordsProcessed: int64(records),
+	}
+	return srv.Send(&vizierapipb.ExecuteScriptResponse{Result: &vizierapipb.ExecuteScriptResponse_Data{Data: &vizierapipb.QueryData{ExecutionStats: stats}}})
+}
+
+// fakeVizierBatches splits the rows of a table into batches, the last of
+// which ends the table's stream. Tables without rows get one empty batch.
+func fakeVizierBatches(id string, t *recordedTable) ([]*vizierapipb.RowBatchData, error) {
+	var batches []*vizierapipb.RowBatchData
+	for start := 0; start == 0 || start < len(t.Rows); start += fakeVizierBatchRows {
+		end := start + fakeVizierBatchRows
+		if end > len(t.Rows) {
+			end = len(t.Rows)
+		}
+		b := &vizierapipb.RowBatchData{TableID: id, NumRows: int64(end - start), Eow: end == len(t.Rows), Eos: end == len(t.Rows)}
+		for i, col := range t.Columns {
+			c, err := fakeVizierColumn(col, t.Rows[start:end], i)
+			if err != nil {
+				return nil, fmt.Errorf("column %s of table %s: %w", col.Name, t.Name, err)
+			}
+			b.Cols = append(b.Cols, c)
+		}
+		batches = append(batches, b)
+	}
+	return batches, nil
+}
+
+// fakeVizierColumn returns the values of column i of rows, which are recorded
+// values as made by localTable.
+func fakeVizierColumn(col recordedColumn, rows [][]interface{}, i int) (*vizierapipb.Column, error) {
+	switch col.Type {
+	case vizierapipb.BOOLEAN:
+		data := make([]bool, len(rows))
+		for j, row := range rows {
+			data[j], _ = row[i].(bool)
+		}
+		return &vizierapipb.Column{ColData: &vizierapipb.Column_BooleanData{BooleanData: &vizierapipb.BooleanColumn{Data: data}}}, nil
+	case vizierapipb.INT64, vizierapipb.TIME64NS:
+		data := make([]int64, len(rows))
+		for j, row := range rows {
+			n, _ := row[i].(json.Number)
+			v, err := n.Int64()
+			if err != nil {
+				return nil, err
+			}
+			data[j] = v
+		}
+		if col.Type == vizierapipb.TIME64NS {
+			return &vizierapipb.Column{ColData: &vizierapipb.Column_Time64NsData{Time64NsData: &vizierapipb.Time64NSColumn{Data: data}}}, nil
+		}
+		return &vizierapipb.Column{ColData: &vizierapipb.Column_Int64Data{Int64Data: &vizierapipb.Int64Column{Data: data}}}, nil
+	case vizierapipb.FLOAT64:
+		data := make([]float64, len(rows))
+		for j, row := range rows {
+			n, _ := row[i].(json.Number)
+			v, err := n.Float64()
+			if err != nil {
+				return nil, err
+			}
+			data[j] = v
+		}
+		return &vizierapipb.Column{ColData: &vizierapipb.Column_Float64Data{Float64Data: &vizierapipb.Float64Column{Data: data}}}, nil
+	case vizierapipb.STRING:
+		data := make([]string, len(rows))
+		for j, row := range rows {
+			data[j], _ = row[i].(string)
+		}
+		return &vizierapipb.Column{ColData: &vizierapipb.Column_StringData{StringData: &vizierapipb.StringColumn{Data: data}}}, nil
+	}
+	return nil, fmt.Errorf("unsupported type %v", col.Type)
+}
+
+// fakeVizierUUID converts a cluster ID to the proto pxapi sends.
+func fakeVizierUUID(id string) *uuidpb.UUID {
+	b, _ := hex.DecodeString(strings.Replace(id, "-", "", -1))
+	return &uuidpb.UUID{Data: b}
+}
+
+func selfSignedCert() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		DNSNames:     []string{"localhost"},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
@@ -0,0 +1,142 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// fileIncidentManager is an IncidentManager that keeps incidents in memory
+// and saves them to a JSON file after every change, so that incident state
+// survives between runs, such as those of a Kubernetes CronJob with the file
+// on a PersistentVolume. It must not be shared by processes running at the
+// same time.
+type fileIncidentManager struct {
+	mem  *memoryIncidentManager
+	path string
+	// Held while saving, so that concurrent checks can't replace the file
+	// with an older snapshot than the last one written.
+	saveMu sync.Mutex
+}
+
+// newFileIncidentManager loads the incidents saved in the file at path, if it exists.
+func newFileIncidentManager(path string) (*fileIncidentManager, error) {
+	f := &fileIncidentManager{mem: newMemoryIncidentManager(), path: path}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return f, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var incidents []*Incident
+	if err := json.Unmarshal(b, &incidents); err != nil {
+		return nil, err
+	}
+	for _, inc := range incidents {
+		f.mem.byID[inc.ID] = inc
+		if !inc.ResolvedAt.IsZero() {
+			continue
+		}
+		key := openKey{rule: inc.Rule, clusterID: inc.Cluster.ID}
+		if f.mem.open[key] == nil {
+			f.mem.open[key] = make(map[string]*Incident)
+		}
+		f.mem.open[key][inc.Service] = inc
+	}
+	return f, nil
+}
+
+func (f *fileIncidentManager) Update(ctx context.Context, rule string, cluster Cluster, over []IncidentData, now time.Time) ([]IncidentEvent, error) {
+	events, err := f.mem.Update(ctx, rule, cluster, over, now)
+	if err != nil {
+		return events, err
+	}
+	return events, f.save(now)
+}
+
+func (f *fileIncidentManager) Get(ctx context.Context, id string) (*Incident, error) {
+	return f.mem.Get(ctx, id)
+}
+
+func (f *fileIncidentManager) Open(ctx context.Context) ([]Incident, error) {
+	return f.mem.Open(ctx)
+}
+
+func (f *fileIncidentManager) All(ctx context.Context) ([]Incident, error) {
+	return f.mem.All(ctx)
+}
+
+func (f *fileIncidentManager) Ack(ctx context.Context, id string) (*Incident, error) {
+	inc, err := f.mem.Ack(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return inc, f.save(time.Now())
+}
+
+func (f *fileIncidentManager) Silence(ctx context.Context, id string, until time.Time) (*Incident, error) {
+	inc, err := f.mem.Silence(ctx, id, until)
+	if err != nil {
+		return nil, err
+	}
+	return inc, f.save(time.Now())
+}
+
+// save writes every incident to the file, dropping incidents that were
+// resolved long ago. The file is replaced atomically, so that a run that is
+// killed while saving leaves the previous state intact.
+func (f *fileIncidentManager) save(now time.Time) error {
+	f.saveMu.Lock()
+	defer f.saveMu.Unlock()
+
+	f.mem.mu.Lock()
+	f.mem.prune(now)
+	var incidents []*Incident
+	for _, inc := range f.mem.byID {
+		incidents = append(incidents, inc)
+	}
+	sort.Slice(incidents, func(i, j int) bool {
+		return incidents[i].OpenedAt.Before(incidents[j].OpenedAt)
+	})
+	b, err := json.MarshalIndent(incidents, "", "  ")
+	f.mem.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(f.path), filepath.Base(f.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), f.path)
+}
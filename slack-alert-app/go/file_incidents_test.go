@@ -0,0 +1,86 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFileIncidentManagerConcurrency(t *testing.T) {
+	m, err := newFileIncidentManager(filepath.Join(t.TempDir(), "incidents.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testConcurrentIncidents(t, m, 30)
+}
+
+// TestFileIncidentManagerConcurrentSaves checks that after concurrent
+// checks, each saving the file, the file has the latest state rather than an
+// older snapshot.
+func TestFileIncidentManagerConcurrentSaves(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "incidents.json")
+	m, err := newFileIncidentManager(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	start := time.Date(2021, time.January, 1, 12, 0, 0, 0, time.UTC)
+	var wg sync.WaitGroup
+	for c := 0; c < 8; c++ {
+		wg.Add(1)
+		go func(cluster Cluster) {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				over := []IncidentData{{Service: "orders", ErrorCount: int64(i), TotalRequests: 100}}
+				if _, err := m.Update(ctx, "http-errors", cluster, over, start.Add(time.Duration(i)*time.Minute)); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(Cluster{ID: fmt.Sprint(c), Name: fmt.Sprint("cluster-", c)})
+	}
+	wg.Wait()
+
+	want, err := m.All(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := newFileIncidentManager(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := loaded.All(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Compared as JSON, since that's what is saved.
+	wantJSON, _ := json.Marshal(want)
+	gotJSON, _ := json.Marshal(got)
+	var wantAll, gotAll interface{}
+	json.Unmarshal(wantJSON, &wantAll)
+	json.Unmarshal(gotJSON, &gotAll)
+	if !reflect.DeepEqual(gotAll, wantAll) {
+		t.Errorf("saved incidents differ from the latest state:\ngot:  %s\nwant: %s", gotJSON, wantJSON)
+	}
+}
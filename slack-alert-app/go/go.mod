@@ -1,8 +1,14 @@
 module slackbot
 
-go 1.15
+go 1.16
 
 require (
-	github.com/slack-go/slack v0.8.0 // indirect
-	go.withpixie.dev/pixie v0.0.0-20210208222151-a27f9c083b83 // indirect
+	github.com/alicebob/miniredis/v2 v2.14.3
+	github.com/go-redis/redis/v8 v8.4.4
+	github.com/golang/protobuf v1.4.2
+	github.com/slack-go/slack v0.8.0
+	go.withpixie.dev/pixie v0.0.0-20210208222151-a27f9c083b83
+	google.golang.org/grpc v1.35.0
+	google.golang.org/protobuf v1.25.0
+	gopkg.in/yaml.v2 v2.4.0
 )
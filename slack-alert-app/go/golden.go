@@ -0,0 +1,87 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// simulationStart is when simulated checks start, so that simulated
+// messages are the same on every run.
+var simulationStart = time.Date(2021, time.January, 1, 12, 0, 0, 0, time.UTC)
+
+// Matches incident IDs in messages, which are random.
+var goldenIncidentID = regexp.MustCompile(`INC-[0-9a-f]{8}`)
+
+// renderGolden renders messages for comparing against a golden file, one
+// per paragraph after its kind, such as "[alert]". Incident IDs are replaced
+// with INC-1, INC-2 and so on, in the order they first appear.
+func renderGolden(msgs []CapturedMessage) []byte {
+	ids := make(map[string]string)
+	var b bytes.Buffer
+	for _, m := range msgs {
+		msg := goldenIncidentID.ReplaceAllStringFunc(m.Msg, func(id string) string {
+			if _, ok := ids[id]; !ok {
+				ids[id] = fmt.Sprintf("INC-%d", len(ids)+1)
+			}
+			return ids[id]
+		})
+		fmt.Fprintf(&b, "[%s]\n%s\n\n", m.Kind, msg)
+	}
+	return b.Bytes()
+}
+
+// checkGolden compares got to the golden file at path, returning an error
+// that shows the first line that differs. If update is set, the golden file
+// is written with got instead.
+func checkGolden(path string, got []byte, update bool) error {
+	if update {
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			return err
+		}
+		return ioutil.WriteFile(path, got, 0o644)
+	}
+	want, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("reading golden file: %w", err)
+	}
+	if bytes.Equal(got, want) {
+		return nil
+	}
+	gotLines := strings.Split(string(got), "\n")
+	wantLines := strings.Split(string(want), "\n")
+	for i := 0; i < len(gotLines) || i < len(wantLines); i++ {
+		var g, w string
+		if i < len(gotLines) {
+			g = gotLines[i]
+		}
+		if i < len(wantLines) {
+			w = wantLines[i]
+		}
+		if g != w {
+			return fmt.Errorf("messages differ from %s at line %d:\n  got:  %q\n  want: %q", path, i+1, g, w)
+		}
+	}
+	return fmt.Errorf("messages differ from %s", path)
+}
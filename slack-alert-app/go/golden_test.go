@@ -0,0 +1,75 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"os"
+	"testing"
+)
+
+// updateGolden is whether to write golden files instead of comparing to them.
+var updateGolden = os.Getenv("UPDATE_GOLDEN") == "true"
+
+// AssertGolden checks that the captured messages match the golden file at
+// path. Setting UPDATE_GOLDEN=true writes the golden file instead, after a
+// deliberate change to messages.
+func (c *CaptureAlerter) AssertGolden(t testing.TB, path string) {
+	t.Helper()
+	if err := checkGolden(path, renderGolden(c.Messages()), updateGolden); err != nil {
+		t.Errorf("%v", err)
+	}
+}
+
+// reportCapture is a ReportSink that keeps the reports written to it.
+type reportCapture struct {
+	reports []*incidentReport
+}
+
+func (c *reportCapture) WriteReport(ctx context.Context, r *incidentReport) error {
+	c.reports = append(c.reports, r)
+	return nil
+}
+
+// TestGoldenMessages checks the messages of an incident that opens, is
+// updated and resolves, the same as
+//
+//	slackbot simulate -rule http-errors -checks 2 -resolve -golden testdata/http-errors.golden
+//
+// and its post-incident reports.
+func TestGoldenMessages(t *testing.T) {
+	r := defaultConfig().Defaults
+	alerts, reportAlerts := &CaptureAlerter{}, &CaptureAlerter{}
+	reports := &reportCapture{}
+	tracker := newSimulationTracker(r, alerts)
+	tracker.reports = []ReportSink{&slackReportSink{alerter: reportAlerts}, reports}
+	stats := []IncidentData{{Service: "px-sock-shop/orders", ErrorCount: 40, TotalRequests: 100}}
+	c := &cluster{Cluster: Cluster{ID: "simulated", Name: "simulated"}}
+	if err := simulate(context.Background(), tracker, c, [][]IncidentData{stats, stats, nil}); err != nil {
+		t.Fatal(err)
+	}
+
+	alerts.AssertGolden(t, "testdata/http-errors.golden")
+	reportAlerts.AssertGolden(t, "testdata/http-errors-report.golden")
+	if len(reports.reports) != 1 {
+		t.Fatalf("got %d reports, want 1", len(reports.reports))
+	}
+	md := goldenIncidentID.ReplaceAllString(reports.reports[0].Markdown(), "INC-1")
+	if err := checkGolden("testdata/http-errors-report.md", []byte(md), updateGolden); err != nil {
+		t.Error(err)
+	}
+}
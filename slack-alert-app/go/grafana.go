@@ -0,0 +1,149 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// grafanaAnnotator marks incidents on Grafana dashboards: an annotation is
+// created when an incident opens and turned into a region ending when it
+// resolves. Annotations are tagged with pixie, the rule, the cluster and the
+// service, so that dashboards can show them with an annotation query by tags.
+type grafanaAnnotator struct {
+	url          string
+	token        string
+	dashboardUID string
+	http         *http.Client
+
+	mu sync.Mutex
+	// Annotation IDs of open incidents, keyed by incident ID. Incidents
+	// opened before a restart get a new region annotation when they resolve.
+	ids map[string]int64
+}
+
+func newGrafanaAnnotator(cfg GrafanaConfig) *grafanaAnnotator {
+	return &grafanaAnnotator{
+		url:          strings.TrimSuffix(cfg.URL, "/"),
+		token:        cfg.Token,
+		dashboardUID: cfg.DashboardUID,
+		http:         &http.Client{Timeout: 10 * time.Second},
+		ids:          make(map[string]int64),
+	}
+}
+
+// grafanaAnnotation is the body of the annotations API's create and patch
+// requests. Times are in milliseconds.
+type grafanaAnnotation struct {
+	DashboardUID string   `json:"dashboardUID,omitempty"`
+	Time         int64    `json:"time,omitempty"`
+	TimeEnd      int64    `json:"timeEnd,omitempty"`
+	Tags         []string `json:"tags,omitempty"`
+	Text         string   `json:"text,omitempty"`
+}
+
+func (g *grafanaAnnotator) WriteEvent(ctx context.Context, e IncidentEvent) error {
+	inc := e.Incident
+	switch e.Kind {
+	case IncidentOpened:
+		id, err := g.create(ctx, inc, 0)
+		if err != nil {
+			return err
+		}
+		g.mu.Lock()
+		g.ids[inc.ID] = id
+		g.mu.Unlock()
+	case IncidentResolved:
+		g.mu.Lock()
+		id, ok := g.ids[inc.ID]
+		delete(g.ids, inc.ID)
+		g.mu.Unlock()
+		if !ok {
+			_, err := g.create(ctx, inc, millis(inc.ResolvedAt))
+			return err
+		}
+		return g.do(ctx, http.MethodPatch, fmt.Sprintf("/api/annotations/%d", id), grafanaAnnotation{
+			TimeEnd: millis(inc.ResolvedAt),
+			Text:    grafanaText(inc),
+		}, nil)
+	}
+	return nil
+}
+
+// create adds an annotation for inc starting when it opened, and ending at
+// end if it isn't 0, and returns its ID.
+func (g *grafanaAnnotator) create(ctx context.Context, inc Incident, end int64) (int64, error) {
+	var resp struct {
+		ID int64 `json:"id"`
+	}
+	err := g.do(ctx, http.MethodPost, "/api/annotations", grafanaAnnotation{
+		DashboardUID: g.dashboardUID,
+		Time:         millis(inc.OpenedAt),
+		TimeEnd:      end,
+		Tags:         []string{"pixie", "rule:" + inc.Rule, "cluster:" + inc.Cluster.Name, "service:" + inc.Service},
+		Text:         grafanaText(inc),
+	}, &resp)
+	return resp.ID, err
+}
+
+func (g *grafanaAnnotator) do(ctx context.Context, method, path string, body, out interface{}) error {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, method, g.url+path, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if g.token != "" {
+		req.Header.Set("Authorization", "Bearer "+g.token)
+	}
+	resp, err := g.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("grafana %s %s returned %s", method, path, resp.Status)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// grafanaText describes an incident in an annotation.
+func grafanaText(inc Incident) string {
+	if inc.ResolvedAt.IsZero() {
+		return fmt.Sprintf("[%s] %s: %s on %s at %s error rate", inc.ID, inc.Rule, inc.Service, inc.Cluster.Name, formatRate(inc.Latest.ErrorRate()))
+	}
+	return fmt.Sprintf("[%s] %s: %s on %s, peak error rate %s, resolved after %s", inc.ID, inc.Rule, inc.Service, inc.Cluster.Name,
+		formatRate(inc.PeakErrorRate()), inc.ResolvedAt.Sub(inc.OpenedAt).Round(time.Second))
+}
+
+// millis returns t in milliseconds since the Unix epoch.
+func millis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
@@ -0,0 +1,153 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// grafanaRequest is a request to the fake annotations API.
+type grafanaRequest struct {
+	method, path string
+	body         map[string]interface{}
+}
+
+func serveGrafana(t *testing.T) (*grafanaAnnotator, func() []grafanaRequest) {
+	t.Helper()
+	var mu sync.Mutex
+	var requests []grafanaRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer grafana-token" || r.Header.Get("Content-Type") != "application/json" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		req := grafanaRequest{method: r.Method, path: r.URL.Path}
+		if err := json.NewDecoder(r.Body).Decode(&req.body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		requests = append(requests, req)
+		mu.Unlock()
+		switch {
+		case r.Method == http.MethodPost && r.URL.Path == "/api/annotations":
+			w.Write([]byte(`{"id": 42, "message": "Annotation added"}`))
+		case r.Method == http.MethodPatch && r.URL.Path == "/api/annotations/42":
+			w.Write([]byte(`{"message": "Annotation patched"}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	g := newGrafanaAnnotator(GrafanaConfig{URL: srv.URL + "/", Token: "grafana-token", DashboardUID: "pixie-http"})
+	return g, func() []grafanaRequest {
+		mu.Lock()
+		defer mu.Unlock()
+		return requests
+	}
+}
+
+func grafanaTestIncident() Incident {
+	opened := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+	return Incident{
+		ID:       "INC-7f3a9c21",
+		Rule:     "http-errors",
+		Cluster:  Cluster{ID: "c1", Name: "prod"},
+		Service:  "px-sock-shop/orders",
+		OpenedAt: opened,
+		Latest:   IncidentData{Service: "px-sock-shop/orders", ErrorCount: 30, TotalRequests: 100},
+	}
+}
+
+func TestGrafanaAnnotator(t *testing.T) {
+	ctx := context.Background()
+	g, requests := serveGrafana(t)
+	inc := grafanaTestIncident()
+	if err := g.WriteEvent(ctx, IncidentEvent{Kind: IncidentOpened, Incident: inc}); err != nil {
+		t.Fatal(err)
+	}
+	// Updates don't change the annotation.
+	if err := g.WriteEvent(ctx, IncidentEvent{Kind: IncidentUpdated, Incident: inc}); err != nil {
+		t.Fatal(err)
+	}
+	inc.ResolvedAt = inc.OpenedAt.Add(10 * time.Minute)
+	if err := g.WriteEvent(ctx, IncidentEvent{Kind: IncidentResolved, Incident: inc}); err != nil {
+		t.Fatal(err)
+	}
+
+	got := requests()
+	if len(got) != 2 {
+		t.Fatalf("got %d requests, want one to create the annotation and one to end it: %+v", len(got), got)
+	}
+	create := got[0]
+	if create.method != http.MethodPost || create.path != "/api/annotations" {
+		t.Errorf("created the annotation with %s %s", create.method, create.path)
+	}
+	wantTags := []interface{}{"pixie", "rule:http-errors", "cluster:prod", "service:px-sock-shop/orders"}
+	if !reflect.DeepEqual(create.body["tags"], wantTags) || create.body["dashboardUID"] != "pixie-http" || create.body["time"] != float64(millis(inc.OpenedAt)) {
+		t.Errorf("created annotation %v", create.body)
+	}
+	if _, ok := create.body["timeEnd"]; ok {
+		t.Errorf("open incident's annotation has an end: %v", create.body)
+	}
+	if text, _ := create.body["text"].(string); !strings.HasPrefix(text, "[INC-7f3a9c21] http-errors: px-sock-shop/orders on prod at ") {
+		t.Errorf("created annotation text %q", text)
+	}
+
+	end := got[1]
+	if end.method != http.MethodPatch || end.path != "/api/annotations/42" {
+		t.Errorf("ended the annotation with %s %s, want PATCH of the created annotation", end.method, end.path)
+	}
+	if end.body["timeEnd"] != float64(millis(inc.ResolvedAt)) {
+		t.Errorf("ended the annotation at %v, want %d", end.body["timeEnd"], millis(inc.ResolvedAt))
+	}
+	if text, _ := end.body["text"].(string); !strings.HasSuffix(text, "resolved after 10m0s") {
+		t.Errorf("ended annotation text %q", text)
+	}
+}
+
+func TestGrafanaAnnotatorResolvedAfterRestart(t *testing.T) {
+	g, requests := serveGrafana(t)
+	inc := grafanaTestIncident()
+	inc.ResolvedAt = inc.OpenedAt.Add(time.Hour)
+	// The annotator doesn't know the annotation of an incident opened before
+	// a restart, so it adds a region for the whole incident.
+	if err := g.WriteEvent(context.Background(), IncidentEvent{Kind: IncidentResolved, Incident: inc}); err != nil {
+		t.Fatal(err)
+	}
+	got := requests()
+	if len(got) != 1 || got[0].method != http.MethodPost || got[0].body["time"] != float64(millis(inc.OpenedAt)) || got[0].body["timeEnd"] != float64(millis(inc.ResolvedAt)) {
+		t.Errorf("got requests %+v, want a region annotation from open to resolve", got)
+	}
+}
+
+func TestGrafanaAnnotatorError(t *testing.T) {
+	g, _ := serveGrafana(t)
+	g.token = "wrong"
+	err := g.WriteEvent(context.Background(), IncidentEvent{Kind: IncidentOpened, Incident: grafanaTestIncident()})
+	if err == nil || !strings.Contains(err.Error(), "grafana POST /api/annotations returned 401 Unauthorized") {
+		t.Errorf("got %v, want Grafana's status", err)
+	}
+}
@@ -0,0 +1,265 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"slackbot/incidentpb"
+)
+
+// grpcServer serves the incident routes of the HTTP API as the gRPC
+// IncidentService in incidentpb/incidents.proto, for internal services that
+// prefer gRPC, along with creating silences, and streams incident events
+// like GET /api/stream. Calls that change incidents or silences need the API token in "authorization: Bearer" metadata.
+type grpcServer struct {
+	incidentpb.UnimplementedIncidentServiceServer
+	api *apiServer
+	// Whether the gRPC API only listens on localhost, so that it can change
+	// incidents without a token.
+	local bool
+}
+
+// newGRPCServer returns a gRPC server with the IncidentService registered.
+func newGRPCServer(api *apiServer, local bool) *grpc.Server {
+	srv := grpc.NewServer()
+	incidentpb.RegisterIncidentServiceServer(srv, &grpcServer{api: api, local: local})
+	return srv
+}
+
+func (s *grpcServer) authorize(ctx context.Context) error {
+	if s.api.token == "" {
+		if s.local {
+			return nil
+		}
+		return status.Error(codes.PermissionDenied, "set API_TOKEN to change incidents through the gRPC API")
+	}
+	var token string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if v := md.Get("authorization"); len(v) > 0 {
+			token = strings.TrimPrefix(v[0], "Bearer ")
+		}
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(s.api.token)) != 1 {
+		return status.Error(codes.Unauthenticated, "invalid or missing API token")
+	}
+	return nil
+}
+
+func (s *grpcServer) ListIncidents(ctx context.Context, req *incidentpb.ListIncidentsRequest) (*incidentpb.ListIncidentsResponse, error) {
+	f := incidentFilter{State: req.State, Rule: req.Rule, Cluster: req.Cluster, Service: req.Service, Limit: int(req.Limit)}
+	if f.Limit < 0 {
+		return nil, status.Error(codes.InvalidArgument, "invalid limit")
+	}
+	if f.Limit == 0 {
+		f.Limit = 100
+	}
+	incidents, err := s.api.listIncidents(ctx, f)
+	if err != nil {
+		return nil, incidentError(err)
+	}
+	res := &incidentpb.ListIncidentsResponse{}
+	for i := range incidents {
+		res.Incidents = append(res.Incidents, incidentProto(&incidents[i]))
+	}
+	return res, nil
+}
+
+func (s *grpcServer) GetIncident(ctx context.Context, req *incidentpb.GetIncidentRequest) (*incidentpb.Incident, error) {
+	inc, err := s.api.incidents.Get(ctx, normalizeID(req.Id))
+	if err != nil {
+		return nil, incidentError(err)
+	}
+	return incidentProto(inc), nil
+}
+
+func (s *grpcServer) AckIncident(ctx context.Context, req *incidentpb.AckIncidentRequest) (*incidentpb.Incident, error) {
+	if err := s.authorize(ctx); err != nil {
+		return nil, err
+	}
+	inc, err := s.api.ackIncident(ctx, normalizeID(req.Id))
+	if err != nil {
+		return nil, incidentError(err)
+	}
+	return incidentProto(inc), nil
+}
+
+func (s *grpcServer) SilenceIncident(ctx context.Context, req *incidentpb.SilenceIncidentRequest) (*incidentpb.Incident, error) {
+	if err := s.authorize(ctx); err != nil {
+		return nil, err
+	}
+	d := defaultIncidentSilence
+	if req.Duration != nil {
+		if err := req.Duration.CheckValid(); err != nil || req.Duration.AsDuration() <= 0 {
+			return nil, status.Error(codes.InvalidArgument, "invalid duration")
+		}
+		d = req.Duration.AsDuration()
+	}
+	inc, err := s.api.silenceIncident(ctx, normalizeID(req.Id), d)
+	if err != nil {
+		return nil, incidentError(err)
+	}
+	return incidentProto(inc), nil
+}
+
+func (s *grpcServer) CreateSilence(ctx context.Context, req *incidentpb.CreateSilenceRequest) (*incidentpb.Silence, error) {
+	if err := s.authorize(ctx); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	var until time.Time
+	switch {
+	case req.Duration != nil:
+		if err := req.Duration.CheckValid(); err != nil || req.Duration.AsDuration() <= 0 {
+			return nil, status.Error(codes.InvalidArgument, "invalid duration")
+		}
+		until = now.Add(req.Duration.AsDuration())
+	case req.Until != nil:
+		if err := req.Until.CheckValid(); err != nil {
+			return nil, status.Error(codes.InvalidArgument, "invalid until time")
+		}
+		until = req.Until.AsTime()
+	}
+	silence := &Silence{
+		Rule:      req.Rule,
+		Cluster:   req.Cluster,
+		Namespace: req.Namespace,
+		Service:   req.Service,
+		Until:     until,
+		CreatedAt: now,
+		CreatedBy: req.CreatedBy,
+		Comment:   req.Comment,
+	}
+	err := s.api.addSilence(ctx, silence)
+	var invalid invalidSilenceError
+	if errors.As(err, &invalid) {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return silenceProto(silence), nil
+}
+
+func (s *grpcServer) WatchIncidents(req *incidentpb.WatchIncidentsRequest, stream incidentpb.IncidentService_WatchIncidentsServer) error {
+	ch := s.api.stream.subscribe()
+	defer s.api.stream.unsubscribe(ch)
+	// Lets the client know it's subscribed before the first event.
+	if err := stream.SendHeader(metadata.MD{}); err != nil {
+		return err
+	}
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case e, ok := <-ch:
+			if !ok {
+				return status.Error(codes.Unavailable, "fell behind on incident events, list incidents to catch up")
+			}
+			if err := stream.Send(&incidentpb.IncidentEvent{Kind: incidentEventKindProto(e.Kind), Incident: incidentProto(&e.Incident)}); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// incidentError converts an error from the incident manager to a gRPC status.
+func incidentError(err error) error {
+	switch {
+	case errors.Is(err, ErrIncidentNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, errInvalidState):
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	return status.Error(codes.Internal, err.Error())
+}
+
+func incidentEventKindProto(k IncidentEventKind) incidentpb.IncidentEvent_Kind {
+	switch k {
+	case IncidentOpened:
+		return incidentpb.IncidentEvent_OPENED
+	case IncidentUpdated:
+		return incidentpb.IncidentEvent_UPDATED
+	case IncidentResolved:
+		return incidentpb.IncidentEvent_RESOLVED
+	}
+	return incidentpb.IncidentEvent_KIND_UNSPECIFIED
+}
+
+func incidentProto(inc *Incident) *incidentpb.Incident {
+	p := &incidentpb.Incident{
+		Id:             inc.ID,
+		Rule:           inc.Rule,
+		Cluster:        &incidentpb.Cluster{Id: inc.Cluster.ID, Name: inc.Cluster.Name, Labels: inc.Cluster.Labels},
+		Service:        inc.Service,
+		OpenedAt:       timestamppb.New(inc.OpenedAt),
+		UpdatedAt:      timestamppb.New(inc.UpdatedAt),
+		Latest:         statsProto(inc.Latest),
+		DroppedSamples: int32(inc.DroppedSamples),
+		Peak:           sampleProto(inc.Peak),
+		Acked:          inc.Acked,
+	}
+	if !inc.ResolvedAt.IsZero() {
+		p.ResolvedAt = timestamppb.New(inc.ResolvedAt)
+	}
+	if !inc.SilencedUntil.IsZero() {
+		p.SilencedUntil = timestamppb.New(inc.SilencedUntil)
+	}
+	for _, d := range inc.Endpoints {
+		p.Endpoints = append(p.Endpoints, statsProto(d))
+	}
+	for _, s := range inc.Samples {
+		p.Samples = append(p.Samples, sampleProto(s))
+	}
+	return p
+}
+
+func silenceProto(s *Silence) *incidentpb.Silence {
+	return &incidentpb.Silence{
+		Id:        s.ID,
+		Rule:      s.Rule,
+		Cluster:   s.Cluster,
+		Namespace: s.Namespace,
+		Service:   s.Service,
+		Until:     timestamppb.New(s.Until),
+		CreatedAt: timestamppb.New(s.CreatedAt),
+		CreatedBy: s.CreatedBy,
+		Comment:   s.Comment,
+	}
+}
+
+func sampleProto(s IncidentSample) *incidentpb.Sample {
+	return &incidentpb.Sample{Time: timestamppb.New(s.Time), Data: statsProto(s.Data)}
+}
+
+func statsProto(d IncidentData) *incidentpb.Stats {
+	p := &incidentpb.Stats{Service: d.Service, Endpoint: d.Endpoint, ErrorCount: d.ErrorCount, TotalRequests: d.TotalRequests}
+	for _, detail := range d.Details {
+		p.Details = append(p.Details, &incidentpb.Detail{Name: detail.Name, Value: detail.Value})
+	}
+	return p
+}
@@ -0,0 +1,205 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"slackbot/incidentpb"
+)
+
+// dialGRPC serves the gRPC API of a over an in-memory connection and returns
+// a client for it.
+func dialGRPC(t *testing.T, a *apiServer, local bool) incidentpb.IncidentServiceClient {
+	t.Helper()
+	lis := bufconn.Listen(1 << 20)
+	srv := newGRPCServer(a, local)
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+	conn, err := grpc.Dial("bufnet", grpc.WithInsecure(), grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+		return lis.Dial()
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return incidentpb.NewIncidentServiceClient(conn)
+}
+
+func TestGRPCIncidents(t *testing.T) {
+	ctx := context.Background()
+	m := newMemoryIncidentManager()
+	prod := Cluster{ID: "c1", Name: "prod"}
+	events, err := m.Update(ctx, "http-errors", prod, []IncidentData{{Service: "orders", ErrorCount: 5, TotalRequests: 10}}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := events[0].Incident.ID
+	if _, err := m.Update(ctx, "http-errors", Cluster{ID: "c2", Name: "staging"}, []IncidentData{{Service: "cart", ErrorCount: 5, TotalRequests: 10}}, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	alerter := &CaptureAlerter{}
+	a := &apiServer{incidents: m, alerter: alerter, token: "secret", stream: newIncidentStream()}
+	c := dialGRPC(t, a, false)
+
+	list, err := c.ListIncidents(ctx, &incidentpb.ListIncidentsRequest{Cluster: "prod"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Incidents) != 1 || list.Incidents[0].Id != id || list.Incidents[0].Latest.ErrorCount != 5 {
+		t.Errorf("got %v, want only %s", list.Incidents, id)
+	}
+	if _, err := c.ListIncidents(ctx, &incidentpb.ListIncidentsRequest{State: "closed"}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("got %v for an unknown state, want InvalidArgument", err)
+	}
+	if _, err := c.GetIncident(ctx, &incidentpb.GetIncidentRequest{Id: "INC-00000000"}); status.Code(err) != codes.NotFound {
+		t.Errorf("got %v for an unknown incident, want NotFound", err)
+	}
+
+	if _, err := c.AckIncident(ctx, &incidentpb.AckIncidentRequest{Id: id}); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("got %v without a token, want Unauthenticated", err)
+	}
+	authed := metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer secret")
+	inc, err := c.AckIncident(authed, &incidentpb.AckIncidentRequest{Id: id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !inc.Acked {
+		t.Errorf("incident %s not acked", id)
+	}
+	inc, err = c.SilenceIncident(authed, &incidentpb.SilenceIncidentRequest{Id: id, Duration: durationpb.New(2 * time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Until(inc.SilencedUntil.AsTime()); d < time.Hour || d > 2*time.Hour {
+		t.Errorf("silenced for %s, want 2h", d)
+	}
+	if n := len(alerter.Messages()); n != 2 {
+		t.Errorf("got %d messages, want one for the ack and one for the silence", n)
+	}
+}
+
+func TestGRPCCreateSilence(t *testing.T) {
+	ctx := context.Background()
+	silences := newMemorySilences()
+	alerter := &CaptureAlerter{}
+	a := &apiServer{incidents: newMemoryIncidentManager(), silences: silences, alerter: alerter, token: "secret", stream: newIncidentStream()}
+	c := dialGRPC(t, a, false)
+
+	req := &incidentpb.CreateSilenceRequest{Service: "px-sock-shop/orders", Duration: durationpb.New(2 * time.Hour), CreatedBy: "alice", Comment: "deploying"}
+	if _, err := c.CreateSilence(ctx, req); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("got %v without a token, want Unauthenticated", err)
+	}
+	authed := metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer secret")
+	silence, err := c.CreateSilence(authed, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if silence.Id == "" || silence.Service != req.Service || silence.CreatedBy != "alice" || silence.Comment != "deploying" {
+		t.Errorf("got silence %v", silence)
+	}
+	if d := silence.Until.AsTime().Sub(silence.CreatedAt.AsTime()); d != 2*time.Hour {
+		t.Errorf("silence lasts %s, want 2h", d)
+	}
+	active, err := silences.Active(ctx, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(active) != 1 || active[0].ID != silence.Id {
+		t.Errorf("active silences %v, want only %s", active, silence.Id)
+	}
+	if n := len(alerter.Messages()); n != 1 {
+		t.Errorf("got %d messages, want one for the silence", n)
+	}
+
+	until := time.Now().Add(time.Hour).Truncate(time.Second)
+	silence, err = c.CreateSilence(authed, &incidentpb.CreateSilenceRequest{Rule: "http-errors", Until: timestamppb.New(until)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !silence.Until.AsTime().Equal(until) {
+		t.Errorf("silenced until %s, want %s", silence.Until.AsTime(), until)
+	}
+
+	for _, tt := range []struct {
+		name string
+		req  *incidentpb.CreateSilenceRequest
+	}{
+		{"matches everything", &incidentpb.CreateSilenceRequest{Duration: durationpb.New(time.Hour)}},
+		{"no duration", &incidentpb.CreateSilenceRequest{Rule: "http-errors"}},
+		{"negative duration", &incidentpb.CreateSilenceRequest{Rule: "http-errors", Duration: durationpb.New(-time.Hour)}},
+		{"until in the past", &incidentpb.CreateSilenceRequest{Rule: "http-errors", Until: timestamppb.New(time.Now().Add(-time.Hour))}},
+		{"long comment", &incidentpb.CreateSilenceRequest{Rule: "http-errors", Duration: durationpb.New(time.Hour), Comment: strings.Repeat("x", maxSilenceCommentLength+1)}},
+	} {
+		if _, err := c.CreateSilence(authed, tt.req); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("%s: got %v, want InvalidArgument", tt.name, err)
+		}
+	}
+}
+
+func TestGRPCAuthorization(t *testing.T) {
+	ctx := context.Background()
+	for _, tt := range []struct {
+		local bool
+		want  codes.Code
+	}{
+		{local: false, want: codes.PermissionDenied},
+		{local: true, want: codes.NotFound},
+	} {
+		a := &apiServer{incidents: newMemoryIncidentManager(), alerter: &CaptureAlerter{}, stream: newIncidentStream()}
+		c := dialGRPC(t, a, tt.local)
+		if _, err := c.AckIncident(ctx, &incidentpb.AckIncidentRequest{Id: "INC-00000000"}); status.Code(err) != tt.want {
+			t.Errorf("local %v: got %v, want %s", tt.local, err, tt.want)
+		}
+	}
+}
+
+func TestGRPCWatchIncidents(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	a := &apiServer{incidents: newMemoryIncidentManager(), alerter: &CaptureAlerter{}, stream: newIncidentStream()}
+	c := dialGRPC(t, a, true)
+
+	watch, err := c.WatchIncidents(ctx, &incidentpb.WatchIncidentsRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The header is sent once the server has subscribed.
+	if _, err := watch.Header(); err != nil {
+		t.Fatal(err)
+	}
+	a.stream.WriteEvent(ctx, IncidentEvent{Kind: IncidentResolved, Incident: Incident{ID: "INC-7f3a9c21", Service: "orders"}})
+	e, err := watch.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Kind != incidentpb.IncidentEvent_RESOLVED || e.Incident.Id != "INC-7f3a9c21" {
+		t.Errorf("got %v, want INC-7f3a9c21 resolved", e)
+	}
+}
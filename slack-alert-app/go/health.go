@@ -0,0 +1,72 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// ready returns why the bot isn't ready, or nil if it is: connected to
+// Pixie Cloud, running a valid config, and every polling rule has been
+// checked within the last two intervals.
+func (a *app) ready() error {
+	// Replayed checks and checks of local data don't connect to Pixie.
+	if a.pixie != nil {
+		if client, _ := a.pixie.Client(); client == nil {
+			return fmt.Errorf("not connected to Pixie Cloud")
+		}
+	}
+
+	a.mu.Lock()
+	engine, started, reloadErr := a.engine, a.started, a.reloadErr
+	a.mu.Unlock()
+	if reloadErr != nil {
+		return fmt.Errorf("config is invalid: %v", reloadErr)
+	}
+	if started.IsZero() {
+		return fmt.Errorf("not running yet")
+	}
+	// Standby replicas don't run checks.
+	if !a.leader.IsLeader() {
+		return nil
+	}
+
+	now := time.Now()
+	status := make(map[string]RuleStatus)
+	for _, st := range engine.Status() {
+		status[st.Rule] = st
+	}
+	for _, t := range engine.trackers {
+		// Streaming rules don't check on an interval, and scheduled rules
+		// can go a long time between checks.
+		if t.rule.Streaming || t.schedule != nil {
+			continue
+		}
+		st, ok := status[t.rule.Name]
+		last := st.LastCheck
+		if !ok {
+			last = started
+		}
+		// Allow for the jitter before each check, and for unhealthy rules backing off.
+		interval := engine.backoff(t.rule.Interval.Duration, st.ConsecutiveFailures)
+		if maxAge := 2*interval + t.rule.Jitter.Duration; now.Sub(last) > maxAge {
+			return fmt.Errorf("rule %s hasn't been checked for %s", t.rule.Name, now.Sub(last).Round(time.Second))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,235 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// heartbeat lets people notice when the bot silently stops: it posts a
+// message saying the bot is alive on a schedule, and pings a dead man's
+// switch, such as a Healthchecks.io check, while the bot is healthy.
+type heartbeat struct {
+	// When to post a message, or nil to not post any.
+	schedule *cronSchedule
+	alerter  Alerter
+	// Whether the scheduled message is an all-clear message.
+	allClear bool
+	// URL to ping every interval, or empty to not ping.
+	url      string
+	interval time.Duration
+	http     *http.Client
+}
+
+// newHeartbeat returns the heartbeat configured by cfg, or nil if none is.
+func newHeartbeat(cfg *Config) (*heartbeat, error) {
+	hc := cfg.Heartbeat
+	if hc.Schedule == "" && hc.URL == "" {
+		return nil, nil
+	}
+	h := &heartbeat{url: hc.URL, interval: hc.Interval.Duration, allClear: hc.AllClear, http: &http.Client{Timeout: 10 * time.Second}}
+	if hc.Schedule != "" {
+		loc, err := time.LoadLocation(cfg.Timezone)
+		if err != nil {
+			return nil, err
+		}
+		if h.schedule, err = parseCron(hc.Schedule, loc); err != nil {
+			return nil, fmt.Errorf("heartbeat schedule: %w", err)
+		}
+		h.alerter = cfg.channelAlerter(cfg.Defaults.Channel)
+		if hc.Alerter != "" {
+			if h.alerter, err = cfg.namedAlerter(hc.Alerter); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return h, nil
+}
+
+// runHeartbeat posts heartbeat messages and pings until ctx is cancelled.
+// Only the leader does, since standby replicas don't run checks.
+func (a *app) runHeartbeat(ctx context.Context) {
+	h := a.heartbeat
+	if h == nil {
+		return
+	}
+	var wg sync.WaitGroup
+	if h.schedule != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// All-clear messages cover the time since the previous one.
+			since := time.Now()
+			for {
+				next := h.schedule.Next(time.Now())
+				if next.IsZero() {
+					return
+				}
+				timer := time.NewTimer(time.Until(next))
+				select {
+				case <-ctx.Done():
+					timer.Stop()
+					return
+				case <-timer.C:
+				}
+				if !a.leader.IsLeader() {
+					continue
+				}
+				var msg string
+				if h.allClear {
+					msg = a.allClearMessage(ctx, since, next.Location())
+					since = next
+				} else {
+					msg = a.heartbeatMessage(ctx, next.Location())
+				}
+				if msg == "" {
+					continue
+				}
+				if err := h.alerter.SendInfo(ctx, msg); err != nil {
+					logError("Error sending heartbeat.", "error", err)
+				}
+			}
+		}()
+	}
+	if h.url != "" {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ticker := time.NewTicker(h.interval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+				}
+				if !a.leader.IsLeader() {
+					continue
+				}
+				// Not pinging lets the dead man's switch go off.
+				if err := a.ready(); err != nil {
+					logWarn("Not pinging the heartbeat URL, the bot isn't ready.", "error", err)
+					continue
+				}
+				if err := h.ping(ctx); err != nil {
+					logError("Error pinging the heartbeat URL.", "error", err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// heartbeatMessage describes the bot's state, such as "Pixie alert bot is
+// alive, last check 12:05 PST, 0 incidents open."
+func (a *app) heartbeatMessage(ctx context.Context, loc *time.Location) string {
+	a.mu.Lock()
+	engine := a.engine
+	a.mu.Unlock()
+
+	var last time.Time
+	failing := 0
+	for _, st := range engine.Status() {
+		if st.LastCheck.After(last) {
+			last = st.LastCheck
+		}
+		if st.ConsecutiveFailures > 0 {
+			failing++
+		}
+	}
+	var b strings.Builder
+	b.WriteString(":heartbeat: Pixie alert bot is alive")
+	if last.IsZero() {
+		b.WriteString(", no checks yet")
+	} else {
+		fmt.Fprintf(&b, ", last check %s", last.In(loc).Format("15:04 MST"))
+	}
+	if incidents, err := a.incidents.Open(ctx); err == nil {
+		fmt.Fprintf(&b, ", %d incidents open", len(incidents))
+	}
+	if failing > 0 {
+		fmt.Fprintf(&b, ", %d of %d rules failing", failing, len(engine.trackers))
+	}
+	b.WriteString(".")
+	return b.String()
+}
+
+// allClearMessage confirms that every rule has been checked since the given
+// time without finding any incidents, such as "All clear: 3 rules checked
+// since Mon 09:00 PST, no services over their thresholds." If a rule hasn't
+// been checked successfully since then, it says which instead. It returns ""
+// while incidents are open, since their alerts already say the bot is working.
+func (a *app) allClearMessage(ctx context.Context, since time.Time, loc *time.Location) string {
+	a.mu.Lock()
+	engine := a.engine
+	a.mu.Unlock()
+
+	incidents, err := a.incidents.Open(ctx)
+	if err != nil {
+		logError("Error listing open incidents for the all-clear message.", "error", err)
+		return ""
+	}
+	if len(incidents) > 0 {
+		logDebug("Not sending the all-clear message, incidents are open.", "incidents", len(incidents))
+		return ""
+	}
+
+	status := make(map[string]RuleStatus)
+	for _, st := range engine.Status() {
+		status[st.Rule] = st
+	}
+	var checked int
+	var unchecked []string
+	for _, t := range engine.trackers {
+		// Streaming rules are evaluated continuously, without checks.
+		if t.rule.Streaming {
+			continue
+		}
+		if st, ok := status[t.rule.Name]; ok && st.LastSuccess.After(since) {
+			checked++
+		} else {
+			unchecked = append(unchecked, t.rule.Name)
+		}
+	}
+	when := since.In(loc).Format("Mon 15:04 MST")
+	if len(unchecked) > 0 {
+		return fmt.Sprintf(":warning: Not all clear: %d of %d rules haven't been checked successfully since %s: %s.",
+			len(unchecked), checked+len(unchecked), when, strings.Join(unchecked, ", "))
+	}
+	return fmt.Sprintf(":white_check_mark: All clear: %d rules checked since %s, no services over their thresholds.", checked, when)
+}
+
+func (h *heartbeat) ping(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, h.url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := h.http.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("heartbeat URL returned %s", resp.Status)
+	}
+	return nil
+}
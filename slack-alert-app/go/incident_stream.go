@@ -0,0 +1,123 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// How often a comment is sent to idle event stream clients, so that proxies
+// don't close the connection.
+const streamKeepAlive = 30 * time.Second
+
+// incidentStream is an IncidentSink that broadcasts incident events to the
+// clients of GET /api/stream. Clients that fall behind are disconnected
+// rather than slowing down checks, and can reconnect and catch up from GET
+// /api/incidents.
+type incidentStream struct {
+	mu      sync.Mutex
+	clients map[chan IncidentEvent]struct{}
+}
+
+func newIncidentStream() *incidentStream {
+	return &incidentStream{clients: make(map[chan IncidentEvent]struct{})}
+}
+
+func (s *incidentStream) WriteEvent(ctx context.Context, e IncidentEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for ch := range s.clients {
+		select {
+		case ch <- e:
+		default:
+			logWarn("Disconnecting slow incident stream client.")
+			delete(s.clients, ch)
+			close(ch)
+		}
+	}
+	return nil
+}
+
+func (s *incidentStream) subscribe() chan IncidentEvent {
+	ch := make(chan IncidentEvent, 64)
+	s.mu.Lock()
+	s.clients[ch] = struct{}{}
+	s.mu.Unlock()
+	return ch
+}
+
+func (s *incidentStream) unsubscribe(ch chan IncidentEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.clients[ch]; ok {
+		delete(s.clients, ch)
+		close(ch)
+	}
+}
+
+// handleStream streams incident events as server-sent events until the
+// client disconnects. Each event is named after its kind (opened, updated or
+// resolved), with the incident as its JSON data.
+func (a *apiServer) handleStream(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	ch := a.stream.subscribe()
+	defer a.stream.unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// Stops nginx from buffering the stream.
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, ": connected\n\n")
+	flusher.Flush()
+
+	ticker := time.NewTicker(streamKeepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case e, ok := <-ch:
+			if !ok {
+				return
+			}
+			b, err := json.Marshal(e.Incident)
+			if err != nil {
+				logError("Error encoding incident event.", "incident", e.Incident.ID, "error", err)
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Kind, b)
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,325 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+
+package incidentpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+const _ = grpc.SupportPackageIsVersion7
+
+// IncidentServiceClient is the client API for IncidentService service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type IncidentServiceClient interface {
+	// ListIncidents returns incidents newest first.
+	ListIncidents(ctx context.Context, in *ListIncidentsRequest, opts ...grpc.CallOption) (*ListIncidentsResponse, error)
+	// GetIncident returns one incident, or NOT_FOUND.
+	GetIncident(ctx context.Context, in *GetIncidentRequest, opts ...grpc.CallOption) (*Incident, error)
+	// AckIncident marks an incident as acknowledged, which stops further
+	// update messages.
+	AckIncident(ctx context.Context, in *AckIncidentRequest, opts ...grpc.CallOption) (*Incident, error)
+	// SilenceIncident mutes all messages for an incident for a while.
+	SilenceIncident(ctx context.Context, in *SilenceIncidentRequest, opts ...grpc.CallOption) (*Incident, error)
+	// CreateSilence silences every incident of a rule, cluster, namespace or
+	// service, like POST /api/silences.
+	CreateSilence(ctx context.Context, in *CreateSilenceRequest, opts ...grpc.CallOption) (*Silence, error)
+	// WatchIncidents streams every change to an incident until the client
+	// cancels. Clients that fall behind are disconnected with UNAVAILABLE, and
+	// can catch up with ListIncidents.
+	WatchIncidents(ctx context.Context, in *WatchIncidentsRequest, opts ...grpc.CallOption) (IncidentService_WatchIncidentsClient, error)
+}
+
+type incidentServiceClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewIncidentServiceClient(cc grpc.ClientConnInterface) IncidentServiceClient {
+	return &incidentServiceClient{cc}
+}
+
+func (c *incidentServiceClient) ListIncidents(ctx context.Context, in *ListIncidentsRequest, opts ...grpc.CallOption) (*ListIncidentsResponse, error) {
+	out := new(ListIncidentsResponse)
+	err := c.cc.Invoke(ctx, "/slackbot.incidents.IncidentService/ListIncidents", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *incidentServiceClient) GetIncident(ctx context.Context, in *GetIncidentRequest, opts ...grpc.CallOption) (*Incident, error) {
+	out := new(Incident)
+	err := c.cc.Invoke(ctx, "/slackbot.incidents.IncidentService/GetIncident", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *incidentServiceClient) AckIncident(ctx context.Context, in *AckIncidentRequest, opts ...grpc.CallOption) (*Incident, error) {
+	out := new(Incident)
+	err := c.cc.Invoke(ctx, "/slackbot.incidents.IncidentService/AckIncident", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *incidentServiceClient) SilenceIncident(ctx context.Context, in *SilenceIncidentRequest, opts ...grpc.CallOption) (*Incident, error) {
+	out := new(Incident)
+	err := c.cc.Invoke(ctx, "/slackbot.incidents.IncidentService/SilenceIncident", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *incidentServiceClient) CreateSilence(ctx context.Context, in *CreateSilenceRequest, opts ...grpc.CallOption) (*Silence, error) {
+	out := new(Silence)
+	err := c.cc.Invoke(ctx, "/slackbot.incidents.IncidentService/CreateSilence", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *incidentServiceClient) WatchIncidents(ctx context.Context, in *WatchIncidentsRequest, opts ...grpc.CallOption) (IncidentService_WatchIncidentsClient, error) {
+	stream, err := c.cc.NewStream(ctx, &_IncidentService_serviceDesc.Streams[0], "/slackbot.incidents.IncidentService/WatchIncidents", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &incidentServiceWatchIncidentsClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type IncidentService_WatchIncidentsClient interface {
+	Recv() (*IncidentEvent, error)
+	grpc.ClientStream
+}
+
+type incidentServiceWatchIncidentsClient struct {
+	grpc.ClientStream
+}
+
+func (x *incidentServiceWatchIncidentsClient) Recv() (*IncidentEvent, error) {
+	m := new(IncidentEvent)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// IncidentServiceServer is the server API for IncidentService service.
+// All implementations must embed UnimplementedIncidentServiceServer
+// for forward compatibility
+type IncidentServiceServer interface {
+	// ListIncidents returns incidents newest first.
+	ListIncidents(context.Context, *ListIncidentsRequest) (*ListIncidentsResponse, error)
+	// GetIncident returns one incident, or NOT_FOUND.
+	GetIncident(context.Context, *GetIncidentRequest) (*Incident, error)
+	// AckIncident marks an incident as acknowledged, which stops further
+	// update messages.
+	AckIncident(context.Context, *AckIncidentRequest) (*Incident, error)
+	// SilenceIncident mutes all messages for an incident for a while.
+	SilenceIncident(context.Context, *SilenceIncidentRequest) (*Incident, error)
+	// CreateSilence silences every incident of a rule, cluster, namespace or
+	// service, like POST /api/silences.
+	CreateSilence(context.Context, *CreateSilenceRequest) (*Silence, error)
+	// WatchIncidents streams every change to an incident until the client
+	// cancels. Clients that fall behind are disconnected with UNAVAILABLE, and
+	// can catch up with ListIncidents.
+	WatchIncidents(*WatchIncidentsRequest, IncidentService_WatchIncidentsServer) error
+	mustEmbedUnimplementedIncidentServiceServer()
+}
+
+// UnimplementedIncidentServiceServer must be embedded to have forward compatible implementations.
+type UnimplementedIncidentServiceServer struct {
+}
+
+func (UnimplementedIncidentServiceServer) ListIncidents(context.Context, *ListIncidentsRequest) (*ListIncidentsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListIncidents not implemented")
+}
+func (UnimplementedIncidentServiceServer) GetIncident(context.Context, *GetIncidentRequest) (*Incident, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetIncident not implemented")
+}
+func (UnimplementedIncidentServiceServer) AckIncident(context.Context, *AckIncidentRequest) (*Incident, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method AckIncident not implemented")
+}
+func (UnimplementedIncidentServiceServer) SilenceIncident(context.Context, *SilenceIncidentRequest) (*Incident, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SilenceIncident not implemented")
+}
+func (UnimplementedIncidentServiceServer) CreateSilence(context.Context, *CreateSilenceRequest) (*Silence, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CreateSilence not implemented")
+}
+func (UnimplementedIncidentServiceServer) WatchIncidents(*WatchIncidentsRequest, IncidentService_WatchIncidentsServer) error {
+	return status.Errorf(codes.Unimplemented, "method WatchIncidents not implemented")
+}
+func (UnimplementedIncidentServiceServer) mustEmbedUnimplementedIncidentServiceServer() {}
+
+// UnsafeIncidentServiceServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to IncidentServiceServer will
+// result in compilation errors.
+type UnsafeIncidentServiceServer interface {
+	mustEmbedUnimplementedIncidentServiceServer()
+}
+
+func RegisterIncidentServiceServer(s grpc.ServiceRegistrar, srv IncidentServiceServer) {
+	s.RegisterService(&_IncidentService_serviceDesc, srv)
+}
+
+func _IncidentService_ListIncidents_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListIncidentsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(IncidentServiceServer).ListIncidents(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/slackbot.incidents.IncidentService/ListIncidents",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(IncidentServiceServer).ListIncidents(ctx, req.(*ListIncidentsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _IncidentService_GetIncident_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetIncidentRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(IncidentServiceServer).GetIncident(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/slackbot.incidents.IncidentService/GetIncident",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(IncidentServiceServer).GetIncident(ctx, req.(*GetIncidentRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _IncidentService_AckIncident_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AckIncidentRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(IncidentServiceServer).AckIncident(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/slackbot.incidents.IncidentService/AckIncident",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(IncidentServiceServer).AckIncident(ctx, req.(*AckIncidentRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _IncidentService_SilenceIncident_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SilenceIncidentRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(IncidentServiceServer).SilenceIncident(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/slackbot.incidents.IncidentService/SilenceIncident",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(IncidentServiceServer).SilenceIncident(ctx, req.(*SilenceIncidentRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _IncidentService_CreateSilence_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CreateSilenceRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(IncidentServiceServer).CreateSilence(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/slackbot.incidents.IncidentService/CreateSilence",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(IncidentServiceServer).CreateSilence(ctx, req.(*CreateSilenceRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _IncidentService_WatchIncidents_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchIncidentsRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(IncidentServiceServer).WatchIncidents(m, &incidentServiceWatchIncidentsServer{stream})
+}
+
+type IncidentService_WatchIncidentsServer interface {
+	Send(*IncidentEvent) error
+	grpc.ServerStream
+}
+
+type incidentServiceWatchIncidentsServer struct {
+	grpc.ServerStream
+}
+
+func (x *incidentServiceWatchIncidentsServer) Send(m *IncidentEvent) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+var _IncidentService_serviceDesc = grpc.ServiceDesc{
+	ServiceName: "slackbot.incidents.IncidentService",
+	HandlerType: (*IncidentServiceServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "ListIncidents",
+			Handler:    _IncidentService_ListIncidents_Handler,
+		},
+		{
+			MethodName: "GetIncident",
+			Handler:    _IncidentService_GetIncident_Handler,
+		},
+		{
+			MethodName: "AckIncident",
+			Handler:    _IncidentService_AckIncident_Handler,
+		},
+		{
+			MethodName: "SilenceIncident",
+			Handler:    _IncidentService_SilenceIncident_Handler,
+		},
+		{
+			MethodName: "CreateSilence",
+			Handler:    _IncidentService_CreateSilence_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "WatchIncidents",
+			Handler:       _IncidentService_WatchIncidents_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "incidents.proto",
+}
@@ -0,0 +1,438 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ErrIncidentNotFound is returned when an incident ID doesn't match any known incident.
+var ErrIncidentNotFound = errors.New("incident not found")
+
+const (
+	// How long resolved incidents are kept around for lookups.
+	resolvedIncidentTTL = 30 * 24 * time.Hour
+	// Number of random IDs tried before giving up on finding an unused one.
+	maxIncidentIDAttempts = 10
+	// Maximum number of samples kept for an incident. Once there are more,
+	// the first half is kept and every other later sample is dropped.
+	maxIncidentSamples = 100
+)
+
+// IncidentData holds the HTTP stats for a single service, or one of its
+// endpoints, from one run of the PxL script. The `px` tags map each field to
+// a column of the script's output table.
+type IncidentData struct {
+	Service string `json:"service" px:"service"`
+	// Request path, or empty if the stats cover the whole service.
+	Endpoint      string `json:"endpoint,omitempty" px:"endpoint,optional"`
+	ErrorCount    int64  `json:"errorCount" px:"error_count"`
+	TotalRequests int64  `json:"totalRequests" px:"total_requests"`
+	// Values of the columns the rule shows in messages, such as a pod's
+	// memory usage, in the order the rule lists them.
+	Details []IncidentDetail `json:"details,omitempty"`
+}
+
+// IncidentDetail is the value of one of the columns a rule shows in messages.
+type IncidentDetail struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// ErrorRate returns the fraction of requests counted as errors by the rule's
+// script, such as those that returned a 4xx+ status.
+func (d IncidentData) ErrorRate() float64 {
+	if d.TotalRequests == 0 {
+		return 0
+	}
+	return float64(d.ErrorCount) / float64(d.TotalRequests)
+}
+
+// Incident tracks a service whose error rate has been over the threshold
+// for one or more consecutive checks.
+type Incident struct {
+	ID         string    `json:"id"`
+	Rule       string    `json:"rule"`
+	Cluster    Cluster   `json:"cluster"`
+	Service    string    `json:"service"`
+	OpenedAt   time.Time `json:"openedAt"`
+	UpdatedAt  time.Time `json:"updatedAt"`
+	ResolvedAt time.Time `json:"resolvedAt,omitempty"`
+	// Latest stats rolled up for the whole service.
+	Latest IncidentData `json:"latest"`
+	// Latest stats for each of the service's endpoints over the threshold,
+	// from highest to lowest error rate.
+	Endpoints []IncidentData `json:"endpoints"`
+	// Stats from the checks during which the incident was open. Long
+	// incidents keep their first checks and a thinned out sample of the rest.
+	Samples []IncidentSample `json:"samples"`
+	// Number of samples dropped to keep Samples short.
+	DroppedSamples int `json:"droppedSamples,omitempty"`
+	// Sample with the highest error rate, which is kept even if dropped from Samples.
+	Peak          IncidentSample `json:"peak"`
+	Acked         bool           `json:"acked"`
+	SilencedUntil time.Time      `json:"silencedUntil,omitempty"`
+}
+
+// IncidentSample is the service's stats from one check.
+type IncidentSample struct {
+	Time time.Time    `json:"time"`
+	Data IncidentData `json:"data"`
+}
+
+// PeakErrorRate returns the highest error rate seen while the incident was open.
+func (i *Incident) PeakErrorRate() float64 {
+	peak := i.Peak.Data.ErrorRate()
+	for _, s := range i.Samples {
+		if r := s.Data.ErrorRate(); r > peak {
+			peak = r
+		}
+	}
+	return peak
+}
+
+// addSample records the stats of a check, thinning out the samples once
+// there are more than maxIncidentSamples, so that long incidents don't grow
+// without bound.
+func (i *Incident) addSample(s IncidentSample) {
+	if s.Data.ErrorRate() > i.Peak.Data.ErrorRate() || i.Peak.Time.IsZero() {
+		i.Peak = s
+	}
+	i.Samples = append(i.Samples, s)
+	if len(i.Samples) <= maxIncidentSamples {
+		return
+	}
+	// Keep the first half, and every other later sample ending with the
+	// latest. The samples are copied rather than moved, since copies of the
+	// incident handed out by incident managers share the old array.
+	half := maxIncidentSamples / 2
+	samples := append(make([]IncidentSample, 0, maxIncidentSamples+1), i.Samples[:half]...)
+	for j := half + (len(i.Samples)-1-half)%2; j < len(i.Samples); j += 2 {
+		samples = append(samples, i.Samples[j])
+	}
+	i.DroppedSamples += len(i.Samples) - len(samples)
+	i.Samples = samples
+}
+
+// Silenced returns whether messages for the incident are currently muted.
+func (i *Incident) Silenced(now time.Time) bool {
+	return now.Before(i.SilencedUntil)
+}
+
+// IncidentEventKind describes how an incident changed during a check.
+type IncidentEventKind int
+
+const (
+	IncidentOpened IncidentEventKind = iota
+	IncidentUpdated
+	IncidentResolved
+)
+
+// String returns the name of the kind of event: opened, updated or resolved.
+func (k IncidentEventKind) String() string {
+	switch k {
+	case IncidentOpened:
+		return "opened"
+	case IncidentUpdated:
+		return "updated"
+	case IncidentResolved:
+		return "resolved"
+	}
+	return "unknown"
+}
+
+// IncidentEvent is a change to an incident produced by IncidentManager.Update.
+type IncidentEvent struct {
+	Kind     IncidentEventKind
+	Incident Incident
+}
+
+// IncidentSink is told about every change to an incident, including silenced
+// ones, such as to mirror incidents in another system.
+type IncidentSink interface {
+	WriteEvent(ctx context.Context, e IncidentEvent) error
+}
+
+// IncidentManager keeps track of open incidents across checks.
+type IncidentManager interface {
+	// Update reconciles the rule's open incidents on a cluster with the endpoints
+	// that are currently over the threshold, opening, updating and resolving
+	// incidents as needed. Endpoints are grouped into a single incident per service.
+	Update(ctx context.Context, rule string, cluster Cluster, over []IncidentData, now time.Time) ([]IncidentEvent, error)
+	// Get returns the incident with the given ID.
+	Get(ctx context.Context, id string) (*Incident, error)
+	// Ack marks an incident as acknowledged, which stops further update messages.
+	Ack(ctx context.Context, id string) (*Incident, error)
+	// Silence mutes all messages for an incident until the given time.
+	Silence(ctx context.Context, id string, until time.Time) (*Incident, error)
+	// Open returns every open incident, oldest first.
+	Open(ctx context.Context) ([]Incident, error)
+	// All returns every incident that is open or was resolved recently enough
+	// to be kept, oldest first.
+	All(ctx context.Context) ([]Incident, error)
+}
+
+// memoryIncidentManager is an IncidentManager that keeps incidents in memory.
+type memoryIncidentManager struct {
+	mu sync.Mutex
+	// Open incidents keyed by rule and cluster ID, then service name.
+	open map[openKey]map[string]*Incident
+	// All incidents, open and resolved, keyed by ID. Resolved incidents are
+	// dropped after resolvedIncidentTTL.
+	byID map[string]*Incident
+	// When resolved incidents were last dropped.
+	pruned time.Time
+}
+
+func newMemoryIncidentManager() *memoryIncidentManager {
+	return &memoryIncidentManager{
+		open: make(map[openKey]map[string]*Incident),
+		byID: make(map[string]*Incident),
+	}
+}
+
+type openKey struct {
+	rule      string
+	clusterID string
+}
+
+func (m *memoryIncidentManager) Update(ctx context.Context, rule string, cluster Cluster, over []IncidentData, now time.Time) ([]IncidentEvent, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := openKey{rule: rule, clusterID: cluster.ID}
+	open, ok := m.open[key]
+	if !ok {
+		open = make(map[string]*Incident)
+		m.open[key] = open
+	}
+	events, err := reconcileIncidents(open, rule, cluster, over, now, m.newID)
+	for _, inc := range open {
+		m.byID[inc.ID] = inc
+	}
+	if now.Sub(m.pruned) >= time.Hour {
+		m.prune(now)
+	}
+	return events, err
+}
+
+// prune drops the incidents that were resolved more than resolvedIncidentTTL
+// before now. Must be called with m.mu held.
+func (m *memoryIncidentManager) prune(now time.Time) {
+	for id, inc := range m.byID {
+		if !inc.ResolvedAt.IsZero() && now.Sub(inc.ResolvedAt) > resolvedIncidentTTL {
+			delete(m.byID, id)
+		}
+	}
+	m.pruned = now
+}
+
+func (m *memoryIncidentManager) Get(ctx context.Context, id string) (*Incident, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	inc, ok := m.byID[id]
+	if !ok {
+		return nil, ErrIncidentNotFound
+	}
+	cp := *inc
+	return &cp, nil
+}
+
+func (m *memoryIncidentManager) Ack(ctx context.Context, id string) (*Incident, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	inc, ok := m.byID[id]
+	if !ok {
+		return nil, ErrIncidentNotFound
+	}
+	inc.Acked = true
+	cp := *inc
+	return &cp, nil
+}
+
+func (m *memoryIncidentManager) Silence(ctx context.Context, id string, until time.Time) (*Incident, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	inc, ok := m.byID[id]
+	if !ok {
+		return nil, ErrIncidentNotFound
+	}
+	inc.SilencedUntil = until
+	cp := *inc
+	return &cp, nil
+}
+
+func (m *memoryIncidentManager) Open(ctx context.Context) ([]Incident, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var incidents []Incident
+	for _, open := range m.open {
+		for _, inc := range open {
+			incidents = append(incidents, *inc)
+		}
+	}
+	sortIncidents(incidents)
+	return incidents, nil
+}
+
+func (m *memoryIncidentManager) All(ctx context.Context) ([]Incident, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	incidents := make([]Incident, 0, len(m.byID))
+	for _, inc := range m.byID {
+		incidents = append(incidents, *inc)
+	}
+	sortIncidents(incidents)
+	return incidents, nil
+}
+
+// sortIncidents sorts incidents from oldest to newest, by ID if they were opened at the same time.
+func sortIncidents(incidents []Incident) {
+	sort.Slice(incidents, func(i, j int) bool {
+		if !incidents[i].OpenedAt.Equal(incidents[j].OpenedAt) {
+			return incidents[i].OpenedAt.Before(incidents[j].OpenedAt)
+		}
+		return incidents[i].ID < incidents[j].ID
+	})
+}
+
+// reconcileIncidents updates open, a map of the rule's open incidents on a
+// cluster keyed by service, with the endpoints that are currently over the threshold.
+// Incidents for services that no longer have any endpoints over the threshold
+// are resolved and removed.
+func reconcileIncidents(open map[string]*Incident, rule string, cluster Cluster, over []IncidentData, now time.Time, newID func() (string, error)) ([]IncidentEvent, error) {
+	var events []IncidentEvent
+	rollups, endpoints := groupByService(over)
+	seen := make(map[string]bool)
+	for _, d := range rollups {
+		seen[d.Service] = true
+		if inc, ok := open[d.Service]; ok {
+			inc.UpdatedAt = now
+			inc.Latest = d
+			inc.Endpoints = endpoints[d.Service]
+			inc.addSample(IncidentSample{Time: now, Data: d})
+			events = append(events, IncidentEvent{Kind: IncidentUpdated, Incident: *inc})
+			continue
+		}
+		id, err := newID()
+		if err != nil {
+			return events, err
+		}
+		inc := &Incident{
+			ID:        id,
+			Rule:      rule,
+			Cluster:   cluster,
+			Service:   d.Service,
+			OpenedAt:  now,
+			UpdatedAt: now,
+			Latest:    d,
+			Endpoints: endpoints[d.Service],
+			Samples:   []IncidentSample{{Time: now, Data: d}},
+			Peak:      IncidentSample{Time: now, Data: d},
+		}
+		open[d.Service] = inc
+		events = append(events, IncidentEvent{Kind: IncidentOpened, Incident: *inc})
+	}
+
+	for service, inc := range open {
+		if seen[service] {
+			continue
+		}
+		inc.ResolvedAt = now
+		delete(open, service)
+		events = append(events, IncidentEvent{Kind: IncidentResolved, Incident: *inc})
+	}
+	return events, nil
+}
+
+// groupByService rolls up per-endpoint stats into per-service stats, in the
+// order each service first appears. It also returns each service's endpoints
+// sorted from highest to lowest error rate.
+func groupByService(stats []IncidentData) ([]IncidentData, map[string][]IncidentData) {
+	var rollups []IncidentData
+	idx := make(map[string]int)
+	endpoints := make(map[string][]IncidentData)
+	for _, d := range stats {
+		i, ok := idx[d.Service]
+		if !ok {
+			i = len(rollups)
+			idx[d.Service] = i
+			rollups = append(rollups, IncidentData{Service: d.Service})
+		}
+		rollups[i].ErrorCount += d.ErrorCount
+		rollups[i].TotalRequests += d.TotalRequests
+		if d.Endpoint != "" {
+			endpoints[d.Service] = append(endpoints[d.Service], d)
+		} else {
+			rollups[i].Details = d.Details
+		}
+	}
+	for _, eps := range endpoints {
+		sort.SliceStable(eps, func(i, j int) bool {
+			return eps[i].ErrorRate() > eps[j].ErrorRate()
+		})
+	}
+	return rollups, endpoints
+}
+
+// newID generates a short incident ID, such as INC-7f3a9c21, that isn't already in use.
+// Must be called with m.mu held.
+func (m *memoryIncidentManager) newID() (string, error) {
+	return newUnusedIncidentID(func(id string) (bool, error) {
+		_, ok := m.byID[id]
+		return ok, nil
+	})
+}
+
+// newUnusedIncidentID generates incident IDs until used reports one isn't in
+// use, giving up after maxIncidentIDAttempts.
+func newUnusedIncidentID(used func(id string) (bool, error)) (string, error) {
+	for i := 0; i < maxIncidentIDAttempts; i++ {
+		id, err := newIncidentID()
+		if err != nil {
+			return "", err
+		}
+		inUse, err := used(id)
+		if err != nil {
+			return "", err
+		}
+		if !inUse {
+			return id, nil
+		}
+	}
+	return "", fmt.Errorf("no unused incident ID found in %d attempts", maxIncidentIDAttempts)
+}
+
+func newIncidentID() (string, error) {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "INC-" + hex.EncodeToString(b), nil
+}
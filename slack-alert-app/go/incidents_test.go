@@ -0,0 +1,154 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testConcurrentIncidents runs checks of several rules at the same time as
+// incidents are acknowledged, silenced and read, as the API and the checks
+// do, for go test -race to catch unsynchronized access. It fails if an
+// acknowledgement or silence is lost, such as by a check saving an older copy
+// of the incident over it.
+func testConcurrentIncidents(t *testing.T, m IncidentManager, checks int) {
+	ctx := context.Background()
+	// Acknowledging and silencing prune resolved incidents as of the current time.
+	start := time.Now()
+	cluster := Cluster{ID: "c1", Name: "prod"}
+	const rules, services = 3, 4
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 100)
+	for r := 0; r < rules; r++ {
+		wg.Add(1)
+		go func(rule string) {
+			defer wg.Done()
+			for i := 0; i < checks; i++ {
+				// Services go over and back under the threshold, so that
+				// incidents open, update, resolve and reopen, except for one
+				// whose incident stays open long enough for its samples to
+				// be thinned out.
+				over := []IncidentData{{Service: "svc-down", ErrorCount: 50, TotalRequests: 100}}
+				for s := 0; s < services; s++ {
+					if (i+s)%3 != 0 {
+						over = append(over, IncidentData{Service: fmt.Sprintf("svc-%d", s), Endpoint: "/", ErrorCount: int64(10 + i), TotalRequests: 100})
+					}
+				}
+				if _, err := m.Update(ctx, rule, cluster, over, start.Add(time.Duration(i)*time.Minute)); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(fmt.Sprintf("rule-%d", r))
+	}
+
+	var mu sync.Mutex
+	acked := make(map[string]bool)
+	silenced := make(map[string]time.Time)
+	stop := make(chan struct{})
+	var readers sync.WaitGroup
+	for w := 0; w < 2; w++ {
+		readers.Add(1)
+		go func(w int) {
+			defer readers.Done()
+			until := start.Add(time.Duration(w+1) * time.Hour)
+			// Ends with a pass after the checks are done, so that every
+			// reader gets to acknowledge or silence something.
+			for done := false; !done; {
+				select {
+				case <-stop:
+					done = true
+				default:
+				}
+				open, err := m.Open(ctx)
+				if err != nil {
+					errs <- err
+					return
+				}
+				for _, inc := range open {
+					var got *Incident
+					if w == 0 {
+						got, err = m.Ack(ctx, inc.ID)
+					} else {
+						got, err = m.Silence(ctx, inc.ID, until)
+					}
+					if err != nil {
+						errs <- err
+						return
+					}
+					// Reading what was returned mustn't race with checks
+					// that update the incident.
+					_ = got.PeakErrorRate()
+					_ = len(got.Endpoints)
+					mu.Lock()
+					if w == 0 {
+						acked[inc.ID] = true
+					} else {
+						silenced[inc.ID] = until
+					}
+					mu.Unlock()
+				}
+				all, err := m.All(ctx)
+				if err != nil {
+					errs <- err
+					return
+				}
+				for _, inc := range all {
+					_ = inc.PeakErrorRate()
+				}
+			}
+		}(w)
+	}
+
+	wg.Wait()
+	close(stop)
+	readers.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+	for id := range acked {
+		inc, err := m.Get(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !inc.Acked {
+			t.Errorf("incident %s was acknowledged, but isn't anymore", id)
+		}
+	}
+	for id, until := range silenced {
+		inc, err := m.Get(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !inc.SilencedUntil.Equal(until) {
+			t.Errorf("incident %s was silenced until %s, but is silenced until %s", id, until, inc.SilencedUntil)
+		}
+	}
+	if len(acked) == 0 || len(silenced) == 0 {
+		t.Errorf("got %d acknowledged and %d silenced incidents, want some of each", len(acked), len(silenced))
+	}
+}
+
+func TestMemoryIncidentManagerConcurrency(t *testing.T) {
+	testConcurrentIncidents(t, newMemoryIncidentManager(), 1000)
+}
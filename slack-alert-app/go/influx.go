@@ -0,0 +1,108 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// influxSink writes the stats of each check to InfluxDB, or any other
+// endpoint that accepts the line protocol, for trends over longer than
+// Pixie keeps data. Each service gets a point in the configured
+// measurement, tagged with the rule, cluster and service:
+//
+//	pixie_service,rule=http-errors,cluster=prod-us,cluster_id=...,service=px-sock-shop/orders error_rate=0.25,max_error=0.5,percent_exceed_threshold=50,requests=120i,errors=30i 1600000000000000000
+//
+// along with a point in <measurement>_incidents with the number of open
+// incidents of the rule on the cluster. Timestamps are the end of the window
+// each check queried, in nanoseconds.
+type influxSink struct {
+	url         string
+	token       string
+	measurement string
+	http        *http.Client
+}
+
+func newInfluxSink(cfg InfluxConfig) *influxSink {
+	return &influxSink{url: cfg.URL, token: cfg.Token, measurement: cfg.Measurement, http: newHTTPClient(10 * time.Second)}
+}
+
+// Close closes the sink's idle connections.
+func (s *influxSink) Close() error {
+	s.http.CloseIdleConnections()
+	return nil
+}
+
+func (s *influxSink) WriteStats(ctx context.Context, b *statsBatch) error {
+	ts := strconv.FormatInt(b.Time.UnixNano(), 10)
+	tags := "rule=" + influxTag(b.Rule) + ",cluster=" + influxTag(b.Cluster.Name) + ",cluster_id=" + influxTag(b.Cluster.ID)
+	var body strings.Builder
+	for _, svc := range b.Services {
+		fmt.Fprintf(&body, "%s,%s,service=%s error_rate=%s,max_error=%s,percent_exceed_threshold=%s,requests=%di,errors=%di %s\n",
+			influxMeasurement(s.measurement), tags, influxTag(svc.Service), influxFloat(svc.ErrorRate), influxFloat(svc.MaxError),
+			influxFloat(svc.PercentExceedThreshold), svc.TotalRequests, svc.ErrorCount, ts)
+	}
+	fmt.Fprintf(&body, "%s,%s open=%di %s\n", influxMeasurement(s.measurement+"_incidents"), tags, b.OpenIncidents, ts)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, strings.NewReader(body.String()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if s.token != "" {
+		req.Header.Set("Authorization", "Token "+s.token)
+	}
+	resp, err := s.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("influx write returned %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+var (
+	influxTagEscaper         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `, "\n", `\n`)
+	influxMeasurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `, "\n", `\n`)
+)
+
+// influxTag escapes a tag value. Empty tag values aren't allowed, so they are written as "none".
+func influxTag(s string) string {
+	if s == "" {
+		return "none"
+	}
+	return influxTagEscaper.Replace(s)
+}
+
+func influxMeasurement(s string) string {
+	return influxMeasurementEscaper.Replace(s)
+}
+
+func influxFloat(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
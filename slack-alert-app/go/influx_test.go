@@ -0,0 +1,83 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestInfluxSink(t *testing.T) {
+	var got *http.Request
+	var body string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		b, _ := ioutil.ReadAll(r.Body)
+		body = string(b)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	s := newInfluxSink(InfluxConfig{URL: srv.URL + "/api/v2/write?org=example&bucket=pixie", Token: "influx-token", Measurement: "pixie_service"})
+	b := testStatsBatch()
+	b.Cluster.Name = "prod us"
+	b.Services[1].Service = "px-sock-shop/carts,v2"
+	if err := s.WriteStats(context.Background(), b); err != nil {
+		t.Fatal(err)
+	}
+	if got.Method != http.MethodPost || got.URL.Path != "/api/v2/write" || got.URL.RawQuery != "org=example&bucket=pixie" {
+		t.Errorf("sent %s %s", got.Method, got.URL)
+	}
+	if auth := got.Header.Get("Authorization"); auth != "Token influx-token" {
+		t.Errorf("Authorization %q, want Token influx-token", auth)
+	}
+	want := `pixie_service,rule=http-errors,cluster=prod\ us,cluster_id=c1,service=px-sock-shop/orders error_rate=0.3,max_error=0.5,percent_exceed_threshold=50,requests=100i,errors=30i 1614600000000000000
+pixie_service,rule=http-errors,cluster=prod\ us,cluster_id=c1,service=px-sock-shop/carts\,v2 error_rate=0,max_error=0,percent_exceed_threshold=0,requests=40i,errors=0i 1614600000000000000
+pixie_service_incidents,rule=http-errors,cluster=prod\ us,cluster_id=c1 open=1i 1614600000000000000
+`
+	if body != want {
+		t.Errorf("wrote\n%s\nwant\n%s", body, want)
+	}
+}
+
+func TestInfluxSinkError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"code":"unauthorized","message":"unauthorized access"}`, http.StatusUnauthorized)
+	}))
+	defer srv.Close()
+	err := newInfluxSink(InfluxConfig{URL: srv.URL, Measurement: "pixie_service"}).WriteStats(context.Background(), testStatsBatch())
+	if err == nil || !strings.Contains(err.Error(), `influx write returned 401 Unauthorized: {"code":"unauthorized","message":"unauthorized access"}`) {
+		t.Errorf("got %v, want InfluxDB's error", err)
+	}
+}
+
+func TestInfluxTag(t *testing.T) {
+	for in, want := range map[string]string{
+		"":                    "none",
+		"px-sock-shop/orders": "px-sock-shop/orders",
+		"a,b=c d":             `a\,b\=c\ d`,
+		"line\nbreak":         `line\nbreak`,
+	} {
+		if got := influxTag(in); got != want {
+			t.Errorf("influxTag(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Files mounted into every pod for talking to the Kubernetes API.
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// serviceAccountTokenFile is a variable so that tests can use their own token.
+var serviceAccountTokenFile = serviceAccountDir + "/token"
+
+// kubeClient is a minimal client for the Kubernetes API server, using the
+// pod's service account.
+type kubeClient struct {
+	host string
+	http *http.Client
+	// Namespace the bot runs in.
+	namespace string
+}
+
+// kubeStatusError is returned for responses with an unexpected status.
+type kubeStatusError struct {
+	code int
+	msg  string
+}
+
+func (e *kubeStatusError) Error() string {
+	return fmt.Sprintf("Kubernetes API returned %d: %s", e.code, e.msg)
+}
+
+// isKubeStatus returns whether err is a response with the given status code.
+func isKubeStatus(err error, code int) bool {
+	var se *kubeStatusError
+	return errors.As(err, &se) && se.code == code
+}
+
+// newInClusterKubeClient returns a client for the API server of the
+// cluster the bot runs in.
+func newInClusterKubeClient() (*kubeClient, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("not running in a Kubernetes cluster")
+	}
+	ca, err := ioutil.ReadFile(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, errors.New("invalid Kubernetes CA certificate")
+	}
+	namespace := os.Getenv("POD_NAMESPACE")
+	if namespace == "" {
+		b, err := ioutil.ReadFile(serviceAccountDir + "/namespace")
+		if err != nil {
+			return nil, err
+		}
+		namespace = strings.TrimSpace(string(b))
+	}
+	return &kubeClient{
+		host: "https://" + net.JoinHostPort(host, port),
+		http: &http.Client{
+			Timeout:   10 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+		},
+		namespace: namespace,
+	}, nil
+}
+
+// Close closes the idle connections to the API server.
+func (k *kubeClient) Close() error {
+	k.http.CloseIdleConnections()
+	return nil
+}
+
+// do sends a request to the API server with in, if not nil, as the JSON
+// body, and decodes the JSON response into out, if not nil.
+func (k *kubeClient) do(ctx context.Context, method, path string, in, out interface{}) error {
+	return k.send(ctx, method, path, "application/json", in, out)
+}
+
+// mergePatch applies a JSON merge patch to the object at path.
+func (k *kubeClient) mergePatch(ctx context.Context, path string, patch interface{}) error {
+	return k.send(ctx, http.MethodPatch, path, "application/merge-patch+json", patch, nil)
+}
+
+func (k *kubeClient) send(ctx context.Context, method, path, contentType string, in, out interface{}) error {
+	var body []byte
+	if in != nil {
+		var err error
+		if body, err = json.Marshal(in); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, method, k.host+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	// The token is read on every request, since Kubernetes rotates it.
+	token, err := ioutil.ReadFile(serviceAccountTokenFile)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	req.Header.Set("Content-Type", contentType)
+	resp, err := k.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		b, _ := ioutil.ReadAll(resp.Body)
+		return &kubeStatusError{code: resp.StatusCode, msg: strings.TrimSpace(string(b))}
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
@@ -0,0 +1,152 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Annotation set on the Kubernetes Service of an open incident.
+const kubeIncidentAnnotation = "px.dev/incident"
+
+// kubeEventRecorder creates Kubernetes Events for the incidents of the
+// cluster the bot runs in, so that kubectl describe and event based tooling
+// show them. Each Event's involved object is the incident's Service, and it
+// can also be annotated with the ID of its open incident.
+type kubeEventRecorder struct {
+	kube *kubeClient
+	// Name or ID of the Pixie cluster the bot runs in. Incidents of other
+	// clusters are left out, since their Services aren't in this cluster.
+	cluster  string
+	annotate bool
+	// Pod name, reported as the instance that created the Events.
+	instance string
+}
+
+func newKubeEventRecorder(cfg KubeEventsConfig, instance string) (*kubeEventRecorder, error) {
+	kube, err := newInClusterKubeClient()
+	if err != nil {
+		return nil, fmt.Errorf("Kubernetes events: %w", err)
+	}
+	return &kubeEventRecorder{kube: kube, cluster: cfg.Cluster, annotate: cfg.Annotate, instance: instance}, nil
+}
+
+// Close closes the connections to the API server.
+func (r *kubeEventRecorder) Close() error {
+	return r.kube.Close()
+}
+
+// kubeObjectReference and kubeEvent are the parts of the core/v1 Event API
+// that the bot sets.
+type kubeObjectReference struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Namespace  string `json:"namespace"`
+	Name       string `json:"name"`
+}
+
+type kubeEvent struct {
+	Metadata struct {
+		Name      string `json:"name"`
+		Namespace string `json:"namespace"`
+	} `json:"metadata"`
+	InvolvedObject kubeObjectReference `json:"involvedObject"`
+	Reason         string              `json:"reason"`
+	Message        string              `json:"message"`
+	Type           string              `json:"type"`
+	Source         struct {
+		Component string `json:"component"`
+	} `json:"source"`
+	ReportingComponent string    `json:"reportingComponent"`
+	ReportingInstance  string    `json:"reportingInstance"`
+	FirstTimestamp     time.Time `json:"firstTimestamp"`
+	LastTimestamp      time.Time `json:"lastTimestamp"`
+	Count              int       `json:"count"`
+}
+
+// WriteEvent creates an Event when an incident opens or resolves. Updates
+// aren't recorded, since they happen on every check.
+func (k *kubeEventRecorder) WriteEvent(ctx context.Context, e IncidentEvent) error {
+	inc := e.Incident
+	if e.Kind == IncidentUpdated || (inc.Cluster.Name != k.cluster && inc.Cluster.ID != k.cluster) {
+		return nil
+	}
+	// Services are named namespace/name. Anything else, such as a list of
+	// services, isn't a single Kubernetes Service.
+	parts := strings.Split(inc.Service, "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" || strings.ContainsAny(inc.Service, "[], ") {
+		return nil
+	}
+	namespace, name := parts[0], parts[1]
+
+	ev := kubeEvent{
+		InvolvedObject:     kubeObjectReference{APIVersion: "v1", Kind: "Service", Namespace: namespace, Name: name},
+		ReportingComponent: "pixie-slackbot",
+		ReportingInstance:  k.instance,
+		Count:              1,
+	}
+	ev.Metadata.Namespace = namespace
+	// Named after the incident, so that retries don't create duplicates.
+	ev.Metadata.Name = fmt.Sprintf("%s.%s-%s", name, strings.ToLower(inc.ID), e.Kind)
+	ev.Source.Component = "pixie-slackbot"
+	var annotation interface{}
+	switch e.Kind {
+	case IncidentOpened:
+		ev.Type = "Warning"
+		ev.Reason = "PixieIncidentOpened"
+		ev.Message = fmt.Sprintf("%s opened: error rate %s over the last %d requests (rule %s).",
+			inc.ID, formatRate(inc.Latest.ErrorRate()), inc.Latest.TotalRequests, inc.Rule)
+		ev.FirstTimestamp = inc.OpenedAt
+		annotation = inc.ID
+	case IncidentResolved:
+		ev.Type = "Normal"
+		ev.Reason = "PixieIncidentResolved"
+		ev.Message = fmt.Sprintf("%s resolved after %s, peak error rate %s (rule %s).",
+			inc.ID, inc.ResolvedAt.Sub(inc.OpenedAt).Round(time.Second), formatRate(inc.PeakErrorRate()), inc.Rule)
+		ev.FirstTimestamp = inc.ResolvedAt
+		// Removes the annotation.
+		annotation = nil
+	}
+	ev.LastTimestamp = ev.FirstTimestamp
+
+	err := k.kube.do(ctx, http.MethodPost, "/api/v1/namespaces/"+namespace+"/events", &ev, nil)
+	if err != nil && !isKubeStatus(err, http.StatusConflict) {
+		return fmt.Errorf("creating event for %s: %w", inc.Service, err)
+	}
+	if !k.annotate {
+		return nil
+	}
+	patch := map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]interface{}{kubeIncidentAnnotation: annotation},
+		},
+	}
+	err = k.kube.mergePatch(ctx, "/api/v1/namespaces/"+namespace+"/services/"+name, patch)
+	if isKubeStatus(err, http.StatusNotFound) {
+		// Pixie also names services that aren't Kubernetes Services.
+		logDebug("No Kubernetes Service to annotate.", "service", inc.Service)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("annotating %s: %w", inc.Service, err)
+	}
+	return nil
+}
@@ -0,0 +1,194 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// kubeRequest is a request to the fake Kubernetes API.
+type kubeRequest struct {
+	method, path, contentType string
+	body                      map[string]interface{}
+}
+
+// serveKubeEvents serves the Event API, which rejects Events that already
+// exist, and merge patches of Services other than missing.
+func serveKubeEvents(t *testing.T) (*kubeClient, func() []kubeRequest) {
+	var mu sync.Mutex
+	var requests []kubeRequest
+	events := make(map[string]bool)
+	kube := serveKube(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer kube-token" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		req := kubeRequest{method: r.Method, path: r.URL.Path, contentType: r.Header.Get("Content-Type")}
+		if err := json.NewDecoder(r.Body).Decode(&req.body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		requests = append(requests, req)
+		switch {
+		case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/events"):
+			name := req.body["metadata"].(map[string]interface{})["name"].(string)
+			if events[name] {
+				http.Error(w, `{"kind": "Status", "reason": "AlreadyExists"}`, http.StatusConflict)
+				return
+			}
+			events[name] = true
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(`{}`))
+		case r.Method == http.MethodPatch && strings.HasSuffix(r.URL.Path, "/services/missing"):
+			http.Error(w, `{"kind": "Status", "reason": "NotFound"}`, http.StatusNotFound)
+		case r.Method == http.MethodPatch:
+			w.Write([]byte(`{}`))
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		}
+	}))
+	return kube, func() []kubeRequest {
+		mu.Lock()
+		defer mu.Unlock()
+		return requests
+	}
+}
+
+func kubeEventsTestIncident() Incident {
+	return Incident{
+		ID:       "INC-7F3A9C21",
+		Rule:     "http-errors",
+		Cluster:  Cluster{ID: "c1", Name: "prod"},
+		Service:  "px-sock-shop/orders",
+		OpenedAt: time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC),
+		Latest:   IncidentData{Service: "px-sock-shop/orders", ErrorCount: 30, TotalRequests: 100},
+	}
+}
+
+func TestKubeEventRecorder(t *testing.T) {
+	ctx := context.Background()
+	kube, requests := serveKubeEvents(t)
+	k := &kubeEventRecorder{kube: kube, cluster: "prod", annotate: true, instance: "slackbot-0"}
+	inc := kubeEventsTestIncident()
+	if err := k.WriteEvent(ctx, IncidentEvent{Kind: IncidentOpened, Incident: inc}); err != nil {
+		t.Fatal(err)
+	}
+	// A retry finds the Event already created, and isn't an error.
+	if err := k.WriteEvent(ctx, IncidentEvent{Kind: IncidentOpened, Incident: inc}); err != nil {
+		t.Fatalf("retrying: %v", err)
+	}
+	if err := k.WriteEvent(ctx, IncidentEvent{Kind: IncidentUpdated, Incident: inc}); err != nil {
+		t.Fatal(err)
+	}
+	inc.ResolvedAt = inc.OpenedAt.Add(10 * time.Minute)
+	if err := k.WriteEvent(ctx, IncidentEvent{Kind: IncidentResolved, Incident: inc}); err != nil {
+		t.Fatal(err)
+	}
+
+	got := requests()
+	if len(got) != 6 {
+		t.Fatalf("got %d requests, want an Event and an annotation for each open and the resolve: %+v", len(got), got)
+	}
+	opened, annotated, resolved, unannotated := got[0], got[1], got[4], got[5]
+	if opened.method != http.MethodPost || opened.path != "/api/v1/namespaces/px-sock-shop/events" || opened.contentType != "application/json" {
+		t.Errorf("created the Event with %s %s (%s)", opened.method, opened.path, opened.contentType)
+	}
+	metadata := opened.body["metadata"].(map[string]interface{})
+	if metadata["name"] != "orders.inc-7f3a9c21-opened" || metadata["namespace"] != "px-sock-shop" {
+		t.Errorf("Event metadata %v", metadata)
+	}
+	wantObject := map[string]interface{}{"apiVersion": "v1", "kind": "Service", "namespace": "px-sock-shop", "name": "orders"}
+	if object := opened.body["involvedObject"].(map[string]interface{}); !reflect.DeepEqual(object, wantObject) {
+		t.Errorf("involvedObject %v, want %v", object, wantObject)
+	}
+	if opened.body["type"] != "Warning" || opened.body["reason"] != "PixieIncidentOpened" || opened.body["reportingInstance"] != "slackbot-0" ||
+		opened.body["firstTimestamp"] != "2021-03-01T12:00:00Z" || opened.body["count"] != float64(1) {
+		t.Errorf("opened Event %v", opened.body)
+	}
+	if msg, _ := opened.body["message"].(string); !strings.HasPrefix(msg, "INC-7F3A9C21 opened: error rate ") || !strings.HasSuffix(msg, "over the last 100 requests (rule http-errors).") {
+		t.Errorf("opened Event message %q", msg)
+	}
+
+	if annotated.method != http.MethodPatch || annotated.path != "/api/v1/namespaces/px-sock-shop/services/orders" || annotated.contentType != "application/merge-patch+json" {
+		t.Errorf("annotated the Service with %s %s (%s)", annotated.method, annotated.path, annotated.contentType)
+	}
+	annotations := annotated.body["metadata"].(map[string]interface{})["annotations"].(map[string]interface{})
+	if annotations[kubeIncidentAnnotation] != "INC-7F3A9C21" {
+		t.Errorf("annotations %v", annotations)
+	}
+
+	if resolved.body["type"] != "Normal" || resolved.body["reason"] != "PixieIncidentResolved" || resolved.body["firstTimestamp"] != "2021-03-01T12:10:00Z" {
+		t.Errorf("resolved Event %v", resolved.body)
+	}
+	annotations = unannotated.body["metadata"].(map[string]interface{})["annotations"].(map[string]interface{})
+	if v, ok := annotations[kubeIncidentAnnotation]; !ok || v != nil {
+		t.Errorf("resolve patched annotations %v, want the incident's annotation removed", annotations)
+	}
+}
+
+func TestKubeEventRecorderSkips(t *testing.T) {
+	ctx := context.Background()
+	kube, requests := serveKubeEvents(t)
+	k := &kubeEventRecorder{kube: kube, cluster: "prod", annotate: true}
+	for _, tt := range []struct {
+		name    string
+		cluster Cluster
+		service string
+	}{
+		{"other cluster", Cluster{ID: "c2", Name: "staging"}, "px-sock-shop/orders"},
+		{"no namespace", Cluster{ID: "c1", Name: "prod"}, "orders"},
+		{"several services", Cluster{ID: "c1", Name: "prod"}, "[px-sock-shop/orders, px-sock-shop/carts]"},
+	} {
+		inc := kubeEventsTestIncident()
+		inc.Cluster, inc.Service = tt.cluster, tt.service
+		if err := k.WriteEvent(ctx, IncidentEvent{Kind: IncidentOpened, Incident: inc}); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+	}
+	if got := requests(); len(got) != 0 {
+		t.Errorf("got requests %+v, want none", got)
+	}
+
+	// Pixie services without a Kubernetes Service only get an Event.
+	inc := kubeEventsTestIncident()
+	inc.Service = "px-sock-shop/missing"
+	if err := k.WriteEvent(ctx, IncidentEvent{Kind: IncidentOpened, Incident: inc}); err != nil {
+		t.Errorf("annotating a missing Service: %v", err)
+	}
+	if got := requests(); len(got) != 2 || got[0].method != http.MethodPost {
+		t.Errorf("got requests %+v, want the Event created and the Service patch tried", got)
+	}
+}
+
+func TestKubeEventRecorderError(t *testing.T) {
+	kube, _ := serveKubeEvents(t)
+	useServiceAccountToken(t, "expired-token")
+	k := &kubeEventRecorder{kube: kube, cluster: "prod"}
+	err := k.WriteEvent(context.Background(), IncidentEvent{Kind: IncidentOpened, Incident: kubeEventsTestIncident()})
+	if err == nil || !strings.Contains(err.Error(), "creating event for px-sock-shop/orders: Kubernetes API returned 401: unauthorized") {
+		t.Errorf("got %v, want the API server's error", err)
+	}
+}
@@ -0,0 +1,209 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Format of the MicroTime fields of a Lease.
+const kubeMicroTime = "2006-01-02T15:04:05.000000Z07:00"
+
+// kubeLease is the subset of a coordination.k8s.io/v1 Lease used for leader election.
+type kubeLease struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Metadata   struct {
+		Name            string `json:"name"`
+		Namespace       string `json:"namespace,omitempty"`
+		ResourceVersion string `json:"resourceVersion,omitempty"`
+	} `json:"metadata"`
+	Spec struct {
+		HolderIdentity       string `json:"holderIdentity"`
+		LeaseDurationSeconds int    `json:"leaseDurationSeconds"`
+		AcquireTime          string `json:"acquireTime,omitempty"`
+		RenewTime            string `json:"renewTime,omitempty"`
+		LeaseTransitions     int    `json:"leaseTransitions"`
+	} `json:"spec"`
+}
+
+// leaderElector uses a Kubernetes Lease to elect one replica of the bot as
+// the leader. Only the leader runs checks, so that replicas can run for
+// availability without sending duplicate alerts. If the leader stops
+// renewing the lease, another replica takes over once it expires.
+type leaderElector struct {
+	kube     *kubeClient
+	lease    string
+	identity string
+	// How long a lease is valid for without being renewed, and how often it's renewed.
+	duration, renewEvery time.Duration
+
+	mu      sync.Mutex
+	leading bool
+	// When the lease was last acquired or renewed by this replica.
+	renewed time.Time
+}
+
+func newLeaderElector(kube *kubeClient, lease, identity string, duration time.Duration) *leaderElector {
+	return &leaderElector{
+		kube:       kube,
+		lease:      lease,
+		identity:   identity,
+		duration:   duration,
+		renewEvery: duration / 3,
+	}
+}
+
+// IsLeader returns whether this replica currently holds the lease.
+func (l *leaderElector) IsLeader() bool {
+	if l == nil {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	// Stop leading as soon as the lease could have expired, even if it
+	// couldn't be renewed because the API server was unreachable.
+	return l.leading && time.Since(l.renewed) < l.duration
+}
+
+// Run tries to acquire or renew the lease until ctx is cancelled, and then
+// releases it if held, so another replica can take over right away.
+func (l *leaderElector) Run(ctx context.Context) {
+	ticker := time.NewTicker(l.renewEvery)
+	defer ticker.Stop()
+	for {
+		l.tryAcquireOrRenew(ctx)
+		select {
+		case <-ctx.Done():
+			l.release()
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (l *leaderElector) path() string {
+	return "/apis/coordination.k8s.io/v1/namespaces/" + l.kube.namespace + "/leases"
+}
+
+func (l *leaderElector) tryAcquireOrRenew(ctx context.Context) {
+	now := time.Now()
+	var lease kubeLease
+	err := l.kube.do(ctx, http.MethodGet, l.path()+"/"+l.lease, nil, &lease)
+	if isKubeStatus(err, http.StatusNotFound) {
+		lease = kubeLease{APIVersion: "coordination.k8s.io/v1", Kind: "Lease"}
+		lease.Metadata.Name = l.lease
+		l.hold(&lease, now)
+		err = l.kube.do(ctx, http.MethodPost, l.path(), &lease, nil)
+		l.setLeading(err == nil, now, err)
+		return
+	}
+	if err != nil {
+		l.setLeading(false, now, err)
+		return
+	}
+
+	if lease.Spec.HolderIdentity != l.identity && !leaseExpired(&lease, now) {
+		l.setLeading(false, now, nil)
+		return
+	}
+	l.hold(&lease, now)
+	// The resourceVersion from the GET makes the update fail with a conflict
+	// if another replica got there first.
+	err = l.kube.do(ctx, http.MethodPut, l.path()+"/"+l.lease, &lease, nil)
+	if isKubeStatus(err, http.StatusConflict) {
+		l.setLeading(false, now, nil)
+		return
+	}
+	l.setLeading(err == nil, now, err)
+}
+
+// hold makes this replica the holder of lease as of now.
+func (l *leaderElector) hold(lease *kubeLease, now time.Time) {
+	ts := now.UTC().Format(kubeMicroTime)
+	if lease.Spec.HolderIdentity != l.identity {
+		if lease.Spec.HolderIdentity != "" {
+			lease.Spec.LeaseTransitions++
+		}
+		lease.Spec.HolderIdentity = l.identity
+		lease.Spec.AcquireTime = ts
+	}
+	lease.Spec.RenewTime = ts
+	lease.Spec.LeaseDurationSeconds = int(l.duration / time.Second)
+}
+
+// leaseExpired returns whether the lease's holder has stopped renewing it.
+func leaseExpired(lease *kubeLease, now time.Time) bool {
+	if lease.Spec.HolderIdentity == "" {
+		return true
+	}
+	renewed, err := time.Parse(kubeMicroTime, lease.Spec.RenewTime)
+	if err != nil {
+		return true
+	}
+	return now.After(renewed.Add(time.Duration(lease.Spec.LeaseDurationSeconds) * time.Second))
+}
+
+func (l *leaderElector) setLeading(leading bool, now time.Time, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err != nil {
+		logError("Error updating leader lease.", "lease", l.lease, "error", err)
+		// Keep leading until the lease would expire, the next attempt may succeed.
+		return
+	}
+	if leading != l.leading {
+		if leading {
+			logInfo("Became the leader, running checks.", "lease", l.lease, "identity", l.identity)
+		} else {
+			logInfo("Not the leader, not running checks.", "lease", l.lease, "identity", l.identity)
+		}
+	}
+	l.leading = leading
+	if leading {
+		l.renewed = now
+	}
+}
+
+// release gives up the lease if this replica holds it.
+func (l *leaderElector) release() {
+	if !l.IsLeader() {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var lease kubeLease
+	if err := l.kube.do(ctx, http.MethodGet, l.path()+"/"+l.lease, nil, &lease); err != nil {
+		logError("Error releasing leader lease.", "lease", l.lease, "error", err)
+		return
+	}
+	if lease.Spec.HolderIdentity != l.identity {
+		return
+	}
+	lease.Spec.HolderIdentity = ""
+	if err := l.kube.do(ctx, http.MethodPut, l.path()+"/"+l.lease, &lease, nil); err != nil {
+		logError("Error releasing leader lease.", "lease", l.lease, "error", err)
+		return
+	}
+	l.mu.Lock()
+	l.leading = false
+	l.mu.Unlock()
+	logInfo("Released leader lease.", "lease", l.lease)
+}
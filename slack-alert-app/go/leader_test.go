@@ -0,0 +1,222 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// serveKube returns a client for a fake Kubernetes API server served by h,
+// with the bot running in the pixie namespace and "kube-token" as its
+// service account token.
+func serveKube(t *testing.T, h http.Handler) *kubeClient {
+	t.Helper()
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+	useServiceAccountToken(t, "kube-token")
+	return &kubeClient{host: srv.URL, http: srv.Client(), namespace: "pixie"}
+}
+
+// fakeLeases serves the Lease API, rejecting updates with a stale
+// resourceVersion like the API server does.
+type fakeLeases struct {
+	t *testing.T
+
+	mu      sync.Mutex
+	leases  map[string]kubeLease
+	version int
+}
+
+func newFakeLeases(t *testing.T) *fakeLeases {
+	return &fakeLeases{t: t, leases: make(map[string]kubeLease)}
+}
+
+func (f *fakeLeases) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if got := r.Header.Get("Authorization"); got != "Bearer kube-token" {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	const prefix = "/apis/coordination.k8s.io/v1/namespaces/pixie/leases"
+	if !strings.HasPrefix(r.URL.Path, prefix) {
+		f.t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		http.NotFound(w, r)
+		return
+	}
+	name := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, prefix), "/")
+	var lease kubeLease
+	if r.Method != http.MethodGet {
+		if ct := r.Header.Get("Content-Type"); ct != "application/json" {
+			f.t.Errorf("%s with Content-Type %q", r.Method, ct)
+		}
+		if err := json.NewDecoder(r.Body).Decode(&lease); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	switch {
+	case r.Method == http.MethodGet && name != "":
+		stored, ok := f.leases[name]
+		if !ok {
+			http.Error(w, `{"reason": "NotFound"}`, http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(stored)
+		return
+	case r.Method == http.MethodPost && name == "":
+		name = lease.Metadata.Name
+		if _, ok := f.leases[name]; ok {
+			http.Error(w, `{"reason": "AlreadyExists"}`, http.StatusConflict)
+			return
+		}
+	case r.Method == http.MethodPut && name != "":
+		if lease.Metadata.ResourceVersion != f.leases[name].Metadata.ResourceVersion {
+			http.Error(w, `{"reason": "Conflict"}`, http.StatusConflict)
+			return
+		}
+	default:
+		f.t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	f.version++
+	lease.Metadata.ResourceVersion = strconv.Itoa(f.version)
+	f.leases[name] = lease
+	json.NewEncoder(w).Encode(lease)
+}
+
+func (f *fakeLeases) lease(name string) kubeLease {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.leases[name]
+}
+
+func (f *fakeLeases) update(name string, fn func(*kubeLease)) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	lease := f.leases[name]
+	fn(&lease)
+	f.version++
+	lease.Metadata.ResourceVersion = strconv.Itoa(f.version)
+	f.leases[name] = lease
+}
+
+func TestLeaderElection(t *testing.T) {
+	ctx := context.Background()
+	leases := newFakeLeases(t)
+	kube := serveKube(t, leases)
+	a := newLeaderElector(kube, "slackbot", "replica-a", 30*time.Second)
+	b := newLeaderElector(kube, "slackbot", "replica-b", 30*time.Second)
+
+	a.tryAcquireOrRenew(ctx)
+	if !a.IsLeader() {
+		t.Fatal("replica-a didn't acquire the new lease")
+	}
+	lease := leases.lease("slackbot")
+	if lease.APIVersion != "coordination.k8s.io/v1" || lease.Kind != "Lease" || lease.Spec.HolderIdentity != "replica-a" || lease.Spec.LeaseDurationSeconds != 30 {
+		t.Errorf("created lease %+v", lease)
+	}
+	acquired := lease.Spec.AcquireTime
+	if _, err := time.Parse(kubeMicroTime, acquired); err != nil {
+		t.Errorf("acquireTime %q isn't a MicroTime: %v", acquired, err)
+	}
+
+	b.tryAcquireOrRenew(ctx)
+	if b.IsLeader() {
+		t.Error("replica-b took over a lease that hasn't expired")
+	}
+	a.tryAcquireOrRenew(ctx)
+	if !a.IsLeader() {
+		t.Error("replica-a lost the lease renewing it")
+	}
+	if lease := leases.lease("slackbot"); lease.Spec.AcquireTime != acquired || lease.Spec.LeaseTransitions != 0 {
+		t.Errorf("renewing changed the lease to %+v", lease)
+	}
+
+	// replica-a stops renewing, such as when its node fails.
+	leases.update("slackbot", func(l *kubeLease) {
+		l.Spec.RenewTime = time.Now().Add(-time.Minute).UTC().Format(kubeMicroTime)
+	})
+	b.tryAcquireOrRenew(ctx)
+	if !b.IsLeader() {
+		t.Fatal("replica-b didn't take over the expired lease")
+	}
+	if lease := leases.lease("slackbot"); lease.Spec.HolderIdentity != "replica-b" || lease.Spec.LeaseTransitions != 1 {
+		t.Errorf("taken over lease %+v", lease)
+	}
+
+	b.release()
+	if b.IsLeader() {
+		t.Error("replica-b still leads after releasing the lease")
+	}
+	if holder := leases.lease("slackbot").Spec.HolderIdentity; holder != "" {
+		t.Errorf("released lease is held by %q", holder)
+	}
+	a.tryAcquireOrRenew(ctx)
+	if !a.IsLeader() {
+		t.Error("replica-a didn't acquire the released lease")
+	}
+}
+
+func TestLeaderElectionConflict(t *testing.T) {
+	ctx := context.Background()
+	leases := newFakeLeases(t)
+	kube := serveKube(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Another replica updates the lease between our GET and PUT.
+		if r.Method == http.MethodPut {
+			leases.update("slackbot", func(l *kubeLease) { l.Spec.HolderIdentity = "replica-b" })
+		}
+		leases.ServeHTTP(w, r)
+	}))
+	leases.update("slackbot", func(l *kubeLease) {
+		l.Metadata.Name = "slackbot"
+		l.Spec.HolderIdentity = "replica-c"
+		l.Spec.LeaseDurationSeconds = 30
+		l.Spec.RenewTime = time.Now().Add(-time.Minute).UTC().Format(kubeMicroTime)
+	})
+	a := newLeaderElector(kube, "slackbot", "replica-a", 30*time.Second)
+	a.tryAcquireOrRenew(ctx)
+	if a.IsLeader() {
+		t.Error("replica-a leads after losing the race to update the lease")
+	}
+	if holder := leases.lease("slackbot").Spec.HolderIdentity; holder != "replica-b" {
+		t.Errorf("lease is held by %q, want replica-b", holder)
+	}
+}
+
+func TestLeaderElectionUnauthorized(t *testing.T) {
+	leases := newFakeLeases(t)
+	kube := serveKube(t, leases)
+	useServiceAccountToken(t, "other-token")
+	a := newLeaderElector(kube, "slackbot", "replica-a", 30*time.Second)
+	a.tryAcquireOrRenew(context.Background())
+	if a.IsLeader() {
+		t.Error("replica-a leads without being able to read the lease")
+	}
+	if lease := leases.lease("slackbot"); lease.Metadata.Name != "" {
+		t.Error("lease was created with the wrong token")
+	}
+}
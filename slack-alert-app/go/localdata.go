@@ -0,0 +1,221 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.withpixie.dev/pixie/src/api/go/pxapi"
+	"go.withpixie.dev/pixie/src/api/public/vizierapipb"
+)
+
+// localDataExecutor is a ScriptExecutor for development that ignores the
+// script and outputs a table for each CSV or JSON file in a directory, named
+// after the file, such as http_table.csv. The files are read on every
+// execution, so edits show up on the next check.
+type localDataExecutor struct {
+	dir string
+}
+
+// newLocalDataCluster returns a cluster named local whose scripts output
+// the tables in dir.
+func newLocalDataCluster(dir string) *cluster {
+	return &cluster{Cluster: Cluster{ID: "local", Name: "local"}, executor: &localDataExecutor{dir: dir}}
+}
+
+func (e *localDataExecutor) ExecuteScript(ctx context.Context, pxl string, mux pxapi.TableMuxer) (ScriptResults, error) {
+	tables, err := loadLocalTables(e.dir)
+	if err != nil {
+		return nil, err
+	}
+	return newStaticExecutor(tables...).ExecuteScript(ctx, pxl, mux)
+}
+
+// loadLocalTables reads every table in dir. CSV files have a header row of
+// column names. JSON files are an array of objects, one per row. The type of
+// each column is inferred from its values: INT64 if they are all integers,
+// FLOAT64 if they are all numbers, BOOLEAN if they are all true or false,
+// TIME64NS if they are all RFC 3339 times, and STRING otherwise. Empty values
+// are the zero value of the column's type.
+func loadLocalTables(dir string) ([]staticTable, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var tables []staticTable
+	for _, entry := range entries {
+		ext := filepath.Ext(entry.Name())
+		if entry.IsDir() || (ext != ".csv" && ext != ".json") {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		var columns []string
+		var rows [][]string
+		if ext == ".csv" {
+			columns, rows, err = parseCSVTable(b)
+		} else {
+			columns, rows, err = parseJSONTable(b)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("parsing %s: %w", path, err)
+		}
+		t := localTable(strings.TrimSuffix(entry.Name(), ext), columns, rows)
+		st, err := t.static()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		tables = append(tables, st)
+	}
+	if len(tables) == 0 {
+		return nil, fmt.Errorf("no CSV or JSON files found in %s", dir)
+	}
+	return tables, nil
+}
+
+func parseCSVTable(b []byte) ([]string, [][]string, error) {
+	records, err := csv.NewReader(bytes.NewReader(b)).ReadAll()
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(records) == 0 {
+		return nil, nil, fmt.Errorf("no header row")
+	}
+	return records[0], records[1:], nil
+}
+
+func parseJSONTable(b []byte) ([]string, [][]string, error) {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	var objects []map[string]interface{}
+	if err := dec.Decode(&objects); err != nil {
+		return nil, nil, err
+	}
+	seen := make(map[string]bool)
+	var columns []string
+	for _, obj := range objects {
+		for k := range obj {
+			if !seen[k] {
+				seen[k] = true
+				columns = append(columns, k)
+			}
+		}
+	}
+	sort.Strings(columns)
+	rows := make([][]string, len(objects))
+	for i, obj := range objects {
+		row := make([]string, len(columns))
+		for j, col := range columns {
+			switch v := obj[col].(type) {
+			case nil:
+			case string:
+				row[j] = v
+			case json.Number:
+				row[j] = v.String()
+			case bool:
+				row[j] = strconv.FormatBool(v)
+			default:
+				return nil, nil, fmt.Errorf("row %d: column %s must be a string, number or bool", i, col)
+			}
+		}
+		rows[i] = row
+	}
+	return columns, rows, nil
+}
+
+// localTable turns rows of strings into a recorded table, with the type of
+// each column inferred from its values.
+func localTable(name string, columns []string, rows [][]string) *recordedTable {
+	t := &recordedTable{Name: name}
+	for i, col := range columns {
+		values := make([]string, 0, len(rows))
+		for _, row := range rows {
+			if i < len(row) && row[i] != "" {
+				values = append(values, row[i])
+			}
+		}
+		t.Columns = append(t.Columns, recordedColumn{Name: col, Type: inferColumnType(values)})
+	}
+	for _, row := range rows {
+		values := make([]interface{}, len(columns))
+		for i, col := range t.Columns {
+			var s string
+			if i < len(row) {
+				s = row[i]
+			}
+			values[i] = localValue(col.Type, s)
+		}
+		t.Rows = append(t.Rows, values)
+	}
+	return t
+}
+
+func inferColumnType(values []string) vizierapipb.DataType {
+	all := func(ok func(string) bool) bool {
+		for _, v := range values {
+			if !ok(v) {
+				return false
+			}
+		}
+		return len(values) > 0
+	}
+	switch {
+	case all(func(v string) bool { _, err := strconv.ParseInt(v, 10, 64); return err == nil }):
+		return vizierapipb.INT64
+	case all(func(v string) bool { _, err := strconv.ParseFloat(v, 64); return err == nil }):
+		return vizierapipb.FLOAT64
+	case all(func(v string) bool { return v == "true" || v == "false" }):
+		return vizierapipb.BOOLEAN
+	case all(func(v string) bool { _, err := time.Parse(time.RFC3339Nano, v); return err == nil }):
+		return vizierapipb.TIME64NS
+	}
+	return vizierapipb.STRING
+}
+
+// localValue converts s, which is empty or was used to infer typ, to a value
+// of a recorded row.
+func localValue(typ vizierapipb.DataType, s string) interface{} {
+	switch typ {
+	case vizierapipb.INT64, vizierapipb.FLOAT64:
+		if s == "" {
+			return json.Number("0")
+		}
+		return json.Number(s)
+	case vizierapipb.BOOLEAN:
+		return s == "true"
+	case vizierapipb.TIME64NS:
+		if s == "" {
+			return json.Number("0")
+		}
+		t, _ := time.Parse(time.RFC3339Nano, s)
+		return json.Number(strconv.FormatInt(t.UnixNano(), 10))
+	}
+	return s
+}
@@ -0,0 +1,164 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// logLevel is the severity of a log entry.
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var logLevelNames = map[string]logLevel{
+	"debug": levelDebug,
+	"info":  levelInfo,
+	"warn":  levelWarn,
+	"error": levelError,
+}
+
+func parseLogLevel(s string) (logLevel, error) {
+	level, ok := logLevelNames[strings.ToLower(s)]
+	if !ok {
+		return 0, fmt.Errorf("unknown log level %q", s)
+	}
+	return level, nil
+}
+
+func (l logLevel) String() string {
+	for name, level := range logLevelNames {
+		if level == l {
+			return name
+		}
+	}
+	return "info"
+}
+
+// structuredLogger writes log entries made of a message and key, value
+// fields, either as text or as one JSON object per line for log aggregation.
+type structuredLogger struct {
+	mu    sync.Mutex
+	out   io.Writer
+	level logLevel
+	json  bool
+}
+
+// logger is used for all of the bot's logs. It logs text at info level
+// until the config is loaded.
+var logger = &structuredLogger{out: os.Stderr, level: levelInfo}
+
+// configure sets the level and format of the logs from the config, which
+// has already been validated.
+func (l *structuredLogger) configure(cfg LogConfig) {
+	level, err := parseLogLevel(cfg.Level)
+	if err != nil {
+		level = levelInfo
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.level = level
+	l.json = cfg.Format == "json"
+}
+
+func logDebug(msg string, kv ...interface{}) { logger.log(levelDebug, msg, kv) }
+func logInfo(msg string, kv ...interface{})  { logger.log(levelInfo, msg, kv) }
+func logWarn(msg string, kv ...interface{})  { logger.log(levelWarn, msg, kv) }
+func logError(msg string, kv ...interface{}) { logger.log(levelError, msg, kv) }
+
+// log writes an entry if level is enabled. kv are alternating keys and
+// values, such as "rule", "http-errors", "cluster_id", c.ID.
+func (l *structuredLogger) log(level logLevel, msg string, kv []interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if level < l.level {
+		return
+	}
+	now := time.Now()
+	var b bytes.Buffer
+	if l.json {
+		b.WriteString(`{"time":`)
+		writeJSON(&b, now.Format(time.RFC3339Nano))
+		b.WriteString(`,"level":`)
+		writeJSON(&b, level.String())
+		b.WriteString(`,"msg":`)
+		writeJSON(&b, msg)
+		for i := 0; i+1 < len(kv); i += 2 {
+			b.WriteByte(',')
+			writeJSON(&b, fmt.Sprint(kv[i]))
+			b.WriteByte(':')
+			writeJSON(&b, logValue(kv[i+1]))
+		}
+		b.WriteString("}\n")
+	} else {
+		fmt.Fprintf(&b, "%s %s %s", now.Format("2006/01/02 15:04:05"), strings.ToUpper(level.String()), msg)
+		for i := 0; i+1 < len(kv); i += 2 {
+			fmt.Fprintf(&b, " %v=%s", kv[i], quoteLogValue(fmt.Sprint(logValue(kv[i+1]))))
+		}
+		b.WriteByte('\n')
+	}
+	l.out.Write(b.Bytes())
+}
+
+// logValue converts errors, durations and other Stringers to strings, and
+// leaves other values as they are.
+func logValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	}
+	return v
+}
+
+func writeJSON(b *bytes.Buffer, v interface{}) {
+	enc, err := json.Marshal(v)
+	if err != nil {
+		enc, _ = json.Marshal(fmt.Sprint(v))
+	}
+	b.Write(enc)
+}
+
+// quoteLogValue quotes text values that would otherwise be ambiguous.
+func quoteLogValue(s string) string {
+	if s == "" || strings.ContainsAny(s, " \t\n\"=") {
+		return fmt.Sprintf("%q", s)
+	}
+	return s
+}
+
+// stdLogWriter sends output of the standard library's log package, such as
+// from dependencies, to logger.
+type stdLogWriter struct{}
+
+func (stdLogWriter) Write(p []byte) (int, error) {
+	logInfo(strings.TrimSpace(string(p)))
+	return len(p), nil
+}
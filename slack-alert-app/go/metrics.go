@@ -0,0 +1,233 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The bot's own metrics, served at /metrics in the Prometheus text format.
+var (
+	metricChecks = newMetricVec("pixie_slackbot_checks_total", "counter",
+		"Checks run, by rule and result.", "rule", "result")
+	metricCheckDuration = newHistogramVec("pixie_slackbot_check_duration_seconds",
+		"Time taken by each check, by rule.", []float64{0.5, 1, 2.5, 5, 10, 30, 60, 120}, "rule")
+	metricRecordsProcessed = newMetricVec("pixie_slackbot_records_processed_total", "counter",
+		"Records processed by Vizier for the bot's queries, by rule and cluster.", "rule", "cluster")
+	metricQueryErrors = newMetricVec("pixie_slackbot_query_errors_total", "counter",
+		"Queries that failed after retries, by rule and cluster.", "rule", "cluster")
+	metricMalformedRecords = newMetricVec("pixie_slackbot_malformed_records_total", "counter",
+		"Records skipped because they couldn't be decoded, by rule and cluster.", "rule", "cluster")
+	metricIncidentsOpen = newMetricVec("pixie_slackbot_incidents_open", "gauge",
+		"Incidents opened and not yet resolved by this replica, by rule.", "rule")
+	metricAlertsSent = newMetricVec("pixie_slackbot_alerts_sent_total", "counter",
+		"Messages sent, by backend and kind (alert or info).", "backend", "kind")
+	metricAlertsFailed = newMetricVec("pixie_slackbot_alerts_failed_total", "counter",
+		"Messages that failed to send, by backend and kind.", "backend", "kind")
+	metricAlertsSuppressed = newMetricVec("pixie_slackbot_alerts_suppressed_total", "counter",
+		"Messages held back for an overflow summary by the alert budget.")
+	metricMissedTicks = newMetricVec("pixie_slackbot_missed_ticks_total", "counter",
+		"Checks that weren't run when due, because the previous check overran or the process was suspended, by rule.", "rule")
+	metricPanics = newMetricVec("pixie_slackbot_panics_total", "counter",
+		"Panics recovered while running checks.")
+
+	allMetrics = []metric{
+		metricChecks, metricCheckDuration, metricRecordsProcessed, metricQueryErrors, metricMalformedRecords,
+		metricIncidentsOpen, metricAlertsSent, metricAlertsFailed, metricAlertsSuppressed, metricMissedTicks, metricPanics,
+	}
+)
+
+type metric interface {
+	write(w io.Writer)
+}
+
+// metricVec is a counter or gauge with a value for each combination of label values.
+type metricVec struct {
+	name, kind, help string
+	labels           []string
+
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func newMetricVec(name, kind, help string, labels ...string) *metricVec {
+	return &metricVec{name: name, kind: kind, help: help, labels: labels, values: make(map[string]float64)}
+}
+
+// Add adds v to the value for the given label values, in the order of the metric's labels.
+func (m *metricVec) Add(v float64, labelValues ...string) {
+	key := formatLabels(m.labels, labelValues)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.values[key] += v
+}
+
+func (m *metricVec) Inc(labelValues ...string) {
+	m.Add(1, labelValues...)
+}
+
+func (m *metricVec) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+	for _, key := range sortedKeys(m.values) {
+		fmt.Fprintf(w, "%s%s %s\n", m.name, key, formatFloat(m.values[key]))
+	}
+}
+
+// histogramVec is a histogram for each combination of label values.
+type histogramVec struct {
+	name, help string
+	labels     []string
+	buckets    []float64
+
+	mu         sync.Mutex
+	histograms map[string]*histogram
+}
+
+type histogram struct {
+	labelValues []string
+	counts      []uint64
+	count       uint64
+	sum         float64
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, labels: labels, buckets: buckets, histograms: make(map[string]*histogram)}
+}
+
+// Observe records v for the given label values.
+func (m *histogramVec) Observe(v float64, labelValues ...string) {
+	key := formatLabels(m.labels, labelValues)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	h, ok := m.histograms[key]
+	if !ok {
+		h = &histogram{labelValues: labelValues, counts: make([]uint64, len(m.buckets))}
+		m.histograms[key] = h
+	}
+	for i, b := range m.buckets {
+		if v <= b {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+func (m *histogramVec) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", m.name, m.help, m.name)
+	keys := make([]string, 0, len(m.histograms))
+	for k := range m.histograms {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	labels := append(append([]string(nil), m.labels...), "le")
+	for _, key := range keys {
+		h := m.histograms[key]
+		for i, b := range m.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, formatLabels(labels, append(h.labelValues, formatFloat(b))), h.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, formatLabels(labels, append(h.labelValues, "+Inf")), h.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", m.name, key, formatFloat(h.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", m.name, key, h.count)
+	}
+}
+
+// formatLabels formats label names and values as {name="value",...}.
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	parts := make([]string, len(names))
+	for i, name := range names {
+		var v string
+		if i < len(values) {
+			v = values[i]
+		}
+		parts[i] = name + "=" + strconv.Quote(v)
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// handleMetrics serves every metric in the Prometheus text format.
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, m := range allMetrics {
+		m.write(w)
+	}
+}
+
+// instrumentedAlerter counts the messages sent through an alerter.
+type instrumentedAlerter struct {
+	Alerter
+	backend string
+}
+
+func (a *instrumentedAlerter) SendAlert(ctx context.Context, msg string) error {
+	return a.count("alert", a.Alerter.SendAlert(ctx, msg))
+}
+
+func (a *instrumentedAlerter) SendInfo(ctx context.Context, msg string) error {
+	return a.count("info", a.Alerter.SendInfo(ctx, msg))
+}
+
+func (a *instrumentedAlerter) count(kind string, err error) error {
+	if err != nil {
+		metricAlertsFailed.Inc(a.backend, kind)
+	} else {
+		metricAlertsSent.Inc(a.backend, kind)
+	}
+	return err
+}
+
+// observeCheck records the outcome and duration of a check.
+func observeCheck(rule string, took time.Duration, err error) {
+	result := "success"
+	if err != nil {
+		result = "error"
+	}
+	metricChecks.Inc(rule, result)
+	metricCheckDuration.Observe(took.Seconds(), rule)
+}
@@ -0,0 +1,156 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// otlpMetricsSink sends the stats of each check to an OpenTelemetry collector
+// as gauges over OTLP/HTTP with JSON encoding, making the bot a lightweight
+// bridge from Pixie to OpenTelemetry. Each service gets these gauges, with
+// the service, rule and cluster as attributes:
+//
+//	http.error.rate                       Error rate of the whole service.
+//	http.error.max_rate                   Highest error rate of any endpoint.
+//	http.error.percent_exceed_threshold   Percentage of endpoints over the threshold.
+//	http.requests                         Requests in the window queried.
+//	http.errors                           Errors in the window queried.
+//
+// along with pixie.incidents.open for the rule on the cluster.
+type otlpMetricsSink struct {
+	url     string
+	headers map[string]string
+	service string
+	http    *http.Client
+}
+
+func newOTLPMetricsSink(cfg OTLPMetricsConfig, service string) *otlpMetricsSink {
+	return &otlpMetricsSink{url: cfg.Endpoint, headers: cfg.Headers, service: service, http: newHTTPClient(10 * time.Second)}
+}
+
+// Close closes the sink's idle connections.
+func (s *otlpMetricsSink) Close() error {
+	s.http.CloseIdleConnections()
+	return nil
+}
+
+type otlpMetrics struct {
+	ResourceMetrics []otlpResourceMetrics `json:"resourceMetrics"`
+}
+
+type otlpResourceMetrics struct {
+	Resource     otlpResource       `json:"resource"`
+	ScopeMetrics []otlpScopeMetrics `json:"scopeMetrics"`
+}
+
+type otlpScopeMetrics struct {
+	Scope   otlpScope    `json:"scope"`
+	Metrics []otlpMetric `json:"metrics"`
+}
+
+type otlpMetric struct {
+	Name        string    `json:"name"`
+	Description string    `json:"description,omitempty"`
+	Unit        string    `json:"unit,omitempty"`
+	Gauge       otlpGauge `json:"gauge"`
+}
+
+type otlpGauge struct {
+	DataPoints []otlpDataPoint `json:"dataPoints"`
+}
+
+type otlpDataPoint struct {
+	Attributes   []otlpAttr `json:"attributes,omitempty"`
+	TimeUnixNano string     `json:"timeUnixNano"`
+	// Exactly one of these is set. Integers are strings, as in the JSON
+	// encoding of protobuf int64s.
+	AsDouble *float64 `json:"asDouble,omitempty"`
+	AsInt    string   `json:"asInt,omitempty"`
+}
+
+func (s *otlpMetricsSink) WriteStats(ctx context.Context, b *statsBatch) error {
+	ts := strconv.FormatInt(b.Time.UnixNano(), 10)
+	attrs := func(service string) []otlpAttr {
+		a := []otlpAttr{
+			{Key: "pixie.rule", Value: otlpAttrValue{StringValue: b.Rule}},
+			{Key: "pixie.cluster.name", Value: otlpAttrValue{StringValue: b.Cluster.Name}},
+			{Key: "pixie.cluster.id", Value: otlpAttrValue{StringValue: b.Cluster.ID}},
+		}
+		if service != "" {
+			a = append(a, otlpAttr{Key: "service", Value: otlpAttrValue{StringValue: service}})
+		}
+		return a
+	}
+	double := func(service string, v float64) otlpDataPoint {
+		return otlpDataPoint{Attributes: attrs(service), TimeUnixNano: ts, AsDouble: &v}
+	}
+	integer := func(service string, v int64) otlpDataPoint {
+		return otlpDataPoint{Attributes: attrs(service), TimeUnixNano: ts, AsInt: strconv.FormatInt(v, 10)}
+	}
+
+	rate := otlpMetric{Name: "http.error.rate", Description: "Error rate of the whole service.", Unit: "1"}
+	maxRate := otlpMetric{Name: "http.error.max_rate", Description: "Highest error rate of any of the service's endpoints.", Unit: "1"}
+	exceed := otlpMetric{Name: "http.error.percent_exceed_threshold", Description: "Percentage of the service's endpoints at or above the rule's threshold.", Unit: "%"}
+	requests := otlpMetric{Name: "http.requests", Description: "Requests in the window the check queried.", Unit: "{request}"}
+	errCount := otlpMetric{Name: "http.errors", Description: "Errors in the window the check queried.", Unit: "{request}"}
+	for _, svc := range b.Services {
+		rate.Gauge.DataPoints = append(rate.Gauge.DataPoints, double(svc.Service, svc.ErrorRate))
+		maxRate.Gauge.DataPoints = append(maxRate.Gauge.DataPoints, double(svc.Service, svc.MaxError))
+		exceed.Gauge.DataPoints = append(exceed.Gauge.DataPoints, double(svc.Service, svc.PercentExceedThreshold))
+		requests.Gauge.DataPoints = append(requests.Gauge.DataPoints, integer(svc.Service, svc.TotalRequests))
+		errCount.Gauge.DataPoints = append(errCount.Gauge.DataPoints, integer(svc.Service, svc.ErrorCount))
+	}
+	open := otlpMetric{Name: "pixie.incidents.open", Description: "Open incidents of the rule on the cluster.", Unit: "{incident}",
+		Gauge: otlpGauge{DataPoints: []otlpDataPoint{integer("", int64(b.OpenIncidents))}}}
+
+	metrics := []otlpMetric{open}
+	if len(b.Services) > 0 {
+		metrics = append([]otlpMetric{rate, maxRate, exceed, requests, errCount}, metrics...)
+	}
+	body, err := json.Marshal(otlpMetrics{ResourceMetrics: []otlpResourceMetrics{{
+		Resource:     otlpResource{Attributes: []otlpAttr{{Key: "service.name", Value: otlpAttrValue{StringValue: s.service}}}},
+		ScopeMetrics: []otlpScopeMetrics{{Scope: otlpScope{Name: "slackbot", Version: version}, Metrics: metrics}},
+	}}})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range s.headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := s.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s returned %s", s.url, resp.Status)
+	}
+	return nil
+}
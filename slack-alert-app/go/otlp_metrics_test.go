@@ -0,0 +1,143 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// otlpExport is an OTLP/HTTP JSON metrics export, decoded independently of
+// the types the sink encodes it with.
+type otlpExport struct {
+	ResourceMetrics []struct {
+		Resource struct {
+			Attributes []otlpTestAttr `json:"attributes"`
+		} `json:"resource"`
+		ScopeMetrics []struct {
+			Scope struct {
+				Name string `json:"name"`
+			} `json:"scope"`
+			Metrics []struct {
+				Name  string `json:"name"`
+				Unit  string `json:"unit"`
+				Gauge struct {
+					DataPoints []map[string]json.RawMessage `json:"dataPoints"`
+				} `json:"gauge"`
+			} `json:"metrics"`
+		} `json:"scopeMetrics"`
+	} `json:"resourceMetrics"`
+}
+
+type otlpTestAttr struct {
+	Key   string `json:"key"`
+	Value struct {
+		StringValue string `json:"stringValue"`
+	} `json:"value"`
+}
+
+func TestOTLPMetricsSink(t *testing.T) {
+	var got *http.Request
+	var export otlpExport
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		if err := json.NewDecoder(r.Body).Decode(&export); err != nil {
+			t.Errorf("decoding export: %v", err)
+		}
+		w.Write([]byte(`{"partialSuccess": {}}`))
+	}))
+	defer srv.Close()
+
+	s := newOTLPMetricsSink(OTLPMetricsConfig{Endpoint: srv.URL + "/v1/metrics", Headers: map[string]string{"api-key": "otlp-key"}}, "pixie-slackbot")
+	b := testStatsBatch()
+	if err := s.WriteStats(context.Background(), b); err != nil {
+		t.Fatal(err)
+	}
+	if got.Method != http.MethodPost || got.URL.Path != "/v1/metrics" || got.Header.Get("Content-Type") != "application/json" || got.Header.Get("api-key") != "otlp-key" {
+		t.Errorf("sent %s %s with headers %v", got.Method, got.URL.Path, got.Header)
+	}
+	if len(export.ResourceMetrics) != 1 || len(export.ResourceMetrics[0].ScopeMetrics) != 1 {
+		t.Fatalf("got %+v, want one resource with one scope", export)
+	}
+	rm := export.ResourceMetrics[0]
+	if attrs := rm.Resource.Attributes; len(attrs) != 1 || attrs[0].Key != "service.name" || attrs[0].Value.StringValue != "pixie-slackbot" {
+		t.Errorf("resource attributes %+v, want service.name pixie-slackbot", attrs)
+	}
+	if name := rm.ScopeMetrics[0].Scope.Name; name != "slackbot" {
+		t.Errorf("scope %q, want slackbot", name)
+	}
+
+	ts := strconv.FormatInt(b.Time.UnixNano(), 10)
+	points := make(map[string]string)
+	for _, m := range rm.ScopeMetrics[0].Metrics {
+		for _, p := range m.Gauge.DataPoints {
+			var attrs []otlpTestAttr
+			json.Unmarshal(p["attributes"], &attrs)
+			var service string
+			for _, a := range attrs {
+				if a.Key == "service" {
+					service = a.Value.StringValue
+				}
+			}
+			if len(attrs) < 3 || attrs[0].Key != "pixie.rule" || attrs[0].Value.StringValue != "http-errors" || attrs[1].Value.StringValue != "prod" || attrs[2].Value.StringValue != "c1" {
+				t.Errorf("%s attributes %+v", m.Name, attrs)
+			}
+			if string(p["timeUnixNano"]) != strconv.Quote(ts) {
+				t.Errorf("%s timeUnixNano %s, want %q", m.Name, p["timeUnixNano"], ts)
+			}
+			value := p["asDouble"]
+			if value == nil {
+				value = p["asInt"]
+			}
+			points[m.Name+"{"+service+"}"] = string(value)
+		}
+	}
+	want := map[string]string{
+		"http.error.rate{px-sock-shop/orders}":                     "0.3",
+		"http.error.max_rate{px-sock-shop/orders}":                 "0.5",
+		"http.error.percent_exceed_threshold{px-sock-shop/orders}": "50",
+		"http.requests{px-sock-shop/orders}":                       `"100"`,
+		"http.errors{px-sock-shop/orders}":                         `"30"`,
+		"http.error.rate{px-sock-shop/carts}":                      "0",
+		"http.error.max_rate{px-sock-shop/carts}":                  "0",
+		"http.error.percent_exceed_threshold{px-sock-shop/carts}":  "0",
+		"http.requests{px-sock-shop/carts}":                        `"40"`,
+		// Zero integers are still sent, rather than left out.
+		"http.errors{px-sock-shop/carts}": `"0"`,
+		"pixie.incidents.open{}":          `"1"`,
+	}
+	if !reflect.DeepEqual(points, want) {
+		t.Errorf("got data points %v, want %v", points, want)
+	}
+}
+
+func TestOTLPMetricsSinkError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+	}))
+	defer srv.Close()
+	err := newOTLPMetricsSink(OTLPMetricsConfig{Endpoint: srv.URL}, "pixie-slackbot").WriteStats(context.Background(), testStatsBatch())
+	if err == nil || !strings.Contains(err.Error(), "401 Unauthorized") {
+		t.Errorf("got %v, want the collector's status", err)
+	}
+}
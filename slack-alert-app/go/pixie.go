@@ -0,0 +1,163 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+
+	"go.withpixie.dev/pixie/src/api/go/pxapi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// pixieConn holds the Pixie Cloud client. When the API key is rejected, the
+// key is loaded again and, if it changed, the client is recreated, so that
+// keys can be rotated without restarting the bot.
+type pixieConn struct {
+	loadKey func() (string, error)
+	// Options passed to pxapi.NewClient in addition to the API key.
+	opts []pxapi.ClientOption
+
+	mu     sync.Mutex
+	key    string
+	client *pxapi.Client
+	// Incremented each time the client is recreated, so that VizierClients
+	// created from an older client can be replaced.
+	generation int
+}
+
+func newPixieConn(ctx context.Context, loadKey func() (string, error), opts ...pxapi.ClientOption) (*pixieConn, error) {
+	p := &pixieConn{loadKey: loadKey, opts: opts}
+	key, err := loadKey()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.connect(ctx, key); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// connect creates a new client with the given API key. Must be called with p.mu held,
+// or before p is shared.
+func (p *pixieConn) connect(ctx context.Context, key string) error {
+	opts := append([]pxapi.ClientOption{pxapi.WithAPIKey(key)}, p.opts...)
+	client, err := pxapi.NewClient(ctx, opts...)
+	if err != nil {
+		return err
+	}
+	p.key = key
+	p.client = client
+	p.generation++
+	return nil
+}
+
+// Client returns the current client and its generation.
+func (p *pixieConn) Client() (*pxapi.Client, int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.client, p.generation
+}
+
+// Key returns the current API key.
+func (p *pixieConn) Key() (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.key, nil
+}
+
+// Refresh loads the API key again and recreates the client if the key
+// changed since the client of the given generation was created. It returns
+// whether there is a newer client than that generation.
+func (p *pixieConn) Refresh(ctx context.Context, generation int) (bool, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// Another cluster already picked up the new key.
+	if p.generation != generation {
+		return true, nil
+	}
+	key, err := p.loadKey()
+	if err != nil {
+		return false, err
+	}
+	if key == p.key {
+		return false, nil
+	}
+	logInfo("Pixie API key changed, reconnecting to Pixie Cloud.")
+	if err := p.connect(ctx, key); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// reconnectedError wraps an error after which the connection was recreated,
+// so that the failed query is worth retrying.
+type reconnectedError struct {
+	err error
+}
+
+func (e *reconnectedError) Error() string {
+	return fmt.Sprintf("%v (reconnected)", e.err)
+}
+
+func (e *reconnectedError) Unwrap() error {
+	return e.err
+}
+
+// grpcCode returns the gRPC status code of err, or codes.Unknown if it doesn't have one.
+func grpcCode(err error) codes.Code {
+	var se interface{ GRPCStatus() *status.Status }
+	if !errors.As(err, &se) {
+		return codes.Unknown
+	}
+	return se.GRPCStatus().Code()
+}
+
+// isAuthError returns whether err means the API key was rejected.
+func isAuthError(err error) bool {
+	c := grpcCode(err)
+	return c == codes.Unauthenticated || c == codes.PermissionDenied
+}
+
+// apiKeyLoader returns a function that loads the API key from file, such as
+// a mounted Kubernetes secret, or else returns key. Only the file can be
+// rotated at runtime.
+func apiKeyLoader(key, file string) (func() (string, error), error) {
+	if file != "" {
+		return func() (string, error) {
+			b, err := ioutil.ReadFile(file)
+			if err != nil {
+				return "", fmt.Errorf("reading Pixie API key: %w", err)
+			}
+			key := strings.TrimSpace(string(b))
+			if key == "" {
+				return "", fmt.Errorf("Pixie API key file %s is empty", file)
+			}
+			return key, nil
+		}, nil
+	}
+	if key == "" {
+		return nil, errors.New("Please set PIXIE_API_KEY or PIXIE_API_KEY_FILE environment variable, or pixie.apiKey in the config file.")
+	}
+	return func() (string, error) { return key, nil }, nil
+}
@@ -0,0 +1,141 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	// Embed the timezone database so TIMEZONE works in minimal containers.
+	_ "time/tzdata"
+)
+
+// Severity of an incident.
+type Severity int
+
+const (
+	SeverityWarning Severity = iota
+	SeverityCritical
+)
+
+func (s Severity) String() string {
+	if s == SeverityCritical {
+		return "critical"
+	}
+	return "warning"
+}
+
+// AlertPolicy sits between the ServiceTracker and the Alerter and decides
+// whether a message is sent as an alert or downgraded to an info message.
+type AlertPolicy interface {
+	ShouldAlert(sev Severity, now time.Time) bool
+}
+
+// alwaysAlertPolicy sends every alert as-is.
+type alwaysAlertPolicy struct{}
+
+func (alwaysAlertPolicy) ShouldAlert(Severity, time.Time) bool {
+	return true
+}
+
+// businessHoursPolicy only sends alerts during business hours, unless they are critical.
+type businessHoursPolicy struct {
+	loc  *time.Location
+	days [7]bool
+	// Start and end of business hours as times of day on the clock.
+	start, end time.Duration
+}
+
+func (p *businessHoursPolicy) ShouldAlert(sev Severity, now time.Time) bool {
+	return sev >= SeverityCritical || p.inBusinessHours(now)
+}
+
+func (p *businessHoursPolicy) inBusinessHours(now time.Time) bool {
+	now = now.In(p.loc)
+	if !p.days[now.Weekday()] {
+		return false
+	}
+	// The time on the clock, rather than since midnight, which is an hour
+	// off on days that daylight saving time starts or ends.
+	clock := time.Duration(now.Hour())*time.Hour + time.Duration(now.Minute())*time.Minute + time.Duration(now.Second())*time.Second
+	return clock >= p.start && clock < p.end
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// parseBusinessHours parses a spec such as "Mon-Fri 09:00-17:00" or
+// "Mon,Wed,Fri 10:00-16:00" in the given timezone.
+func parseBusinessHours(spec string, loc *time.Location) (*businessHoursPolicy, error) {
+	fields := strings.Fields(spec)
+	if len(fields) != 2 {
+		return nil, fmt.Errorf("invalid business hours %q, expected e.g. \"Mon-Fri 09:00-17:00\"", spec)
+	}
+	p := &businessHoursPolicy{loc: loc}
+
+	for _, part := range strings.Split(fields[0], ",") {
+		bounds := strings.SplitN(part, "-", 2)
+		first, ok := weekdays[strings.ToLower(bounds[0])]
+		if !ok {
+			return nil, fmt.Errorf("invalid weekday %q", bounds[0])
+		}
+		last := first
+		if len(bounds) == 2 {
+			if last, ok = weekdays[strings.ToLower(bounds[1])]; !ok {
+				return nil, fmt.Errorf("invalid weekday %q", bounds[1])
+			}
+		}
+		for d := first; ; d = (d + 1) % 7 {
+			p.days[d] = true
+			if d == last {
+				break
+			}
+		}
+	}
+
+	hours := strings.SplitN(fields[1], "-", 2)
+	if len(hours) != 2 {
+		return nil, fmt.Errorf("invalid hours %q, expected e.g. \"09:00-17:00\"", fields[1])
+	}
+	var err error
+	if p.start, err = parseClock(hours[0]); err != nil {
+		return nil, err
+	}
+	if p.end, err = parseClock(hours[1]); err != nil {
+		return nil, err
+	}
+	if p.end <= p.start {
+		return nil, fmt.Errorf("business hours must end after they start: %q", fields[1])
+	}
+	return p, nil
+}
+
+// parseClock parses a "15:04" time of day into an offset from midnight.
+func parseClock(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
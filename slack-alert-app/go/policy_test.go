@@ -0,0 +1,143 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseBusinessHours(t *testing.T) {
+	for _, tt := range []struct {
+		spec       string
+		wantDays   string
+		start, end time.Duration
+		wantErr    string
+	}{
+		{spec: "Mon-Fri 09:00-17:00", wantDays: "MTWTF", start: 9 * time.Hour, end: 17 * time.Hour},
+		{spec: "mon,wed,FRI 10:30-16:45", wantDays: "M W F", start: 10*time.Hour + 30*time.Minute, end: 16*time.Hour + 45*time.Minute},
+		{spec: "Sun 00:00-23:59", wantDays: "      S", start: 0, end: 23*time.Hour + 59*time.Minute},
+		// Ranges can wrap around the end of the week.
+		{spec: "Fri-Mon 08:00-12:00", wantDays: "M   FSS", start: 8 * time.Hour, end: 12 * time.Hour},
+		{spec: "Mon-Fri,Sun 09:00-17:00", wantDays: "MTWTF S", start: 9 * time.Hour, end: 17 * time.Hour},
+		{spec: "Mon-Fri", wantErr: `invalid business hours "Mon-Fri"`},
+		{spec: "Mon-Fri 09:00 17:00", wantErr: `invalid business hours "Mon-Fri 09:00 17:00"`},
+		{spec: "Mon-Funday 09:00-17:00", wantErr: `invalid weekday "Funday"`},
+		{spec: "Monday 09:00-17:00", wantErr: `invalid weekday "Monday"`},
+		{spec: "Mon-Fri 09:00", wantErr: `invalid hours "09:00"`},
+		{spec: "Mon-Fri 9am-5pm", wantErr: `invalid time of day "9am"`},
+		{spec: "Mon-Fri 09:00-24:00", wantErr: `invalid time of day "24:00"`},
+		{spec: "Mon-Fri 17:00-09:00", wantErr: `business hours must end after they start: "17:00-09:00"`},
+		{spec: "Mon-Fri 09:00-09:00", wantErr: `business hours must end after they start`},
+	} {
+		p, err := parseBusinessHours(tt.spec, time.UTC)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("parseBusinessHours(%q) returned error %v, want %q", tt.spec, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseBusinessHours(%q): %v", tt.spec, err)
+			continue
+		}
+		// Days from Monday to Sunday, by initial.
+		days := []byte("       ")
+		for i, d := range []time.Weekday{time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday, time.Saturday, time.Sunday} {
+			if p.days[d] {
+				days[i] = "MTWTFSS"[i]
+			}
+		}
+		if got := strings.TrimRight(string(days), " "); got != strings.TrimRight(tt.wantDays, " ") {
+			t.Errorf("parseBusinessHours(%q) days = %q, want %q", tt.spec, got, tt.wantDays)
+		}
+		if p.start != tt.start || p.end != tt.end {
+			t.Errorf("parseBusinessHours(%q) hours = %v-%v, want %v-%v", tt.spec, p.start, p.end, tt.start, tt.end)
+		}
+	}
+}
+
+func TestBusinessHoursPolicy(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := parseBusinessHours("Mon-Fri 09:00-17:00", ny)
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := func(month time.Month, day, hour, min int) time.Time {
+		return time.Date(2021, month, day, hour, min, 0, 0, ny)
+	}
+	for _, tt := range []struct {
+		name string
+		now  time.Time
+		sev  Severity
+		want bool
+	}{
+		{name: "start", now: at(2, 8, 9, 0), want: true},
+		{name: "before start", now: at(2, 8, 8, 59), want: false},
+		{name: "last minute", now: at(2, 8, 16, 59), want: true},
+		{name: "end", now: at(2, 8, 17, 0), want: false},
+		{name: "weekend", now: at(2, 13, 12, 0), want: false},
+		{name: "critical on the weekend", now: at(2, 13, 12, 0), sev: SeverityCritical, want: true},
+		{name: "critical at night", now: at(2, 8, 3, 0), sev: SeverityCritical, want: true},
+		// In the policy's timezone, not the time's: 14:30 UTC is 09:30 in New York.
+		{name: "other timezone", now: time.Date(2021, 2, 8, 14, 30, 0, 0, time.UTC), want: true},
+		{name: "Monday in UTC, Sunday in New York", now: time.Date(2021, 2, 15, 0, 30, 0, 0, time.UTC), want: false},
+		{name: "after clocks went forward", now: at(3, 15, 9, 0), want: true},
+		{name: "before start after clocks went forward", now: at(3, 15, 8, 59), want: false},
+		{name: "after clocks went back", now: at(11, 8, 9, 0), want: true},
+	} {
+		if got := p.ShouldAlert(tt.sev, tt.now); got != tt.want {
+			t.Errorf("%s: ShouldAlert(%v, %v) = %v, want %v", tt.name, tt.sev, tt.now, got, tt.want)
+		}
+	}
+}
+
+// TestBusinessHoursDaylightSaving checks business hours on the days clocks
+// change in New York: forward from 02:00 to 03:00 on Sunday 2021-03-14, and
+// back from 02:00 to 01:00 on Sunday 2021-11-07.
+func TestBusinessHoursDaylightSaving(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := parseBusinessHours("Sun 09:00-17:00", ny)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		now  time.Time
+		want bool
+	}{
+		{now: time.Date(2021, 3, 14, 8, 59, 0, 0, ny), want: false},
+		{now: time.Date(2021, 3, 14, 9, 0, 0, 0, ny), want: true},
+		{now: time.Date(2021, 3, 14, 16, 59, 0, 0, ny), want: true},
+		{now: time.Date(2021, 3, 14, 17, 0, 0, 0, ny), want: false},
+		{now: time.Date(2021, 11, 7, 8, 0, 0, 0, ny), want: false},
+		{now: time.Date(2021, 11, 7, 8, 59, 0, 0, ny), want: false},
+		{now: time.Date(2021, 11, 7, 9, 0, 0, 0, ny), want: true},
+		{now: time.Date(2021, 11, 7, 16, 59, 0, 0, ny), want: true},
+		{now: time.Date(2021, 11, 7, 17, 0, 0, 0, ny), want: false},
+	} {
+		if got := p.ShouldAlert(SeverityWarning, tt.now); got != tt.want {
+			t.Errorf("ShouldAlert(%v) = %v, want %v", tt.now, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.withpixie.dev/pixie/src/api/go/pxapi/errdefs"
+)
+
+// preflightTimeout bounds the pre-flight run of each script.
+const preflightTimeout = 30 * time.Second
+
+// preflight runs each rule's script once over a one second window, so that a
+// script that doesn't compile fails at startup with the compiler error
+// instead of on the first check. Only compilation errors are returned;
+// other errors, such as a cluster being unavailable, are logged and left
+// for the regular checks to retry.
+func preflight(ctx context.Context, trackers []*ServiceTracker) error {
+	for _, t := range trackers {
+		clusters, err := t.clusters.Clusters(ctx)
+		if err != nil || len(clusters) == 0 {
+			logWarn("Skipping pre-flight check, no clusters available.", "rule", t.rule.Name, "error", err)
+			continue
+		}
+		c := clusters[0]
+		err = t.preflightCluster(ctx, c)
+		if errdefs.IsCompilationError(err) || errors.Is(err, errdefs.ErrCompilation) {
+			return fmt.Errorf("rule %s: PxL script %s doesn't compile: %w", t.rule.Name, t.script.tmpl.Name(), err)
+		}
+		if err != nil {
+			logError("Pre-flight check failed.", "rule", t.rule.Name, "cluster", c.Name, "cluster_id", c.ID, "error", err)
+			continue
+		}
+		logInfo("Pre-flight check passed.", "rule", t.rule.Name, "cluster", c.Name, "cluster_id", c.ID)
+	}
+	return nil
+}
+
+func (s *ServiceTracker) preflightCluster(ctx context.Context, c *cluster) error {
+	ctx, cancel := context.WithTimeout(ctx, preflightTimeout)
+	defer cancel()
+
+	pxl, err := s.script.Render(newScriptVars(s.rule, time.Second))
+	if err != nil {
+		return err
+	}
+	exec, err := c.scriptExecutor(ctx)
+	if err != nil {
+		return err
+	}
+	resultSet, err := exec.ExecuteScript(ctx, pxl, newTableMux())
+	if err != nil {
+		return err
+	}
+	defer resultSet.Close()
+	err = resultSet.Stream()
+	if s.rule.Streaming && errors.Is(err, context.DeadlineExceeded) {
+		// Streaming scripts run until cancelled, so getting this far means it compiled.
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,184 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// QueryStats describes the latest query of a rule on a cluster.
+type QueryStats struct {
+	Rule    string    `json:"rule"`
+	Cluster Cluster   `json:"cluster"`
+	Time    time.Time `json:"time"`
+	// Error from the latest query, after retries, if it failed.
+	Error string `json:"error,omitempty"`
+	// Number of checks in a row that have failed.
+	ConsecutiveFailures int `json:"consecutiveFailures"`
+	// Stats of the latest successful query, as reported by Vizier.
+	ExecutionTime    time.Duration `json:"executionTime"`
+	CompilationTime  time.Duration `json:"compilationTime"`
+	BytesProcessed   int64         `json:"bytesProcessed"`
+	RecordsProcessed int64         `json:"recordsProcessed"`
+	// Whether the latest successful query was slower than the rule's slow query threshold.
+	Slow bool `json:"slow"`
+	// Number of records of the latest successful query that were skipped
+	// because they couldn't be decoded, and why the first of them couldn't be.
+	MalformedRecords int    `json:"malformedRecords"`
+	MalformedError   string `json:"malformedError,omitempty"`
+	// Fraction (0-1) of the latest successful query's records that were skipped.
+	MalformedRate float64 `json:"malformedRate"`
+	// Total number of records skipped because they couldn't be decoded, across every query.
+	TotalMalformedRecords int64 `json:"totalMalformedRecords"`
+	// Table the rule expects that the latest query didn't output, if any.
+	MissingTable string `json:"missingTable,omitempty"`
+}
+
+// queryRegistry keeps the QueryStats of each rule and cluster.
+type queryRegistry struct {
+	mu    sync.Mutex
+	stats map[openKey]*QueryStats
+}
+
+func newQueryRegistry() *queryRegistry {
+	return &queryRegistry{stats: make(map[openKey]*QueryStats)}
+}
+
+// Record updates the stats of a rule on a cluster with the outcome of a
+// query, and returns the stats before and after the update.
+func (q *queryRegistry) Record(rule Rule, c Cluster, res *queryResult, err error, now time.Time) (prev, cur QueryStats) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	key := openKey{rule: rule.Name, clusterID: c.ID}
+	s, ok := q.stats[key]
+	if !ok {
+		s = &QueryStats{Rule: rule.Name}
+		q.stats[key] = s
+	}
+	prev = *s
+	s.Cluster = c
+	s.Time = now
+	if err != nil {
+		s.Error = err.Error()
+		s.ConsecutiveFailures++
+		var missing *missingTableError
+		if errors.As(err, &missing) {
+			s.MissingTable = missing.table
+		}
+		return prev, *s
+	}
+	s.Error = ""
+	s.MissingTable = ""
+	s.ConsecutiveFailures = 0
+	s.MalformedRecords, s.MalformedError, s.MalformedRate = 0, "", 0
+	if res != nil {
+		s.MalformedRecords = res.malformed
+		if res.records > 0 {
+			s.MalformedRate = float64(res.malformed) / float64(res.records)
+		}
+		s.TotalMalformedRecords += int64(res.malformed)
+		if res.malformedErr != nil {
+			s.MalformedError = res.malformedErr.Error()
+		}
+	}
+	if rs := res.resultsStats(); rs != nil {
+		s.ExecutionTime = rs.ExecutionTime
+		s.CompilationTime = rs.CompilationTime
+		s.BytesProcessed = rs.BytesProcessed
+		s.RecordsProcessed = rs.RecordsProcessed
+		s.Slow = rule.SlowQuery.Duration > 0 && rs.ExecutionTime > rule.SlowQuery.Duration
+	}
+	return prev, *s
+}
+
+// All returns the stats of every rule and cluster, sorted by rule and cluster name.
+func (q *queryRegistry) All() []QueryStats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	all := make([]QueryStats, 0, len(q.stats))
+	for _, s := range q.stats {
+		all = append(all, *s)
+	}
+	sort.Slice(all, func(i, j int) bool {
+		if all[i].Rule != all[j].Rule {
+			return all[i].Rule < all[j].Rule
+		}
+		return all[i].Cluster.Name < all[j].Cluster.Name
+	})
+	return all
+}
+
+// observeQuery records the outcome of a query and sends a message when the
+// query doesn't output the rule's table, becomes slow, has failed
+// failureAlertAfter checks in a row or skips
+// more than malformedAlertRate of its records, and when it recovers. It returns the number of checks in a row that have failed.
+func (s *ServiceTracker) observeQuery(ctx context.Context, c *cluster, res *queryResult, err error) int {
+	prev, cur := s.queries.Record(s.rule, c.Cluster, res, err, time.Now())
+	rs := res.resultsStats()
+	if err != nil {
+		metricQueryErrors.Inc(s.rule.Name, c.Name)
+	}
+	if err == nil && rs != nil {
+		metricRecordsProcessed.Add(float64(rs.RecordsProcessed), s.rule.Name, c.Name)
+		logInfo("Query finished.", "rule", s.rule.Name, "cluster", c.Name, "cluster_id", c.ID,
+			"execution_time", rs.ExecutionTime, "records_processed", rs.RecordsProcessed, "bytes_processed", rs.BytesProcessed)
+	}
+
+	var msgErr error
+	switch n := s.queryFailureAlertAfter; {
+	// A missing table won't go away by itself, so it's alerted on right away.
+	case cur.MissingTable != "" && prev.MissingTable == "":
+		msgErr = s.alerter.SendAlert(ctx, fmt.Sprintf(":warning: %s: the PxL script didn't output table %s on %s, so the rule can't find incidents. "+
+			"Check the rule's table and script: %s", s.rule.Name, formatName(cur.MissingTable), formatName(c.Name), escapeMrkdwn(cur.Error)))
+	case prev.MissingTable != "" && err == nil:
+		msgErr = s.alerter.SendInfo(ctx, fmt.Sprintf(":white_check_mark: %s: the PxL script outputs table %s on %s again.",
+			s.rule.Name, formatName(s.rule.Table), formatName(c.Name)))
+	case n > 0 && cur.ConsecutiveFailures == n:
+		msgErr = s.alerter.SendAlert(ctx, fmt.Sprintf(":warning: %s: query on %s has failed %d checks in a row: %s",
+			s.rule.Name, formatName(c.Name), n, escapeMrkdwn(cur.Error)))
+	case n > 0 && prev.ConsecutiveFailures >= n && cur.ConsecutiveFailures == 0:
+		msgErr = s.alerter.SendInfo(ctx, fmt.Sprintf(":white_check_mark: %s: query on %s is working again.", s.rule.Name, formatName(c.Name)))
+	case cur.Slow && !prev.Slow:
+		msgErr = s.alerter.SendInfo(ctx, fmt.Sprintf(":snail: %s: query on %s took %s, over the %s slow query threshold.",
+			s.rule.Name, formatName(c.Name), cur.ExecutionTime.Round(time.Millisecond), s.rule.SlowQuery.Duration))
+	}
+	if msgErr != nil {
+		logError("Error sending query message.", "rule", s.rule.Name, "cluster", c.Name, "error", msgErr)
+	}
+
+	// Records that are skipped can hide incidents, so too many of them are alerted on separately.
+	msgErr = nil
+	switch r := s.malformedAlertRate; {
+	case err != nil || r == 0:
+	case cur.MalformedRate > r && prev.MalformedRate <= r:
+		msgErr = s.alerter.SendAlert(ctx, fmt.Sprintf(":warning: %s: %d records (%s) from %s couldn't be decoded and were skipped, "+
+			"so incidents may be missed: %s", s.rule.Name, cur.MalformedRecords, formatRate(cur.MalformedRate), formatName(c.Name), escapeMrkdwn(cur.MalformedError)))
+	case cur.MalformedRate <= r && prev.MalformedRate > r:
+		msgErr = s.alerter.SendInfo(ctx, fmt.Sprintf(":white_check_mark: %s: records from %s are being decoded again.", s.rule.Name, formatName(c.Name)))
+	}
+	if msgErr != nil {
+		logError("Error sending query message.", "rule", s.rule.Name, "cluster", c.Name, "error", msgErr)
+	}
+	return cur.ConsecutiveFailures
+}
@@ -0,0 +1,367 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.withpixie.dev/pixie/src/api/go/pxapi"
+	"go.withpixie.dev/pixie/src/api/go/pxapi/types"
+	"go.withpixie.dev/pixie/src/api/public/vizierapipb"
+)
+
+// recording is the raw output of a check on a cluster, as saved by -record
+// and fed back by -replay. It is written to
+// <dir>/<rule>/<cluster ID>/<time>.json.
+type recording struct {
+	Rule    string           `json:"rule"`
+	Cluster Cluster          `json:"cluster"`
+	Time    time.Time        `json:"time"`
+	Tables  []*recordedTable `json:"tables"`
+}
+
+type recordedTable struct {
+	Name    string           `json:"name"`
+	ID      string           `json:"id,omitempty"`
+	Columns []recordedColumn `json:"columns"`
+	// Values of each record, in the order of the columns: bools, numbers,
+	// strings, times as Unix nanoseconds and UINT128s as hex strings.
+	// Non-finite floats are strings, such as "NaN".
+	Rows [][]interface{} `json:"rows"`
+}
+
+type recordedColumn struct {
+	Name         string                   `json:"name"`
+	Type         vizierapipb.DataType     `json:"type"`
+	SemanticType vizierapipb.SemanticType `json:"semanticType,omitempty"`
+}
+
+// resultRecorder saves the output of every check to a directory.
+type resultRecorder struct {
+	dir string
+}
+
+// wrap returns an executor that records the output of the scripts exec
+// runs for a rule on a cluster, once each has streamed successfully.
+func (r *resultRecorder) wrap(exec ScriptExecutor, rule string, c Cluster) ScriptExecutor {
+	return &recordingExecutor{next: exec, recorder: r, rule: rule, cluster: c}
+}
+
+type recordingExecutor struct {
+	next     ScriptExecutor
+	recorder *resultRecorder
+	rule     string
+	cluster  Cluster
+}
+
+func (e *recordingExecutor) ExecuteScript(ctx context.Context, pxl string, mux pxapi.TableMuxer) (ScriptResults, error) {
+	rec := &recording{Rule: e.rule, Cluster: e.cluster, Time: time.Now().UTC()}
+	results, err := e.next.ExecuteScript(ctx, pxl, &recordingMux{next: mux, rec: rec})
+	if err != nil {
+		return nil, err
+	}
+	return &recordingResults{ScriptResults: results, recorder: e.recorder, rec: rec}, nil
+}
+
+type recordingResults struct {
+	ScriptResults
+	recorder *resultRecorder
+	rec      *recording
+}
+
+func (r *recordingResults) Stream() error {
+	if err := r.ScriptResults.Stream(); err != nil {
+		return err
+	}
+	// Failing to record doesn't fail the check.
+	if err := r.recorder.save(r.rec); err != nil {
+		logError("Error recording results.", "rule", r.rec.Rule, "cluster", r.rec.Cluster.Name, "error", err)
+	}
+	return nil
+}
+
+func (r *resultRecorder) save(rec *recording) error {
+	dir := filepath.Join(r.dir, keyUnsafe.ReplaceAllString(rec.Rule, "_"), keyUnsafe.ReplaceAllString(rec.Cluster.ID, "_"))
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	// Names sort in the order the checks ran.
+	path := filepath.Join(dir, rec.Time.Format("20060102T150405.000000000Z")+".json")
+	return ioutil.WriteFile(path, b, 0o644)
+}
+
+// recordingMux records every table and record before passing them on.
+type recordingMux struct {
+	next pxapi.TableMuxer
+	mu   sync.Mutex
+	rec  *recording
+}
+
+func (m *recordingMux) AcceptTable(ctx context.Context, metadata types.TableMetadata) (pxapi.TableRecordHandler, error) {
+	h, err := m.next.AcceptTable(ctx, metadata)
+	if err != nil {
+		return nil, err
+	}
+	t := &recordedTable{Name: metadata.Name, ID: metadata.ID, Rows: [][]interface{}{}}
+	for _, col := range metadata.ColInfo {
+		t.Columns = append(t.Columns, recordedColumn{Name: col.Name, Type: col.Type, SemanticType: col.SemanticType})
+	}
+	m.mu.Lock()
+	m.rec.Tables = append(m.rec.Tables, t)
+	m.mu.Unlock()
+	return &recordingHandler{next: h, table: t}, nil
+}
+
+type recordingHandler struct {
+	next  pxapi.TableRecordHandler
+	table *recordedTable
+}
+
+func (h *recordingHandler) HandleInit(ctx context.Context, metadata types.TableMetadata) error {
+	return h.next.HandleInit(ctx, metadata)
+}
+
+func (h *recordingHandler) HandleRecord(ctx context.Context, r *types.Record) error {
+	row := make([]interface{}, len(r.Data))
+	for i, d := range r.Data {
+		row[i] = recordDatum(d)
+	}
+	h.table.Rows = append(h.table.Rows, row)
+	return h.next.HandleRecord(ctx, r)
+}
+
+func (h *recordingHandler) HandleDone(ctx context.Context) error {
+	return h.next.HandleDone(ctx)
+}
+
+func recordDatum(d types.Datum) interface{} {
+	switch v := d.(type) {
+	case *types.BooleanValue:
+		return v.Value()
+	case *types.Int64Value:
+		return v.Value()
+	case *types.Float64Value:
+		f := v.Value()
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			return strconv.FormatFloat(f, 'g', -1, 64)
+		}
+		return f
+	case *types.StringValue:
+		return v.Value()
+	case *types.Time64NSValue:
+		return v.Value().UnixNano()
+	case nil:
+		return nil
+	default:
+		return d.String()
+	}
+}
+
+// replayer feeds recorded results back through checks instead of running
+// scripts on Pixie, one recording per check, in the order they were
+// recorded. Once the recordings of a rule on a cluster run out, the last one
+// is replayed again.
+type replayer struct {
+	clusters staticClusters
+	// Recordings keyed by rule and then cluster ID, in the order they were recorded.
+	recordings map[string]map[string][]*recording
+
+	mu sync.Mutex
+	// Index of the next recording to replay, keyed like recordings.
+	next map[string]map[string]int
+}
+
+// loadReplay reads every recording in dir.
+func loadReplay(dir string) (*replayer, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*", "*", "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no recordings found in %s", dir)
+	}
+	sort.Strings(paths)
+	r := &replayer{recordings: make(map[string]map[string][]*recording), next: make(map[string]map[string]int)}
+	seen := make(map[string]bool)
+	for _, path := range paths {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		rec := &recording{}
+		dec := json.NewDecoder(bytes.NewReader(b))
+		// Keeps int64s that don't fit in a float64 exact.
+		dec.UseNumber()
+		if err := dec.Decode(rec); err != nil {
+			return nil, fmt.Errorf("parsing %s: %w", path, err)
+		}
+		if r.recordings[rec.Rule] == nil {
+			r.recordings[rec.Rule] = make(map[string][]*recording)
+			r.next[rec.Rule] = make(map[string]int)
+		}
+		r.recordings[rec.Rule][rec.Cluster.ID] = append(r.recordings[rec.Rule][rec.Cluster.ID], rec)
+		if !seen[rec.Cluster.ID] {
+			seen[rec.Cluster.ID] = true
+			// Streaming rules and pre-flight checks see a script that outputs nothing.
+			r.clusters = append(r.clusters, &cluster{Cluster: rec.Cluster, executor: newStaticExecutor()})
+		}
+	}
+	return r, nil
+}
+
+// Remaining returns the number of recordings of a rule not yet replayed on
+// the cluster with the most left.
+func (r *replayer) Remaining(rule string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n := 0
+	for id, recs := range r.recordings[rule] {
+		if left := len(recs) - r.next[rule][id]; left > n {
+			n = left
+		}
+	}
+	return n
+}
+
+// Next returns an executor that replays the next recording of a rule's
+// checks on a cluster.
+func (r *replayer) Next(rule string, c Cluster) (ScriptExecutor, error) {
+	recs := r.recordings[rule][c.ID]
+	if len(recs) == 0 {
+		return nil, fmt.Errorf("no recordings of rule %s on cluster %s", rule, c.Name)
+	}
+	r.mu.Lock()
+	i := r.next[rule][c.ID]
+	if i < len(recs) {
+		r.next[rule][c.ID]++
+	} else {
+		i = len(recs) - 1
+	}
+	r.mu.Unlock()
+	rec := recs[i]
+
+	var tables []staticTable
+	for _, t := range rec.Tables {
+		st, err := t.static()
+		if err != nil {
+			return nil, fmt.Errorf("recording of rule %s on %s at %s: %w", rule, c.Name, rec.Time.Format(time.RFC3339), err)
+		}
+		tables = append(tables, st)
+	}
+	return newStaticExecutor(tables...), nil
+}
+
+// static turns the recorded table back into records. UINT128 values, such as
+// UPIDs, are replayed as strings.
+func (t *recordedTable) static() (staticTable, error) {
+	md := types.TableMetadata{Name: t.Name, ID: t.ID, ColIdxByName: make(map[string]int64)}
+	for i, col := range t.Columns {
+		typ := col.Type
+		if typ == vizierapipb.UINT128 {
+			typ = vizierapipb.STRING
+		}
+		md.ColInfo = append(md.ColInfo, types.ColSchema{Name: col.Name, Type: typ, SemanticType: col.SemanticType})
+		md.ColIdxByName[col.Name] = int64(i)
+	}
+	st := staticTable{Metadata: md}
+	for _, row := range t.Rows {
+		if len(row) != len(md.ColInfo) {
+			return staticTable{}, fmt.Errorf("table %s has a row of %d values, expected %d", t.Name, len(row), len(md.ColInfo))
+		}
+		rec := &types.Record{TableMetadata: &st.Metadata}
+		for i, v := range row {
+			d, err := replayDatum(&st.Metadata.ColInfo[i], v)
+			if err != nil {
+				return staticTable{}, fmt.Errorf("column %s of table %s: %w", md.ColInfo[i].Name, t.Name, err)
+			}
+			rec.Data = append(rec.Data, d)
+		}
+		st.Records = append(st.Records, rec)
+	}
+	return st, nil
+}
+
+func replayDatum(col *types.ColSchema, v interface{}) (types.Datum, error) {
+	switch col.Type {
+	case vizierapipb.BOOLEAN:
+		b, ok := v.(bool)
+		if !ok {
+			return nil, fmt.Errorf("expected a bool, not %v", v)
+		}
+		d := types.NewBooleanValue(col)
+		d.ScalarValue(b)
+		return d, nil
+	case vizierapipb.INT64, vizierapipb.TIME64NS:
+		n, ok := v.(json.Number)
+		if !ok {
+			return nil, fmt.Errorf("expected an integer, not %v", v)
+		}
+		i, err := n.Int64()
+		if err != nil {
+			return nil, err
+		}
+		if col.Type == vizierapipb.TIME64NS {
+			d := types.NewTime64NSValue(col)
+			d.ScalarValue(i)
+			return d, nil
+		}
+		d := types.NewInt64Value(col)
+		d.ScalarValue(i)
+		return d, nil
+	case vizierapipb.FLOAT64:
+		var f float64
+		var err error
+		switch n := v.(type) {
+		case json.Number:
+			f, err = n.Float64()
+		case string:
+			f, err = strconv.ParseFloat(n, 64)
+		default:
+			err = fmt.Errorf("expected a number, not %v", v)
+		}
+		if err != nil {
+			return nil, err
+		}
+		d := types.NewFloat64Value(col)
+		d.ScalarValue(f)
+		return d, nil
+	case vizierapipb.STRING:
+		s, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("expected a string, not %v", v)
+		}
+		d := types.NewStringValue(col)
+		d.ScalarValue(s)
+		return d, nil
+	}
+	return nil, fmt.Errorf("unsupported type %s", col.Type)
+}
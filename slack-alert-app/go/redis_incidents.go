@@ -0,0 +1,277 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	// How long the state lock is held before it expires, in case a replica dies while holding it.
+	redisLockTTL = 30 * time.Second
+	// Maximum time to wait for Redis to release the state lock.
+	redisUnlockTimeout = 5 * time.Second
+)
+
+// Deletes the lock only if it is still held by the caller.
+var redisUnlockScript = redis.NewScript(`
+if redis.call("get", KEYS[1]) == ARGV[1] then
+	return redis.call("del", KEYS[1])
+end
+return 0`)
+
+// redisIncidentManager is an IncidentManager that keeps incidents in Redis,
+// so that multiple replicas of the bot share incident state.
+//
+// Keys used, all under the configured prefix:
+//
+//	<prefix>:incident:<id>         JSON encoded Incident.
+//	<prefix>:open:<rule>:<cluster> Hash of service name to ID of its open incident.
+//	<prefix>:lock                  Lock held while modifying incidents.
+//	<prefix>:check:<rule>          Claimed by the replica running the rule's current check.
+type redisIncidentManager struct {
+	client *redis.Client
+	prefix string
+}
+
+func newRedisIncidentManager(redisURL, prefix string) (*redisIncidentManager, error) {
+	opts, err := redis.ParseURL(redisURL)
+	if err != nil {
+		return nil, err
+	}
+	return &redisIncidentManager{client: redis.NewClient(opts), prefix: prefix}, nil
+}
+
+// ClaimCheck claims the rule's current check for this replica. It returns
+// false if another replica has already claimed a check within the last ttl.
+func (m *redisIncidentManager) ClaimCheck(ctx context.Context, rule string, ttl time.Duration) (bool, error) {
+	return m.client.SetNX(ctx, m.prefix+":check:"+rule, time.Now().Format(time.RFC3339), ttl).Result()
+}
+
+func (m *redisIncidentManager) Update(ctx context.Context, rule string, cluster Cluster, over []IncidentData, now time.Time) ([]IncidentEvent, error) {
+	openKey := m.prefix + ":open:" + rule + ":" + cluster.ID
+	var events []IncidentEvent
+	err := m.withLock(ctx, func() error {
+		ids, err := m.client.HGetAll(ctx, openKey).Result()
+		if err != nil {
+			return err
+		}
+		open := make(map[string]*Incident)
+		for service, id := range ids {
+			inc, err := m.get(ctx, id)
+			if errors.Is(err, ErrIncidentNotFound) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			open[service] = inc
+		}
+
+		newID := func() (string, error) {
+			return newUnusedIncidentID(func(id string) (bool, error) {
+				_, err := m.get(ctx, id)
+				if errors.Is(err, ErrIncidentNotFound) {
+					return false, nil
+				}
+				return err == nil, err
+			})
+		}
+		events, err = reconcileIncidents(open, rule, cluster, over, now, newID)
+		if err != nil {
+			return err
+		}
+
+		for _, e := range events {
+			inc := e.Incident
+			switch e.Kind {
+			case IncidentOpened:
+				if err := m.client.HSet(ctx, openKey, inc.Service, inc.ID).Err(); err != nil {
+					return err
+				}
+				err = m.save(ctx, &inc, 0)
+			case IncidentUpdated:
+				err = m.save(ctx, &inc, 0)
+			case IncidentResolved:
+				if err := m.save(ctx, &inc, resolvedIncidentTTL); err != nil {
+					return err
+				}
+				err = m.client.HDel(ctx, openKey, inc.Service).Err()
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return events, err
+}
+
+func (m *redisIncidentManager) Get(ctx context.Context, id string) (*Incident, error) {
+	return m.get(ctx, id)
+}
+
+func (m *redisIncidentManager) Ack(ctx context.Context, id string) (*Incident, error) {
+	return m.modify(ctx, id, func(inc *Incident) {
+		inc.Acked = true
+	})
+}
+
+func (m *redisIncidentManager) Silence(ctx context.Context, id string, until time.Time) (*Incident, error) {
+	return m.modify(ctx, id, func(inc *Incident) {
+		inc.SilencedUntil = until
+	})
+}
+
+func (m *redisIncidentManager) Open(ctx context.Context) ([]Incident, error) {
+	var incidents []Incident
+	it := m.client.Scan(ctx, 0, m.prefix+":open:*", 100).Iterator()
+	for it.Next(ctx) {
+		ids, err := m.client.HGetAll(ctx, it.Val()).Result()
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range ids {
+			inc, err := m.get(ctx, id)
+			if errors.Is(err, ErrIncidentNotFound) {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			incidents = append(incidents, *inc)
+		}
+	}
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+	sortIncidents(incidents)
+	return incidents, nil
+}
+
+func (m *redisIncidentManager) All(ctx context.Context) ([]Incident, error) {
+	var incidents []Incident
+	it := m.client.Scan(ctx, 0, m.prefix+":incident:*", 100).Iterator()
+	for it.Next(ctx) {
+		inc, err := m.get(ctx, strings.TrimPrefix(it.Val(), m.prefix+":incident:"))
+		if errors.Is(err, ErrIncidentNotFound) {
+			// Resolved incidents expire.
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		incidents = append(incidents, *inc)
+	}
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+	sortIncidents(incidents)
+	return incidents, nil
+}
+
+// Close closes the connection to Redis.
+func (m *redisIncidentManager) Close() error {
+	return m.client.Close()
+}
+
+// modify applies fn to the incident with the given ID and saves the result.
+func (m *redisIncidentManager) modify(ctx context.Context, id string, fn func(*Incident)) (*Incident, error) {
+	var inc *Incident
+	err := m.withLock(ctx, func() error {
+		var err error
+		inc, err = m.get(ctx, id)
+		if err != nil {
+			return err
+		}
+		fn(inc)
+		var ttl time.Duration
+		if !inc.ResolvedAt.IsZero() {
+			ttl = resolvedIncidentTTL
+		}
+		return m.save(ctx, inc, ttl)
+	})
+	return inc, err
+}
+
+func (m *redisIncidentManager) get(ctx context.Context, id string) (*Incident, error) {
+	b, err := m.client.Get(ctx, m.prefix+":incident:"+id).Bytes()
+	if err == redis.Nil {
+		return nil, ErrIncidentNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	inc := &Incident{}
+	if err := json.Unmarshal(b, inc); err != nil {
+		return nil, err
+	}
+	return inc, nil
+}
+
+func (m *redisIncidentManager) save(ctx context.Context, inc *Incident, ttl time.Duration) error {
+	b, err := json.Marshal(inc)
+	if err != nil {
+		return err
+	}
+	return m.client.Set(ctx, m.prefix+":incident:"+inc.ID, b, ttl).Err()
+}
+
+// withLock runs fn while holding the lock on incident state, waiting for
+// other replicas to release it if necessary.
+func (m *redisIncidentManager) withLock(ctx context.Context, fn func() error) error {
+	key := m.prefix + ":lock"
+	token, err := newIncidentID()
+	if err != nil {
+		return err
+	}
+	token += time.Now().Format(time.RFC3339Nano)
+
+	for {
+		ok, err := m.client.SetNX(ctx, key, token, redisLockTTL).Result()
+		if err != nil {
+			return err
+		}
+		if ok {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+	defer m.unlock(key, token)
+	return fn()
+}
+
+// unlock releases the state lock taken with token. It doesn't use the
+// caller's context, which is often cancelled or timed out when fn fails, so
+// that other replicas don't wait for the lock to expire.
+func (m *redisIncidentManager) unlock(key, token string) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisUnlockTimeout)
+	defer cancel()
+	if err := redisUnlockScript.Run(ctx, m.client, []string{key}, token).Err(); err != nil {
+		logError("Error releasing Redis state lock, other replicas wait for it to expire.", "ttl", redisLockTTL, "error", err)
+	}
+}
@@ -0,0 +1,222 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// remoteRules fetches the rules file from a URL, so that many bots can be
+// managed from one place. The last file fetched is kept with its ETag, so
+// that polling for changes only downloads the file when it has changed.
+type remoteRules struct {
+	url     string
+	headers map[string]string
+	// Key the file's signature, at url + ".sig", is verified with, or nil to
+	// not verify it.
+	publicKey ed25519.PublicKey
+	http      *http.Client
+
+	mu   sync.Mutex
+	etag string
+	body []byte
+}
+
+var (
+	remoteRulesMu sync.Mutex
+	// Fetchers by URL, shared by config reloads and polling.
+	remoteRulesByURL = make(map[string]*remoteRules)
+)
+
+// remoteRulesFor returns the fetcher for cfg's URL, creating it on first use.
+func remoteRulesFor(cfg RulesURLConfig) (*remoteRules, error) {
+	var key ed25519.PublicKey
+	if cfg.PublicKey != "" {
+		var err error
+		if key, err = parsePublicKey(cfg.PublicKey); err != nil {
+			return nil, err
+		}
+	}
+	remoteRulesMu.Lock()
+	defer remoteRulesMu.Unlock()
+	r, ok := remoteRulesByURL[cfg.URL]
+	if !ok {
+		r = &remoteRules{url: cfg.URL, http: &http.Client{Timeout: 30 * time.Second}}
+		remoteRulesByURL[cfg.URL] = r
+	}
+	// Settings other than the URL may change on reload.
+	r.mu.Lock()
+	r.headers = cfg.Headers
+	if !key.Equal(r.publicKey) {
+		// The cached file was verified with a different key.
+		r.publicKey, r.etag, r.body = key, "", nil
+	}
+	r.mu.Unlock()
+	return r, nil
+}
+
+// parsePublicKey parses a base64 encoded Ed25519 public key.
+func parsePublicKey(s string) (ed25519.PublicKey, error) {
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil || len(b) != ed25519.PublicKeySize {
+		return nil, errors.New("invalid public key, expected a base64 encoded Ed25519 public key")
+	}
+	return b, nil
+}
+
+// Fetch returns the rules file, and whether it changed since the last
+// fetch. A file whose signature doesn't verify is an error.
+func (r *remoteRules) Fetch(ctx context.Context) ([]byte, bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, r.url, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	for k, v := range r.headers {
+		req.Header.Set(k, v)
+	}
+	if r.etag != "" {
+		req.Header.Set("If-None-Match", r.etag)
+	}
+	resp, err := r.http.Do(req)
+	if err != nil {
+		return nil, false, fmt.Errorf("fetching rules: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified && r.body != nil {
+		return r.body, false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, false, fmt.Errorf("fetching rules: %s returned %s", r.url, resp.Status)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, false, fmt.Errorf("fetching rules: %w", err)
+	}
+	if r.publicKey != nil {
+		if err := r.verify(ctx, body); err != nil {
+			return nil, false, err
+		}
+	}
+	changed := r.body == nil || string(body) != string(r.body)
+	r.etag, r.body = resp.Header.Get("ETag"), body
+	return body, changed, nil
+}
+
+// verify checks body against the base64 encoded Ed25519 signature at the
+// rules URL with .sig appended.
+func (r *remoteRules) verify(ctx context.Context, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, r.url+".sig", nil)
+	if err != nil {
+		return err
+	}
+	for k, v := range r.headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := r.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("fetching rules signature: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("fetching rules signature: %s.sig returned %s", r.url, resp.Status)
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("fetching rules signature: %w", err)
+	}
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(b)))
+	if err != nil || !ed25519.Verify(r.publicKey, body, sig) {
+		return errors.New("rules signature doesn't verify, refusing to load them")
+	}
+	return nil
+}
+
+// loadRulesURL fetches the rules file from cfg's URL and reads the rules
+// from it like from RULES_FILE. Relative script paths are resolved against dir.
+func loadRulesURL(cfg RulesURLConfig, defaults Rule, dir string) ([]Rule, error) {
+	r, err := remoteRulesFor(cfg)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	body, _, err := r.Fetch(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var f rulesFile
+	if err := json.Unmarshal(body, &f); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", cfg.URL, err)
+	}
+	if len(f.Rules) == 0 {
+		return nil, fmt.Errorf("%s has no rules", cfg.URL)
+	}
+	if err := prepareRules(f.Rules, defaults, dir); err != nil {
+		return nil, fmt.Errorf("%s: %w", cfg.URL, err)
+	}
+	return f.Rules, nil
+}
+
+// watchRulesURL sends on the returned channel whenever the rules file at
+// cfg's URL changes, until ctx is cancelled. Failed polls are logged and
+// retried on the next interval.
+func watchRulesURL(ctx context.Context, cfg RulesURLConfig) <-chan struct{} {
+	changed := make(chan struct{}, 1)
+	r, err := remoteRulesFor(cfg)
+	if err != nil {
+		logError("Can't poll rules URL.", "error", err)
+		return changed
+	}
+	go func() {
+		ticker := time.NewTicker(cfg.PollInterval.Duration)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			_, ok, err := r.Fetch(ctx)
+			if err != nil {
+				logWarn("Error polling rules URL.", "url", cfg.URL, "error", err)
+				continue
+			}
+			if !ok {
+				continue
+			}
+			logInfo("Rules changed, reloading config.", "url", cfg.URL)
+			select {
+			case changed <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return changed
+}
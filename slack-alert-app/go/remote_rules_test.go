@@ -0,0 +1,202 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// rulesServer serves a rules file with an ETag, and its signature.
+type rulesServer struct {
+	*httptest.Server
+
+	mu   sync.Mutex
+	body string
+	// sig is the signature served at .sig, or empty for none.
+	sig string
+	// Requests with their If-None-Match header, such as "/rules.json etag-1".
+	requests []string
+}
+
+func newRulesServer(t *testing.T) *rulesServer {
+	s := &rulesServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.requests = append(s.requests, strings.TrimSpace(r.URL.Path+" "+r.Header.Get("If-None-Match")))
+		if r.Header.Get("Authorization") != "Bearer rules-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/rules.json":
+			etag := `"` + sha256Hex([]byte(s.body))[:8] + `"`
+			if r.Header.Get("If-None-Match") == etag {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			w.Header().Set("ETag", etag)
+			w.Write([]byte(s.body))
+		case "/rules.json.sig":
+			if s.sig == "" {
+				http.NotFound(w, r)
+				return
+			}
+			w.Write([]byte(s.sig + "\n"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// serve serves body, signed with key if not nil.
+func (s *rulesServer) serve(body string, key ed25519.PrivateKey) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.body, s.sig = body, ""
+	if key != nil {
+		s.sig = base64.StdEncoding.EncodeToString(ed25519.Sign(key, []byte(body)))
+	}
+}
+
+// Requests returns the requests made since the last call.
+func (s *rulesServer) Requests() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	requests := s.requests
+	s.requests = nil
+	return requests
+}
+
+func newRulesKey(t *testing.T) (string, ed25519.PrivateKey) {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(pub), priv
+}
+
+func TestRemoteRulesFetch(t *testing.T) {
+	const rules = `{"rules": [{"name": "http-errors"}]}`
+	pub, priv := newRulesKey(t)
+	_, otherPriv := newRulesKey(t)
+	for _, tt := range []struct {
+		name    string
+		key     string
+		signer  ed25519.PrivateKey
+		body    string
+		sig     string
+		wantErr string
+	}{
+		{name: "unsigned", body: rules},
+		{name: "good signature", key: pub, signer: priv, body: rules},
+		{name: "signed by another key", key: pub, signer: otherPriv, body: rules, wantErr: "doesn't verify"},
+		{name: "tampered", key: pub, signer: priv, body: rules, sig: "tampered", wantErr: "doesn't verify"},
+		{name: "missing signature", key: pub, body: rules, wantErr: "rules.json.sig returned 404 Not Found"},
+		{name: "signature for another key ignored without a key", signer: otherPriv, body: rules},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newRulesServer(t)
+			srv.serve(tt.body, tt.signer)
+			if tt.sig != "" {
+				srv.sig = base64.StdEncoding.EncodeToString([]byte(tt.sig))
+			}
+			r, err := remoteRulesFor(RulesURLConfig{URL: srv.URL + "/rules.json", PublicKey: tt.key, Headers: map[string]string{"Authorization": "Bearer rules-token"}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, changed, err := r.Fetch(context.Background())
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Fetch() = %q, %v, want an error containing %q", body, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(body) != tt.body || !changed {
+				t.Errorf("Fetch() = %q, %v, want %q, true", body, changed, tt.body)
+			}
+		})
+	}
+}
+
+func TestRemoteRulesCache(t *testing.T) {
+	srv := newRulesServer(t)
+	pub, priv := newRulesKey(t)
+	otherPub, otherPriv := newRulesKey(t)
+	cfg := RulesURLConfig{URL: srv.URL + "/rules.json", PublicKey: pub, Headers: map[string]string{"Authorization": "Bearer rules-token"}}
+	fetch := func(wantBody string, wantChanged bool, wantRequests ...string) {
+		t.Helper()
+		r, err := remoteRulesFor(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, changed, err := r.Fetch(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != wantBody || changed != wantChanged {
+			t.Errorf("Fetch() = %q, %v, want %q, %v", body, changed, wantBody, wantChanged)
+		}
+		if got := srv.Requests(); strings.Join(got, ", ") != strings.Join(wantRequests, ", ") {
+			t.Errorf("requests %q, want %q", got, wantRequests)
+		}
+	}
+	v1, v2 := `{"rules": [{"name": "v1"}]}`, `{"rules": [{"name": "v2"}]}`
+	etag1 := `"` + sha256Hex([]byte(v1))[:8] + `"`
+	etag2 := `"` + sha256Hex([]byte(v2))[:8] + `"`
+
+	srv.serve(v1, priv)
+	fetch(v1, true, "/rules.json", "/rules.json.sig")
+	// A 304 returns the cached file, without fetching its signature again.
+	fetch(v1, false, "/rules.json "+etag1)
+	srv.serve(v2, priv)
+	fetch(v2, true, "/rules.json "+etag1, "/rules.json.sig")
+
+	// A new key drops the file verified with the old one, so it is fetched
+	// and verified again, even if it hasn't changed.
+	srv.serve(v2, otherPriv)
+	cfg.PublicKey = otherPub
+	fetch(v2, true, "/rules.json", "/rules.json.sig")
+	fetch(v2, false, "/rules.json "+etag2)
+
+	// A file that no longer verifies is an error, and isn't cached.
+	srv.serve(v1, priv)
+	r, err := remoteRulesFor(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := r.Fetch(context.Background()); err == nil || !strings.Contains(err.Error(), "doesn't verify") {
+		t.Errorf("Fetch() of a file signed with the old key returned %v, want it to not verify", err)
+	}
+	srv.Requests()
+	srv.serve(v1, otherPriv)
+	fetch(v1, true, "/rules.json "+etag2, "/rules.json.sig")
+}
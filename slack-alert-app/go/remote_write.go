@@ -0,0 +1,184 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// remoteWriteSink pushes the stats of each check to a Prometheus remote-write
+// endpoint, such as Prometheus itself with --web.enable-remote-write-receiver,
+// Grafana Mimir or Thanos Receive. Each service gets these gauges, labeled
+// with the rule, cluster and service:
+//
+//	pixie_service_error_rate                 Error rate of the whole service.
+//	pixie_service_max_error                  Highest error rate of any endpoint.
+//	pixie_service_percent_exceed_threshold   Percentage of endpoints over the threshold.
+//	pixie_service_requests                   Requests in the window queried.
+//	pixie_service_errors                     Errors in the window queried.
+//
+// along with pixie_incidents_open for the rule on the cluster.
+//
+// Requests are encoded by hand, to avoid depending on the Prometheus and
+// protobuf libraries for a handful of fields.
+type remoteWriteSink struct {
+	url     string
+	headers map[string]string
+	http    *http.Client
+}
+
+func newRemoteWriteSink(cfg RemoteWriteConfig) *remoteWriteSink {
+	return &remoteWriteSink{url: cfg.URL, headers: cfg.Headers, http: newHTTPClient(10 * time.Second)}
+}
+
+// Close closes the sink's idle connections.
+func (s *remoteWriteSink) Close() error {
+	s.http.CloseIdleConnections()
+	return nil
+}
+
+// promSeries is a single sample of a time series.
+type promSeries struct {
+	labels map[string]string
+	value  float64
+}
+
+func (s *remoteWriteSink) WriteStats(ctx context.Context, b *statsBatch) error {
+	var series []promSeries
+	add := func(name, service string, v float64) {
+		labels := map[string]string{"__name__": name, "rule": b.Rule, "cluster": b.Cluster.Name}
+		if service != "" {
+			labels["service"] = service
+		}
+		series = append(series, promSeries{labels: labels, value: v})
+	}
+	for _, svc := range b.Services {
+		add("pixie_service_error_rate", svc.Service, svc.ErrorRate)
+		add("pixie_service_max_error", svc.Service, svc.MaxError)
+		add("pixie_service_percent_exceed_threshold", svc.Service, svc.PercentExceedThreshold)
+		add("pixie_service_requests", svc.Service, float64(svc.TotalRequests))
+		add("pixie_service_errors", svc.Service, float64(svc.ErrorCount))
+	}
+	add("pixie_incidents_open", "", float64(b.OpenIncidents))
+
+	body := snappyEncode(encodeWriteRequest(series, millis(b.Time)))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	for k, v := range s.headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := s.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("remote write returned %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// encodeWriteRequest encodes series as a prometheus.WriteRequest protobuf
+// message, with a single sample at timestamp (in milliseconds) per series:
+//
+//	message WriteRequest { repeated TimeSeries timeseries = 1; }
+//	message TimeSeries { repeated Label labels = 1; repeated Sample samples = 2; }
+//	message Label { string name = 1; string value = 2; }
+//	message Sample { double value = 1; int64 timestamp = 2; }
+func encodeWriteRequest(series []promSeries, timestamp int64) []byte {
+	var req []byte
+	for _, s := range series {
+		var ts []byte
+		// Remote write requires labels sorted by name.
+		names := make([]string, 0, len(s.labels))
+		for k := range s.labels {
+			names = append(names, k)
+		}
+		sort.Strings(names)
+		for _, k := range names {
+			var label []byte
+			label = appendProtoBytes(label, 1, []byte(k))
+			label = appendProtoBytes(label, 2, []byte(s.labels[k]))
+			ts = appendProtoBytes(ts, 1, label)
+		}
+		var sample []byte
+		sample = appendProtoKey(sample, 1, 1)
+		var v [8]byte
+		binary.LittleEndian.PutUint64(v[:], math.Float64bits(s.value))
+		sample = append(sample, v[:]...)
+		sample = appendProtoKey(sample, 2, 0)
+		sample = appendUvarint(sample, uint64(timestamp))
+		ts = appendProtoBytes(ts, 2, sample)
+		req = appendProtoBytes(req, 1, ts)
+	}
+	return req
+}
+
+func appendProtoKey(b []byte, field, wireType int) []byte {
+	return appendUvarint(b, uint64(field<<3|wireType))
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutUvarint(buf[:], v)]...)
+}
+
+// appendProtoBytes appends a length-delimited field, such as a string or an embedded message.
+func appendProtoBytes(b []byte, field int, v []byte) []byte {
+	b = appendProtoKey(b, field, 2)
+	b = appendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+// snappyEncode encodes src in the Snappy block format that remote write
+// requires. It only emits literals, which any decoder accepts: the requests
+// are small, so compressing them isn't worth a dependency.
+func snappyEncode(src []byte) []byte {
+	dst := appendUvarint(nil, uint64(len(src)))
+	for len(src) > 0 {
+		n := len(src)
+		if n > 1<<16 {
+			n = 1 << 16
+		}
+		switch l := n - 1; {
+		case l < 60:
+			dst = append(dst, byte(l<<2))
+		case l < 1<<8:
+			dst = append(dst, 60<<2, byte(l))
+		default:
+			dst = append(dst, 61<<2, byte(l), byte(l>>8))
+		}
+		dst = append(dst, src[:n]...)
+		src = src[n:]
+	}
+	return dst
+}
@@ -0,0 +1,241 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// testStatsBatch returns the stats of a check that found one of two services over the threshold.
+func testStatsBatch() *statsBatch {
+	return &statsBatch{
+		Rule:    "http-errors",
+		Cluster: Cluster{ID: "c1", Name: "prod"},
+		Time:    time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC),
+		Services: []serviceStats{
+			{Service: "px-sock-shop/orders", ErrorCount: 30, TotalRequests: 100, ErrorRate: 0.3, MaxError: 0.5, PercentExceedThreshold: 50},
+			{Service: "px-sock-shop/carts", TotalRequests: 40},
+		},
+		OpenIncidents: 1,
+	}
+}
+
+// snappyDecode decodes a Snappy block, for the literal-only blocks that
+// snappyEncode emits.
+func snappyDecode(b []byte) ([]byte, error) {
+	n, l := binary.Uvarint(b)
+	if l <= 0 {
+		return nil, errors.New("invalid length")
+	}
+	b = b[l:]
+	var dst []byte
+	for len(b) > 0 {
+		if b[0]&3 != 0 {
+			return nil, fmt.Errorf("unsupported tag %#x", b[0])
+		}
+		var size int
+		switch tag := int(b[0] >> 2); {
+		case tag < 60:
+			size, b = tag+1, b[1:]
+		case tag == 60 && len(b) >= 2:
+			size, b = int(b[1])+1, b[2:]
+		case tag == 61 && len(b) >= 3:
+			size, b = (int(b[1])|int(b[2])<<8)+1, b[3:]
+		default:
+			return nil, fmt.Errorf("unsupported literal tag %#x", b[0])
+		}
+		if size > len(b) {
+			return nil, errors.New("literal past the end of the block")
+		}
+		dst, b = append(dst, b[:size]...), b[size:]
+	}
+	if uint64(len(dst)) != n {
+		return nil, fmt.Errorf("decoded %d bytes, want %d", len(dst), n)
+	}
+	return dst, nil
+}
+
+// decodedSeries is a time series of a decoded WriteRequest.
+type decodedSeries struct {
+	labels    map[string]string
+	value     float64
+	timestamp int64
+}
+
+// protoFields calls fn with each field of a protobuf message.
+func protoFields(b []byte, fn func(num protowire.Number, typ protowire.Type, v []byte)) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		m := protowire.ConsumeFieldValue(num, typ, b)
+		if m < 0 {
+			return protowire.ParseError(m)
+		}
+		fn(num, typ, b[:m])
+		b = b[m:]
+	}
+	return nil
+}
+
+func decodeWriteRequest(t *testing.T, b []byte) map[string]decodedSeries {
+	t.Helper()
+	series := make(map[string]decodedSeries)
+	err := protoFields(b, func(_ protowire.Number, _ protowire.Type, ts []byte) {
+		ts, _ = protowire.ConsumeBytes(ts)
+		s := decodedSeries{labels: make(map[string]string)}
+		var names []string
+		protoFields(ts, func(num protowire.Number, _ protowire.Type, v []byte) {
+			v, _ = protowire.ConsumeBytes(v)
+			switch num {
+			case 1:
+				var name, value string
+				protoFields(v, func(num protowire.Number, _ protowire.Type, f []byte) {
+					f, _ = protowire.ConsumeBytes(f)
+					if num == 1 {
+						name = string(f)
+					} else {
+						value = string(f)
+					}
+				})
+				names = append(names, name)
+				s.labels[name] = value
+			case 2:
+				protoFields(v, func(num protowire.Number, _ protowire.Type, f []byte) {
+					if num == 1 {
+						bits, _ := protowire.ConsumeFixed64(f)
+						s.value = math.Float64frombits(bits)
+					} else {
+						ts, _ := protowire.ConsumeVarint(f)
+						s.timestamp = int64(ts)
+					}
+				})
+			}
+		})
+		if !sort.StringsAreSorted(names) {
+			t.Errorf("labels %v aren't sorted", names)
+		}
+		series[s.labels["__name__"]+"{"+s.labels["service"]+"}"] = s
+	})
+	if err != nil {
+		t.Fatalf("decoding WriteRequest: %v", err)
+	}
+	return series
+}
+
+func TestRemoteWriteSink(t *testing.T) {
+	var got *http.Request
+	var body []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		body, _ = ioutil.ReadAll(r.Body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	s := newRemoteWriteSink(RemoteWriteConfig{URL: srv.URL + "/api/v1/write", Headers: map[string]string{"Authorization": "Bearer remote-write-token"}})
+	b := testStatsBatch()
+	if err := s.WriteStats(context.Background(), b); err != nil {
+		t.Fatal(err)
+	}
+	for k, want := range map[string]string{
+		"Content-Type":                      "application/x-protobuf",
+		"Content-Encoding":                  "snappy",
+		"X-Prometheus-Remote-Write-Version": "0.1.0",
+		"Authorization":                     "Bearer remote-write-token",
+	} {
+		if v := got.Header.Get(k); v != want {
+			t.Errorf("%s: %q, want %q", k, v, want)
+		}
+	}
+	if got.Method != http.MethodPost || got.URL.Path != "/api/v1/write" {
+		t.Errorf("sent %s %s", got.Method, got.URL.Path)
+	}
+	decoded, err := snappyDecode(body)
+	if err != nil {
+		t.Fatalf("decoding snappy: %v", err)
+	}
+	series := decodeWriteRequest(t, decoded)
+	if len(series) != 11 {
+		t.Errorf("got %d series, want 5 per service and pixie_incidents_open", len(series))
+	}
+	for name, want := range map[string]float64{
+		"pixie_service_error_rate{px-sock-shop/orders}":               0.3,
+		"pixie_service_max_error{px-sock-shop/orders}":                0.5,
+		"pixie_service_percent_exceed_threshold{px-sock-shop/orders}": 50,
+		"pixie_service_requests{px-sock-shop/orders}":                 100,
+		"pixie_service_errors{px-sock-shop/orders}":                   30,
+		"pixie_service_requests{px-sock-shop/carts}":                  40,
+		"pixie_service_errors{px-sock-shop/carts}":                    0,
+		"pixie_incidents_open{}":                                      1,
+	} {
+		s, ok := series[name]
+		if !ok {
+			t.Errorf("no series %s", name)
+			continue
+		}
+		if s.value != want || s.timestamp != b.Time.UnixNano()/1e6 {
+			t.Errorf("%s = %v at %d, want %v at %d", name, s.value, s.timestamp, want, b.Time.UnixNano()/1e6)
+		}
+	}
+	wantLabels := map[string]string{"__name__": "pixie_service_requests", "rule": "http-errors", "cluster": "prod", "service": "px-sock-shop/carts"}
+	if labels := series["pixie_service_requests{px-sock-shop/carts}"].labels; !reflect.DeepEqual(labels, wantLabels) {
+		t.Errorf("labels %v, want %v", labels, wantLabels)
+	}
+}
+
+func TestRemoteWriteSinkError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "out of order sample", http.StatusBadRequest)
+	}))
+	defer srv.Close()
+	err := newRemoteWriteSink(RemoteWriteConfig{URL: srv.URL}).WriteStats(context.Background(), testStatsBatch())
+	if err == nil || !strings.Contains(err.Error(), "remote write returned 400 Bad Request: out of order sample") {
+		t.Errorf("got %v, want the endpoint's error", err)
+	}
+}
+
+func TestSnappyEncodeLong(t *testing.T) {
+	// Long requests are split into several literals.
+	for _, n := range []int{0, 1, 60, 61, 256, 257, 1 << 16, 1<<16 + 1, 3 << 16} {
+		src := make([]byte, n)
+		for i := range src {
+			src[i] = byte(i * 7)
+		}
+		got, err := snappyDecode(snappyEncode(src))
+		if err != nil || !bytes.Equal(got, src) {
+			t.Errorf("%d bytes: round trip failed: %v", n, err)
+		}
+	}
+}
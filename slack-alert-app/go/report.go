@@ -0,0 +1,157 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Maximum number of affected windows listed in a Slack report, so that
+// reports of long incidents fit in a Slack message.
+const maxSlackReportWindows = 20
+
+// incidentReport summarizes a resolved incident for post-incident review.
+type incidentReport struct {
+	Incident Incident
+	// Length of the time window queried by each check.
+	Window time.Duration
+	// What the rule's error count counts, such as "4xx+ errors".
+	Problem string
+	// Link to the service in the Pixie Live UI.
+	PixieLink string
+}
+
+func newIncidentReport(inc Incident, window time.Duration, problem string) *incidentReport {
+	return &incidentReport{
+		Incident:  inc,
+		Window:    window,
+		Problem:   problem,
+		PixieLink: pixieServiceLink(inc.Cluster.Name, inc.Service),
+	}
+}
+
+func (r *incidentReport) duration() time.Duration {
+	return r.Incident.ResolvedAt.Sub(r.Incident.OpenedAt).Round(time.Second)
+}
+
+// Markdown renders the report as a Markdown document.
+func (r *incidentReport) Markdown() string {
+	inc := r.Incident
+	var b strings.Builder
+	fmt.Fprintf(&b, "# %s: %s %s\n\n", inc.ID, formatName(inc.Service), r.Problem)
+	fmt.Fprintf(&b, "- **Rule:** %s\n", inc.Rule)
+	fmt.Fprintf(&b, "- **Cluster:** %s (%s)\n", inc.Cluster.Name, inc.Cluster.ID)
+	for _, k := range sortedLabelKeys(inc.Cluster.Labels) {
+		fmt.Fprintf(&b, "- **%s:** %s\n", k, inc.Cluster.Labels[k])
+	}
+	fmt.Fprintf(&b, "- **Opened:** %s\n", inc.OpenedAt.Format(time.RFC3339))
+	fmt.Fprintf(&b, "- **Resolved:** %s\n", inc.ResolvedAt.Format(time.RFC3339))
+	fmt.Fprintf(&b, "- **Duration:** %s\n", r.duration())
+	fmt.Fprintf(&b, "- **Peak error rate:** %s\n", formatRate(inc.PeakErrorRate()))
+	fmt.Fprintf(&b, "- **Pixie:** [%s](%s)\n\n", inc.Service, r.PixieLink)
+	b.WriteString("## Affected windows\n\n")
+	b.WriteString("| Window | Error rate | Errors | Requests |\n")
+	b.WriteString("| --- | --- | --- | --- |\n")
+	for _, s := range inc.Samples {
+		fmt.Fprintf(&b, "| %s - %s | %s | %d | %d |\n", s.Time.Add(-r.Window).Format("15:04:05"), s.Time.Format("15:04:05"),
+			formatRate(s.Data.ErrorRate()), s.Data.ErrorCount, s.Data.TotalRequests)
+	}
+	if inc.DroppedSamples > 0 {
+		fmt.Fprintf(&b, "\n%d more windows are left out to keep the incident's history short.\n", inc.DroppedSamples)
+	}
+	return b.String()
+}
+
+// Slack renders the report as a Slack message.
+func (r *incidentReport) Slack() string {
+	inc := r.Incident
+	var b strings.Builder
+	fmt.Fprintf(&b, "*Post-incident report [%s]* %s: %s on %s\n", inc.ID, inc.Rule, formatName(inc.Service), formatCluster(inc.Cluster))
+	fmt.Fprintf(&b, "*Duration:* %s (%s to %s)\n", r.duration(), inc.OpenedAt.Format(time.RFC3339), inc.ResolvedAt.Format(time.RFC3339))
+	fmt.Fprintf(&b, "*Peak error rate:* %s\n", formatRate(inc.PeakErrorRate()))
+	b.WriteString("*Affected windows:*\n")
+	samples := inc.Samples
+	if len(samples) > maxSlackReportWindows {
+		samples = samples[:maxSlackReportWindows]
+	}
+	for _, s := range samples {
+		fmt.Fprintf(&b, "• %s - %s: %s (%d errors out of %d requests)\n", s.Time.Add(-r.Window).Format("15:04:05"), s.Time.Format("15:04:05"),
+			formatRate(s.Data.ErrorRate()), s.Data.ErrorCount, s.Data.TotalRequests)
+	}
+	if more := len(inc.Samples) - len(samples) + inc.DroppedSamples; more > 0 {
+		fmt.Fprintf(&b, "• …and %d more\n", more)
+	}
+	fmt.Fprintf(&b, "<%s|View %s in Pixie>", r.PixieLink, formatName(inc.Service))
+	return b.String()
+}
+
+// pixieUIURL is the base URL of the Pixie Live UI. It is changed by
+// setPixieCloudAddr for self-hosted Pixie Cloud.
+var pixieUIURL = "https://work.withpixie.ai"
+
+// setPixieCloudAddr points links at the Live UI of the Pixie Cloud at addr,
+// such as pixie.example.com:443, which is served at work.pixie.example.com.
+func setPixieCloudAddr(addr string) {
+	host := addr
+	if h, _, err := net.SplitHostPort(addr); err == nil {
+		host = h
+	}
+	pixieUIURL = "https://work." + host
+}
+
+// pixieServiceLink returns a link to the px/service script in the Pixie Live UI.
+func pixieServiceLink(clusterName, service string) string {
+	q := url.Values{}
+	q.Set("script", "px/service")
+	q.Set("service", service)
+	return fmt.Sprintf("%s/live/clusters/%s?%s", pixieUIURL, url.PathEscape(clusterName), q.Encode())
+}
+
+// ReportSink publishes post-incident reports.
+type ReportSink interface {
+	WriteReport(ctx context.Context, r *incidentReport) error
+}
+
+// slackReportSink posts reports to a Slack channel.
+type slackReportSink struct {
+	alerter Alerter
+}
+
+func (s *slackReportSink) WriteReport(ctx context.Context, r *incidentReport) error {
+	return s.alerter.SendInfo(ctx, r.Slack())
+}
+
+// dirReportSink writes each report to a Markdown file in a directory.
+type dirReportSink struct {
+	dir string
+}
+
+func (s *dirReportSink) WriteReport(ctx context.Context, r *incidentReport) error {
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%s-%s.md", r.Incident.OpenedAt.Format("2006-01-02"), r.Incident.ID)
+	return ioutil.WriteFile(filepath.Join(s.dir, name), []byte(r.Markdown()), 0644)
+}
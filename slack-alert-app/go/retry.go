@@ -0,0 +1,97 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.withpixie.dev/pixie/src/api/go/pxapi/errdefs"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// retryPolicy retries transient Vizier errors with exponential backoff.
+type retryPolicy struct {
+	// Maximum number of attempts, including the first one.
+	attempts int
+	// Delay before the first retry. It doubles on each retry, up to maxDelay.
+	initialDelay time.Duration
+	maxDelay     time.Duration
+}
+
+// do calls fn until it succeeds, returns an error that isn't retryable, or
+// runs out of attempts. name is used in log messages.
+func (p retryPolicy) do(ctx context.Context, name string, fn func() error) error {
+	delay := p.initialDelay
+	var err error
+	for attempt := 1; ; attempt++ {
+		err = fn()
+		if err == nil || attempt >= p.attempts || !isRetryable(ctx, err) {
+			break
+		}
+		logWarn("Attempt failed, retrying.", "operation", name, "attempt", attempt, "attempts", p.attempts, "delay", delay, "error", err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > p.maxDelay {
+			delay = p.maxDelay
+		}
+	}
+	if err != nil && p.attempts > 1 && isRetryable(ctx, err) {
+		return fmt.Errorf("giving up after %d attempts: %w", p.attempts, err)
+	}
+	return err
+}
+
+// isRetryable returns whether err is likely to be transient: the cluster was
+// briefly unreachable or the query timed out. Errors in the script or with
+// the API key, and cancellation of ctx itself, are not retried.
+func isRetryable(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	var re *reconnectedError
+	if errors.As(err, &re) {
+		return true
+	}
+	if errdefs.IsCompilationError(err) || errors.Is(err, errdefs.ErrInvalidArgument) {
+		return false
+	}
+	// A per-attempt timeout expired while ctx is still live.
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var se interface{ GRPCStatus() *status.Status }
+	if !errors.As(err, &se) {
+		// Errors from the pxapi stream, such as errdefs.ErrInternal, aren't
+		// gRPC statuses. Retrying them is cheap, so assume they're transient.
+		return errors.Is(err, errdefs.ErrInternal)
+	}
+	switch grpcCode(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.ResourceExhausted, codes.Aborted, codes.Internal, codes.Unknown:
+		return true
+	default:
+		// Unauthenticated, PermissionDenied, InvalidArgument, NotFound and
+		// the like won't go away by trying again.
+		return false
+	}
+}
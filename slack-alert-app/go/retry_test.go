@@ -0,0 +1,68 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"go.withpixie.dev/pixie/src/api/go/pxapi/errdefs"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestIsRetryable(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "unavailable", err: status.Error(codes.Unavailable, "connection refused"), want: true},
+		{name: "deadline exceeded status", err: status.Error(codes.DeadlineExceeded, "timed out"), want: true},
+		{name: "resource exhausted", err: status.Error(codes.ResourceExhausted, "too many queries"), want: true},
+		{name: "aborted", err: status.Error(codes.Aborted, "aborted"), want: true},
+		{name: "internal status", err: status.Error(codes.Internal, "oops"), want: true},
+		{name: "unknown status", err: status.Error(codes.Unknown, "?"), want: true},
+		{name: "wrapped status", err: fmt.Errorf("running script: %w", status.Error(codes.Unavailable, "gone")), want: true},
+		{name: "unauthenticated", err: status.Error(codes.Unauthenticated, "bad API key"), want: false},
+		{name: "permission denied", err: status.Error(codes.PermissionDenied, "no access"), want: false},
+		{name: "invalid argument status", err: status.Error(codes.InvalidArgument, "bad script"), want: false},
+		{name: "not found", err: status.Error(codes.NotFound, "no such cluster"), want: false},
+		{name: "per-attempt timeout", err: fmt.Errorf("query: %w", context.DeadlineExceeded), want: true},
+		{name: "reconnected", err: &reconnectedError{err: errors.New("token expired")}, want: true},
+		{name: "compilation error", err: fmt.Errorf("%w: line 1, column 1: bad", errdefs.ErrCompilation), want: false},
+		{name: "invalid argument", err: fmt.Errorf("%w: no such table", errdefs.ErrInvalidArgument), want: false},
+		{name: "internal stream error", err: fmt.Errorf("stream: %w", errdefs.ErrInternal), want: true},
+		{name: "other error", err: errors.New("decoding record"), want: false},
+	} {
+		if got := isRetryable(context.Background(), tt.err); got != tt.want {
+			t.Errorf("isRetryable(%s: %v) = %v, want %v", tt.name, tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestIsRetryableCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for _, err := range []error{status.Error(codes.Unavailable, "gone"), context.Canceled, &reconnectedError{err: errors.New("x")}} {
+		if isRetryable(ctx, err) {
+			t.Errorf("isRetryable(%v) = true once ctx is cancelled, want false", err)
+		}
+	}
+}
@@ -0,0 +1,303 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Rule is a single check: a PxL script whose output table is turned into
+// incidents for endpoints over the error rate threshold.
+type Rule struct {
+	Name string `json:"name" yaml:"name"`
+	// Path to the PxL script template. If empty, Builtin is used.
+	Script string `json:"script" yaml:"script"`
+	// Name of a built-in script, such as http-latency. Defaults to http-errors.
+	Builtin string `json:"builtin" yaml:"builtin"`
+	// PxL script template given inline, instead of Script or Builtin.
+	Source string `json:"source,omitempty" yaml:"source"`
+	// Script specific parameters, such as latency_ms for http-latency.
+	Params map[string]string `json:"params" yaml:"params"`
+	// What the script's error count counts, such as "4xx+ errors", used in messages.
+	Problem string `json:"problem" yaml:"problem"`
+	// What the script's total requests count, such as "pods", used in
+	// messages. Defaults to requests.
+	Unit string `json:"unit,omitempty" yaml:"unit"`
+	// Columns of the script's table to show in messages along with the
+	// error rate, such as memory_mb.
+	Details []string `json:"details,omitempty" yaml:"details"`
+	// Name of the table output by the script.
+	Table string `json:"table" yaml:"table"`
+	// Namespace to monitor. Shorthand for a single entry in Namespaces.
+	Namespace string `json:"namespace" yaml:"namespace"`
+	// Namespaces to monitor, or "all" for every namespace.
+	Namespaces []string `json:"namespaces" yaml:"namespaces"`
+	// Namespaces not to monitor, such as kube-system when monitoring all namespaces.
+	ExcludeNamespaces []string `json:"excludeNamespaces" yaml:"excludeNamespaces"`
+	// Error rate (0-1) at or above which a service has an incident.
+	Threshold float64 `json:"threshold" yaml:"threshold"`
+	// Error rate (0-1) at or above which an incident is critical.
+	CriticalThreshold float64 `json:"criticalThreshold" yaml:"criticalThreshold"`
+	// Interval between checks. This is also the time window queried by the script.
+	Interval duration `json:"interval" yaml:"interval"`
+	// Cron expression for when to run checks, such as "0 9-17 * * Mon-Fri",
+	// instead of every Interval. Interval still sets the window of the first check.
+	Schedule string `json:"schedule" yaml:"schedule"`
+	// Maximum random delay added to each check, so that rules and replicas
+	// don't all query Pixie Cloud at the same instant.
+	Jitter duration `json:"jitter" yaml:"jitter"`
+	// Maximum time a check on a single cluster can take, including streaming the results.
+	Timeout duration `json:"timeout" yaml:"timeout"`
+	// Query execution time over which a message is sent, or 0 to never send one.
+	SlowQuery duration `json:"slowQuery" yaml:"slowQuery"`
+	// Whether the script is a streaming script, whose records are evaluated
+	// over a sliding window of Interval every few seconds instead of polling.
+	Streaming bool `json:"streaming" yaml:"streaming"`
+	// Slack channel to send the rule's alerts to.
+	Channel string `json:"channel" yaml:"channel"`
+	// Names of the alerters in the config to send the rule's alerts to,
+	// instead of Channel.
+	Alerters []string `json:"alerters" yaml:"alerters"`
+}
+
+// rulesFile is the format of the file given by RULES_FILE.
+type rulesFile struct {
+	Rules []Rule `json:"rules"`
+}
+
+// loadRules reads the rules from a JSON file. Fields that a rule doesn't set
+// are taken from defaults, and script paths are relative to the file.
+func loadRules(path string, defaults Rule) ([]Rule, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var f rulesFile
+	if err := json.Unmarshal(b, &f); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	if len(f.Rules) == 0 {
+		return nil, fmt.Errorf("%s has no rules", path)
+	}
+
+	if err := prepareRules(f.Rules, defaults, filepath.Dir(path)); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return f.Rules, nil
+}
+
+// prepareRules checks that every rule has a unique name, resolves script
+// paths relative to dir and fills in the fields the rules don't set from defaults.
+func prepareRules(rules []Rule, defaults Rule, dir string) error {
+	names := make(map[string]bool)
+	for i := range rules {
+		r := &rules[i]
+		if r.Name == "" {
+			return fmt.Errorf("rule %d has no name", i)
+		}
+		if names[r.Name] {
+			return fmt.Errorf("duplicate rule %q", r.Name)
+		}
+		names[r.Name] = true
+
+		if r.Script == "" && r.Builtin == "" && r.Source == "" {
+			r.Script = defaults.Script
+		} else if r.Script != "" && !filepath.IsAbs(r.Script) {
+			r.Script = filepath.Join(dir, r.Script)
+		}
+		if err := r.applyDefaults(defaults); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadRulesDir turns every PxL script in dir into a rule named after the
+// script. Each script, such as http_errors.pxl, may have a YAML sidecar
+// (http_errors.yaml) with the rule's other fields. Fields that aren't set in
+// the sidecar are taken from defaults.
+func loadRulesDir(dir string, defaults Rule) ([]Rule, error) {
+	scripts, err := filepath.Glob(filepath.Join(dir, "*.pxl"))
+	if err != nil {
+		return nil, err
+	}
+	if len(scripts) == 0 {
+		return nil, fmt.Errorf("no PxL scripts found in %s", dir)
+	}
+
+	var rules []Rule
+	for _, script := range scripts {
+		base := strings.TrimSuffix(script, ".pxl")
+		r := Rule{Name: filepath.Base(base)}
+		b, err := ioutil.ReadFile(base + ".yaml")
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		if err == nil {
+			if err := yaml.UnmarshalStrict(b, &r); err != nil {
+				return nil, fmt.Errorf("parsing %s.yaml: %w", base, err)
+			}
+		}
+		r.Script = script
+		if err := r.applyDefaults(defaults); err != nil {
+			return nil, fmt.Errorf("%s.yaml: %w", base, err)
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+// applyDefaults sets every field of r that isn't set to its value in
+// defaults. Rules using a built-in script take its table, description and
+// parameters instead.
+func (r *Rule) applyDefaults(defaults Rule) error {
+	if r.Builtin != "" {
+		b, err := lookupBuiltin(r.Builtin)
+		if err != nil {
+			return fmt.Errorf("rule %s: %w", r.Name, err)
+		}
+		if r.Table == "" {
+			r.Table = b.table
+		}
+		if r.Problem == "" {
+			r.Problem = b.problem
+		}
+		if r.Unit == "" {
+			r.Unit = b.unit
+		}
+		if r.Details == nil {
+			r.Details = b.details
+		}
+		r.Streaming = r.Streaming || b.streaming
+		params := make(map[string]string)
+		for k, v := range b.params {
+			params[k] = v
+		}
+		for k, v := range r.Params {
+			params[k] = v
+		}
+		r.Params = params
+	}
+	if r.Table == "" {
+		r.Table = defaults.Table
+	}
+	if r.Problem == "" {
+		r.Problem = defaults.Problem
+	}
+	if r.Unit == "" {
+		r.Unit = defaults.Unit
+	}
+	if r.Details == nil {
+		r.Details = defaults.Details
+	}
+	if r.Namespace == "" && len(r.Namespaces) == 0 {
+		r.Namespace = defaults.Namespace
+		r.Namespaces = defaults.Namespaces
+	}
+	if r.ExcludeNamespaces == nil {
+		r.ExcludeNamespaces = defaults.ExcludeNamespaces
+	}
+	if r.Threshold == 0 {
+		r.Threshold = defaults.Threshold
+	}
+	if r.CriticalThreshold == 0 {
+		r.CriticalThreshold = defaults.CriticalThreshold
+	}
+	if r.Interval.Duration == 0 {
+		r.Interval = defaults.Interval
+	}
+	if r.Timeout.Duration == 0 {
+		r.Timeout = defaults.Timeout
+	}
+	if r.SlowQuery.Duration == 0 {
+		r.SlowQuery = defaults.SlowQuery
+	}
+	if r.Jitter.Duration == 0 {
+		r.Jitter = defaults.Jitter
+	}
+	if r.Channel == "" {
+		r.Channel = defaults.Channel
+	}
+	if r.Alerters == nil {
+		r.Alerters = defaults.Alerters
+	}
+	return nil
+}
+
+// monitoredNamespaces returns the namespaces the rule monitors, or nil for all namespaces.
+func (r *Rule) monitoredNamespaces() []string {
+	var namespaces []string
+	if r.Namespace != "" {
+		namespaces = append(namespaces, r.Namespace)
+	}
+	for _, ns := range r.Namespaces {
+		if ns == "all" {
+			return nil
+		}
+		namespaces = append(namespaces, ns)
+	}
+	return namespaces
+}
+
+// duration is a time.Duration that is encoded in JSON and YAML as a string, such as "5m".
+type duration struct {
+	time.Duration
+}
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	return d.parse(s)
+}
+
+func (d duration) MarshalYAML() (interface{}, error) {
+	return d.String(), nil
+}
+
+func (d *duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	return d.parse(s)
+}
+
+func (d *duration) parse(s string) error {
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	if v <= 0 {
+		return fmt.Errorf("duration must be positive: %q", s)
+	}
+	d.Duration = v
+	return nil
+}
@@ -0,0 +1,143 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// scriptVars are the variables available to PxL script templates, e.g.
+// `{{ .NamespaceRegex }}`.
+type scriptVars struct {
+	// Namespace to monitor, if the rule monitors a single namespace. Kept for
+	// scripts written before rules could monitor several; new scripts should
+	// use NamespaceRegex.
+	Namespace string
+	// Regular expression that matches the names of the monitored namespaces.
+	NamespaceRegex string
+	// Regular expression that matches the names of namespaces not to
+	// monitor, or empty if none are excluded.
+	ExcludeNamespaceRegex string
+	// Start of the time window to query, such as "-300s". The window ends
+	// when the script runs, and starts where the previous check's window ended.
+	StartTime string
+	// Start of the window of the same length before the one queried, such as
+	// "-600s", for scripts that compare the two. It ends at StartTime.
+	PreviousStartTime string
+	// Error rate (0-1) at or above which a service has an incident.
+	ErrorRateThreshold float64
+	// Script specific parameters set by the rule, such as `{{ .Params.latency_ms }}`.
+	Params map[string]string
+}
+
+func newScriptVars(r Rule, window time.Duration) scriptVars {
+	// Round up to whole seconds, so there are no gaps between windows.
+	seconds := int64((window + time.Second - 1) / time.Second)
+	v := scriptVars{
+		NamespaceRegex:        ".*",
+		ExcludeNamespaceRegex: namespaceRegex(r.ExcludeNamespaces),
+		StartTime:             fmt.Sprintf("-%ds", seconds),
+		PreviousStartTime:     fmt.Sprintf("-%ds", 2*seconds),
+		ErrorRateThreshold:    r.Threshold,
+		Params:                r.Params,
+	}
+	if namespaces := r.monitoredNamespaces(); namespaces != nil {
+		v.NamespaceRegex = namespaceRegex(namespaces)
+		if len(namespaces) == 1 {
+			v.Namespace = namespaces[0]
+		}
+	}
+	return v
+}
+
+// namespaceRegex returns a regular expression that matches exactly the given
+// namespace names, or "" if there are none.
+func namespaceRegex(namespaces []string) string {
+	if len(namespaces) == 0 {
+		return ""
+	}
+	quoted := make([]string, len(namespaces))
+	for i, ns := range namespaces {
+		quoted[i] = regexp.QuoteMeta(ns)
+	}
+	return "^(" + strings.Join(quoted, "|") + ")$"
+}
+
+// pxlTemplate is a PxL script with `{{ }}` variables that are filled in
+// each time the script is executed.
+type pxlTemplate struct {
+	tmpl *template.Template
+}
+
+// loadRuleScript loads the rule's PxL script template: either the script at
+// its path, its inline source or a built-in script. Rules that set none use
+// the built-in http-errors script, or http-errors-stream for streaming rules.
+func loadRuleScript(r Rule) (*pxlTemplate, error) {
+	set := 0
+	for _, s := range []string{r.Script, r.Builtin, r.Source} {
+		if s != "" {
+			set++
+		}
+	}
+	if set > 1 {
+		return nil, fmt.Errorf("rule %s sets more than one of a script, a built-in script and an inline source", r.Name)
+	}
+	if r.Script != "" {
+		return loadScript(r.Script)
+	}
+	if r.Source != "" {
+		return parsePxLTemplate(r.Name, r.Source)
+	}
+	if r.Builtin != "" {
+		return loadBuiltinScript(r.Builtin)
+	}
+	if r.Streaming {
+		return loadBuiltinScript("http-errors-stream")
+	}
+	return loadBuiltinScript("http-errors")
+}
+
+// loadScript loads the PxL script template at path.
+func loadScript(path string) (*pxlTemplate, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading PxL script: %w", err)
+	}
+	return parsePxLTemplate(path, string(b))
+}
+
+func parsePxLTemplate(name, src string) (*pxlTemplate, error) {
+	tmpl, err := template.New(name).Option("missingkey=error").Parse(src)
+	if err != nil {
+		return nil, fmt.Errorf("parsing PxL script %s: %w", name, err)
+	}
+	return &pxlTemplate{tmpl: tmpl}, nil
+}
+
+// Render returns the PxL script with the given variables filled in.
+func (t *pxlTemplate) Render(vars scriptVars) (string, error) {
+	var b strings.Builder
+	if err := t.tmpl.Execute(&b, vars); err != nil {
+		return "", fmt.Errorf("rendering PxL script %s: %w", t.tmpl.Name(), err)
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,219 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// ErrSilenceNotFound is returned when a silence ID doesn't match any active silence.
+var ErrSilenceNotFound = errors.New("silence not found")
+
+// Silence mutes messages for every incident it matches until a given time,
+// such as all incidents of a service or namespace during maintenance.
+// Matchers that are empty match everything, but at least one must be set.
+type Silence struct {
+	ID   string `json:"id"`
+	Rule string `json:"rule,omitempty"`
+	// Cluster name or ID.
+	Cluster   string `json:"cluster,omitempty"`
+	Namespace string `json:"namespace,omitempty"`
+	// Service, such as px-sock-shop/orders.
+	Service   string    `json:"service,omitempty"`
+	Until     time.Time `json:"until"`
+	CreatedAt time.Time `json:"createdAt"`
+	CreatedBy string    `json:"createdBy,omitempty"`
+	Comment   string    `json:"comment,omitempty"`
+}
+
+// Matches returns whether the silence applies to an incident.
+func (s *Silence) Matches(inc Incident) bool {
+	namespace := ""
+	if i := strings.IndexByte(inc.Service, '/'); i >= 0 {
+		namespace = inc.Service[:i]
+	}
+	return (s.Rule == "" || s.Rule == inc.Rule) &&
+		(s.Cluster == "" || s.Cluster == inc.Cluster.Name || s.Cluster == inc.Cluster.ID) &&
+		(s.Namespace == "" || s.Namespace == namespace) &&
+		(s.Service == "" || s.Service == inc.Service)
+}
+
+// SilenceStore keeps the silences created through the API.
+type SilenceStore interface {
+	// Add saves a new silence, giving it an ID.
+	Add(ctx context.Context, s *Silence) error
+	// Active returns the silences that haven't expired, oldest first.
+	Active(ctx context.Context, now time.Time) ([]Silence, error)
+	// Delete ends a silence early.
+	Delete(ctx context.Context, id string) error
+}
+
+// silenced returns whether any active silence in store matches inc.
+func silenced(ctx context.Context, store SilenceStore, inc Incident, now time.Time) (bool, error) {
+	silences, err := store.Active(ctx, now)
+	if err != nil {
+		return false, err
+	}
+	for _, s := range silences {
+		if s.Matches(inc) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func newSilenceID() (string, error) {
+	b := make([]byte, 2)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "SIL-" + hex.EncodeToString(b), nil
+}
+
+func sortSilences(silences []Silence) {
+	sort.Slice(silences, func(i, j int) bool {
+		return silences[i].CreatedAt.Before(silences[j].CreatedAt)
+	})
+}
+
+// memorySilences is a SilenceStore that keeps silences in memory.
+type memorySilences struct {
+	mu       sync.Mutex
+	silences map[string]Silence
+}
+
+func newMemorySilences() *memorySilences {
+	return &memorySilences{silences: make(map[string]Silence)}
+}
+
+func (m *memorySilences) Add(ctx context.Context, s *Silence) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for {
+		id, err := newSilenceID()
+		if err != nil {
+			return err
+		}
+		if _, ok := m.silences[id]; !ok {
+			s.ID = id
+			break
+		}
+	}
+	m.silences[s.ID] = *s
+	return nil
+}
+
+func (m *memorySilences) Active(ctx context.Context, now time.Time) ([]Silence, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var active []Silence
+	for id, s := range m.silences {
+		if !now.Before(s.Until) {
+			delete(m.silences, id)
+			continue
+		}
+		active = append(active, s)
+	}
+	sortSilences(active)
+	return active, nil
+}
+
+func (m *memorySilences) Delete(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.silences[id]; !ok {
+		return ErrSilenceNotFound
+	}
+	delete(m.silences, id)
+	return nil
+}
+
+// redisSilences is a SilenceStore that keeps silences in Redis, so that every
+// replica applies them. Silences are kept in a hash of ID to JSON encoded
+// Silence under <prefix>:silences.
+type redisSilences struct {
+	client *redis.Client
+	key    string
+}
+
+func newRedisSilences(m *redisIncidentManager) *redisSilences {
+	return &redisSilences{client: m.client, key: m.prefix + ":silences"}
+}
+
+func (r *redisSilences) Add(ctx context.Context, s *Silence) error {
+	for {
+		id, err := newSilenceID()
+		if err != nil {
+			return err
+		}
+		s.ID = id
+		b, err := json.Marshal(s)
+		if err != nil {
+			return err
+		}
+		added, err := r.client.HSetNX(ctx, r.key, id, b).Result()
+		if err != nil {
+			return err
+		}
+		if added {
+			return nil
+		}
+	}
+}
+
+func (r *redisSilences) Active(ctx context.Context, now time.Time) ([]Silence, error) {
+	all, err := r.client.HGetAll(ctx, r.key).Result()
+	if err != nil {
+		return nil, err
+	}
+	var active []Silence
+	for id, b := range all {
+		var s Silence
+		if err := json.Unmarshal([]byte(b), &s); err != nil {
+			return nil, err
+		}
+		if !now.Before(s.Until) {
+			// Expired silences are cleaned up by whoever sees them first.
+			r.client.HDel(ctx, r.key, id)
+			continue
+		}
+		active = append(active, s)
+	}
+	sortSilences(active)
+	return active, nil
+}
+
+func (r *redisSilences) Delete(ctx context.Context, id string) error {
+	n, err := r.client.HDel(ctx, r.key, id).Result()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrSilenceNotFound
+	}
+	return nil
+}
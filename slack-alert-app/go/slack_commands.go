@@ -0,0 +1,125 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/slack-go/slack"
+)
+
+// Largest slash command request read, which are a few hundred bytes.
+const maxSlackCommandSize = 64 << 10
+
+const slackCommandUsage = "Usage: `ack <incident ID>` or `silence <incident ID> [duration, such as 2h]`."
+
+// slackCommandResponse is the reply to a slash command. In-channel replies
+// are seen by everyone in the channel, and ephemeral ones only by the user
+// who sent the command.
+type slackCommandResponse struct {
+	ResponseType string `json:"response_type"`
+	Text         string `json:"text"`
+}
+
+// handleSlackCommand acknowledges or silences an incident from a Slack
+// slash command, such as /pixie ack INC-7f3a9c21 or /pixie silence
+// INC-7f3a9c21 2h. Requests must be signed with the Slack app's signing
+// secret, instead of sending the API token.
+func (a *apiServer) handleSlackCommand(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxSlackCommandSize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	verifier, err := slack.NewSecretsVerifier(r.Header, a.slackSigningSecret)
+	if err == nil {
+		verifier.Write(body)
+		err = verifier.Ensure()
+	}
+	if err != nil {
+		logWarn("Rejected Slack command with an invalid signature.", "remote_addr", r.RemoteAddr, "error", err)
+		http.Error(w, "invalid Slack signature", http.StatusUnauthorized)
+		return
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	cmd, err := slack.SlashCommandParse(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	text, inChannel := a.runSlackCommand(r, cmd)
+	resp := slackCommandResponse{ResponseType: "ephemeral", Text: text}
+	if inChannel {
+		resp.ResponseType = "in_channel"
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// runSlackCommand runs a slash command and returns the reply, and whether
+// everyone in the channel should see it.
+func (a *apiServer) runSlackCommand(r *http.Request, cmd slack.SlashCommand) (string, bool) {
+	args := strings.Fields(cmd.Text)
+	if len(args) < 2 || len(args) > 3 || (args[0] != "silence" && len(args) > 2) {
+		return slackCommandUsage, false
+	}
+	id := normalizeID(args[1])
+	// Slack only sends IDs of its own users, so mentioning one is safe.
+	by := fmt.Sprintf("<@%s>", cmd.UserID)
+	var msg string
+	var err error
+	switch args[0] {
+	case "ack":
+		_, err = a.incidents.Ack(r.Context(), id)
+		msg = fmt.Sprintf("*[%s]* acknowledged by %s.", id, by)
+	case "silence":
+		d := defaultIncidentSilence
+		if len(args) == 3 {
+			d, err = time.ParseDuration(args[2])
+			if err != nil || d <= 0 {
+				return fmt.Sprintf("Invalid duration %s. %s", formatName(args[2]), slackCommandUsage), false
+			}
+		}
+		_, err = a.incidents.Silence(r.Context(), id, time.Now().Add(d))
+		msg = fmt.Sprintf("*[%s]* silenced for %s by %s.", id, d, by)
+	default:
+		return slackCommandUsage, false
+	}
+	if errors.Is(err, ErrIncidentNotFound) {
+		return fmt.Sprintf("No incident %s.", formatName(id)), false
+	}
+	if err != nil {
+		logError("Error running Slack command.", "command", args[0], "incident", id, "user", cmd.UserID, "error", err)
+		return "Something went wrong, see the bot's logs.", false
+	}
+	logInfo("Ran Slack command.", "command", args[0], "incident", id, "user", cmd.UserID, "user_name", cmd.UserName)
+	return msg, true
+}
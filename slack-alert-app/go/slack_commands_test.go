@@ -0,0 +1,111 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// slackCommandRequest returns a slash command request signed with secret,
+// the way Slack signs them.
+func slackCommandRequest(secret, text string) *http.Request {
+	body := url.Values{"command": {"/pixie"}, "text": {text}, "user_id": {"U123"}, "user_name": {"alice"}}.Encode()
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("v0:" + ts + ":" + body))
+	r := httptest.NewRequest(http.MethodPost, "/slack/commands", strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Set("X-Slack-Request-Timestamp", ts)
+	r.Header.Set("X-Slack-Signature", "v0="+hex.EncodeToString(mac.Sum(nil)))
+	return r
+}
+
+func TestSlackCommands(t *testing.T) {
+	ctx := context.Background()
+	incidents := newMemoryIncidentManager()
+	events, err := incidents.Update(ctx, "http-errors", Cluster{ID: "c1", Name: "prod"}, []IncidentData{{Service: "orders", ErrorCount: 40, TotalRequests: 100}}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := events[0].Incident.ID
+	a := &apiServer{incidents: incidents, silences: newMemorySilences(), alerter: &CaptureAlerter{}, token: "api-token", slackSigningSecret: "secret"}
+
+	run := func(r *http.Request) (int, slackCommandResponse) {
+		w := httptest.NewRecorder()
+		a.Handler().ServeHTTP(w, r)
+		var resp slackCommandResponse
+		if w.Code == http.StatusOK {
+			if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return w.Code, resp
+	}
+
+	if code, _ := run(slackCommandRequest("wrong", "ack "+id)); code != http.StatusUnauthorized {
+		t.Errorf("got status %d for a wrong signature, want %d", code, http.StatusUnauthorized)
+	}
+	if inc, _ := incidents.Get(ctx, id); inc.Acked {
+		t.Fatal("incident acknowledged by a command with a wrong signature")
+	}
+
+	// IDs are accepted in any case, as people type them.
+	_, resp := run(slackCommandRequest("secret", "ack "+strings.ToUpper(id)))
+	if resp.ResponseType != "in_channel" || !strings.Contains(resp.Text, "acknowledged by <@U123>") {
+		t.Errorf("got reply %+v, want an acknowledgement in the channel", resp)
+	}
+	if inc, _ := incidents.Get(ctx, id); !inc.Acked {
+		t.Error("incident wasn't acknowledged")
+	}
+
+	_, resp = run(slackCommandRequest("secret", "silence "+id+" 2h"))
+	if resp.ResponseType != "in_channel" || !strings.Contains(resp.Text, "silenced for 2h0m0s") {
+		t.Errorf("got reply %+v, want a silence in the channel", resp)
+	}
+	if inc, _ := incidents.Get(ctx, id); time.Until(inc.SilencedUntil) < time.Hour {
+		t.Errorf("incident silenced until %s, want in 2h", inc.SilencedUntil)
+	}
+
+	for _, text := range []string{"", "help", "ack", "ack " + id + " 2h", "silence " + id + " forever", "ack INC-00000000"} {
+		if _, resp := run(slackCommandRequest("secret", text)); resp.ResponseType != "ephemeral" {
+			t.Errorf("%q: got reply %+v, want an ephemeral one", text, resp)
+		}
+	}
+}
+
+func TestNormalizeID(t *testing.T) {
+	for in, want := range map[string]string{
+		"INC-7f3a9c21": "INC-7f3a9c21",
+		"inc-7F3A9C21": "INC-7f3a9c21",
+		"sil-1C2D":     "SIL-1c2d",
+	} {
+		if got := normalizeID(in); got != want {
+			t.Errorf("normalizeID(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
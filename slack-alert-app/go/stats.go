@@ -0,0 +1,84 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// serviceStats is what a check found for a single service, exported to
+// metrics backends so that dashboards show the same data the bot alerts on.
+type serviceStats struct {
+	Service       string
+	ErrorCount    int64
+	TotalRequests int64
+	// Error rate of the whole service.
+	ErrorRate float64
+	// Highest error rate of any of the service's endpoints.
+	MaxError float64
+	// Percentage (0-100) of the service's endpoints at or above the rule's threshold.
+	PercentExceedThreshold float64
+}
+
+// statsBatch is the stats of every service from one check on one cluster.
+type statsBatch struct {
+	Rule    string
+	Cluster Cluster
+	// End of the window the check queried.
+	Time     time.Time
+	Services []serviceStats
+	// Number of open incidents of the rule on the cluster after the check.
+	OpenIncidents int
+}
+
+// StatsSink exports the per-service stats of each check.
+type StatsSink interface {
+	WriteStats(ctx context.Context, b *statsBatch) error
+}
+
+// summarizeServices rolls up per-endpoint stats into serviceStats, in the
+// order each service first appears. over reports whether an endpoint is at
+// or above the rule's threshold.
+func summarizeServices(stats []IncidentData, over func(IncidentData) bool) []serviceStats {
+	rollups, endpoints := groupByService(stats)
+	services := make([]serviceStats, len(rollups))
+	for i, d := range rollups {
+		s := serviceStats{
+			Service:       d.Service,
+			ErrorCount:    d.ErrorCount,
+			TotalRequests: d.TotalRequests,
+			ErrorRate:     d.ErrorRate(),
+			MaxError:      d.ErrorRate(),
+		}
+		if eps := endpoints[d.Service]; len(eps) > 0 {
+			// Endpoints are sorted from highest to lowest error rate.
+			s.MaxError = eps[0].ErrorRate()
+			n := 0
+			for _, e := range eps {
+				if over(e) {
+					n++
+				}
+			}
+			s.PercentExceedThreshold = 100 * float64(n) / float64(len(eps))
+		} else if over(d) {
+			s.PercentExceedThreshold = 100
+		}
+		services[i] = s
+	}
+	return services
+}
@@ -0,0 +1,122 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const (
+	// Tags are sent in the DogStatsD format, as understood by the Datadog
+	// agent and Telegraf.
+	statsdFormatDogStatsD = "dogstatsd"
+	// Tags are appended to the metric name, for StatsD servers without tag support.
+	statsdFormatStatsD = "statsd"
+)
+
+// Largest UDP packet sent, which fits in a typical MTU without fragmenting.
+const statsdMaxPacket = 1432
+
+// statsdSink sends the stats of each check as gauges to a StatsD or
+// DogStatsD server over UDP. Each service gets these gauges, tagged with the
+// rule, cluster and service:
+//
+//	<prefix>service.error_rate
+//	<prefix>service.max_error
+//	<prefix>service.percent_exceed_threshold
+//	<prefix>service.requests
+//	<prefix>service.errors
+//
+// along with <prefix>incidents.open for the rule on the cluster.
+type statsdSink struct {
+	addr   string
+	prefix string
+	format string
+}
+
+func newStatsDSink(cfg StatsDConfig) *statsdSink {
+	return &statsdSink{addr: cfg.Addr, prefix: cfg.Prefix, format: cfg.Format}
+}
+
+func (s *statsdSink) WriteStats(ctx context.Context, b *statsBatch) error {
+	var lines []string
+	for _, svc := range b.Services {
+		tags := [][2]string{{"rule", b.Rule}, {"cluster", b.Cluster.Name}, {"service", svc.Service}}
+		lines = append(lines,
+			s.gauge("service.error_rate", svc.ErrorRate, tags),
+			s.gauge("service.max_error", svc.MaxError, tags),
+			s.gauge("service.percent_exceed_threshold", svc.PercentExceedThreshold, tags),
+			s.gauge("service.requests", float64(svc.TotalRequests), tags),
+			s.gauge("service.errors", float64(svc.ErrorCount), tags))
+	}
+	lines = append(lines, s.gauge("incidents.open", float64(b.OpenIncidents), [][2]string{{"rule", b.Rule}, {"cluster", b.Cluster.Name}}))
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", s.addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	// Pack as many lines into each packet as fit.
+	var packet bytes.Buffer
+	for _, line := range lines {
+		if packet.Len() > 0 && packet.Len()+1+len(line) > statsdMaxPacket {
+			if _, err := conn.Write(packet.Bytes()); err != nil {
+				return err
+			}
+			packet.Reset()
+		}
+		if packet.Len() > 0 {
+			packet.WriteByte('\n')
+		}
+		packet.WriteString(line)
+	}
+	_, err = conn.Write(packet.Bytes())
+	return err
+}
+
+// gauge formats a gauge in the sink's format, such as
+// "pixie.service.error_rate:0.25|g|#rule:http-errors,service:px-sock-shop/orders".
+func (s *statsdSink) gauge(name string, v float64, tags [][2]string) string {
+	value := strconv.FormatFloat(v, 'f', -1, 64)
+	if s.format == statsdFormatStatsD {
+		parts := []string{s.prefix + name}
+		for _, t := range tags {
+			parts = append(parts, statsdNameSanitizer.Replace(t[1]))
+		}
+		return fmt.Sprintf("%s:%s|g", strings.Join(parts, "."), value)
+	}
+	pairs := make([]string, len(tags))
+	for i, t := range tags {
+		pairs[i] = t[0] + ":" + statsdTagSanitizer.Replace(t[1])
+	}
+	return fmt.Sprintf("%s%s:%s|g|#%s", s.prefix, name, value, strings.Join(pairs, ","))
+}
+
+var (
+	// Tag values can't contain the characters that separate tags and fields.
+	statsdTagSanitizer = strings.NewReplacer(",", "_", "|", "_", "#", "_", "\n", "_")
+	// Name segments can't contain dots, which separate segments, or any of
+	// the characters that separate fields. Slashes are replaced too, so that
+	// px-sock-shop/orders becomes px-sock-shop_orders.
+	statsdNameSanitizer = strings.NewReplacer(".", "_", ":", "_", "|", "_", "@", "_", "/", "_", " ", "_", "\n", "_")
+)
@@ -0,0 +1,142 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// listenStatsD returns the address of a UDP server and a function that
+// returns the packets it has received once want lines have arrived.
+func listenStatsD(t *testing.T) (string, func(want int) []string) {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn.LocalAddr().String(), func(want int) []string {
+		var packets []string
+		lines := 0
+		buf := make([]byte, 64<<10)
+		for lines < want {
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			n, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				t.Fatalf("got %d of %d lines: %v", lines, want, err)
+			}
+			packets = append(packets, string(buf[:n]))
+			lines += strings.Count(string(buf[:n]), "\n") + 1
+		}
+		return packets
+	}
+}
+
+func TestStatsDSink(t *testing.T) {
+	b := testStatsBatch()
+	for _, tt := range []struct {
+		format string
+		want   []string
+	}{
+		{
+			format: statsdFormatDogStatsD,
+			want: []string{
+				"pixie.service.error_rate:0.3|g|#rule:http-errors,cluster:prod,service:px-sock-shop/orders",
+				"pixie.service.max_error:0.5|g|#rule:http-errors,cluster:prod,service:px-sock-shop/orders",
+				"pixie.service.percent_exceed_threshold:50|g|#rule:http-errors,cluster:prod,service:px-sock-shop/orders",
+				"pixie.service.requests:100|g|#rule:http-errors,cluster:prod,service:px-sock-shop/orders",
+				"pixie.service.errors:30|g|#rule:http-errors,cluster:prod,service:px-sock-shop/orders",
+				"pixie.service.error_rate:0|g|#rule:http-errors,cluster:prod,service:px-sock-shop/carts",
+				"pixie.service.max_error:0|g|#rule:http-errors,cluster:prod,service:px-sock-shop/carts",
+				"pixie.service.percent_exceed_threshold:0|g|#rule:http-errors,cluster:prod,service:px-sock-shop/carts",
+				"pixie.service.requests:40|g|#rule:http-errors,cluster:prod,service:px-sock-shop/carts",
+				"pixie.service.errors:0|g|#rule:http-errors,cluster:prod,service:px-sock-shop/carts",
+				"pixie.incidents.open:1|g|#rule:http-errors,cluster:prod",
+			},
+		},
+		{
+			format: statsdFormatStatsD,
+			want: []string{
+				"pixie.service.error_rate.http-errors.prod.px-sock-shop_orders:0.3|g",
+				"pixie.service.max_error.http-errors.prod.px-sock-shop_orders:0.5|g",
+				"pixie.service.percent_exceed_threshold.http-errors.prod.px-sock-shop_orders:50|g",
+				"pixie.service.requests.http-errors.prod.px-sock-shop_orders:100|g",
+				"pixie.service.errors.http-errors.prod.px-sock-shop_orders:30|g",
+				"pixie.service.error_rate.http-errors.prod.px-sock-shop_carts:0|g",
+				"pixie.service.max_error.http-errors.prod.px-sock-shop_carts:0|g",
+				"pixie.service.percent_exceed_threshold.http-errors.prod.px-sock-shop_carts:0|g",
+				"pixie.service.requests.http-errors.prod.px-sock-shop_carts:40|g",
+				"pixie.service.errors.http-errors.prod.px-sock-shop_carts:0|g",
+				"pixie.incidents.open.http-errors.prod:1|g",
+			},
+		},
+	} {
+		addr, received := listenStatsD(t)
+		s := newStatsDSink(StatsDConfig{Addr: addr, Prefix: "pixie.", Format: tt.format})
+		if err := s.WriteStats(context.Background(), b); err != nil {
+			t.Fatal(err)
+		}
+		packets := received(len(tt.want))
+		if len(packets) != 1 {
+			t.Errorf("%s: sent %d packets, want the lines in one", tt.format, len(packets))
+		}
+		if got := strings.Split(strings.Join(packets, "\n"), "\n"); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got\n%s\nwant\n%s", tt.format, strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+		}
+	}
+}
+
+func TestStatsDSinkPackets(t *testing.T) {
+	b := testStatsBatch()
+	b.Services = nil
+	for i := 0; i < 100; i++ {
+		b.Services = append(b.Services, serviceStats{Service: fmt.Sprintf("px-sock-shop/service-%d", i), TotalRequests: 10})
+	}
+	addr, received := listenStatsD(t)
+	if err := newStatsDSink(StatsDConfig{Addr: addr, Format: statsdFormatDogStatsD}).WriteStats(context.Background(), b); err != nil {
+		t.Fatal(err)
+	}
+	want := 5*len(b.Services) + 1
+	packets := received(want)
+	if len(packets) < 2 {
+		t.Errorf("sent %d packets, want the lines split across several", len(packets))
+	}
+	for _, p := range packets {
+		if len(p) > statsdMaxPacket {
+			t.Errorf("sent a %d byte packet, want at most %d", len(p), statsdMaxPacket)
+		}
+		if strings.HasPrefix(p, "\n") || strings.HasSuffix(p, "\n") || strings.Contains(p, "\n\n") {
+			t.Errorf("packet has empty lines: %q", p)
+		}
+	}
+}
+
+func TestStatsDGaugeSanitized(t *testing.T) {
+	tags := [][2]string{{"service", "ns/a|b,c#d"}}
+	if got, want := (&statsdSink{format: statsdFormatDogStatsD}).gauge("x", 1, tags), "x:1|g|#service:ns/a_b_c_d"; got != want {
+		t.Errorf("DogStatsD gauge %q, want %q", got, want)
+	}
+	if got, want := (&statsdSink{format: statsdFormatStatsD}).gauge("x", 1, [][2]string{{"service", "ns/a.b:c"}}), "x.ns_a_b_c:1|g"; got != want {
+		t.Errorf("StatsD gauge %q, want %q", got, want)
+	}
+}
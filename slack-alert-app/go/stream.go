@@ -0,0 +1,298 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"go.withpixie.dev/pixie/src/api/go/pxapi/types"
+)
+
+// streamEvalInterval is how often a streaming rule's sliding window is evaluated.
+const streamEvalInterval = 10 * time.Second
+
+// streamEvent is a single HTTP request output by a streaming PxL script.
+type streamEvent struct {
+	Time     time.Time `px:"time_"`
+	Service  string    `px:"service"`
+	Endpoint string    `px:"endpoint,optional"`
+	Failed   bool      `px:"error"`
+}
+
+type endpointKey struct {
+	service  string
+	endpoint string
+}
+
+// slidingWindow counts the requests and errors of each endpoint over the
+// last window, in one second buckets.
+type slidingWindow struct {
+	window time.Duration
+
+	mu sync.Mutex
+	// Keyed by Unix time in seconds.
+	buckets map[int64]map[endpointKey]*IncidentData
+}
+
+func newSlidingWindow(window time.Duration) *slidingWindow {
+	return &slidingWindow{window: window, buckets: make(map[int64]map[endpointKey]*IncidentData)}
+}
+
+func (w *slidingWindow) Add(e streamEvent) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	sec := e.Time.Unix()
+	b, ok := w.buckets[sec]
+	if !ok {
+		b = make(map[endpointKey]*IncidentData)
+		w.buckets[sec] = b
+	}
+	k := endpointKey{service: e.Service, endpoint: e.Endpoint}
+	d, ok := b[k]
+	if !ok {
+		d = &IncidentData{Service: e.Service, Endpoint: e.Endpoint}
+		b[k] = d
+	}
+	d.TotalRequests++
+	if e.Failed {
+		d.ErrorCount++
+	}
+}
+
+// Reset drops every bucket.
+func (w *slidingWindow) Reset() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.buckets = make(map[int64]map[endpointKey]*IncidentData)
+}
+
+// Stats drops the buckets that have fallen out of the window and returns the
+// stats of each endpoint over the rest, sorted by service and endpoint.
+func (w *slidingWindow) Stats(now time.Time) []IncidentData {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	start := now.Add(-w.window).Unix()
+	totals := make(map[endpointKey]*IncidentData)
+	for sec, b := range w.buckets {
+		if sec <= start {
+			delete(w.buckets, sec)
+			continue
+		}
+		for k, d := range b {
+			t, ok := totals[k]
+			if !ok {
+				t = &IncidentData{Service: d.Service, Endpoint: d.Endpoint}
+				totals[k] = t
+			}
+			t.ErrorCount += d.ErrorCount
+			t.TotalRequests += d.TotalRequests
+		}
+	}
+
+	stats := make([]IncidentData, 0, len(totals))
+	for _, d := range totals {
+		stats = append(stats, *d)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Service != stats[j].Service {
+			return stats[i].Service < stats[j].Service
+		}
+		return stats[i].Endpoint < stats[j].Endpoint
+	})
+	return stats
+}
+
+// streamHandler feeds the records of a streaming table into a sliding
+// window. Records that can't be decoded are skipped and counted, and only the
+// first is logged, since streams run for a long time.
+type streamHandler struct {
+	window  *slidingWindow
+	rule    string
+	cluster *cluster
+
+	malformed int
+}
+
+func (h *streamHandler) HandleInit(ctx context.Context, metadata types.TableMetadata) error {
+	return validateSchema(metadata, &streamEvent{})
+}
+
+func (h *streamHandler) HandleRecord(ctx context.Context, r *types.Record) error {
+	var e streamEvent
+	if err := decodeRecord(r, &e); err != nil {
+		if h.malformed == 0 {
+			logWarn("Skipping stream records that can't be decoded.", "rule", h.rule, "cluster", h.cluster.Name, "cluster_id", h.cluster.ID, "error", err)
+		}
+		h.malformed++
+		metricMalformedRecords.Inc(h.rule, h.cluster.Name)
+		return nil
+	}
+	h.window.Add(e)
+	return nil
+}
+
+func (h *streamHandler) HandleDone(ctx context.Context) error {
+	return nil
+}
+
+// Stream runs a streaming rule until ctx is cancelled. Each cluster gets a
+// long-running query whose records feed a sliding window of the rule's
+// interval, which is evaluated every few seconds instead of once per interval.
+// Clusters are picked up, and the streams of removed clusters stopped, once
+// per interval. A renamed cluster is a new *cluster, so its stream is
+// restarted under the new name.
+func (s *ServiceTracker) Stream(ctx context.Context) {
+	ticker := time.NewTicker(s.rule.Interval.Duration)
+	defer ticker.Stop()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	type stream struct {
+		cluster *cluster
+		cancel  context.CancelFunc
+	}
+	streaming := make(map[string]stream)
+	for {
+		clusters, err := s.clusters.Clusters(ctx)
+		if err != nil {
+			logError("Error listing clusters.", "rule", s.rule.Name, "error", err)
+		} else {
+			listed := make(map[string]bool, len(clusters))
+			for _, c := range clusters {
+				listed[c.ID] = true
+			}
+			for id, st := range streaming {
+				if !listed[id] {
+					logInfo("Stopping PxL stream of removed cluster.", "rule", s.rule.Name, "cluster", st.cluster.Name, "cluster_id", id)
+					st.cancel()
+					delete(streaming, id)
+				}
+			}
+		}
+		for _, c := range clusters {
+			if st, ok := streaming[c.ID]; ok {
+				if st.cluster == c {
+					continue
+				}
+				st.cancel()
+			}
+			streamCtx, cancel := context.WithCancel(ctx)
+			streaming[c.ID] = stream{cluster: c, cancel: cancel}
+			wg.Add(1)
+			go func(c *cluster) {
+				defer wg.Done()
+				s.streamCluster(streamCtx, c)
+			}(c)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// streamCluster keeps a streaming query running on a cluster, restarting it
+// with backoff when it fails, and evaluates its window until ctx is cancelled.
+func (s *ServiceTracker) streamCluster(ctx context.Context, c *cluster) {
+	window := newSlidingWindow(s.rule.Interval.Duration)
+
+	evalCtx, stopEval := context.WithCancel(ctx)
+	defer stopEval()
+	go func() {
+		ticker := time.NewTicker(streamEvalInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-evalCtx.Done():
+				return
+			case <-ticker.C:
+			}
+			// Standby replicas keep their window up to date, so they can take over right away.
+			if !s.leader.IsLeader() {
+				continue
+			}
+			err := recoverPanic(func() error {
+				_, err := s.evaluate(evalCtx, c, window.Stats(time.Now()))
+				return err
+			})
+			if err != nil {
+				logError("Error evaluating stream.", "rule", s.rule.Name, "cluster", c.Name, "cluster_id", c.ID, "error", err)
+			}
+		}
+	}()
+
+	delay := s.retry.initialDelay
+	for {
+		start := time.Now()
+		err := recoverPanic(func() error { return s.runStream(ctx, c, window) })
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			err = c.handleError(ctx, err)
+		}
+		// Reset the backoff if the stream ran for a while before ending.
+		if time.Since(start) > s.rule.Interval.Duration {
+			delay = s.retry.initialDelay
+		}
+		logWarn("Stream ended, restarting.", "rule", s.rule.Name, "cluster", c.Name, "cluster_id", c.ID, "delay", delay, "error", err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > s.retry.maxDelay {
+			delay = s.retry.maxDelay
+		}
+	}
+}
+
+// runStream executes the rule's streaming script on a cluster and blocks until the stream ends.
+func (s *ServiceTracker) runStream(ctx context.Context, c *cluster, window *slidingWindow) error {
+	pxl, err := s.script.Render(newScriptVars(s.rule, s.rule.Interval.Duration))
+	if err != nil {
+		return err
+	}
+	exec, err := c.scriptExecutor(ctx)
+	if err != nil {
+		return err
+	}
+
+	// The script starts with the requests from the last window, which would
+	// be counted twice after a restart.
+	window.Reset()
+	tm := newTableMux()
+	tm.Handle(s.rule.Table, &streamHandler{window: window, rule: s.rule.Name, cluster: c})
+	logInfo("Starting PxL stream.", "rule", s.rule.Name, "cluster", c.Name, "cluster_id", c.ID)
+	resultSet, err := exec.ExecuteScript(ctx, pxl, tm)
+	if err != nil {
+		return err
+	}
+	defer resultSet.Close()
+	if err := resultSet.Stream(); err != nil {
+		return fmt.Errorf("streaming results: %w", err)
+	}
+	return nil
+}
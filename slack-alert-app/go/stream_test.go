@@ -0,0 +1,168 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.withpixie.dev/pixie/src/api/go/pxapi"
+	"go.withpixie.dev/pixie/src/api/go/pxapi/types"
+)
+
+// blockingExecutor runs scripts whose results stream until they are
+// cancelled, counting the running streams of each cluster name.
+type blockingExecutor struct {
+	name    string
+	mu      *sync.Mutex
+	running map[string]int
+}
+
+func (e *blockingExecutor) ExecuteScript(ctx context.Context, pxl string, mux pxapi.TableMuxer) (ScriptResults, error) {
+	e.mu.Lock()
+	e.running[e.name]++
+	e.mu.Unlock()
+	return &blockingResults{ctx: ctx, exec: e}, nil
+}
+
+type blockingResults struct {
+	ctx  context.Context
+	exec *blockingExecutor
+}
+
+func (r *blockingResults) Stream() error {
+	<-r.ctx.Done()
+	return r.ctx.Err()
+}
+
+func (r *blockingResults) Close() error {
+	r.exec.mu.Lock()
+	r.exec.running[r.exec.name]--
+	r.exec.mu.Unlock()
+	return nil
+}
+
+func (r *blockingResults) Stats() *pxapi.ResultsStats {
+	return nil
+}
+
+// swappableClusters is a clusterSource whose clusters can be changed while
+// it is used.
+type swappableClusters struct {
+	mu       sync.Mutex
+	clusters []*cluster
+}
+
+func (s *swappableClusters) Clusters(ctx context.Context) ([]*cluster, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.clusters, nil
+}
+
+func (s *swappableClusters) set(clusters ...*cluster) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.clusters = clusters
+}
+
+func TestStreamStopsRemovedAndRenamedClusters(t *testing.T) {
+	var mu sync.Mutex
+	running := make(map[string]int)
+	newTestCluster := func(id, name string) *cluster {
+		return &cluster{Cluster: Cluster{ID: id, Name: name}, executor: &blockingExecutor{name: name, mu: &mu, running: running}}
+	}
+	script, err := parsePxLTemplate("stream", `px.display(df.stream(), "http_events")`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clusters := &swappableClusters{}
+	clusters.set(newTestCluster("1", "prod"), newTestCluster("2", "staging"))
+	s := &ServiceTracker{
+		rule:     Rule{Name: "http-errors", Table: "http_events", Interval: duration{10 * time.Millisecond}},
+		script:   script,
+		clusters: clusters,
+		retry:    retryPolicy{initialDelay: time.Millisecond, maxDelay: time.Millisecond},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.Stream(ctx)
+	}()
+
+	waitFor := func(want map[string]int) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			mu.Lock()
+			ok := len(running) >= len(want)
+			for name, n := range running {
+				if n != want[name] {
+					ok = false
+				}
+			}
+			got := make(map[string]int, len(running))
+			for name, n := range running {
+				got[name] = n
+			}
+			mu.Unlock()
+			if ok {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("got running streams %v, want %v", got, want)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	waitFor(map[string]int{"prod": 1, "staging": 1})
+	// Cluster 2 is removed and cluster 1 is renamed.
+	clusters.set(newTestCluster("1", "production"))
+	waitFor(map[string]int{"prod": 0, "staging": 0, "production": 1})
+
+	cancel()
+	<-done
+	waitFor(map[string]int{"prod": 0, "staging": 0, "production": 0})
+}
+
+func TestStreamHandlerSkipsMalformedRecords(t *testing.T) {
+	logs := captureLogs(t)
+	ctx := context.Background()
+	now := time.Now()
+	h := &streamHandler{window: newSlidingWindow(time.Minute), rule: "http-errors", cluster: &cluster{Cluster: Cluster{ID: "prod-id", Name: "prod"}}}
+	event := func(failed interface{}) *types.Record {
+		return testRecord(testColumn{"time_", now}, testColumn{"service", "px-sock-shop/orders"}, testColumn{"endpoint", "/orders"}, testColumn{"error", failed})
+	}
+	for _, r := range []*types.Record{event(true), event("yes"), event(false), event("no"), event("maybe")} {
+		if err := h.HandleRecord(ctx, r); err != nil {
+			t.Fatalf("HandleRecord: %v", err)
+		}
+	}
+	if h.malformed != 3 {
+		t.Errorf("got %d malformed records, want 3", h.malformed)
+	}
+	if n := strings.Count(logs(), "Skipping stream records that can't be decoded."); n != 1 {
+		t.Errorf("logged the skipped records %d times, want only the first:\n%s", n, logs())
+	}
+	stats := h.window.Stats(now)
+	if len(stats) != 1 || stats[0].ErrorCount != 1 || stats[0].TotalRequests != 2 {
+		t.Errorf("got stats %+v, want the 2 records that could be decoded", stats)
+	}
+}
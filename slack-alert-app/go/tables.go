@@ -0,0 +1,340 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.withpixie.dev/pixie/src/api/go/pxapi"
+	"go.withpixie.dev/pixie/src/api/go/pxapi/types"
+)
+
+// errTableUnfinished is returned for a table whose results stopped
+// streaming before the whole table was sent.
+var errTableUnfinished = errors.New("table never finished streaming")
+
+// missingTableError is returned when a script's results finished streaming
+// without the table a rule expects, which usually means the rule's table or
+// script is wrong. A table that was output with no rows is fine, since it
+// just means there is nothing to alert on.
+type missingTableError struct {
+	table string
+	// Names of the tables the script did output.
+	received []string
+}
+
+func (e *missingTableError) Error() string {
+	if len(e.received) == 0 {
+		return fmt.Sprintf("PxL script did not output table %q, or any other table", e.table)
+	}
+	return fmt.Sprintf("PxL script did not output table %q, only %s", e.table, quoteAll(e.received))
+}
+
+func quoteAll(names []string) string {
+	quoted := make([]string, len(names))
+	for i, n := range names {
+		quoted[i] = fmt.Sprintf("%q", n)
+	}
+	return strings.Join(quoted, ", ")
+}
+
+// maxTableRecords is the most records a tableCollector keeps. Exported rules
+// keep every record, so this bounds the memory a script that outputs far more
+// rows than expected can take.
+const maxTableRecords = 100000
+
+// Implement the TableRecordHandler interface to processes the PxL script output table record-wise.
+// It turns each record into the IncidentData for a service endpoint, and only
+// those that are kept are held in memory, up to maxTableRecords. Records that
+// can't be decoded, such as a string where a number is expected, are skipped
+// and counted instead of failing the whole table.
+type tableCollector struct {
+	// Reports whether to keep a record. If nil, every record is kept.
+	keep func(IncidentData) bool
+	// Columns to keep as the details of each record.
+	details []string
+
+	stats []IncidentData
+	// Number of records handled, including malformed ones.
+	records int
+	// Number of records that would have been kept past maxTableRecords.
+	dropped int
+	// Number of records skipped because they couldn't be decoded, and the
+	// error from the first of them.
+	malformed    int
+	malformedErr error
+	// Closed by HandleDone, once the whole table has been received.
+	finished chan struct{}
+}
+
+// newTableCollector returns a collector that keeps the records keep returns
+// true for, along with the given detail columns.
+func newTableCollector(keep func(IncidentData) bool, details []string) *tableCollector {
+	return &tableCollector{
+		keep:     keep,
+		details:  details,
+		finished: make(chan struct{}),
+	}
+}
+
+// HandleInit checks that the table has the columns needed for IncidentData, so
+// that changes to the PxL script's output fail with a clear error.
+func (t *tableCollector) HandleInit(ctx context.Context, metadata types.TableMetadata) error {
+	return validateSchema(metadata, &IncidentData{})
+}
+
+func (t *tableCollector) HandleRecord(ctx context.Context, r *types.Record) error {
+	t.records++
+	var d IncidentData
+	if err := decodeRecord(r, &d); err != nil {
+		t.malformed++
+		if t.malformedErr == nil {
+			t.malformedErr = err
+		}
+		return nil
+	}
+	if t.keep != nil && !t.keep(d) {
+		return nil
+	}
+	if len(t.stats) >= maxTableRecords {
+		t.dropped++
+		return nil
+	}
+	d.Details = recordDetails(r, t.details)
+	t.stats = append(t.stats, d)
+	return nil
+}
+
+// recordDetails returns the values of the given columns of a record. Columns
+// the table doesn't have are left out.
+func recordDetails(r *types.Record, columns []string) []IncidentDetail {
+	var details []IncidentDetail
+	for _, col := range columns {
+		d := r.GetDatum(col)
+		if d == nil {
+			continue
+		}
+		var v string
+		switch d := d.(type) {
+		case *types.Float64Value:
+			if f := d.Value(); f == math.Trunc(f) || math.Abs(f) >= 100 {
+				v = strconv.FormatFloat(f, 'f', 0, 64)
+			} else {
+				v = strconv.FormatFloat(f, 'g', 3, 64)
+			}
+		case *types.Time64NSValue:
+			v = d.Value().UTC().Format(time.RFC3339)
+		default:
+			v = d.String()
+		}
+		details = append(details, IncidentDetail{Name: col, Value: v})
+	}
+	return details
+}
+
+func (t *tableCollector) HandleDone(ctx context.Context) error {
+	close(t.finished)
+	return nil
+}
+
+// Records returns the number of records in the table, including malformed
+// ones. It must only be called once the table has finished streaming.
+func (t *tableCollector) Records() int {
+	return t.records
+}
+
+// Malformed returns the number of records that were skipped because they
+// couldn't be decoded, and the error from the first of them. It must only be
+// called once the table has finished streaming.
+func (t *tableCollector) Malformed() (int, error) {
+	return t.malformed, t.malformedErr
+}
+
+// Dropped returns the number of records that weren't kept because
+// maxTableRecords had already been kept. It must only be called once the
+// table has finished streaming.
+func (t *tableCollector) Dropped() int {
+	return t.dropped
+}
+
+// GetTableDataSync returns the records of the table that were kept. It's
+// called once the script's results have finished streaming, so a table that
+// hasn't been received in full by then never will be, and errTableUnfinished
+// is returned instead of waiting.
+func (t *tableCollector) GetTableDataSync(ctx context.Context) ([]IncidentData, error) {
+	if t == nil {
+		return nil, errors.New("no table collected")
+	}
+	select {
+	case <-t.finished:
+		return t.stats, nil
+	case <-ctx.Done():
+		return nil, fmt.Errorf("waiting for table data: %w", ctx.Err())
+	default:
+		return nil, errTableUnfinished
+	}
+}
+
+// Implement the TableMuxer to route pxl script output tables to the correct handler.
+// The records of tables without a registered handler are only counted,
+// unless keepOthers is set, so that extra tables a script displays don't
+// have to fit in memory.
+type tableMux struct {
+	// Whether to keep the records of tables without a registered handler.
+	keepOthers bool
+	// Whether to record every table as gzipped CSV, for the result archive.
+	archive bool
+
+	mu       sync.Mutex
+	handlers map[string]pxapi.TableRecordHandler
+	// Names of the tables the script output.
+	received map[string]bool
+	// Tables without a registered handler.
+	others map[string]*recordCollector
+	// Gzipped CSV of each table, if archived.
+	archives map[string]*csvArchive
+}
+
+func newTableMux() *tableMux {
+	return &tableMux{
+		handlers: make(map[string]pxapi.TableRecordHandler),
+		received: make(map[string]bool),
+		others:   make(map[string]*recordCollector),
+		archives: make(map[string]*csvArchive),
+	}
+}
+
+// Handle registers the handler for the table with the given name.
+func (s *tableMux) Handle(tableName string, h pxapi.TableRecordHandler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.handlers[tableName] = h
+}
+
+func (s *tableMux) AcceptTable(ctx context.Context, metadata types.TableMetadata) (pxapi.TableRecordHandler, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.received[metadata.Name] = true
+	h, ok := s.handlers[metadata.Name]
+	if !ok {
+		c := &recordCollector{keep: s.keepOthers, done: make(chan struct{})}
+		s.others[metadata.Name] = c
+		h = c
+	}
+	if s.archive {
+		a := newCSVArchive(h)
+		s.archives[metadata.Name] = a
+		h = a
+	}
+	return h, nil
+}
+
+// Received returns whether the script output the table with the given name.
+func (s *tableMux) Received(tableName string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.received[tableName]
+}
+
+// Names returns the names of the tables the script output, sorted.
+func (s *tableMux) Names() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	names := make([]string, 0, len(s.received))
+	for name := range s.received {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Others returns the tables the script output that had no registered handler, keyed by name.
+func (s *tableMux) Others() map[string]*recordCollector {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	others := make(map[string]*recordCollector, len(s.others))
+	for name, c := range s.others {
+		others[name] = c
+	}
+	return others
+}
+
+// Archives returns the gzipped CSV of each table the script output, keyed by
+// name, if archive is set.
+func (s *tableMux) Archives() map[string]*csvArchive {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	archives := make(map[string]*csvArchive, len(s.archives))
+	for name, a := range s.archives {
+		archives[name] = a
+	}
+	return archives
+}
+
+// recordCollector counts the records of a table, and keeps them if keep is set.
+type recordCollector struct {
+	keep     bool
+	metadata types.TableMetadata
+	count    int
+	records  []*types.Record
+	done     chan struct{}
+}
+
+func (c *recordCollector) HandleInit(ctx context.Context, metadata types.TableMetadata) error {
+	c.metadata = metadata
+	return nil
+}
+
+func (c *recordCollector) HandleRecord(ctx context.Context, r *types.Record) error {
+	c.count++
+	if c.keep {
+		c.records = append(c.records, r)
+	}
+	return nil
+}
+
+func (c *recordCollector) HandleDone(ctx context.Context) error {
+	close(c.done)
+	return nil
+}
+
+// GetRecordsSync returns the table's metadata, number of records and the
+// records, if they were kept. Like GetTableDataSync, it's called once the
+// script's results have finished streaming, and returns errTableUnfinished if
+// the table wasn't received in full.
+func (c *recordCollector) GetRecordsSync(ctx context.Context) (types.TableMetadata, int, []*types.Record, error) {
+	if c == nil {
+		return types.TableMetadata{}, 0, nil, errors.New("no table collected")
+	}
+	select {
+	case <-c.done:
+		return c.metadata, c.count, c.records, nil
+	case <-ctx.Done():
+		return c.metadata, 0, nil, fmt.Errorf("waiting for table data: %w", ctx.Err())
+	default:
+		return c.metadata, 0, nil, errTableUnfinished
+	}
+}
@@ -0,0 +1,131 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"go.withpixie.dev/pixie/src/api/go/pxapi/types"
+)
+
+func endpointRecord(service string, errorCount, total int64) *types.Record {
+	return testRecord(
+		testColumn{"service", service},
+		testColumn{"error_count", errorCount},
+		testColumn{"total_requests", total},
+		testColumn{"cpu_cores", 0.5},
+	)
+}
+
+func TestTableCollector(t *testing.T) {
+	ctx := context.Background()
+	overHalf := func(d IncidentData) bool { return d.ErrorRate() >= 0.5 }
+	tests := []struct {
+		name    string
+		keep    func(IncidentData) bool
+		records []*types.Record
+		want    []string
+	}{
+		{
+			name:    "keeps every record",
+			records: []*types.Record{endpointRecord("orders", 1, 10), endpointRecord("carts", 9, 10)},
+			want:    []string{"orders", "carts"},
+		},
+		{
+			name:    "filters",
+			keep:    overHalf,
+			records: []*types.Record{endpointRecord("orders", 1, 10), endpointRecord("carts", 9, 10)},
+			want:    []string{"carts"},
+		},
+		{
+			name:    "keeps none",
+			keep:    overHalf,
+			records: []*types.Record{endpointRecord("orders", 1, 10)},
+		},
+		{
+			name: "skips malformed",
+			records: []*types.Record{
+				testRecord(testColumn{"service", "orders"}, testColumn{"error_count", "many"}, testColumn{"total_requests", int64(10)}),
+				endpointRecord("carts", 9, 10),
+			},
+			want: []string{"carts"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTableCollector(tt.keep, []string{"cpu_cores"})
+			for _, r := range tt.records {
+				if err := c.HandleRecord(ctx, r); err != nil {
+					t.Fatalf("HandleRecord: %v", err)
+				}
+			}
+			if _, err := c.GetTableDataSync(ctx); !errors.Is(err, errTableUnfinished) {
+				t.Fatalf("GetTableDataSync before HandleDone = %v, want errTableUnfinished", err)
+			}
+			if err := c.HandleDone(ctx); err != nil {
+				t.Fatalf("HandleDone: %v", err)
+			}
+			stats, err := c.GetTableDataSync(ctx)
+			if err != nil {
+				t.Fatalf("GetTableDataSync: %v", err)
+			}
+			var got []string
+			for _, d := range stats {
+				got = append(got, d.Service)
+				if len(d.Details) != 1 || d.Details[0] != (IncidentDetail{Name: "cpu_cores", Value: "0.5"}) {
+					t.Errorf("details of %s = %v, want cpu_cores 0.5", d.Service, d.Details)
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("kept %v, want %v", got, tt.want)
+			}
+			if c.Records() != len(tt.records) {
+				t.Errorf("Records() = %d, want %d", c.Records(), len(tt.records))
+			}
+		})
+	}
+}
+
+func TestTableCollectorLimit(t *testing.T) {
+	ctx := context.Background()
+	c := newTableCollector(nil, nil)
+	r := endpointRecord("orders", 1, 10)
+	for i := 0; i < maxTableRecords+3; i++ {
+		if err := c.HandleRecord(ctx, r); err != nil {
+			t.Fatalf("HandleRecord: %v", err)
+		}
+	}
+	if err := c.HandleDone(ctx); err != nil {
+		t.Fatalf("HandleDone: %v", err)
+	}
+	stats, err := c.GetTableDataSync(ctx)
+	if err != nil {
+		t.Fatalf("GetTableDataSync: %v", err)
+	}
+	if len(stats) != maxTableRecords {
+		t.Errorf("kept %d records, want %d", len(stats), maxTableRecords)
+	}
+	if c.Dropped() != 3 {
+		t.Errorf("Dropped() = %d, want 3", c.Dropped())
+	}
+	if c.Records() != maxTableRecords+3 {
+		t.Errorf("Records() = %d, want %d", c.Records(), maxTableRecords+3)
+	}
+}
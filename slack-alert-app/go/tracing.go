@@ -0,0 +1,286 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// How often finished spans are exported.
+	traceExportInterval = 5 * time.Second
+	// Spans finished beyond this many before the next export are dropped.
+	traceMaxPending = 2048
+)
+
+// tracer exports spans to an OpenTelemetry collector with OTLP over HTTP,
+// using the JSON encoding.
+type tracer struct {
+	// URL of the collector's traces endpoint, such as http://otel-collector:4318/v1/traces.
+	url     string
+	headers map[string]string
+	service string
+	http    *http.Client
+
+	mu      sync.Mutex
+	pending []*span
+	dropped int
+}
+
+func newTracer(cfg TracingConfig) *tracer {
+	return &tracer{
+		url:     strings.TrimSuffix(cfg.Endpoint, "/") + "/v1/traces",
+		headers: cfg.Headers,
+		service: cfg.ServiceName,
+		http:    &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// parseOTLPHeaders parses headers given as a comma separated list of
+// key=value pairs, the format of OTEL_EXPORTER_OTLP_HEADERS.
+func parseOTLPHeaders(s string) (map[string]string, error) {
+	headers := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, fmt.Errorf("invalid header %q, expected key=value", pair)
+		}
+		headers[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+	return headers, nil
+}
+
+// span is a timed operation within a trace.
+type span struct {
+	tracer  *tracer
+	name    string
+	traceID [16]byte
+	id      [8]byte
+	parent  [8]byte
+	start   time.Time
+	end     time.Time
+	attrs   map[string]string
+	err     error
+}
+
+type spanKey struct{}
+
+// Start starts a root span, returning a context carrying it for child spans.
+// It does nothing if t is nil, so that tracing can be left unconfigured.
+func (t *tracer) Start(ctx context.Context, name string, attrs ...string) (context.Context, *span) {
+	if t == nil {
+		return ctx, nil
+	}
+	s := &span{tracer: t, name: name, start: time.Now(), attrs: make(map[string]string)}
+	rand.Read(s.traceID[:])
+	rand.Read(s.id[:])
+	s.SetAttrs(attrs...)
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// startSpan starts a child of the span in ctx, if there is one.
+func startSpan(ctx context.Context, name string, attrs ...string) (context.Context, *span) {
+	parent, _ := ctx.Value(spanKey{}).(*span)
+	if parent == nil {
+		return ctx, nil
+	}
+	s := &span{tracer: parent.tracer, name: name, traceID: parent.traceID, parent: parent.id, start: time.Now(), attrs: make(map[string]string)}
+	rand.Read(s.id[:])
+	s.SetAttrs(attrs...)
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// SetAttrs sets attributes on the span, given as key, value pairs.
+func (s *span) SetAttrs(kv ...string) {
+	if s == nil {
+		return
+	}
+	for i := 0; i+1 < len(kv); i += 2 {
+		s.attrs[kv[i]] = kv[i+1]
+	}
+}
+
+// End finishes the span, marking it as failed if err isn't nil, and queues it for export.
+func (s *span) End(err error) {
+	if s == nil {
+		return
+	}
+	s.end = time.Now()
+	s.err = err
+	t := s.tracer
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.pending) >= traceMaxPending {
+		t.dropped++
+		return
+	}
+	t.pending = append(t.pending, s)
+}
+
+// Run exports finished spans periodically until ctx is cancelled, then
+// exports any that are left.
+func (t *tracer) Run(ctx context.Context) {
+	if t == nil {
+		return
+	}
+	ticker := time.NewTicker(traceExportInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			flushCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			t.Flush(flushCtx)
+			cancel()
+			return
+		case <-ticker.C:
+			t.Flush(ctx)
+		}
+	}
+}
+
+// Flush exports the spans that have finished since the last export. Spans
+// that fail to export are dropped, since tracing is best effort.
+func (t *tracer) Flush(ctx context.Context) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	spans, dropped := t.pending, t.dropped
+	t.pending, t.dropped = nil, 0
+	t.mu.Unlock()
+	if dropped > 0 {
+		logWarn("Dropped trace spans, the collector isn't keeping up.", "spans", dropped)
+	}
+	if len(spans) == 0 {
+		return
+	}
+	if err := t.export(ctx, spans); err != nil {
+		logError("Error exporting trace spans.", "spans", len(spans), "error", err)
+	}
+}
+
+// The subset of the OTLP JSON encoding used to export spans.
+type otlpTraces struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttr `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string     `json:"traceId"`
+	SpanID            string     `json:"spanId"`
+	ParentSpanID      string     `json:"parentSpanId,omitempty"`
+	Name              string     `json:"name"`
+	Kind              int        `json:"kind"`
+	StartTimeUnixNano string     `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string     `json:"endTimeUnixNano"`
+	Attributes        []otlpAttr `json:"attributes,omitempty"`
+	Status            otlpStatus `json:"status"`
+}
+
+type otlpAttr struct {
+	Key   string        `json:"key"`
+	Value otlpAttrValue `json:"value"`
+}
+
+type otlpAttrValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpStatus struct {
+	// 0 is unset, 2 is error.
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+const otlpSpanKindInternal = 1
+
+func (t *tracer) export(ctx context.Context, spans []*span) error {
+	scope := otlpScopeSpans{Scope: otlpScope{Name: "slackbot", Version: version}}
+	for _, s := range spans {
+		out := otlpSpan{
+			TraceID:           hex.EncodeToString(s.traceID[:]),
+			SpanID:            hex.EncodeToString(s.id[:]),
+			Name:              s.name,
+			Kind:              otlpSpanKindInternal,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+		}
+		if s.parent != ([8]byte{}) {
+			out.ParentSpanID = hex.EncodeToString(s.parent[:])
+		}
+		for _, k := range sortedLabelKeys(s.attrs) {
+			out.Attributes = append(out.Attributes, otlpAttr{Key: k, Value: otlpAttrValue{StringValue: s.attrs[k]}})
+		}
+		if s.err != nil {
+			out.Status = otlpStatus{Code: 2, Message: s.err.Error()}
+		}
+		scope.Spans = append(scope.Spans, out)
+	}
+	body, err := json.Marshal(otlpTraces{ResourceSpans: []otlpResourceSpans{{
+		Resource:   otlpResource{Attributes: []otlpAttr{{Key: "service.name", Value: otlpAttrValue{StringValue: t.service}}}},
+		ScopeSpans: []otlpScopeSpans{scope},
+	}}})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range t.headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := t.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s returned %s", t.url, resp.Status)
+	}
+	return nil
+}
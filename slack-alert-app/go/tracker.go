@@ -0,0 +1,577 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"go.withpixie.dev/pixie/src/api/go/pxapi"
+)
+
+// ServiceTracker runs a rule's PxL script against each cluster, turns services
+// whose error rate is over the threshold into incidents and sends alerts for them.
+type ServiceTracker struct {
+	rule   Rule
+	script *pxlTemplate
+	// When to run checks, or nil to run them every rule.Interval.
+	schedule *cronSchedule
+
+	clusters clusterSource
+	// Maximum number of clusters to query at the same time.
+	maxParallel int
+	// Workers shared by all rules that run the queries.
+	workers *workerPool
+	// How to retry transient errors while querying a cluster.
+	retry retryPolicy
+	// Time window queried on each cluster.
+	windows *queryWindows
+	// Stats of the latest query on each cluster.
+	queries *queryRegistry
+	// Standby clusters to query when a cluster keeps failing, or nil.
+	fallbacks *fallbackClusters
+	// Number of failed checks in a row on a cluster after which an alert is
+	// sent, or 0 to never alert.
+	queryFailureAlertAfter int
+	// Fraction of a query's records that couldn't be decoded over which an
+	// alert is sent, or 0 to never alert.
+	malformedAlertRate float64
+	incidents          IncidentManager
+	// Silences created through the API.
+	silences SilenceStore
+	policy   AlertPolicy
+	alerter  Alerter
+	// Where to publish post-incident reports when an incident resolves.
+	reports []ReportSink
+	// Where to export the stats of every service after each check.
+	exporters []StatsSink
+	// Where to send every change to an incident.
+	sinks []IncidentSink
+	// Keeps the raw output of every check, or nil.
+	archive *resultArchiver
+	// Saves the raw output of every check to replay it later, or nil.
+	record *resultRecorder
+	// Recorded output to run checks against instead of the clusters, or nil.
+	replay *replayer
+	// Elects the replica that runs checks, or nil if every replica does.
+	leader *leaderElector
+	// Exports a trace of each check, or nil.
+	tracer *tracer
+	// Returns the time incidents are updated and alerts are sent at, or nil
+	// for the current time. Simulations step it through their checks.
+	now func() time.Time
+
+	// Held while checking, so that checks run on demand don't overlap scheduled ones.
+	checking sync.Mutex
+}
+
+// checkClaimer is implemented by IncidentManagers that are shared between
+// replicas of the bot, so that only one replica runs each check.
+type checkClaimer interface {
+	ClaimCheck(ctx context.Context, rule string, ttl time.Duration) (bool, error)
+}
+
+// errNotLeader is returned by Check on replicas that aren't the leader.
+var errNotLeader = errors.New("not the leader")
+
+// Check runs a single iteration of the PxL script and sends any resulting alerts.
+func (s *ServiceTracker) Check(ctx context.Context) (err error) {
+	if !s.leader.IsLeader() {
+		return errNotLeader
+	}
+	ctx, span := s.tracer.Start(ctx, "check", "rule", s.rule.Name)
+	defer func() { span.End(err) }()
+	if c, ok := s.incidents.(checkClaimer); ok {
+		// Expire the claim a bit before the next check is due, so that the
+		// next check can be claimed by whichever replica gets there first.
+		claimed, err := c.ClaimCheck(ctx, s.rule.Name, s.rule.Interval.Duration*9/10)
+		if err != nil {
+			return err
+		}
+		if !claimed {
+			logInfo("Check already run by another replica, skipping.", "rule", s.rule.Name)
+			s.windows.Reset()
+			return nil
+		}
+	}
+	_, err = s.checkClusters(ctx)
+	return err
+}
+
+// RunNow runs a check out of band, such as when a deploy pipeline asks for
+// one, and returns the changes to incidents it made. Unlike Check, it runs
+// even if another replica has claimed the current check, but waits for any
+// check in flight on this replica to finish first.
+func (s *ServiceTracker) RunNow(ctx context.Context) (events []IncidentEvent, err error) {
+	if !s.leader.IsLeader() {
+		return nil, errNotLeader
+	}
+	ctx, span := s.tracer.Start(ctx, "check", "rule", s.rule.Name, "trigger", "api")
+	defer func() { span.End(err) }()
+	return s.checkClusters(ctx)
+}
+
+// checkClusters checks every cluster and returns the changes to incidents.
+func (s *ServiceTracker) checkClusters(ctx context.Context) ([]IncidentEvent, error) {
+	s.checking.Lock()
+	defer s.checking.Unlock()
+
+	clusters, err := s.clusters.Clusters(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, s.maxParallel)
+	errs := make([]error, len(clusters))
+	events := make([][]IncidentEvent, len(clusters))
+	for i, c := range clusters {
+		wg.Add(1)
+		go func(i int, c *cluster) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			// Goroutines have to recover their own panics.
+			errs[i] = s.workers.Do(ctx, func() error {
+				return recoverPanic(func() error {
+					var err error
+					events[i], err = s.checkCluster(ctx, c)
+					return err
+				})
+			})
+			if errs[i] != nil {
+				logError("Error checking cluster.", "rule", s.rule.Name, "cluster", c.Name, "cluster_id", c.ID, "error", errs[i])
+			}
+		}(i, c)
+	}
+	wg.Wait()
+
+	var all []IncidentEvent
+	for _, e := range events {
+		all = append(all, e...)
+	}
+	// Only fail the check if no cluster could be checked.
+	for _, err := range errs {
+		if err == nil {
+			return all, nil
+		}
+	}
+	return all, fmt.Errorf("all %d clusters failed, last error: %w", len(errs), errs[len(errs)-1])
+}
+
+// checkCluster runs the PxL script against a single cluster, sends any
+// resulting alerts and returns the changes to incidents. If the cluster keeps failing and has a standby cluster,
+// the check runs against the standby instead, but incidents are still
+// attributed to the primary cluster.
+func (s *ServiceTracker) checkCluster(ctx context.Context, c *cluster) (events []IncidentEvent, err error) {
+	ctx, span := startSpan(ctx, "check cluster", "cluster.id", c.ID, "cluster.name", c.Name)
+	defer func() { span.End(err) }()
+
+	res, err := s.queryWithRetry(ctx, c, c.ID)
+	failures := s.observeQuery(ctx, c, res, err)
+	if rs := res.resultsStats(); rs != nil {
+		span.SetAttrs("pixie.execution_time", rs.ExecutionTime.String(),
+			"pixie.records_processed", strconv.FormatInt(rs.RecordsProcessed, 10),
+			"pixie.bytes_processed", strconv.FormatInt(rs.BytesProcessed, 10))
+	}
+	if err != nil {
+		standby := s.fallbacks.Standby(ctx, c.Cluster, failures)
+		if standby == nil {
+			return nil, err
+		}
+		logWarn("Cluster keeps failing, running the check on its standby cluster.", "rule", s.rule.Name, "cluster", c.Name,
+			"cluster_id", c.ID, "consecutive_failures", failures, "standby", standby.Name, "standby_id", standby.ID, "error", err)
+		res, err = s.queryWithRetry(ctx, standby, c.ID)
+		if err != nil {
+			return nil, fmt.Errorf("standby cluster %s: %w", standby.Name, err)
+		}
+	}
+	s.windows.Done(c.ID, res.end)
+	events, err = s.evaluate(ctx, c, res.stats)
+	if err != nil {
+		return nil, err
+	}
+	s.export(ctx, c, res.stats, res.end, events)
+	return events, nil
+}
+
+// export sends the stats of every service from a check to the exporters.
+// Errors are logged rather than failing the check, since alerting matters more.
+func (s *ServiceTracker) export(ctx context.Context, c *cluster, stats []IncidentData, end time.Time, events []IncidentEvent) {
+	if len(s.exporters) == 0 {
+		return
+	}
+	b := &statsBatch{Rule: s.rule.Name, Cluster: c.Cluster, Time: end, Services: summarizeServices(stats, s.overThreshold)}
+	for _, e := range events {
+		if e.Kind != IncidentResolved {
+			b.OpenIncidents++
+		}
+	}
+	for _, sink := range s.exporters {
+		if err := sink.WriteStats(ctx, b); err != nil {
+			logError("Error exporting stats.", "rule", s.rule.Name, "cluster", c.Name, "cluster_id", c.ID, "error", err)
+		}
+	}
+}
+
+// queryResult is the outcome of a successful query of a cluster.
+type queryResult struct {
+	stats []IncidentData
+	rs    *pxapi.ResultsStats
+	// End of the queried window.
+	end time.Time
+	// Number of records in the rule's table.
+	records int
+	// Number of records that were skipped because they couldn't be decoded,
+	// and the error from the first of them.
+	malformed    int
+	malformedErr error
+}
+
+func (r *queryResult) resultsStats() *pxapi.ResultsStats {
+	if r == nil {
+		return nil
+	}
+	return r.rs
+}
+
+// queryWithRetry queries a cluster, retrying transient errors. The window
+// queried picks up where the previous window of windowKey ended.
+func (s *ServiceTracker) queryWithRetry(ctx context.Context, c *cluster, windowKey string) (*queryResult, error) {
+	var res *queryResult
+	err := s.retry.do(ctx, s.rule.Name+" on "+c.Name, func() error {
+		var err error
+		end := time.Now()
+		start := s.windows.Start(windowKey, end, s.rule.Interval.Duration)
+		res, err = s.queryCluster(ctx, c, end.Sub(start))
+		if err != nil {
+			return c.handleError(ctx, err)
+		}
+		res.end = end
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// evaluate turns the endpoints in stats that are over the threshold into
+// incidents on a cluster, sends any resulting alerts and returns the changes
+// to incidents.
+func (s *ServiceTracker) evaluate(ctx context.Context, c *cluster, stats []IncidentData) ([]IncidentEvent, error) {
+	var over []IncidentData
+	for _, d := range stats {
+		if s.overThreshold(d) {
+			over = append(over, d)
+		}
+	}
+
+	events, err := s.incidents.Update(ctx, s.rule.Name, c.Cluster, over, s.clock())
+	if err != nil {
+		return nil, err
+	}
+	logDebug("Evaluated results.", "rule", s.rule.Name, "cluster", c.Name, "cluster_id", c.ID,
+		"endpoints_over_threshold", len(over), "incident_events", len(events))
+	for _, e := range events {
+		switch e.Kind {
+		case IncidentOpened:
+			metricIncidentsOpen.Add(1, s.rule.Name)
+		case IncidentResolved:
+			metricIncidentsOpen.Add(-1, s.rule.Name)
+		}
+		s.notify(ctx, e)
+		for _, sink := range s.sinks {
+			if err := sink.WriteEvent(ctx, e); err != nil {
+				logError("Error sending incident event.", "rule", s.rule.Name, "incident", e.Incident.ID, "error", err)
+			}
+		}
+		if e.Kind == IncidentResolved {
+			s.report(ctx, e.Incident)
+		}
+	}
+	return events, nil
+}
+
+// overThreshold returns whether an endpoint's error rate is over the rule's threshold.
+func (s *ServiceTracker) overThreshold(d IncidentData) bool {
+	return d.TotalRequests > 0 && d.ErrorRate() >= s.rule.Threshold
+}
+
+// queryCluster runs the PxL script over the given window against a single
+// cluster, within the rule's timeout, and returns the stats of the endpoints
+// over the threshold, or of every endpoint if the stats are exported, along
+// with Vizier's stats for the query. Each retry gets the full timeout.
+func (s *ServiceTracker) queryCluster(ctx context.Context, c *cluster, window time.Duration) (*queryResult, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.rule.Timeout.Duration)
+	defer cancel()
+
+	pxl, err := s.script.Render(newScriptVars(s.rule, window))
+	if err != nil {
+		return nil, err
+	}
+
+	// Exporters get every service, not just those over the threshold.
+	keep := s.overThreshold
+	if len(s.exporters) > 0 {
+		keep = nil
+	}
+	table := newTableCollector(keep, s.rule.Details)
+	tm := newTableMux()
+	tm.archive = s.archive != nil
+	tm.Handle(s.rule.Table, table)
+	exec, err := s.scriptExecutor(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	logDebug("Executing PxL script.", "rule", s.rule.Name, "cluster", c.Name, "cluster_id", c.ID)
+	_, span := startSpan(ctx, "execute script", "pixie.window", window.String())
+	resultSet, err := exec.ExecuteScript(ctx, pxl, tm)
+	span.End(err)
+	if err != nil {
+		return nil, err
+	}
+	defer resultSet.Close()
+
+	logDebug("Streaming PxL script results.", "rule", s.rule.Name, "cluster", c.Name, "cluster_id", c.ID)
+	_, span = startSpan(ctx, "stream")
+	err = resultSet.Stream()
+	span.End(err)
+	if err != nil {
+		return nil, fmt.Errorf("streaming results: %w", err)
+	}
+
+	if !tm.Received(s.rule.Table) {
+		return nil, &missingTableError{table: s.rule.Table, received: tm.Names()}
+	}
+	for name, c := range tm.Others() {
+		_, count, _, err := c.GetRecordsSync(ctx)
+		if errors.Is(err, errTableUnfinished) {
+			// Tables the rule doesn't use don't fail the check.
+			logWarn("Table with no handler never finished streaming.", "rule", s.rule.Name, "table", name)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		logDebug("Dropped records of a table the rule doesn't use.", "rule", s.rule.Name, "table", name, "records", count)
+	}
+	_, span = startSpan(ctx, "summarize")
+	stats, err := table.GetTableDataSync(ctx)
+	span.SetAttrs("endpoints", strconv.Itoa(len(stats)))
+	span.End(err)
+	if err != nil {
+		return nil, fmt.Errorf("table %q: %w", s.rule.Table, err)
+	}
+	if s.archive != nil {
+		now := time.Now()
+		for name, archive := range tm.Archives() {
+			// The rule's table is archived under the check's key, and the
+			// other tables next to it.
+			if name == s.rule.Table {
+				name = ""
+			}
+			key := s.archive.Key(s.rule.Name, c.Cluster, now, name)
+			// Failing to archive doesn't fail the check, which would only lose its alerts too.
+			if err := s.archive.Archive(ctx, key, archive); err != nil {
+				logError("Error archiving results.", "rule", s.rule.Name, "cluster", c.Name, "cluster_id", c.ID, "error", err)
+			}
+		}
+	}
+	res := &queryResult{stats: stats, rs: resultSet.Stats(), records: table.Records()}
+	if res.records == 0 {
+		logDebug("Table has no rows.", "rule", s.rule.Name, "cluster", c.Name, "cluster_id", c.ID, "table", s.rule.Table)
+	}
+	if res.malformed, res.malformedErr = table.Malformed(); res.malformed > 0 {
+		metricMalformedRecords.Add(float64(res.malformed), s.rule.Name, c.Name)
+		logWarn("Skipped records that couldn't be decoded.", "rule", s.rule.Name, "cluster", c.Name, "cluster_id", c.ID,
+			"table", s.rule.Table, "records", res.malformed, "error", res.malformedErr)
+	}
+	if dropped := table.Dropped(); dropped > 0 {
+		logWarn("Table has too many rows, dropped the rest.", "rule", s.rule.Name, "cluster", c.Name, "cluster_id", c.ID,
+			"table", s.rule.Table, "kept", len(stats), "records", dropped)
+	}
+	return res, nil
+}
+
+// scriptExecutor returns what runs the rule's script against a cluster: the
+// next recording of it when replaying, or else the cluster, recorded if enabled.
+func (s *ServiceTracker) scriptExecutor(ctx context.Context, c *cluster) (ScriptExecutor, error) {
+	if s.replay != nil {
+		return s.replay.Next(s.rule.Name, c.Cluster)
+	}
+	exec, err := c.scriptExecutor(ctx)
+	if err != nil || s.record == nil {
+		return exec, err
+	}
+	return s.record.wrap(exec, s.rule.Name, c.Cluster), nil
+}
+
+func (s *ServiceTracker) report(ctx context.Context, inc Incident) {
+	r := newIncidentReport(inc, s.rule.Interval.Duration, s.rule.Problem)
+	for _, sink := range s.reports {
+		if err := sink.WriteReport(ctx, r); err != nil {
+			logError("Error writing report.", "rule", s.rule.Name, "incident", inc.ID, "error", err)
+		}
+	}
+}
+
+func (s *ServiceTracker) notify(ctx context.Context, e IncidentEvent) {
+	inc := e.Incident
+	if inc.Silenced(s.clock()) {
+		return
+	}
+	if ok, err := silenced(ctx, s.silences, inc, s.clock()); err != nil {
+		// Better to send a silenced alert than to miss one.
+		logError("Error checking silences.", "rule", s.rule.Name, "incident", inc.ID, "error", err)
+	} else if ok {
+		return
+	}
+
+	var err error
+	ctx, span := startSpan(ctx, "send alert", "incident.id", inc.ID)
+	defer func() { span.End(err) }()
+	sev := s.severity(inc)
+	switch e.Kind {
+	case IncidentOpened:
+		err = s.alert(ctx, sev, fmt.Sprintf(":rotating_light: *[%s]* (%s) %s: %s on %s in %s",
+			inc.ID, sev, inc.Rule, s.rule.Problem, formatCluster(inc.Cluster), formatEndpoints(inc, s.rule.Unit)))
+	case IncidentUpdated:
+		if inc.Acked {
+			return
+		}
+		err = s.alert(ctx, sev, fmt.Sprintf("*[%s]* (%s) %s: still open for %s, %s on %s in %s",
+			inc.ID, sev, inc.Rule, inc.UpdatedAt.Sub(inc.OpenedAt).Round(time.Second), s.rule.Problem, formatCluster(inc.Cluster), formatEndpoints(inc, s.rule.Unit)))
+	case IncidentResolved:
+		// The threshold is on the share of what the rule counts, which isn't
+		// always errors, such as slow queries or restarted containers.
+		err = s.alerter.SendInfo(ctx, fmt.Sprintf(":white_check_mark: *[%s]* %s: %s on %s recovered after %s, the share of %s is back under %s.",
+			inc.ID, inc.Rule, formatName(inc.Service), formatCluster(inc.Cluster), inc.ResolvedAt.Sub(inc.OpenedAt).Round(time.Second), s.rule.Problem, formatRate(s.rule.Threshold)))
+	}
+	if err != nil {
+		logError("Error sending alert.", "rule", s.rule.Name, "incident", inc.ID, "error", err)
+	}
+}
+
+// alert sends msg as an alert if the policy allows it, and as an info message otherwise.
+func (s *ServiceTracker) alert(ctx context.Context, sev Severity, msg string) error {
+	if s.policy.ShouldAlert(sev, s.clock()) {
+		return s.alerter.SendAlert(ctx, msg)
+	}
+	return s.alerter.SendInfo(ctx, msg)
+}
+
+func (s *ServiceTracker) clock() time.Time {
+	if s.now != nil {
+		return s.now()
+	}
+	return time.Now()
+}
+
+// severity of an incident, based on its worst endpoint.
+func (s *ServiceTracker) severity(inc Incident) Severity {
+	worst := inc.Latest.ErrorRate()
+	if len(inc.Endpoints) > 0 {
+		worst = inc.Endpoints[0].ErrorRate()
+	}
+	if worst >= s.rule.CriticalThreshold {
+		return SeverityCritical
+	}
+	return SeverityWarning
+}
+
+// formatEndpoints describes the error rates of an incident's endpoints, such as
+// "`orders` `/checkout` at 40.0% errors (40 of 100 requests)".
+func formatEndpoints(inc Incident, unit string) string {
+	if len(inc.Endpoints) == 0 {
+		return formatStats(inc.Latest, unit)
+	}
+	var parts []string
+	for _, d := range inc.Endpoints {
+		parts = append(parts, formatStats(d, unit))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// formatStats describes the error rate of a service or endpoint, counting
+// unit, such as "requests", followed by its details, such as
+// "`orders` at 40.0% errors (40 of 100 requests)" or
+// "`orders` `orders-7d9f` at 100.0% errors (1 of 1 pods; memory_mb `1210`)".
+func formatStats(d IncidentData, unit string) string {
+	if unit == "" {
+		unit = "requests"
+	}
+	name := formatName(d.Service)
+	if d.Endpoint != "" {
+		name += " " + formatName(d.Endpoint)
+	}
+	counts := fmt.Sprintf("%d of %d %s", d.ErrorCount, d.TotalRequests, unit)
+	for _, detail := range d.Details {
+		counts += "; " + detail.Name + " " + formatName(detail.Value)
+	}
+	return fmt.Sprintf("%s at %s errors (%s)", name, formatRate(d.ErrorRate()), counts)
+}
+
+// Longest name, in characters, shown in messages.
+const maxNameLength = 100
+
+// formatName formats a name that comes from cluster data, such as a service
+// or an endpoint, as inline code in a Slack message. Anything can show up in
+// pod names and request paths, so characters that would end the code span,
+// start a mention or link, or break the line are replaced, invisible
+// formatting characters are dropped and long names are shortened.
+func formatName(s string) string {
+	var b strings.Builder
+	n := 0
+	for _, r := range s {
+		if n == maxNameLength {
+			b.WriteString("…")
+			break
+		}
+		switch {
+		case unicode.Is(unicode.Cf, r):
+			// Such as zero width spaces and right-to-left overrides.
+			continue
+		case r == '`':
+			b.WriteRune('\'')
+		case unicode.IsControl(r) || r == '\u2028' || r == '\u2029':
+			b.WriteRune(' ')
+		default:
+			b.WriteRune(r)
+		}
+		n++
+	}
+	return "`" + escapeMrkdwn(b.String()) + "`"
+}
+
+// escapeMrkdwn escapes the characters that Slack uses for mentions and
+// links, such as <!channel>, in text that may come from cluster data.
+func escapeMrkdwn(s string) string {
+	return mrkdwnEscaper.Replace(s)
+}
+
+var mrkdwnEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+func formatRate(r float64) string {
+	return fmt.Sprintf("%.1f%%", r*100)
+}
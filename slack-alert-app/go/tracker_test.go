@@ -0,0 +1,382 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"go.withpixie.dev/pixie/src/api/go/pxapi"
+	"go.withpixie.dev/pixie/src/api/go/pxapi/errdefs"
+	"go.withpixie.dev/pixie/src/api/public/cloudapipb"
+	"go.withpixie.dev/pixie/src/api/public/vizierapipb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// simulateRule runs a check of the default rule, changed by edit, for each
+// of the given stats, and returns the messages it sent.
+func simulateRule(t *testing.T, edit func(r *Rule), stats ...[]IncidentData) *CaptureAlerter {
+	t.Helper()
+	r := defaultConfig().Defaults
+	if edit != nil {
+		edit(&r)
+	}
+	alerts := &CaptureAlerter{}
+	c := &cluster{Cluster: Cluster{ID: "prod", Name: "prod"}}
+	if err := simulate(context.Background(), newSimulationTracker(r, alerts), c, stats); err != nil {
+		t.Fatal(err)
+	}
+	return alerts
+}
+
+func TestThresholds(t *testing.T) {
+	stats := []IncidentData{
+		{Service: "px-sock-shop/orders", Endpoint: "/orders", ErrorCount: 20, TotalRequests: 100},
+		{Service: "px-sock-shop/carts", Endpoint: "/carts", ErrorCount: 5, TotalRequests: 100},
+		{Service: "px-sock-shop/catalogue", Endpoint: "/catalogue", ErrorCount: 60, TotalRequests: 100},
+		{Service: "px-sock-shop/user", Endpoint: "/login"},
+	}
+
+	alerts := simulateRule(t, nil, stats)
+	alerts.AssertSeverity(t, "orders", SeverityWarning)
+	alerts.AssertSeverity(t, "catalogue", SeverityCritical)
+	alerts.AssertNotAlertedFor(t, "carts")
+	alerts.AssertNotAlertedFor(t, "user")
+
+	// Raising the thresholds leaves only the worst service, as a warning.
+	alerts = simulateRule(t, func(r *Rule) { r.Threshold, r.CriticalThreshold = 0.5, 0.9 }, stats)
+	alerts.AssertSeverity(t, "catalogue", SeverityWarning)
+	alerts.AssertNotAlertedFor(t, "orders")
+
+	// A service whose error rate is at the threshold is alerted for.
+	alerts = simulateRule(t, func(r *Rule) { r.Threshold = 0.05 }, stats)
+	alerts.AssertAlertedFor(t, "carts")
+
+	alerts = simulateRule(t, func(r *Rule) { r.Threshold = 0.7 }, stats)
+	alerts.AssertNoAlerts(t)
+}
+
+func TestIncidentLifecycle(t *testing.T) {
+	over := []IncidentData{{Service: "px-sock-shop/orders", Endpoint: "/orders", ErrorCount: 40, TotalRequests: 100}}
+	under := []IncidentData{{Service: "px-sock-shop/orders", Endpoint: "/orders", ErrorCount: 1, TotalRequests: 100}}
+	alerts := simulateRule(t, nil, over, over, under)
+
+	msgs := alerts.Messages()
+	if len(msgs) != 3 {
+		t.Fatalf("got %d messages, want opened, updated and resolved: %v", len(msgs), msgs)
+	}
+	if len(alerts.AlertsFor("orders")) != 2 {
+		t.Errorf("got %d alerts, want opened and updated: %v", len(alerts.Alerts()), msgs)
+	}
+	// Resolving isn't an alert, so it doesn't page anyone.
+	if msgs[2].Kind != capturedInfo || msgs[2].Severity != "" {
+		t.Errorf("resolved message is a %s with severity %q, want info without a severity: %s", msgs[2].Kind, msgs[2].Severity, msgs[2].Msg)
+	}
+}
+
+// fakeVizierTracker returns a tracker of the default rule, changed by edit,
+// that checks the healthy clusters of a fake Vizier through pxapi.
+func fakeVizierTracker(t *testing.T, f *fakeVizier, edit func(r *Rule)) (*ServiceTracker, *CaptureAlerter) {
+	t.Helper()
+	r := defaultConfig().Defaults
+	if edit != nil {
+		edit(&r)
+	}
+	conn, err := newPixieConn(context.Background(), func() (string, error) { return f.apiKey, nil }, pxapi.WithCloudAddr(f.addr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newTestTracker(t, r, newDiscoveredClusters(conn, regexp.MustCompile(""), nil))
+}
+
+// newTestTracker returns a tracker of r that checks clusters, keeping
+// incidents in memory and capturing its messages.
+func newTestTracker(t *testing.T, r Rule, clusters clusterSource) (*ServiceTracker, *CaptureAlerter) {
+	t.Helper()
+	script, err := loadRuleScript(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alerts := &CaptureAlerter{}
+	return &ServiceTracker{
+		rule:        r,
+		script:      script,
+		clusters:    clusters,
+		maxParallel: 1,
+		workers:     newWorkerPool(1),
+		retry:       retryPolicy{attempts: 3, initialDelay: time.Millisecond, maxDelay: time.Millisecond},
+		windows:     &queryWindows{},
+		queries:     newQueryRegistry(),
+		incidents:   newMemoryIncidentManager(),
+		silences:    newMemorySilences(),
+		policy:      alwaysAlertPolicy{},
+		alerter:     alerts,
+	}, alerts
+}
+
+// httpTable is the default rule's table with the given rows of service,
+// endpoint, error count and total requests.
+func httpTable(rows ...[]string) *recordedTable {
+	return localTable("http_table", []string{"service", "endpoint", "error_count", "total_requests"}, rows)
+}
+
+func TestCheckAgainstFakeVizier(t *testing.T) {
+	f := newFakeVizier(t, "px-api-key",
+		fakeVizierCluster{ID: "6ba7b810-9dad-11d1-80b4-00c04fd430c8", Name: "prod", Status: cloudapipb.CS_HEALTHY},
+		fakeVizierCluster{ID: "6ba7b811-9dad-11d1-80b4-00c04fd430c8", Name: "staging", Status: cloudapipb.CS_DISCONNECTED})
+	f.reply(fakeVizierReply{Tables: []*recordedTable{
+		localTable("debug", []string{"msg"}, [][]string{{"a"}, {"b"}, {"c"}}),
+		httpTable(
+			[]string{"px-sock-shop/orders", "/orders", "40", "100"},
+			[]string{"px-sock-shop/orders", "/orders/new", "10", "100"},
+			[]string{"px-sock-shop/carts", "/carts", "1", "100"},
+			[]string{"px-sock-shop/catalogue", "/catalogue", "0", "100"},
+			[]string{"px-sock-shop/user", "/login", "90", "100"},
+		),
+	}})
+	s, alerts := fakeVizierTracker(t, f, nil)
+	if err := s.Check(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	alerts.AssertSeverity(t, "orders", SeverityWarning)
+	alerts.AssertSeverity(t, "user", SeverityCritical)
+	alerts.AssertNotAlertedFor(t, "carts")
+	alerts.AssertNotAlertedFor(t, "catalogue")
+
+	// Only the healthy cluster is checked, with the rendered script.
+	scripts := f.Scripts()
+	if len(scripts) != 1 || !strings.Contains(scripts[0], "px-sock-shop") {
+		t.Errorf("got scripts %q, want one for the px-sock-shop namespace", scripts)
+	}
+	q := s.queries.All()
+	if len(q) != 1 || q[0].Cluster.Name != "prod" || q[0].RecordsProcessed != 8 || q[0].ExecutionTime != 10*time.Millisecond {
+		t.Errorf("got queries %+v, want Vizier's stats of the 8 records of both tables from prod", q)
+	}
+}
+
+func TestCheckRetriesVizierErrors(t *testing.T) {
+	f := newFakeVizier(t, "px-api-key", fakeVizierCluster{ID: "6ba7b810-9dad-11d1-80b4-00c04fd430c8", Name: "prod", Status: cloudapipb.CS_HEALTHY})
+	table := httpTable([]string{"px-sock-shop/orders", "/orders", "40", "100"}, []string{"px-sock-shop/carts", "/carts", "0", "100"}, []string{"px-sock-shop/user", "/login", "0", "100"})
+	f.reply(
+		fakeVizierReply{Err: status.Error(codes.Unavailable, "vizier unreachable")},
+		fakeVizierReply{Tables: []*recordedTable{table}, StreamErr: status.Error(codes.Internal, "stream reset")},
+		fakeVizierReply{Tables: []*recordedTable{table}},
+	)
+	s, alerts := fakeVizierTracker(t, f, nil)
+	if err := s.Check(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(f.Scripts()); n != 3 {
+		t.Errorf("got %d attempts, want 3", n)
+	}
+	// The rows of the failed attempt aren't counted twice.
+	if a := alerts.AlertsFor("orders"); len(a) != 1 {
+		t.Errorf("got %d alerts, want 1: %v", len(a), alerts.Messages())
+	}
+}
+
+func TestCheckVizierTimeout(t *testing.T) {
+	f := newFakeVizier(t, "px-api-key", fakeVizierCluster{ID: "6ba7b810-9dad-11d1-80b4-00c04fd430c8", Name: "prod", Status: cloudapipb.CS_HEALTHY})
+	f.reply(fakeVizierReply{Tables: []*recordedTable{httpTable([]string{"px-sock-shop/orders", "/orders", "40", "100"})}, Stall: true})
+	s, alerts := fakeVizierTracker(t, f, func(r *Rule) { r.Timeout = duration{100 * time.Millisecond} })
+	s.retry.attempts = 2
+	err := s.Check(context.Background())
+	if grpcCode(err) != codes.DeadlineExceeded && !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want the query to time out", err)
+	}
+	if n := len(f.Scripts()); n != 2 {
+		t.Errorf("got %d attempts, want timeouts to be retried", n)
+	}
+	alerts.AssertNoAlerts(t)
+}
+
+func TestCheckVizierScriptErrors(t *testing.T) {
+	f := newFakeVizier(t, "px-api-key", fakeVizierCluster{ID: "6ba7b810-9dad-11d1-80b4-00c04fd430c8", Name: "prod", Status: cloudapipb.CS_HEALTHY})
+	f.reply(fakeVizierReply{Status: &vizierapipb.Status{
+		Code:         3,
+		Message:      "Compilation failed",
+		ErrorDetails: []*vizierapipb.ErrorDetails{{Error: &vizierapipb.ErrorDetails_CompilerError{CompilerError: &vizierapipb.CompilerError{Line: 1, Message: "name 'dff' is not defined"}}}},
+	}})
+	s, _ := fakeVizierTracker(t, f, nil)
+	if err := s.Check(context.Background()); !errdefs.IsCompilationError(err) {
+		t.Fatalf("got %v, want a compilation error", err)
+	}
+	if n := len(f.Scripts()); n != 1 {
+		t.Errorf("got %d attempts, want script errors not to be retried", n)
+	}
+}
+
+func TestDiscoverClustersWithRejectedAPIKey(t *testing.T) {
+	f := newFakeVizier(t, "px-api-key", fakeVizierCluster{ID: "6ba7b810-9dad-11d1-80b4-00c04fd430c8", Name: "prod", Status: cloudapipb.CS_HEALTHY})
+	ctx := context.Background()
+	conn, err := newPixieConn(ctx, func() (string, error) { return "revoked", nil }, pxapi.WithCloudAddr(f.addr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newDiscoveredClusters(conn, regexp.MustCompile(""), nil).Clusters(ctx); !isAuthError(err) {
+		t.Errorf("got %v, want the API key to be rejected", err)
+	}
+}
+
+// captureLogs sends the bot's logs to a buffer until the test ends, and
+// returns a func that reads them.
+func captureLogs(t *testing.T) func() string {
+	t.Helper()
+	var buf bytes.Buffer
+	logger.mu.Lock()
+	out := logger.out
+	logger.out = &buf
+	logger.mu.Unlock()
+	t.Cleanup(func() {
+		logger.mu.Lock()
+		defer logger.mu.Unlock()
+		logger.out = out
+	})
+	return func() string {
+		logger.mu.Lock()
+		defer logger.mu.Unlock()
+		return buf.String()
+	}
+}
+
+// malformedTable is the default rule's table with the given rows, followed
+// by n records whose error count is a string instead of a number.
+func malformedTable(t *testing.T, n int, rows ...[]string) staticTable {
+	t.Helper()
+	table, err := httpTable(rows...).static()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		table.Records = append(table.Records, testRecord(testColumn{"service", "px-sock-shop/user"}, testColumn{"endpoint", "/login"},
+			testColumn{"error_count", "many"}, testColumn{"total_requests", int64(100)}))
+	}
+	return table
+}
+
+func TestCheckSkipsMalformedRecords(t *testing.T) {
+	logs := captureLogs(t)
+	table := malformedTable(t, 2, []string{"px-sock-shop/orders", "/orders", "40", "100"}, []string{"px-sock-shop/carts", "/carts", "0", "100"})
+	c := &cluster{Cluster: Cluster{ID: "prod-id", Name: "prod"}, executor: newStaticExecutor(table)}
+	s, alerts := newTestTracker(t, defaultConfig().Defaults, staticClusters{c})
+	if err := s.Check(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// The rest of the table is still checked.
+	alerts.AssertSeverity(t, "orders", SeverityWarning)
+	alerts.AssertNotAlertedFor(t, "user")
+
+	q := s.queries.All()
+	if len(q) != 1 {
+		t.Fatalf("got queries %+v, want one", q)
+	}
+	if q[0].MalformedRecords != 2 || q[0].MalformedRate != 0.5 || q[0].TotalMalformedRecords != 2 || !strings.Contains(q[0].MalformedError, "error_count") {
+		t.Errorf("got %d malformed records (rate %v, total %d, error %q), want 2 of 4 skipped because of error_count",
+			q[0].MalformedRecords, q[0].MalformedRate, q[0].TotalMalformedRecords, q[0].MalformedError)
+	}
+	if n := strings.Count(logs(), "Skipped records that couldn't be decoded."); n != 1 {
+		t.Errorf("logged the skipped records %d times, want once per check:\n%s", n, logs())
+	}
+
+	// A check without malformed records resets the count, but not the total.
+	table, err := httpTable([]string{"px-sock-shop/orders", "/orders", "40", "100"}).static()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.executor.(*staticExecutor).tables = []staticTable{table}
+	if err := s.Check(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if q := s.queries.All(); q[0].MalformedRecords != 0 || q[0].MalformedRate != 0 || q[0].MalformedError != "" || q[0].TotalMalformedRecords != 2 {
+		t.Errorf("got %+v, want no malformed records from the last check and 2 in total", q[0])
+	}
+}
+
+func TestMalformedAlertRate(t *testing.T) {
+	c := &cluster{Cluster: Cluster{ID: "prod-id", Name: "prod"}, executor: newStaticExecutor()}
+	s, alerts := newTestTracker(t, defaultConfig().Defaults, staticClusters{c})
+	s.malformedAlertRate = 0.25
+	check := func(malformed int) []CapturedMessage {
+		t.Helper()
+		alerts.Reset()
+		c.executor.(*staticExecutor).tables = []staticTable{malformedTable(t, malformed,
+			[]string{"px-sock-shop/carts", "/carts", "0", "100"}, []string{"px-sock-shop/user", "/login", "0", "100"}, []string{"px-sock-shop/catalogue", "/catalogue", "0", "100"})}
+		if err := s.Check(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		return alerts.Messages()
+	}
+
+	// Skipping a quarter of the records is still within the rate.
+	if msgs := check(1); len(msgs) != 0 {
+		t.Errorf("got %v, want no messages at the alert rate", msgs)
+	}
+	msgs := check(2)
+	if len(msgs) != 1 || msgs[0].Kind != capturedAlert || !strings.Contains(msgs[0].Msg, "2 records (40.0%) from `prod` couldn't be decoded") {
+		t.Fatalf("got %v, want an alert for the 2 skipped records", msgs)
+	}
+	if msgs := check(3); len(msgs) != 0 {
+		t.Errorf("got %v, want no repeated alert while records are still skipped", msgs)
+	}
+	msgs = check(0)
+	if len(msgs) != 1 || msgs[0].Kind != capturedInfo || !strings.Contains(msgs[0].Msg, "are being decoded again") {
+		t.Errorf("got %v, want a recovery message", msgs)
+	}
+}
+
+func TestFormatName(t *testing.T) {
+	for _, tt := range []struct{ in, want string }{
+		{"px-sock-shop/orders", "`px-sock-shop/orders`"},
+		{"<!channel>", "`&lt;!channel&gt;`"},
+		{"<!here|here>", "`&lt;!here|here&gt;`"},
+		{"<@U123>", "`&lt;@U123&gt;`"},
+		{"<https://evil.example|click>", "`&lt;https://evil.example|click&gt;`"},
+		{"a & b", "`a &amp; b`"},
+		{"&lt;", "`&amp;lt;`"},
+		// A backtick would end the code span, letting the rest be formatted.
+		{"a`<!channel>`b", "`a'&lt;!channel&gt;'b`"},
+		// Inside a code span, Slack doesn't format these.
+		{"*bold* _italic_ ~strike~", "`*bold* _italic_ ~strike~`"},
+		{"line\nbreak\ttab", "`line break tab`"},
+		{"zero\u200bwidth\u202eoverride", "`zerowidthoverride`"},
+		{strings.Repeat("x", maxNameLength+1), "`" + strings.Repeat("x", maxNameLength) + "…`"},
+	} {
+		if got := formatName(tt.in); got != tt.want {
+			t.Errorf("formatName(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestEscapeMrkdwn(t *testing.T) {
+	for _, tt := range []struct{ in, want string }{
+		{"<!channel>", "&lt;!channel&gt;"},
+		{"<@U123>", "&lt;@U123&gt;"},
+		{"a & b", "a &amp; b"},
+		{"&amp;", "&amp;amp;"},
+		{"*_~`", "*_~`"},
+	} {
+		if got := escapeMrkdwn(tt.in); got != tt.want {
+			t.Errorf("escapeMrkdwn(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// vaultClient reads secrets from HashiCorp Vault over its HTTP API. It logs
+// in with the Kubernetes auth method using the pod's service account, unless
+// a token is given, so that no long-lived Vault token needs to be stored.
+type vaultClient struct {
+	addr string
+	// Kubernetes auth role and the path the auth method is mounted at.
+	role     string
+	authPath string
+	http     *http.Client
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+func newVaultClient(cfg VaultConfig) *vaultClient {
+	return &vaultClient{
+		addr:     strings.TrimSuffix(cfg.Addr, "/"),
+		role:     cfg.Role,
+		authPath: cfg.AuthPath,
+		token:    cfg.Token,
+		http:     &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// login gets a client token using the Kubernetes auth method, if there is no
+// token or it has expired. Must be called with c.mu held.
+func (c *vaultClient) login(ctx context.Context) error {
+	if c.token != "" && (c.expires.IsZero() || time.Now().Before(c.expires)) {
+		return nil
+	}
+	if c.role == "" {
+		return errors.New("Vault token expired and no Vault role is set to log in with")
+	}
+	jwt, err := ioutil.ReadFile(serviceAccountTokenFile)
+	if err != nil {
+		return fmt.Errorf("reading service account token: %w", err)
+	}
+	body, err := json.Marshal(map[string]string{"role": c.role, "jwt": strings.TrimSpace(string(jwt))})
+	if err != nil {
+		return err
+	}
+	var resp struct {
+		Auth struct {
+			ClientToken   string `json:"client_token"`
+			LeaseDuration int    `json:"lease_duration"`
+		} `json:"auth"`
+	}
+	if err := c.do(ctx, http.MethodPost, "auth/"+c.authPath+"/login", "", body, &resp); err != nil {
+		return fmt.Errorf("logging in to Vault: %w", err)
+	}
+	c.token = resp.Auth.ClientToken
+	c.expires = time.Time{}
+	if resp.Auth.LeaseDuration > 0 {
+		c.expires = time.Now().Add(time.Duration(resp.Auth.LeaseDuration) * time.Second)
+	}
+	return nil
+}
+
+// read reads a secret given as path#key, such as
+// secret/data/slackbot#slack-bot-token, and returns its value and lease
+// duration, or 0 if the secret doesn't expire. Both KV version 1 and 2
+// secrets engines are supported.
+func (c *vaultClient) read(ctx context.Context, ref string) (string, time.Duration, error) {
+	parts := strings.SplitN(ref, "#", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", 0, fmt.Errorf("invalid Vault secret %q, expected path#key", ref)
+	}
+	path, key := parts[0], parts[1]
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.login(ctx); err != nil {
+		return "", 0, err
+	}
+	var resp struct {
+		LeaseDuration int                    `json:"lease_duration"`
+		Data          map[string]interface{} `json:"data"`
+	}
+	if err := c.do(ctx, http.MethodGet, path, c.token, nil, &resp); err != nil {
+		return "", 0, fmt.Errorf("reading %s from Vault: %w", path, err)
+	}
+	data := resp.Data
+	// KV version 2 nests the secret's data under data.
+	if nested, ok := data["data"].(map[string]interface{}); ok {
+		data = nested
+	}
+	v, ok := data[key].(string)
+	if !ok || v == "" {
+		return "", 0, fmt.Errorf("Vault secret %s has no %s", path, key)
+	}
+	return v, time.Duration(resp.LeaseDuration) * time.Second, nil
+}
+
+func (c *vaultClient) do(ctx context.Context, method, path, token string, body []byte, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, method, c.addr+"/v1/"+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(b)))
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// vaultSecret is a secret in Vault, which is fetched again once its lease expires.
+type vaultSecret struct {
+	client *vaultClient
+	ref    string
+
+	mu      sync.Mutex
+	value   string
+	expires time.Time
+}
+
+func newVaultSecret(client *vaultClient, ref string) *vaultSecret {
+	return &vaultSecret{client: client, ref: ref}
+}
+
+// Get returns the secret's value, fetching it from Vault if it hasn't been
+// fetched yet or its lease has expired.
+func (s *vaultSecret) Get(ctx context.Context) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.value != "" && (s.expires.IsZero() || time.Now().Before(s.expires)) {
+		return s.value, nil
+	}
+	v, lease, err := s.client.read(ctx, s.ref)
+	if err != nil {
+		return "", err
+	}
+	s.value = v
+	s.expires = time.Time{}
+	if lease > 0 {
+		s.expires = time.Now().Add(lease)
+	}
+	return v, nil
+}
+
+// Invalidate makes the next Get fetch the secret from Vault, such as after
+// the current value was rejected.
+func (s *vaultSecret) Invalidate() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.value = ""
+}
@@ -0,0 +1,77 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// maxWindowIntervals is how long ago, in multiples of the rule's interval,
+// the previous window can have ended for a check to pick up where it left
+// off. After longer gaps, such as when the bot was down, the check only
+// queries the last interval.
+const maxWindowIntervals = 3
+
+// queryWindows keeps the end of the last successfully queried window on each
+// cluster, so that each check queries exactly the time since the previous
+// one. This avoids gaps and double counting when checks run late or the
+// interval is changed. The ends are only this replica's, so they are reset
+// whenever another replica runs a check.
+type queryWindows struct {
+	mu   sync.Mutex
+	ends map[string]time.Time
+}
+
+// Start returns the start of the window to query on a cluster at now: the
+// end of the previous window, or one interval ago for the first check or
+// after a gap of more than maxWindowIntervals intervals.
+func (w *queryWindows) Start(clusterID string, now time.Time, interval time.Duration) time.Time {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	end, ok := w.ends[clusterID]
+	if !ok || !end.Before(now) {
+		return now.Add(-interval)
+	}
+	if now.Sub(end) > maxWindowIntervals*interval {
+		logWarn("Last check on cluster was too long ago, only querying the last interval.", "cluster_id", clusterID, "since", now.Sub(end).Round(time.Second), "interval", interval)
+		return now.Add(-interval)
+	}
+	return end
+}
+
+// Done records that the window up to end was queried on a cluster.
+func (w *queryWindows) Done(clusterID string, end time.Time) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.ends == nil {
+		w.ends = make(map[string]time.Time)
+	}
+	w.ends[clusterID] = end
+}
+
+// Reset forgets the ends of the windows on every cluster, such as when
+// another replica ran the last check, so that the next check only queries
+// the last interval instead of the windows the other replica already did.
+func (w *queryWindows) Reset() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.ends = nil
+}
@@ -0,0 +1,112 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestQueryWindows(t *testing.T) {
+	now := time.Date(2021, 2, 8, 12, 0, 0, 0, time.UTC)
+	interval := 5 * time.Minute
+	tests := []struct {
+		name string
+		// ends are the ends of the previous windows on the cluster, if any.
+		ends []time.Time
+		want time.Time
+	}{
+		{name: "first check", want: now.Add(-interval)},
+		{name: "on time", ends: []time.Time{now.Add(-interval)}, want: now.Add(-interval)},
+		{name: "late", ends: []time.Time{now.Add(-7 * time.Minute)}, want: now.Add(-7 * time.Minute)},
+		{name: "early", ends: []time.Time{now.Add(-time.Minute)}, want: now.Add(-time.Minute)},
+		{name: "latest end", ends: []time.Time{now.Add(-10 * time.Minute), now.Add(-2 * time.Minute)}, want: now.Add(-2 * time.Minute)},
+		{name: "at the longest gap", ends: []time.Time{now.Add(-maxWindowIntervals * interval)}, want: now.Add(-maxWindowIntervals * interval)},
+		{name: "gap too long", ends: []time.Time{now.Add(-maxWindowIntervals*interval - time.Second)}, want: now.Add(-interval)},
+		{name: "ended now", ends: []time.Time{now}, want: now.Add(-interval)},
+		{name: "ended in the future", ends: []time.Time{now.Add(time.Minute)}, want: now.Add(-interval)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := &queryWindows{}
+			for _, end := range tt.ends {
+				w.Done("prod", end)
+			}
+			if got := w.Start("prod", now, interval); !got.Equal(tt.want) {
+				t.Errorf("Start() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestQueryWindowsPerCluster(t *testing.T) {
+	now := time.Date(2021, 2, 8, 12, 0, 0, 0, time.UTC)
+	interval := 5 * time.Minute
+	w := &queryWindows{}
+	w.Done("prod", now.Add(-7*time.Minute))
+	if got, want := w.Start("staging", now, interval), now.Add(-interval); !got.Equal(want) {
+		t.Errorf("Start() on another cluster = %v, want %v", got, want)
+	}
+
+	w.Reset()
+	if got, want := w.Start("prod", now, interval), now.Add(-interval); !got.Equal(want) {
+		t.Errorf("Start() after Reset() = %v, want %v", got, want)
+	}
+}
+
+// claimingIncidents is an IncidentManager that is shared with other
+// replicas, which claim the checks that aren't in claims.
+type claimingIncidents struct {
+	IncidentManager
+	claims []bool
+}
+
+func (m *claimingIncidents) ClaimCheck(ctx context.Context, rule string, ttl time.Duration) (bool, error) {
+	claimed := m.claims[0]
+	m.claims = m.claims[1:]
+	return claimed, nil
+}
+
+func TestQueryWindowsResetByOtherReplicas(t *testing.T) {
+	table, err := httpTable([]string{"px-sock-shop/orders", "/orders", "1", "100"}).static()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &cluster{Cluster: Cluster{ID: "prod", Name: "prod"}, executor: newStaticExecutor(table)}
+	s, _ := newTestTracker(t, defaultConfig().Defaults, staticClusters{c})
+	s.incidents = &claimingIncidents{IncidentManager: s.incidents, claims: []bool{true, false}}
+	interval := s.rule.Interval.Duration
+
+	if err := s.Check(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// Soon after a check, the next window picks up where it ended.
+	now := time.Now().Add(2 * interval)
+	if got := now.Sub(s.windows.Start("prod", now, interval)); got <= interval {
+		t.Fatalf("window after our check is %v, want more than %v", got, interval)
+	}
+
+	// Once another replica ran a check, it only goes back one interval,
+	// since the other replica queried the rest.
+	if err := s.Check(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := now.Sub(s.windows.Start("prod", now, interval)); got != interval {
+		t.Errorf("window after another replica's check is %v, want %v", got, interval)
+	}
+}